@@ -35,14 +35,29 @@
 #include <time.h>
 #include <ctype.h>
 #include <iso646.h>
+#include <complex.h>
+#include <dirent.h>
+#include <sys/stat.h>
 
 #ifdef _WIN32
 #include <windows.h>
+#include <io.h>
+#include <fcntl.h>
+#define popen _popen
+#define pclose _pclose
+#define setenv(name, value, overwrite) _putenv_s (name, value)
+#define realpath(path, resolved) _fullpath (resolved, path, MAX_PATH)
 #elif defined __APPLE__
 #include <sys/param.h>
 #include <sys/sysctl.h>
 #endif
 
+#ifndef _WIN32
+#include <signal.h>
+#include <sys/wait.h>
+#include <sys/resource.h>
+#endif
+
 #ifdef HAVE_CONFIG_H
 #include "config.h"
 #endif
@@ -76,6 +91,10 @@
 #include <libavcodec/avcodec.h>
 #include <libavformat/avformat.h>
 #include <libavutil/avutil.h>
+#include <libavutil/intreadwrite.h>
+#ifdef HAVE_LIBAVDEVICE
+#include <libavdevice/avdevice.h>
+#endif
 //for calculation of true peak with ffmpeg I could use libavresample, see https://www.ffmpeg.org/doxygen/3.4/group__lavr.html
 //see also ebur128.c for and example
 #elif defined SNDFILELIB
@@ -107,6 +126,8 @@
 
 #endif
 
+//points of the spectrum taken from every buffer for the bandwidth estimate
+#define SPECTRUMPOINTS 2048
 
 #define min(x, y) ({                \
 		typeof(x) _min1 = (x);          \
@@ -160,6 +181,7 @@ typedef struct
 {
 
   double *vector;		//TruePeak in each channel
+  long long *position;		//frame of the TruePeak in each channel
   int oversampling_ratio;
   int filtertaps;
   double *filter_coeffs;	//interpolation coefficients
@@ -167,11 +189,27 @@ typedef struct
 
 } TruePeak;
 
+typedef struct
+{
+  int nch;
+  double threshold;		//linear, absolute sample value counting as clipped
+  int minrun;			//consecutive samples needed to count as a clip
+  long long *count;		//clips in each channel
+  long long *worstrun;		//longest run in each channel
+  /* runs touching the buffer edges are joined at the end, so the following
+     are per buffer and channel, index buffer * nch + channel */
+  int nbuffers;
+  int capacity;
+  long long *head;		//clipped samples at the start of the buffer
+  long long *tail;		//clipped samples at the end of the buffer
+  int *full;			//whole buffer clipped
+} Clip;
+
 struct Sum
 {
   double csum;			// convolved sum
   double sum;			// flat sum
-  int nsamples;
+  long long nsamples;
   double cmean;			//convolved mean
   double mean;
   double leqm;
@@ -211,6 +249,18 @@ typedef struct coefficient_context
 } coeff;
 
 
+/* M filter coefficients designed at runtime for sample rates without
+   a shipped coefficient set, see precalculate_coeffs_M_filter */
+typedef struct M_Coefficients
+{
+  int samplerate;
+  int nb;			// numerator taps
+  int na;			// denominator taps, a[0] is 1
+  double b[7];
+  double a[7];
+} mcoeff;
+
+
 
 typedef struct LevelGate
 {
@@ -274,6 +324,15 @@ typedef struct Lg_BufferLeqM
 } LG_BufLeqM;
 
 
+// State of the --meter display between two redraws
+struct Meter
+{
+  double *lastchsum;		// channel sums at the last redraw
+  struct Sum lastsum;
+  struct timespec lastdraw;
+  int lines;			// lines drawn, to go back up over them
+};
+
 struct WorkerArgs
 {
   double *argbuffer;
@@ -286,10 +345,15 @@ struct WorkerArgs
   coeff *Kcoeffs;
   struct Sum *ptrtotsum;
   double *chconf;
+  double *chsum;		// weighted energy per channel, see accumulatechenergy
+  double *chsumnw;		// same without weighting, NULL if not needed
+  int *chexclude;		// channels left out of the program sum
+  double *chdc;			// sum of the raw samples per channel, NULL if DC offset is not checked
   int *chgate;
   int shorttermindex;
   double **sc_shorttermarray;	// on the long run this should substitute shorttermarray. First index is channel and second is shorttermarray for a single channel 
   double *shorttermarray;	// here every shortperiod is the accumulation of all channels
+  double *shorttermnwarray;	// same without weighting, NULL if not needed
 #ifdef DI
   uint8_t **shorttermarray_di;	//this will point to the dialog / nodialog feature array shorttermdidecisionarray
   void **di_array;
@@ -299,12 +363,22 @@ struct WorkerArgs
   unsigned int *samples_read_array;
   int leqm10flag;
   int leqmlogflag;
+  int shorttermflag;		// per buffer Leq(M) for the short-term statistics
   int lkfsflag;
   int leqmdiflag;
   int polyflag;
   int truepeakflag;
   TruePeak *truepeak;
   unsigned int sample_rate;	//needed by DI
+  long long firstframe;		//position of the buffer in the file, for peak timestamps
+  int bufferindex;		//order of the buffer in the file
+  Clip *clip;			//NULL if clipping is not checked
+  double *spectrum;		//power spectrum summed over buffers and channels, NULL if bandwidth is not checked
+  int *speech;			//voice activity per buffer, NULL without --vad
+  double *correlation;		//stereo phase correlation per buffer, NULL if not needed
+  int *silence;			//1 where the buffer is silent, NULL if silence is not checked
+  double silencethreshold;	//linear peak level below which the buffer is silent
+  double *tone;			//line-up tone level per buffer, NULL if the tone is not looked for
   int channel;			//this is the channel being worked on at present. Needed by DI.
   LG *lg_ctx;
   LG_Buf *lg_buffers;
@@ -324,8 +398,64 @@ LG *LGCtx;
 LGLeqM *LGCtxLeqMDI;
 
 coeff *coeffs;
+mcoeff *mcoeffs = NULL;
+
+/* frequency weighting of the measurement, see --weighting */
+enum weighting_curve
+{
+  WEIGHTING_M,
+  WEIGHTING_A,
+  WEIGHTING_C
+};
+
+int weighting = WEIGHTING_M;
+const char *weightinglabel = "M";
+mcoeff *wcoeffs = NULL;		// coefficients when weighting is not M
+
+/* SMPTE D-Cinema 16-channel layout. Role 1 is program audio, 2 an
+   accessibility track measured on its own and 0 not audio at all */
+const char *dcinema16names[16] = {
+  "L", "R", "C", "LFE", "Ls", "Rs", "HI", "VI-N",
+  "Lc", "Rc", "Lrs", "Rrs", "Motion data", "Sync", "Sign language", "Unused"
+};
+
+/* Sample formats of --raw, named as the ffmpeg demuxers. Pairs of
+   little and big endian for 16, 24 and 32 bit integer, 32 and 64 bit float */
+const char *rawformatnames[10] = {
+  "s16le", "s16be", "s24le", "s24be", "s32le", "s32be",
+  "f32le", "f32be", "f64le", "f64be"
+};
+
+const int dcinema16roles[16] = {
+  1, 1, 1, 1, 1, 1, 2, 2, 1, 1, 1, 1, 0, 0, 0, 0
+};
+
+/* rounding applied to every reported dB value, see --rounding */
+enum rounding_policy
+{
+  ROUND_HALFUP,
+  ROUND_BANKERS,
+  ROUND_TRUNCATE
+};
+
+int roundingpolicy = ROUND_HALFUP;
+
+/* timecode of reported positions, see --tcrate and --starttc. tcoffset is
+   the timecode in seconds of the first measured sample (--starttc plus
+   --start or --in) */
+double tcrate = 24.0;
+double tcoffset = 0.0;
 
 int precalculate_coeffs_K_filter (coeff * coeff_ctx, int samplerate);
+double complex analog_M_response (double freq);
+double complex analog_A_response (double freq);
+double complex analog_C_response (double freq);
+int design_weighting_filter (mcoeff * mcoeff_ctx, int samplerate,
+			     const double complex * poles, int npoles,
+			     int dczeros, double complex (*response) (double));
+int precalculate_coeffs_M_filter (mcoeff * mcoeff_ctx, int samplerate);
+int precalculate_coeffs_A_filter (mcoeff * mcoeff_ctx, int samplerate);
+int precalculate_coeffs_C_filter (mcoeff * mcoeff_ctx, int samplerate);
 
 int equalinterval (double *freqsamples, double *freqresp,
 		   double *eqfreqsamples, double *eqfreqresp, int points,
@@ -339,11 +469,63 @@ int equalinterval3 (double freqsamples[], double *freqresp,
 int convloglin (double *in, double *out, int points);
 double convlinlog_single (double in);
 double convloglin_single (double in);
+double rounddb (double value, int decimals);
+void fputs_json_string (const char *str, FILE * stream);
+char *json_string (const char *str);
+char *bext_report (const char *description, const char *originator,
+		   const char *reference, const char *date, const char *time,
+		   unsigned long long timereference, int samplerate,
+		   double tcrate);
+char *read_wav_chunk (const char *path, const char *id,
+		      unsigned long long *size);
+int *adm_tracks (const char *path, int nchannels, const char **names);
+char *ixml_report (const char *xml);
+int run_posthook (const char *command, const char *filename,
+		  const char *measurementid, struct Sum *totsum,
+		  const char *extrajson);
+unsigned long long fnv1a (unsigned long long hash, const void *data,
+			  size_t len);
+unsigned long long content_id (unsigned long long hash,
+			       const char *filename);
+int run_prehook (const char *command, const char *filename);
+int write_normalized (const char *inpath, const char *outpath, double gain);
+double weighted_energy (double *interleaved, int nframes, int nch,
+			int samplerate);
+double measure_file_leq (const char *path, int buffersizems, int *samplerate,
+			 int *channels);
+int is_pipe (const char *path);
+const char *sniff_format (const char *path);
+FILE *create_temp_file (char *path, const char *stem);
+int fetch_url (const char *url, char *outpath);
+int convert_dsd (const char *inpath, char *outpath, int rate);
+FILE *start_plugin (const char *command, int samplerate, int nch);
+void plugin_write (FILE * plugin, double *interleaved, int nsamples,
+		   int nch);
+int finish_plugin (FILE * plugin, const char *command);
+char *read_options_file (const char *path);
+int read_cpl (const char *path, char **files, double *entries,
+	      double *lengths, int maxfiles, const char **label);
+int split_options (char *text, const char **args, int maxargs);
+int negate_options (const char **args, int nargs);
 int convolv_buff (double *sigin, double *sigout, double *impresp,
 		  int sigin_dim, int impresp_dim);
 double inputcalib (double dbdiffch);
 int rectify (double *squared, double *inputsamples, int nsamples);
 int accumulatech (double *chaccumulator, double *inputchannel, int nsamples);
+int accumulatechenergy (double *chsum, int channel, double *squared,
+			int nsamples);
+double channelleq (double chsum, long long nsamples);
+void draw_meter (struct Meter *meter, struct Sum *totsum,
+		 const double *chsum, int nch, const char **names,
+		 const double *truepeaks, int samplerate, int final);
+void progress_json (struct Sum *totsum, int samplerate,
+		    const struct timespec *start, double interval,
+		    double *lastemit, int final);
+void draw_progress (long long frames, long long totalframes,
+		    const struct timespec *start, double *lastdraw,
+		    int final);
+int accumulatechdc (double *chdc, int channel, double *interleaved,
+		    int nsamples, int nch);
 double msaccumulate (double *inputbuffer, int nsamples);
 #ifdef DI
 int accumulatechwithdigate (double *chaccumulator, double *inputchannel,
@@ -365,6 +547,46 @@ void logleqm (FILE * filehandle, double featuretimesec, double temp_leqm);
 double sumandshorttermavrg (double *channelaccumulator, int nsamples);
 double logleqm10 (FILE * filehandle, double featuretimesec,
 		  double longaverage);
+void statlevels_finalcomputation (double *shorttermarray, int nperiods,
+				  int buffersizems, const char *label);
+char *append_json (char *json, char *member);
+int parse_channellist (const char *spec, int *channels, int maxchannels);
+char *histogram_finalcomputation (double *shorttermarray, int nperiods,
+				  double binwidth, const char *label);
+int write_timeseries (const char *filename, double *shorttermarray,
+		      double *shorttermnwarray, int nperiods,
+		      double buffersec, double lastbuffersec,
+		      const char *label);
+int parse_segmentlengths (const char *spec, double *lengths, int maxlengths);
+double parse_clocktime (const char *spec);
+void segment_finalcomputation (double *shorttermarray, int nperiods,
+			       double buffersec, double lastbuffersec,
+			       double *lengths, int nlengths,
+			       const char *kind, char **titles,
+			       const char *label);
+int read_cuesheet (const char *path, double *starts, char **titles,
+		   int maxtracks);
+void tracks_finalcomputation (double *shorttermarray, int nperiods,
+			      double buffersec, double lastbuffersec,
+			      double *starts, char **titles, int ntracks,
+			      const char *kind, const char *label);
+void maxwindow_finalcomputation (double *shorttermarray, int nperiods,
+				  double buffersec, double lastbuffersec,
+				  double windowsec, const char *label);
+void vad_finalcomputation (double *shorttermarray, int *speecharray,
+			  int nperiods, double buffersec,
+			  double lastbuffersec, const char *label);
+void silence_finalcomputation (int *silencearray, int nperiods,
+			       double buffersec, double lastbuffersec,
+			       int *gate);
+void tone_finalcomputation (double *tonearray, int nperiods,
+			    double buffersec, double lastbuffersec, int *gate);
+void correlation_finalcomputation (double *correlationarray, int nperiods,
+				  double buffersec, double lastbuffersec);
+void timeabove_finalcomputation (double *shorttermarray, int nperiods,
+				 double buffersec, double lastbuffersec,
+				 double *thresholds, int nthresholds,
+				 const char *label);
 #ifdef DI
 void savedidecision (uint8_t ** dibytearray, int shortperiodidx,
 		     uint8_t dibyte, int chnumb);
@@ -397,7 +619,26 @@ void dolbydifinalcomputation2 (LGLeqM * pt_lgctx_leqmdi, int *pt_chgateconf,
 #endif
 double leqmtosum (double leqm, double ref);
 void levelgatefinalcomputation (double **sc_staa, double linearthreshold, int nch, int stpn, struct Sum *ptSum);	//<-- Look at this 
-void lkfs_finalcomputation (LG * pt_lgctx, int *pt_chgateconf, int nchannels);
+double lkfs_finalcomputation (LG * pt_lgctx, int *pt_chgateconf,
+			      int nchannels);
+int comparedoubles (const void *a, const void *b);
+double *lkfs_blockpower (LG * pt_lgctx, int nchannels);
+int lkfs_shorttermblocks (LG * pt_lgctx, int samplerate);
+double shorttermwindowstart (LG * pt_lgctx, int index, int samplerate);
+void format_timecode (char *tc, size_t len, double seconds, double fps);
+double parse_timecode (const char *tc, double fps);
+void lra_finalcomputation (LG * pt_lgctx, int nchannels, int samplerate);
+void maxloudness_finalcomputation (LG * pt_lgctx, int nchannels,
+				   int samplerate, const char **chnames);
+void default_channel_names (const char **names, int nchannels);
+double *downmix_matrix (const char **names, int nchannels, int outch);
+void downmix_buffer (double *interleaved, int nsamples, int nch,
+		     const double *matrix);
+const char *channel_label (char *label, size_t len, int index,
+			   const char **names);
+void balance_finalcomputation (const double *chsum, const double *chconf,
+			       const int *chexclude, const char **names,
+			       int nchannels);
 void lkfs_finalcomputation_withdolbydi (LG * pt_lgctx, int *pt_chgateconf,
 					int nchannels,
 					uint8_t ** stdda,
@@ -405,9 +646,23 @@ void lkfs_finalcomputation_withdolbydi (LG * pt_lgctx, int *pt_chgateconf,
 
 double *calc_lp_os_coeffs (int samplerate, int os_factor, int taps);
 double truepeakcheck (double *in_buf, int ns, double truepeak, int os_ratio,
-		      int filtertaps, double *coeff_vector);
+		      int filtertaps, double *coeff_vector,
+		      int *pt_peakframe);
 TruePeak *init_truepeak_ctx (int ch, int os, int taps);
 int freetruepeak (TruePeak * tp);
+Clip *init_clip_ctx (int ch, double threshold, int minrun);
+void freeclip (Clip * cl);
+void clipcheck (Clip * cl, int bufferindex, int channel, double *interleaved,
+		int nsamples, int nch);
+int clip_finalcomputation (Clip * cl, const char **chnames);
+void fft_radix2 (double complex * x, int n);
+void accumulatespectrum (double *spectrum, int channel, double *interleaved,
+			 int nsamples, int nch);
+void bandwidth_finalcomputation (double *spectrum, int samplerate);
+int speechcheck (double *interleaved, int nsamples, int nch, int samplerate);
+double stereocorrelation (double *interleaved, int nsamples);
+int silencecheck (double *interleaved, int nsamples, double threshold);
+double tonecheck (double *interleaved, int nsamples, int nch, int samplerate);
 
 int calcSampleStepLG (float percentOverlap, int samplerate, int LGbufferms);
 int K_filter_stage1 (double *smp_out, double *smp_in, int nsamples,
@@ -415,6 +670,14 @@ int K_filter_stage1 (double *smp_out, double *smp_in, int nsamples,
 int K_filter_stage2 (double *smp_out, double *smp_in, int nsamples,
 		     coeff * coeffctx);
 int M_filter (double *smp_out, double *smp_in, int samples, int samplerate);
+int weighting_filter (double *smp_out, double *smp_in, int samples,
+		      int samplerate);
+int M_filter_supported (int samplerate);
+int print_M_filter_response (int samplerate, int json);
+int M_filter_selftest (int samplerate, int verbose);
+int generate_signal (const char **args);
+int iir_filter (double *smp_out, double *smp_in, int nsamples,
+		const double *b, int nb, const double *a, int na);
 LG_Buf *allocateLGBuffer (int samplenumber);
 int freeLGBuffer (LG_Buf * pt_LG_Buf);
 
@@ -430,6 +693,27 @@ int transfer_remaining_decoded_samples (AVFrame * ptr_frame,
 					double *bufremain,
 					AVCodecContext * codecCon,
 					int nxtsmpl, int *doublesample_index);
+int trim_frame (AVFrame * ptr_frame, AVCodecContext * codecCon,
+		long long *position, long long startframe,
+		long long endframe);
+int open_concat_input (AVFormatContext ** ctx, const char *first,
+		       const char **files, int nfiles, const double *entries,
+		       const double *lengths);
+void channel_names (AVCodecContext * codecCon, const char **names);
+double probe_audio (const char *path, int *samplerate, int *channels);
+int ac3_dialnorm (const char *path, int streamindex);
+#elif defined SNDFILELIB
+sf_count_t read_program (SNDFILE ** files, sf_count_t * fileframes,
+			 int nfiles, int *current, double *buf,
+			 sf_count_t items, int nch, sf_count_t * framesleft);
+SNDFILE *open_soundfile (const char *path, SF_INFO * info);
+int spool_input (const char *inpath, char *outpath);
+int open_multimono (SNDFILE * first, SF_INFO * info, const char **files,
+		    int nfiles, SNDFILE ** monofiles);
+void channel_names (SNDFILE * file, int nchannels, const char **names);
+sf_count_t read_multimono (SNDFILE ** monofiles, int nfiles, double *buf,
+			   double *scratch, sf_count_t items,
+			   sf_count_t * framesleft);
 #endif
 
 pthread_mutex_t mutex = PTHREAD_MUTEX_INITIALIZER;
@@ -495,6 +779,296 @@ precalculate_coeffs_K_filter (coeff * coeff_ctx, int samplerate)
 }
 
 
+double complex
+analog_M_response (double freq)
+{
+  /* CCIR 468 network (ITU-R BS.468-4) lowered by 5.6 dB, which gives the
+     M curve of ISO 21727 */
+  double h1 =
+    -4.737338981378384e-24 * pow (freq, 6) +
+    2.043828333606125e-15 * pow (freq, 4) -
+    1.363894795463638e-7 * pow (freq, 2) + 1.0;
+  double h2 =
+    1.306612257412824e-19 * pow (freq, 5) -
+    2.118150887518656e-11 * pow (freq, 3) + 5.559488023498642e-4 * freq;
+  return 1.246332637532143e-4 * pow (10.0, (18.2 - 5.6) / 20.0) * I * freq /
+    (h1 + I * h2);
+}
+
+
+double complex
+analog_A_response (double freq)
+{
+  /* IEC 61672-1 A weighting, normalized to 0 dB at 1 kHz */
+  const double f1 = 20.598997;
+  const double f2 = 107.65265;
+  const double f3 = 737.86223;
+  const double f4 = 12194.217;
+  double complex h = 1.0;
+  for (int n = 0; n < 2; n++)
+    {
+      double f = n ? freq : 1000.0;
+      double complex s = I * f;
+      double complex v = cpow (s, 4) / (cpow (s + f1, 2) * (s + f2) *
+					 (s + f3) * cpow (s + f4, 2));
+      h = n ? h * v : 1.0 / cabs (v);
+    }
+  return h;
+}
+
+
+double complex
+analog_C_response (double freq)
+{
+  /* IEC 61672-1 C weighting, normalized to 0 dB at 1 kHz */
+  const double f1 = 20.598997;
+  const double f4 = 12194.217;
+  double complex h = 1.0;
+  for (int n = 0; n < 2; n++)
+    {
+      double f = n ? freq : 1000.0;
+      double complex s = I * f;
+      double complex v = cpow (s, 2) / (cpow (s + f1, 2) * cpow (s + f4, 2));
+      h = n ? h * v : 1.0 / cabs (v);
+    }
+  return h;
+}
+
+
+int
+design_weighting_filter (mcoeff * mcoeff_ctx, int samplerate,
+			 const double complex * poles, int npoles,
+			 int dczeros, double complex (*response) (double))
+{
+
+  /* A plain bilinear transform warps the high end of the weighting curves
+     by several dB at 44.1 or 48 kHz (and by tens of dB for the M curve at
+     32 kHz), so only the analog poles (in rad/s) are used, mapped with the
+     matched z-transform z = exp(p / FS), and the numerator is fitted by
+     weighted least squares to the complex analog response on a log-spaced
+     grid from 20 Hz to min(0.49 FS, 40 kHz). With dczeros > 0 that many
+     zeros are placed at z = 1 and only the remaining taps are fitted, the
+     high order zero at DC of the A and C curves is out of reach of the
+     fit otherwise. */
+
+  const int nb = 7;
+  int nfit = nb - dczeros;
+  const int gridpoints = 400;
+  double complex a[7];
+  double normal[7][8];
+
+  /* matched z-transform of the poles, expanded to a[] */
+  a[0] = 1.0;
+  for (int k = 1; k <= npoles; k++)
+    {
+      a[k] = 0.0;
+    }
+  for (int k = 0; k < npoles; k++)
+    {
+      double complex zp = cexp (poles[k] / samplerate);
+      for (int m = k + 1; m > 0; m--)
+	{
+	  a[m] -= zp * a[m - 1];
+	}
+    }
+
+  /* weighted least squares fit of the numerator, normal equations */
+  memset (normal, 0, sizeof (normal));
+  double flow = 20.0;
+  double fhigh = fmin (0.49 * samplerate, 40000.0);
+  for (int n = 0; n < gridpoints; n++)
+    {
+      double f = flow * pow (fhigh / flow, (double) n / (gridpoints - 1));
+      double complex target = response (f);
+      double complex zinv = cexp (-I * 2.0 * M_PI * f / samplerate);
+      double complex aresp = 0.0;
+      for (int m = npoles; m >= 0; m--)
+	{
+	  aresp = aresp * zinv + a[m];
+	}
+      target *= aresp;
+      double weight = 1.0 / cabs (target);
+      double complex basis[7];
+      basis[0] = weight * cpow (1.0 - zinv, dczeros);
+      for (int j = 1; j < nfit; j++)
+	{
+	  basis[j] = basis[j - 1] * zinv;
+	}
+      for (int j = 0; j < nfit; j++)
+	{
+	  for (int k = 0; k < nfit; k++)
+	    {
+	      normal[j][k] += creal (conj (basis[j]) * basis[k]);
+	    }
+	  normal[j][nfit] += creal (conj (basis[j]) * target * weight);
+	}
+    }
+
+  /* gaussian elimination with partial pivoting */
+  for (int j = 0; j < nfit; j++)
+    {
+      int pivot = j;
+      for (int k = j + 1; k < nfit; k++)
+	{
+	  if (fabs (normal[k][j]) > fabs (normal[pivot][j]))
+	    {
+	      pivot = k;
+	    }
+	}
+      for (int k = 0; k <= nfit; k++)
+	{
+	  double tmp = normal[j][k];
+	  normal[j][k] = normal[pivot][k];
+	  normal[pivot][k] = tmp;
+	}
+      for (int k = j + 1; k < nfit; k++)
+	{
+	  double factor = normal[k][j] / normal[j][j];
+	  for (int m = j; m <= nfit; m++)
+	    {
+	      normal[k][m] -= factor * normal[j][m];
+	    }
+	}
+    }
+  for (int j = nb - 1; j >= nfit; j--)
+    {
+      mcoeff_ctx->b[j] = 0.0;
+    }
+  for (int j = nfit - 1; j >= 0; j--)
+    {
+      double acc = normal[j][nfit];
+      for (int k = j + 1; k < nfit; k++)
+	{
+	  acc -= normal[j][k] * mcoeff_ctx->b[k];
+	}
+      mcoeff_ctx->b[j] = acc / normal[j][j];
+    }
+
+  /* multiply in the zeros at DC */
+  for (int n = 0; n < dczeros; n++)
+    {
+      for (int j = nb - 1; j > 0; j--)
+	{
+	  mcoeff_ctx->b[j] -= mcoeff_ctx->b[j - 1];
+	}
+    }
+
+  mcoeff_ctx->samplerate = samplerate;
+  mcoeff_ctx->nb = nb;
+  mcoeff_ctx->na = npoles + 1;
+  for (int k = 0; k <= npoles; k++)
+    {
+      mcoeff_ctx->a[k] = creal (a[k]);
+    }
+
+  return 0;
+
+}
+
+
+int
+precalculate_coeffs_M_filter (mcoeff * mcoeff_ctx, int samplerate)
+{
+
+  /* denominator of the CCIR 468 prototype in ascending powers of
+     s / (2 pi 10 kHz), see analog_M_response */
+  const double d[7] = {
+    1.0,
+    5.559488023498642e-4 * 1e4,
+    1.363894795463638e-7 * 1e8,
+    2.118150887518656e-11 * 1e12,
+    2.043828333606125e-15 * 1e16,
+    1.306612257412824e-19 * 1e20,
+    4.737338981378384e-24 * 1e24
+  };
+  const int npoles = 6;
+  double complex poles[6];
+
+  /* Durand-Kerner on the monic prototype denominator */
+  for (int k = 0; k < npoles; k++)
+    {
+      poles[k] = cpow (0.4 + 0.9 * I, k);
+    }
+  for (int iter = 0; iter < 500; iter++)
+    {
+      for (int k = 0; k < npoles; k++)
+	{
+	  double complex num = 1.0;
+	  double complex den = 1.0;
+	  for (int m = npoles - 1; m >= 0; m--)
+	    {
+	      num = num * poles[k] + d[m] / d[npoles];
+	    }
+	  for (int m = 0; m < npoles; m++)
+	    {
+	      if (m != k)
+		{
+		  den *= poles[k] - poles[m];
+		}
+	    }
+	  poles[k] -= num / den;
+	}
+    }
+  for (int k = 0; k < npoles; k++)
+    {
+      poles[k] *= 2.0 * M_PI * 1e4;
+    }
+
+  design_weighting_filter (mcoeff_ctx, samplerate, poles, npoles, 0,
+			   analog_M_response);
+
+  /* 6.3 kHz is the one frequency of the curve without tolerance, the fit
+     is scaled to meet it exactly */
+  if (6300.0 < 0.49 * samplerate)
+    {
+      double complex zinv = cexp (-I * 2.0 * M_PI * 6300.0 / samplerate);
+      double complex aresp = 0.0;
+      double complex bresp = 0.0;
+      for (int m = npoles; m >= 0; m--)
+	{
+	  aresp = aresp * zinv + mcoeff_ctx->a[m];
+	  bresp = bresp * zinv + mcoeff_ctx->b[m];
+	}
+      double scale =
+	cabs (analog_M_response (6300.0)) * cabs (aresp) / cabs (bresp);
+      for (int m = 0; m < mcoeff_ctx->nb; m++)
+	{
+	  mcoeff_ctx->b[m] *= scale;
+	}
+    }
+
+  return 0;
+
+}
+
+
+int
+precalculate_coeffs_A_filter (mcoeff * mcoeff_ctx, int samplerate)
+{
+  const double complex poles[6] = {
+    -2.0 * M_PI * 20.598997, -2.0 * M_PI * 20.598997,
+    -2.0 * M_PI * 107.65265, -2.0 * M_PI * 737.86223,
+    -2.0 * M_PI * 12194.217, -2.0 * M_PI * 12194.217
+  };
+
+  return design_weighting_filter (mcoeff_ctx, samplerate, poles, 6, 4,
+				  analog_A_response);
+}
+
+
+int
+precalculate_coeffs_C_filter (mcoeff * mcoeff_ctx, int samplerate)
+{
+  const double complex poles[4] = {
+    -2.0 * M_PI * 20.598997, -2.0 * M_PI * 20.598997,
+    -2.0 * M_PI * 12194.217, -2.0 * M_PI * 12194.217
+  };
+
+  return design_weighting_filter (mcoeff_ctx, samplerate, poles, 4, 2,
+				  analog_C_response);
+}
+
+
 
 
 
@@ -531,12 +1105,13 @@ get (uint8_t * a[], int ch, int index, int ch_count, enum AVSampleFormat f)
 
   switch (f)
     {
+      // full scale is the negative peak, as libsndfile normalizes
     case AV_SAMPLE_FMT_U8:
-      return ((const uint8_t *) p)[index] / 127.0 - 1.0;
+      return (((const uint8_t *) p)[index] - 128) / 128.0;
     case AV_SAMPLE_FMT_S16:
-      return ((const int16_t *) p)[index] / 32767.0;
+      return ((const int16_t *) p)[index] / 32768.0;
     case AV_SAMPLE_FMT_S32:
-      return ((const int32_t *) p)[index] / 2147483647.0;
+      return ((const int32_t *) p)[index] / 2147483648.0;
     case AV_SAMPLE_FMT_FLT:
       return ((const float *) p)[index];
     case AV_SAMPLE_FMT_DBL:
@@ -631,6 +1206,7 @@ main (int argc, const char **argv)
   int origpoints = 21;		//number of points in the standard CCIR filter
   int samplingfreq;		// this and the next is defined later taking it from sound file
   int bitdepth;
+  int floatsamples = 0;		// IEEE float coding, bitdepth 32 or 64
   // double normalizer;
   int timing = 0;
   int dolbydi = 0;
@@ -647,6 +1223,98 @@ main (int argc, const char **argv)
   int fileopenstate = 0;
   int leqm10 = 0;
   int leqmlog = 0;
+  int shortterm = 0;		// keep per buffer Leq(M), see shorttermaveragedarray
+  int statlevels = 0;
+  double timeabovethresholds[16];	// Leq(M) levels for time above threshold
+  int ntimeabove = 0;
+  double histogrambin = 0.0;	// dB, 0 is no histogram
+  char *posthookjson = NULL;	// further members for the post-hook JSON
+  int channelselection[64];	// --channels, numbered from 1
+  int nchannelselection = 0;
+  int excludelfe = 0;
+  int lfecompare = 0;		// report Leq(M) with and without LFE
+  int lfechannel = -1;
+  int centrereport = 0;		// Leq(M) of the centre channel as a dialog proxy
+  int centrechannel = -1;
+  int balance = 0;		// left/right and front/rear energy difference
+  const char **channelnames = NULL;	// L, R, C, LFE... NULL where unknown
+  int downmix = 0;		// output channels of --downmix, 0 is off
+  int admmode = 1;		// ADM tracks measured, 1 beds, 3 objects, 0 all
+  int *admtypes = NULL;		// ADM type of every track, NULL if not ADM
+  double *downmixmatrix = NULL;
+  const char *timeseriesfile = NULL;
+  double maxwindow = 0.0;	// seconds, 0 is off
+  int vad = 0;
+  int *speecharray = NULL;	// 1 where the buffer is speech, see speechcheck
+  int correlation = 0;
+  double *correlationarray = NULL;	// NAN where the buffer is silent
+  int silence = 0;		// 1 report silence, 2 also leave it out of Leq(M)
+  double silencethreshold = 0.001;	// -60 dBFS peak
+  int *silencearray = NULL;
+  int linetone = 0;		// 1 report the line-up tone, 2 also leave it out of Leq(M)
+  double *tonearray = NULL;	// dBFS where the buffer is tone, see tonecheck
+  double segmentlengths[64];	// seconds, the last one repeats
+  double trimstart = 0.0;	// seconds
+  double trimduration = -1.0;	// seconds, negative is to the end
+  const char *tcin = NULL;	// SMPTE range, mapped to trimstart and trimduration
+  const char *tcout = NULL;
+  const char *tcstart = "00:00:00:00";	// timecode of the first sample
+  long long trimstartframe = 0;
+  long long trimendframe = -1;	// negative is to the end
+#ifdef FFMPEG
+  long long decodedframes = 0;	// position of the next decoded frame
+#endif
+  int nsegmentlengths = 0;
+  const char *cuefile = NULL;	// or "auto" for the .cue next to the audio file
+  double cuestarts[99];
+  char *cuetitles[99] = { NULL };
+  int ncuetracks = 0;
+  const char *concatfiles[64];	// the files following the first one
+  int nconcat = 0;
+  const char *concatlabel = "File";	// Reel or Resource for a DCP or IMF
+  char *reelfiles[65];
+  double concatentry[65] = { 0.0 };	// seconds into each file
+  double concatlength[65] = { 0.0 };	// seconds played, 0 to its end
+  double concatstarts[65];
+  char *concattitles[65] = { NULL };
+  const char *monofiles[63];	// channel 2 and following of a multi-mono set
+  int nmono = 0;
+  int rawformat = -1;		// index in rawformatnames, -1 if the file has a header
+  int rawrate = 0;
+  int rawchannels = 0;
+  const char *captureformat = NULL;	// the audio file is a device of this ffmpeg input
+  int dsdrate = 88200;		// PCM rate DSD files are converted to
+  char dsdpath[4096] = "";	// the converted file, removed at the end
+  char spoolpath[4096] = "";	// copy of stdin, a FIFO or a URL, same
+  char inputname[2048] = "";	// the audio file as given, for the hooks
+  char idpath[4096] = "";	// what --measurementid hashes
+#ifdef SNDFILELIB
+  SNDFILE *monosf[64];		// file and then those of --multimono
+  double *monoscratch = NULL;
+  SNDFILE *sndfiles[65];	// file and then those of --concat
+  int currentsndfile = 0;
+  sf_count_t concatfirst[65];	// frame range of each file
+  sf_count_t concatframes[65];
+  sf_count_t concatleft[65];
+#endif
+#ifdef FFMPEG
+  int chapters = 0;
+  int audiotrack = 0;		// --stream, from 1, 0 for the best one
+  int follow = 0;		// --follow, read on at the end of the file
+  int followidle = 10;		// seconds without growth ending it
+  double nextfollowreport = 10.0;	// seconds of audio
+  double chapterstarts[99];
+  char *chaptertitles[99] = { NULL };
+  int nchapters = 0;
+#endif
+  int meter = 0;
+  struct Meter meterstate = { NULL };
+  double progressinterval = 0.0;	// --progress-json, wall clock seconds
+  double lastprogress = 0.0;
+  int progressbar = isatty (fileno (stderr));	// off with --quiet
+  long long progressframes = 0;	// frames to measure, 0 if unknown
+  double lastprogressbar = 0.0;
+  double *shorttermnwarray = NULL;	// unweighted companion of shorttermaveragedarray
 #if defined __unix__ || defined  __APPLE__
   int numCPU = sysconf (_SC_NPROCESSORS_ONLN) - 1;
 #elif defined _WIN64 || defined _WIN32
@@ -679,6 +1347,37 @@ main (int argc, const char **argv)
 
   double *channelconfcalvector;
   channelconfcalvector = NULL;
+  double *channelsumvector;
+  channelsumvector = NULL;
+  int *channelexcludevector;
+  channelexcludevector = NULL;
+  double *channeldcvector;
+  channeldcvector = NULL;
+  double *channelnwsumvector = NULL;	// unweighted energy per channel, for --centre
+  int dcoffset = 0;
+  const char *foldfile = NULL;	// stereo fold-down measured against the 5.1
+  int target = 0;
+  int replaygain = 0;
+  int soundcheck = 0;		// Apple Sound Check iTunNORM
+  double lkfsvalue = NAN;	// integrated loudness, NAN if not measured
+  int dialnorm = 0;		// dialogue level of AC-3 input in dB, 0 if none
+  double targetleq = 0.0;	// Leq(M) the gain suggestion aims at
+  const char *normalizefile = NULL;	// copy of the input with the gain to target
+  double foldtolerance = 1.0;	// dB
+  double dcthreshold = -50.0;	// dBFS
+  int clipping = 0;
+  double clipthreshold = 32767.0 / 32768.0;	// 16 bit full scale
+  int cliprun = 3;
+  Clip *clip_ctx = NULL;
+  int bandwidth = 0;
+  int verbose = 0;		// channel layout and bit depth in the report
+#ifdef FFMPEG
+  int noskip = 0;
+  long long primingskipped = 0;	// encoder delay signalled by the container
+  long long paddingskipped = 0;
+#endif
+  double *spectrumvector = NULL;
+  int accessibility = 0;
   int *channelgateconfvector;
   channelgateconfvector = NULL;
   printf
@@ -694,6 +1393,10 @@ main (int argc, const char **argv)
   int src_ratio = 8;		//fix at present, could become a parameter
 #elif defined FFMPEG
   //av_register_all (); //it seems this is no more need for FFMPEG > 4.0
+  avformat_network_init ();	// http(s) input
+#ifdef HAVE_LIBAVDEVICE
+  avdevice_register_all ();	// --capture
+#endif
   AVFrame *frame = NULL;
   frame = av_frame_alloc ();
   AVFormatContext *formatContext = NULL;
@@ -715,6 +1418,9 @@ main (int argc, const char **argv)
   int tempchgate[128];
   tempchgate[0] = -1;		//this is just to see if the array is set
   int numcalread = 0;
+  int powersum = 0;		// --sumlaw power: every channel at 0 dB
+  double templkfsgain[128];
+  int numlkfsgainread = 0;
   int numgateconfread = 0;
   double longperiod = 10.0;	//this is in minutes and correspond to the period for leqm10
   double threshold = 80.0;	//this is the threshold for the Allen metric
@@ -748,17 +1454,26 @@ main (int argc, const char **argv)
   int parameterstate = 0;
   int leqnw = 0;
   int lkfs = 0;
+  int lra = 0;
+  int maxloudness = 0;
   int poly = 1;			//default to polynomial filtering starting from v. 0.20
   int truepeak = 0;
   int oversamp_ratio = 4;
   TruePeak *truepeak_ctx;
 
 
+  int printid = 0;
+  char measurementid[17] = "";
+  const char *prehook = NULL;
+  const char *posthook = NULL;
+  const char *plugins[8];	// external metric processors, see start_plugin
+  FILE *pluginpipes[8];
+  int nplugins = 0;
   char soundfilename[2048];
   // This is a requirement of sndfile library, do not forget it.
 
   const char helptext[] =
-    "Order of parameters after audio file is free.\nPossible parameters are:\n--convpoints <integer number> \tUse convolution with n points interpolation instead of polynomial filter.\n\t\t\t\tDefault is polynomial filter.\n--numcpus <integer number> \tNumber of slave threads to speed up operation.\n--timing \t\t\tFor benchmarking speed.\n--chconfcal <dB correction> <dB correction> <etc. so many times as channels>\n--leqnw\t\t\t\toutput leq with no weighting\n--logleqm10\t\t\t(will also print Allen metric as output)\n--lkfs\t\t\t\tSwitch LKFS ITU 1770-4 on.\n--dolbydi\t\t\tSwitch Dolby Dialogue Intelligence on\n--chgateconf <0|1|2>, 0 = no gate, 1 = level gate (in dB) and 2 = dialogue gate\n--agsthreshold <speech %%>\tFor Leq(M,DI) and LKFS(DI) default 33%%.\n--levelgate <Leq(M)>\t\tThis will force level gating and deactivate speech gating\n--threshold <Leq(M)>\t\tThreshold used for Allen metric (default 80)\n--longperiod <minutes>\t\tLong period for leqm10 (default 10)\n--logleqm\t\t\tLog Leq(M) from start every buffersize ms.\n--buffersize <milliseconds>\t\t\tSize of Buffer in milliseconds.\n--truepeak\t\t\tShow true peak value\n--oversampling <n>\t\tDefault: 4 times\n--printdiinfo\t\t\tShow detailed speech intelligence information\n\nUsing:\ngnuplot -e \"plot \\\"logfile.txt\\\" u 1:2; pause -1\"\nit is possible to directly plot the logged data\n";
+    "Order of parameters after audio file is free. The audio file - is the standard\ninput (WAV, or headerless PCM with --raw), it can also be a FIFO (only with ffmpeg)\nor an http(s) URL (streamed by ffmpeg, downloaded with curl for libsndfile). s3://, gs:// and\naz://<account>/<container>/<blob> files are downloaded with aws, gcloud and azcopy\nfirst, with the credentials these tools find.\nPossible parameters are:\n--convpoints <integer number> \tUse convolution with n points interpolation instead of polynomial filter.\n\t\t\t\tDefault is polynomial filter.\n--numcpus <integer number> \tNumber of slave threads to speed up operation.\n--timing \t\t\tFor benchmarking speed: execution and CPU time, speed against real time\n\t\t\t\tand peak memory, to go with performance reports.\n--quiet\t\t\t\tNo progress bar (shown on stderr when it is a terminal)\n--verbose\t\t\tAlso show the channel layout and the bit depth of the file\n--progress-json <seconds>\tA JSON line on stderr every so many seconds while measuring: elapsed\n\t\t\t\ttime, frames and seconds of audio measured, running Leq(M)\n--meter\t\t\t\tLive meter on the terminal (stderr) while measuring: Leq(M) per channel,\n\t\t\t\trunning and short-term Leq(M), true peak with --truepeak\n--chconfcal <dB correction> <dB correction> <etc. so many times as channels>\n--sumlaw <gains|power>\t\tHow channel energies are summed. gains (default): with the\n\t\t\t\t--chconfcal offsets or else -3 dB for the surrounds of 5.1, 7.1\n\t\t\t\tand 16-channel files, 0 dB for the others. power: straight sum\n\t\t\t\tof all channels at 0 dB, for any number of channels\n--leqnw\t\t\t\toutput leq with no weighting\n--logleqm10\t\t\t(will also print Allen metric as output)\n--lkfs\t\t\t\tSwitch LKFS ITU 1770-4 on (-70 LKFS absolute, -10 LU relative gate).\n--lufs\t\t\t\tSame as --lkfs, integrated loudness per EBU R128 (LUFS = LKFS).\n--lra\t\t\t\tLoudness Range per EBU Tech 3342 (implies --lkfs)\n--maxloudness\t\t\tMax momentary (400 ms) and short-term (3 s) loudness (implies --lkfs)\n--lkfschgain <gain> <gain> <etc. so many times as channels>\n\t\t\t\tLinear LKFS channel weights (default 1, 1.41 for surrounds, 0 for LFE)\n--dolbydi\t\t\tSwitch Dolby Dialogue Intelligence on\n--chgateconf <0|1|2>, 0 = no gate, 1 = level gate (in dB) and 2 = dialogue gate\n--agsthreshold <speech %%>\tFor Leq(M,DI) and LKFS(DI) default 33%%.\n--replaygain\t\t\tReplayGain 2.0 track gain (to -18 LUFS) and true peak\n\t\t\t\t(implies --lkfs and --truepeak), also in the post-hook JSON\n--soundcheck\t\t\tApple Sound Check gain (to -16 LKFS) and iTunNORM tag value\n\t\t\t\t(implies --lkfs and --truepeak), also in the post-hook JSON\n--target <Leq(M)>\t\tShow the gain in dB that brings the program to this Leq(M)\n\t\t\t\t(and the true peak after it with --truepeak), also in the post-hook JSON\n--normalize <out>\t\tWrite the input file with the gain to --target applied (with\n\t\t\t\tlibsndfile in the same format, with ffmpeg by the ffmpeg program)\n--foldcheck <stereo file>\tMeasure this stereo fold-down too and compare its Leq with the\n\t\t\t\tone expected from this 5.1 program (ITU-R BS.775 coefficients)\n--foldtolerance <dB>\t\tAllowed fold-down difference (default 1 dB)\n--levelgate <Leq(M)>\t\tThis will force level gating and deactivate speech gating\n--threshold <Leq(M)>\t\tThreshold used for Allen metric (default 80)\n--longperiod <minutes>\t\tLong period for leqm10 (default 10)\n--logleqm\t\t\tLog Leq(M) from start every buffersize ms.\n--buffersize <milliseconds>\t\t\tSize of Buffer in milliseconds.\n--truepeak\t\t\tShow true peak value and its position\n--oversampling <n>\t\tDefault: 4 times\n--dcoffset\t\t\tShow DC offset per channel\n--noskip\t\t\tKeep encoder priming and padding of lossy files (trimmed by default\n\t\t\t\tas signalled by the container, only with ffmpeg)\n--statlevels\t\t\tStatistical levels L10, L50 and L90 of Leq(M) over buffersize windows\n--timeabove <Leq(M)> [<Leq(M)> ...]\tTime the buffersize window Leq(M) is above each threshold\n--histogram <dB>\t\tHistogram of the buffersize window Leq(M) with this bin width,\n\t\t\t\talso passed to the post-hook JSON\n--start <time>\t\t\tStart the measurement at this time (seconds or hh:mm:ss.sss)\n--duration <time>\t\tMeasure only this long, times are reported from the start\n--in <hh:mm:ss:ff>\t\tStart the measurement at this timecode (instead of --start)\n--out <hh:mm:ss:ff>\t\tStop the measurement at this timecode (excluded)\n--starttc <hh:mm:ss:ff>\tTimecode of the first sample (default 00:00:00:00)\n--tcrate <fps>\t\t\tFrame rate of --in, --out, --starttc and of reported timecodes\n\t\t\t\t(default 24, non-drop)\n--channels <n>[,<n> ...]\tSum only these channels (from 1), e.g. 3 for the centre alone\n--exclude-lfe\t\t\tLeave the LFE channel out of the sum (from the channel layout,\n\t\t\t\telse channel 4 of 5.1, 7.1 and 16-channel files)\n--lfe-compare\t\t\tShow Leq(M) with and without LFE too\n--centre\t\t\tShow Leq(M) and RMS level of the centre channel alone (5.1, 7.1),\n\t\t\t\ta common proxy for the dialog level\n--balance\t\t\tLeft/right and front/rear balance in dB from the channel layout\n\t\t\t\t(mean level per channel, before --chconfcal), warns about\n\t\t\t\tleft/right above 3 dB and silent channels\n--adm <beds|objects|all>\tTracks of an ADM BW64 file (Dolby Atmos master) to measure,\n\t\t\t\tdefault the bed channels. Objects are summed as they are, not rendered\n--downmix <stereo|mono>\tMeasure the ITU-R BS.775 downmix (LFE dropped) instead of the\n\t\t\t\tdiscrete channels, the layout must be known\n--segment <length>[,<length> ...]\tLeq(M) per segment, e.g. 60s, 20m or one length per reel\n\t\t\t\t(seconds, the last one repeats, boundaries in steps of buffersize)\n--maxwindow <seconds>\t\tMaximum Leq(M) over any window of this length (steps of buffersize)\n--silence\t\t\tShow leading, trailing and internal (1 s or more) silence,\n\t\t\t\tin steps of buffersize\n--gate-silence\t\t\tSame and leave the silence out of Leq(M) and Leq(noW)\n--silencethreshold <dBFS>\tPeak level of silence (default -60)\n--linetone\t\t\tLook for a leading 1 kHz line-up tone (2 s or more, after silence\n\t\t\t\tat most) and show its level\n--exclude-linetone\t\tSame and leave the tone out of Leq(M) and Leq(noW)\n--correlation\t\t\tStereo phase correlation over buffersize windows (minimum and\n\t\t\t\taverage), warns about out of phase content. Only for 2 channels\n--vad\t\t\t\tLeq(M) of the speech only (dialog level), from a simple voice activity\n\t\t\t\tdetection per buffersize window (level, speech band, modulation)\n--multimono <file> [<file> ...]\tThe audio file and these mono stems are channel 1, 2, ... of one\n\t\t\t\tprogram, e.g. L R C LFE Ls Rs (same rate and length, only with libsndfile)\n--raw <format> <rate> <channels>\tRead the audio file as headerless PCM, format s16le, s16be,\n\t\t\t\ts24le, s24be, s32le, s32be, f32le, f32be, f64le or f64be\n--dsdrate <Hz>\t\t\tSample rate DSD files (.dsf, .dff) are converted to by the ffmpeg\n\t\t\t\tprogram before the measurement, default 88200\n--concat <file> [<file> ...]\tMeasure the audio file and these ones as one continuous program\n\t\t\t\t(same rate and channels), Leq(M) also per file (boundaries in steps\n\t\t\t\tof buffersize). A DCP or IMF folder or CPL as the audio file is\n\t\t\t\tmeasured the same way, per reel or resource in the ranges of the\n\t\t\t\tCPL (IMF: the first main audio track)\n--cue <file.cue|auto>\t\tLeq(M) per track of a single file CUE sheet, auto takes the\n\t\t\t\t.cue next to the audio file (boundaries in steps of buffersize)\n--stream <n>\t\t\tMeasure audio track n (from 1) of a multi-track file, e.g. a ProRes\n\t\t\t\tmaster (only with ffmpeg, default the best one)\n--capture <format>\t\tThe audio file is a capture device of this ffmpeg input (alsa, pulse,\n\t\t\t\tavfoundation, dshow...), e.g. hw:0 --capture alsa --duration 600.\n\t\t\t\tOnly with ffmpeg built with libavdevice\n--follow\t\t\tMeasure a file still being written (live recording, render), with\n\t\t\t\tthe running Leq(M) every 10 s of audio (only with ffmpeg)\n--followidle <seconds>\t\tEnd --follow when the file stops growing this long (default 10)\n--chapters\t\t\tLeq(M) per chapter of the container, e.g. .m4a or .mp4 (only with\n\t\t\t\tffmpeg, boundaries in steps of buffersize)\n--timeseries <file.csv>\tWrite Leq(M) and Leq(noW) of every buffersize window\n\t\t\t\t(use --buffersize 1000 for one row per second)\n--bandwidth\t\t\tEstimate the audio bandwidth and warn about upsampled or lossy proxies\n--clipping\t\t\tCount clips (runs of full scale samples) per channel\n--clipthreshold <dBFS>\t\tSample level counting as clipped (default 16 bit full scale)\n--cliprun <samples>\t\tConsecutive samples making a clip (default 3)\n--dcthreshold <dBFS>\t\tWarn about DC offset above this level (default -50)\n--printdiinfo\t\t\tShow detailed speech intelligence information\n--rounding <halfup|bankers|truncate>\tRounding of reported dB values (default halfup)\n--weighting <m|a|c>\t\tFrequency weighting, M (ISO 21727, default), A or C (IEC 61672)\n--accessibility\t\t\tFor 8-channel DCP audio measure HI (7) and VI-N (8) separately\n\t\t\t\tfrom the main program\n--measurementid\t\tPrint an ID derived from the content of the input files and the\n\t\t\t\toptions that change the results (FNV-1a 64), stable across runs\n\t\t\t\tand machines\n--pre-hook <command>\t\tRun command with LEQM_FILE set before the measurement,\n\t\t\t\ta non-zero exit status skips the file\n--plugin <command>\t\tFeed the decoded audio to an external metric processor (LEQM-PCM\n\t\t\t\tframes on stdin), its output is added to the report. Up to 8.\n--post-hook <command>\t\tRun command after the measurement, results as JSON on stdin\n\t\t\t\tand in LEQM_FILE, LEQM_LEQM and LEQM_LEQNW.\n\t\t\t\tA non-zero exit status of the hook makes the exit status 1\n--filterresponse <sample rate> [csv|json]\tPrint the M filter magnitude response and exit.\n\t\t\t\tUse instead of the audio file.\n--selftest <sample rate>\tCheck the M filter against the CCIR 468 tolerance mask and exit.\n\t\t\t\tUse instead of the audio file.\n--generate <tone|pink> <out.wav> [--freq <Hz>] [--level <dBFS>] [--rate <Hz>]\n\t\t[--duration <seconds>] [--channels <n>]\n\t\t\t\tWrite a 24 bit WAV test signal and exit, defaults 1000 Hz, -20 dBFS,\n\t\t\t\t48000 Hz, 10 s, 1 channel. Levels as in AES17 (a full scale sine\n\t\t\t\tis 0 dBFS), pink noise is independent per channel.\n\t\t\t\tUse instead of the audio file.\n--print-config\t\t\tShow the options from ~/.leqm-nrt.conf (or LEQM_NRT_CONFIG),\n\t\t\t\tLEQM_NRT_OPTIONS and the command line merged in this order, and exit\n--no-<switch>\t\t\tTake back a switch without value of an earlier layer, e.g. --no-leqnw.\n\t\t\t\tA list option (--chconfcal, --lkfschgain...) given again replaces the list\n\nUsing:\ngnuplot -e \"plot \\\"logfile.txt\\\" u 1:2; pause -1\"\nit is possible to directly plot the logged data\n";
 
 
   if (argc == 1)
@@ -768,31 +1483,297 @@ main (int argc, const char **argv)
       return 0;
     }
 
+  /* Layered configuration: defaults < options file < environment < command
+     line. The layers are merged into one argument list after the audio file,
+     later switches override earlier ones as they are parsed in order. */
+  const char *configpath = getenv ("LEQM_NRT_CONFIG");
+  char defaultconfigpath[4096];
+  char *configtext = NULL;
+  char *envtext = NULL;
+  const char *configargs[256];
+  const char *envargs[256];
+  int nconfigargs = 0;
+  int nenvargs = 0;
+  int printconfig = 0;
+
+  if (configpath == NULL && getenv ("HOME") != NULL)
+    {
+      snprintf (defaultconfigpath, sizeof (defaultconfigpath),
+		"%s/.leqm-nrt.conf", getenv ("HOME"));
+      configpath = defaultconfigpath;
+    }
+  if (configpath != NULL && (configtext = read_options_file (configpath)))
+    {
+      nconfigargs = split_options (configtext, configargs, 256);
+    }
+  if (getenv ("LEQM_NRT_OPTIONS") != NULL)
+    {
+      envtext = strdup (getenv ("LEQM_NRT_OPTIONS"));
+      nenvargs = split_options (envtext, envargs, 256);
+    }
+  for (int in = 1; in < argc; in++)
+    {
+      if (strcmp (argv[in], "--print-config") == 0)
+	printconfig = 1;
+    }
+  // the modes without an audio file take no measurement options
+  int filelessmode = strcmp (argv[1], "--help") == 0
+    || strcmp (argv[1], "--version") == 0
+    || strcmp (argv[1], "--filterresponse") == 0
+    || strcmp (argv[1], "--selftest") == 0
+    || strcmp (argv[1], "--generate") == 0;
+  if ((nconfigargs + nenvargs > 0 && !filelessmode) || printconfig)
+    {
+      const char **mergedargv =
+	malloc (sizeof (char *) * (argc + nconfigargs + nenvargs + 1));
+      int mergedargc = 0;
+      int firstflag = 1;
+
+      mergedargv[mergedargc++] = argv[0];
+      //the audio file stays the first argument, - is the standard input
+      if (strncmp (argv[1], "-", 1) != 0 || strcmp (argv[1], "-") == 0)
+	{
+	  mergedargv[mergedargc++] = argv[1];
+	  firstflag = 2;
+	}
+      for (int i = 0; i < nconfigargs; i++)
+	mergedargv[mergedargc++] = configargs[i];
+      for (int i = 0; i < nenvargs; i++)
+	mergedargv[mergedargc++] = envargs[i];
+      for (int in = firstflag; in < argc; in++)
+	{
+	  if (strcmp (argv[in], "--print-config") != 0)
+	    mergedargv[mergedargc++] = argv[in];
+	}
+      mergedargv[mergedargc] = NULL;
+      mergedargc = negate_options (mergedargv, mergedargc);
+
+      if (printconfig)
+	{
+	  printf ("Options file (%s%s):", configpath ? configpath : "none",
+		  configtext ? "" : ", not found");
+	  for (int i = 0; i < nconfigargs; i++)
+	    printf (" %s", configargs[i]);
+	  printf ("\nEnvironment (LEQM_NRT_OPTIONS):");
+	  for (int i = 0; i < nenvargs; i++)
+	    printf (" %s", envargs[i]);
+	  printf ("\nCommand line:");
+	  for (int in = firstflag; in < argc; in++)
+	    {
+	      if (strcmp (argv[in], "--print-config") != 0)
+		printf (" %s", argv[in]);
+	    }
+	  printf
+	    ("\nEffective arguments (later switches override earlier ones):");
+	  for (int i = 1; i < mergedargc; i++)
+	    printf (" %s", mergedargv[i]);
+	  printf ("\n");
+	  return 0;
+	}
+      argc = mergedargc;
+      argv = mergedargv;
+    }
+  else
+    {
+      argc = negate_options (argv, argc);
+    }
+
+  // the audio file is opened while parsing, so the files of --concat have
+  // to be known before
+  for (int in = 1; in < argc; in++)
+    {
+      if (strcmp (argv[in], "--concat") == 0)
+	{
+	  // a later --concat replaces the files of an earlier layer
+	  nconcat = 0;
+	  while (in + 1 < argc && strncmp (argv[in + 1], "-", 1) != 0
+		 && nconcat < 64)
+	    concatfiles[nconcat++] = argv[++in];
+	}
+      if (strcmp (argv[in], "--multimono") == 0)
+	{
+	  nmono = 0;
+	  while (in + 1 < argc && strncmp (argv[in + 1], "-", 1) != 0
+		 && nmono < 63)
+	    monofiles[nmono++] = argv[++in];
+	}
+      if (strcmp (argv[in], "--raw") == 0)
+	{
+	  for (int i = 0; in + 3 < argc && i < 10; i++)
+	    {
+	      if (strcmp (argv[in + 1], rawformatnames[i]) == 0)
+		rawformat = i;
+	    }
+	  if (rawformat < 0 || (rawrate = atoi (argv[in + 2])) <= 0
+	      || (rawchannels = atoi (argv[in + 3])) <= 0)
+	    {
+	      printf
+		("Please use --raw <s16le|s16be|s24le|s24be|s32le|s32be|f32le|f32be|f64le|f64be> <sample rate> <channels>.\n");
+	      return 1;
+	    }
+	  in += 3;
+	}
+      if (strcmp (argv[in], "--dsdrate") == 0 && in + 1 < argc)
+	dsdrate = atoi (argv[in + 1]);
+      // the pre-hook runs before the file is opened, spooled or downloaded
+      if (strcmp (argv[in], "--pre-hook") == 0 && in + 1 < argc)
+	prehook = argv[in + 1];
+      if (strcmp (argv[in], "--capture") == 0)
+	{
+#ifdef FFMPEG
+	  if (in + 1 >= argc || av_find_input_format (argv[in + 1]) == NULL)
+	    {
+	      printf
+		("Please use --capture <alsa|pulse|avfoundation|dshow|...>, an input device of ffmpeg.\n");
+	      return 1;
+	    }
+	  captureformat = argv[++in];
+#else
+	  printf ("--capture is only available with ffmpeg.\n");
+	  return 1;
+#endif
+	}
+#ifdef FFMPEG
+      if (strcmp (argv[in], "--stream") == 0 && in + 1 < argc)
+	audiotrack = atoi (argv[in + 1]);
+      if (strcmp (argv[in], "--follow") == 0)
+	follow = 1;
+      if (strcmp (argv[in], "--followidle") == 0 && in + 1 < argc)
+	followidle = atoi (argv[in + 1]);
+#endif
+    }
+
   for (int in = 1; in < argc;)
     {
-      if ((!(strncmp (argv[in], "-", 1) == 0)) && (argv[in] != NULL))
+      // "-" is the standard input
+      if ((!(strncmp (argv[in], "-", 1) == 0) || strcmp (argv[in], "-") == 0)
+	  && (argv[in] != NULL))
 	{
+	  if (fileopenstate == 0 && inputname[0] == '\0')
+	    {
+	      snprintf (inputname, sizeof (inputname), "%s", argv[in]);
+	      if (prehook != NULL)
+		{
+		  int prehookstatus = run_prehook (prehook, inputname);
+		  if (prehookstatus != 0)
+		    {
+		      printf ("Measurement vetoed by pre-hook (status %d).\n",
+			      prehookstatus);
+		      return 1;
+		    }
+		}
+	    }
+	  if (fileopenstate == 0 && captureformat == NULL)
+	    {
+	      // a remote file is measured from a local copy
+	      int fetched = fetch_url (argv[in], spoolpath);
+	      if (fetched < 0)
+		return 1;
+	      if (fetched > 0)
+		argv[in] = spoolpath;
+	    }
+	  if (fileopenstate == 0 && nconcat == 0 && rawformat < 0
+	      && nmono == 0 && captureformat == NULL)
+	    {
+	      // a DCP or IMF folder or CPL: its sound as one program
+	      int nreels = read_cpl (argv[in], reelfiles, concatentry,
+				     concatlength, 65, &concatlabel);
+	      if (nreels < 0)
+		return 1;
+	      if (nreels > 0)
+		{
+		  argv[in] = reelfiles[0];
+		  for (int i = 1; i < nreels; i++)
+		    concatfiles[nconcat++] = reelfiles[i];
+		  if (nconcat)
+		    {
+		      shortterm = 1;
+		      printf ("Measure %d %s as one program.\n", nreels,
+			      strcmp (concatlabel, "Reel") == 0 ? "reels" :
+			      "resources");
+		    }
+		  else
+		    {
+		      // the range of a single one is an ordinary trim
+		      trimstart = concatentry[0];
+		      trimduration = concatlength[0];
+		    }
+		}
+	    }
+	  // the ID is that of the DSD file, not of its conversion
+	  if (fileopenstate == 0 && captureformat == NULL)
+	    snprintf (idpath, sizeof (idpath), "%s", argv[in]);
+	  if (fileopenstate == 0 && rawformat < 0 && captureformat == NULL)
+	    {
+	      // DSD is measured on its PCM conversion
+	      int converted = convert_dsd (argv[in], dsdpath, dsdrate);
+	      if (converted < 0)
+		return 1;
+	      if (converted > 0)
+		{
+		  printf ("DSD converted to PCM at %d Hz for the measurement.\n",
+			  dsdrate);
+		  argv[in] = dsdpath;
+		}
+	    }
+#ifdef SNDFILELIB
+	  if (fileopenstate == 0 && is_pipe (argv[in])
+	      && strcmp (argv[in], "-") != 0)
+	    {
+	      printf
+		("%s is a FIFO, libsndfile cannot measure it as a stream. Use the ffmpeg\nbuild or write the audio to a file.\n",
+		 argv[in]);
+	      return 1;
+	    }
+	  if (fileopenstate == 0 && is_pipe (argv[in]))
+	    {
+	      if (spool_input (argv[in], spoolpath) != 0)
+		return 1;
+	      argv[in] = spoolpath;
+	      strcpy (idpath, spoolpath);
+	    }
+#endif
 
 #ifdef SNDFILELIB
 	  if (fileopenstate == 0)
 	    {
-	      if (!(file = sf_open (argv[in], SFM_READ, &sfinfo)))
+	      if (rawformat >= 0)
+		{
+		  const int subformats[5] = { SF_FORMAT_PCM_16,
+		    SF_FORMAT_PCM_24, SF_FORMAT_PCM_32, SF_FORMAT_FLOAT,
+		    SF_FORMAT_DOUBLE
+		  };
+		  sfinfo.format = SF_FORMAT_RAW | subformats[rawformat / 2] |
+		    (rawformat % 2 ? SF_ENDIAN_BIG : SF_ENDIAN_LITTLE);
+		  sfinfo.samplerate = rawrate;
+		  sfinfo.channels = rawchannels;
+		}
+	      if (!(file = open_soundfile (argv[in], &sfinfo)))
 		{
 		  printf
 		    ("Error while opening audio file, could not open  %s\n.",
 		     argv[in]);
 		  puts (sf_strerror (NULL));
+		  if (sniff_format (argv[in]) != NULL)
+		    printf ("The file holds %s data, whatever its name.\n",
+			    sniff_format (argv[in]));
 		  return 1;
 		}
 
 
+	      if (nmono
+		  && open_multimono (file, &sfinfo, monofiles, nmono,
+				     monosf) != 0)
+		return 1;
 	      strcpy (soundfilename, argv[in]);
 	      fileopenstate = 1;
 	      printf ("Opened file: %s\n", argv[in]);
+	      for (int i = 0; i < nmono; i++)
+		printf ("Channel %d: %s\n", i + 2, monofiles[i]);
 	      printf ("Sample rate: %d\n", sfinfo.samplerate);
 	      printf ("Channels: %d\n", sfinfo.channels);
 	      printf ("Format: %d\n", sfinfo.format);
-	      printf ("Frames: %d\n", (int) sfinfo.frames);
+	      printf ("Frames: %lld\n", (long long) sfinfo.frames);
 	      channelconfcalvector =
 		malloc (sizeof (double) * sfinfo.channels);
 #ifdef DI
@@ -833,12 +1814,44 @@ main (int argc, const char **argv)
 #elif defined FFMPEG
 	  if (fileopenstate == 0)
 	    {
-	      if (avformat_open_input (&formatContext, argv[in], NULL, NULL)
-		  != 0)
+	      AVDictionary *inputoptions = NULL;
+	      if (rawformat >= 0)
+		{
+		  char value[16];
+		  snprintf (value, sizeof (value), "%d", rawrate);
+		  av_dict_set (&inputoptions, "sample_rate", value, 0);
+		  snprintf (value, sizeof (value), "%d", rawchannels);
+		  av_dict_set (&inputoptions, "channels", value, 0);
+		}
+	      if (follow)
+		{
+		  // the file protocol waits at the end for more data
+		  char value[24];
+		  snprintf (value, sizeof (value), "%lld",
+			    followidle * 1000000LL);
+		  av_dict_set (&inputoptions, "follow", "1", 0);
+		  av_dict_set (&inputoptions, "rw_timeout", value, 0);
+		}
+	      int openstatus = nconcat ?
+		open_concat_input (&formatContext, argv[in], concatfiles,
+				   nconcat, concatentry, concatlength) :
+		avformat_open_input (&formatContext,
+				     strcmp (argv[in], "-") == 0 ? "pipe:0" :
+				     argv[in], rawformat >= 0 ?
+				     av_find_input_format (rawformatnames
+							   [rawformat]) :
+				     captureformat != NULL ?
+				     av_find_input_format (captureformat) :
+				     NULL, &inputoptions);
+	      av_dict_free (&inputoptions);
+	      if (openstatus != 0)
 		{
 		  //av_free(frame);
 		  av_frame_free (&frame);
 		  printf ("Error opening the file\n");
+		  if (sniff_format (argv[in]) != NULL)
+		    printf ("The file holds %s data, whatever its name.\n",
+			    sniff_format (argv[in]));
 		  return 1;
 		}
 	      //fileopenstate = 1;
@@ -857,6 +1870,25 @@ main (int argc, const char **argv)
 	      int streamIndex =
 		av_find_best_stream (formatContext, AVMEDIA_TYPE_AUDIO, -1,
 				     -1, &cdc, 0);
+	      if (audiotrack > 0)
+		{
+		  int naudio = 0;
+		  streamIndex = -1;
+		  for (unsigned i = 0; i < formatContext->nb_streams; i++)
+		    {
+		      if (formatContext->streams[i]->codecpar->codec_type ==
+			  AVMEDIA_TYPE_AUDIO && ++naudio == audiotrack)
+			streamIndex = i;
+		    }
+		  if (streamIndex < 0)
+		    {
+		      av_frame_free (&frame);
+		      avformat_close_input (&formatContext);
+		      printf ("Audio track %d asked, the file has %d.\n",
+			      audiotrack, naudio);
+		      return 1;
+		    }
+		}
 	      if (streamIndex < 0)
 		{
 		  //av_free(frame);
@@ -895,14 +1927,22 @@ main (int argc, const char **argv)
 	       *
 	       */
 
-	      if (avcodec_open2 (codecContext, cdc, NULL) != 0)
+	      // the AC-3 decoder applies the dynamic range compression of
+	      // the stream by default, the program is measured without it
+	      AVDictionary *decoderoptions = NULL;
+	      if (codecContext->codec_id == AV_CODEC_ID_AC3
+		  || codecContext->codec_id == AV_CODEC_ID_EAC3)
+		av_dict_set (&decoderoptions, "drc_scale", "0", 0);
+	      if (avcodec_open2 (codecContext, cdc, &decoderoptions) != 0)
 		{
 		  //      av_free(frame);
+		  av_dict_free (&decoderoptions);
 		  av_frame_free (&frame);
 		  avformat_close_input (&formatContext);
 		  printf ("Couldn't open the context with the decoder\n");
 		  return 1;
 		}
+	      av_dict_free (&decoderoptions);
 
 	      strcpy (soundfilename, argv[in]);
 	      fileopenstate = 1;
@@ -967,23 +2007,82 @@ main (int argc, const char **argv)
 	  return 0;
 
 	}
-      else if (fileopenstate == 0)
+      else if ((strcmp (argv[in], "--filterresponse") == 0)
+	       && (fileopenstate == 0))
 	{
-	  printf
-	    ("Please indicate audio file to be processed as first argument.\n");
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  if (atoi (argv[in + 1]) <= 0)
+	    {
+	      printf ("Please provide a positive sample rate.\n");
+	      return 1;
+	    }
+	  int json = 0;
+	  if (argv[in + 2] != NULL && strcmp (argv[in + 2], "json") == 0)
+	    {
+	      json = 1;
+	    }
+	  print_M_filter_response (atoi (argv[in + 1]), json);
 	  return 0;
+
 	}
+      else if ((strcmp (argv[in], "--selftest") == 0) && (fileopenstate == 0))
+	{
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  if (atoi (argv[in + 1]) <= 0)
+	    {
+	      printf ("Please provide a positive sample rate.\n");
+	      return 1;
+	    }
+	  return M_filter_selftest (atoi (argv[in + 1]), 1) ? 1 : 0;
 
-      if (strcmp (argv[in], "--chconfcal") == 0)
+	}
+      else if ((strcmp (argv[in], "--generate") == 0) && (fileopenstate == 0))
 	{
-	  /* as the order of parameter is free I have to postpone 
+	  return generate_signal (argv + in + 1) ? 1 : 0;
+	}
+      else if (fileopenstate == 0)
+	{
+	  printf
+	    ("Please indicate audio file to be processed as first argument.\n");
+	  return 0;
+	}
+
+      if (strcmp (argv[in], "--sumlaw") == 0)
+	{
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  if (strcmp (argv[in + 1], "power") == 0)
+	    powersum = 1;
+	  else if (strcmp (argv[in + 1], "gains") == 0)
+	    powersum = 0;
+	  else
+	    {
+	      printf ("Unknown summation law %s, use gains or power.\n",
+		      argv[in + 1]);
+	      return 1;
+	    }
+	  in += 2;
+	  printf ("Channel summation law: %s.\n",
+		  powersum ? "straight power sum" : "per-channel gains");
+	  continue;
+	}
+      if (strcmp (argv[in], "--chconfcal") == 0)
+	{
+	  /* as the order of parameter is free I have to postpone 
 	     the check for consistency with the number of channels.
 	     So first create a temporary array, whose number of element will be checked after 
 	     the parsing of the command line parameters is finished. 
 	     The calibration will be expressed in dB on the command line and converted to multiplier 
 	     here so that it can be stored as a factor in the channelconfcalvector.
+	     A later --chconfcal (command line over options file) replaces the list.
 	   */
 
+	  numcalread = 0;
 	  in++;
 	  for (;;)
 	    {
@@ -1006,6 +2105,20 @@ main (int argc, const char **argv)
 	  continue;
 	}
 
+      if (strcmp (argv[in], "--lkfschgain") == 0)
+	{
+	  /* linear channel weights G_i of ITU-R BS.1770, checked against
+	     the number of channels once the parameters are parsed */
+	  numlkfsgainread = 0;
+	  in++;
+	  while (in < argc && numlkfsgainread < 128
+		 && (isdigit (argv[in][0]) || argv[in][0] == '.'))
+	    {
+	      templkfsgain[numlkfsgainread++] = atof (argv[in++]);
+	    }
+	  continue;
+	}
+
       if (strcmp (argv[in], "--convpoints") == 0)
 	{
 	  if (checkargvalue (argv[in + 1]))
@@ -1016,6 +2129,125 @@ main (int argc, const char **argv)
 	  convpointsset = 1;
 	  continue;
 
+	}
+      if (strcmp (argv[in], "--rounding") == 0)
+	{
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  if (strcmp (argv[in + 1], "halfup") == 0)
+	    roundingpolicy = ROUND_HALFUP;
+	  else if (strcmp (argv[in + 1], "bankers") == 0)
+	    roundingpolicy = ROUND_BANKERS;
+	  else if (strcmp (argv[in + 1], "truncate") == 0)
+	    roundingpolicy = ROUND_TRUNCATE;
+	  else
+	    {
+	      printf ("Unknown rounding policy %s. Use halfup, bankers or truncate.\n",
+		      argv[in + 1]);
+	      return 1;
+	    }
+	  printf ("Rounding policy for reported values set to %s.\n",
+		  argv[in + 1]);
+	  in += 2;
+	  continue;
+
+	}
+      if (strcmp (argv[in], "--weighting") == 0)
+	{
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  if (strcmp (argv[in + 1], "m") == 0)
+	    {
+	      weighting = WEIGHTING_M;
+	      weightinglabel = "M";
+	    }
+	  else if (strcmp (argv[in + 1], "a") == 0)
+	    {
+	      weighting = WEIGHTING_A;
+	      weightinglabel = "A";
+	    }
+	  else if (strcmp (argv[in + 1], "c") == 0)
+	    {
+	      weighting = WEIGHTING_C;
+	      weightinglabel = "C";
+	    }
+	  else
+	    {
+	      printf ("Unknown weighting %s. Use m, a or c.\n", argv[in + 1]);
+	      return 1;
+	    }
+	  printf ("Frequency weighting set to %s.\n", weightinglabel);
+	  in += 2;
+	  continue;
+
+	}
+      if (strcmp (argv[in], "--accessibility") == 0)
+	{
+	  accessibility = 1;
+	  printf
+	    ("HI and VI-N tracks of 8-channel DCP audio will be measured separately.\n");
+	  in++;
+	  continue;
+
+	}
+      if (strcmp (argv[in], "--measurementid") == 0)
+	{
+	  printid = 1;
+	  printf ("A content derived measurement ID will be printed.\n");
+	  in++;
+	  continue;
+
+	}
+      if (strcmp (argv[in], "--pre-hook") == 0)
+	{
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  // taken in the first pass, it has already run on the file
+	  in += 2;
+	  continue;
+
+	}
+      if (strcmp (argv[in], "--post-hook") == 0)
+	{
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  posthook = argv[in + 1];
+	  printf ("Post-hook %s will run after the measurement.\n",
+		  posthook);
+	  in += 2;
+	  continue;
+
+	}
+      if (strcmp (argv[in], "--plugin") == 0)
+	{
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  if (nplugins == 8)
+	    {
+	      printf ("At most 8 plugins can be used.\n");
+	      return 1;
+	    }
+	  plugins[nplugins++] = argv[in + 1];
+	  printf ("Plugin %s will receive the decoded audio.\n",
+		  argv[in + 1]);
+	  in += 2;
+	  continue;
+
 	}
       if (strcmp (argv[in], "--numcpus") == 0)
 	{
@@ -1029,3289 +2261,5994 @@ main (int argc, const char **argv)
 	  continue;
 
 	}
-      if (strcmp (argv[in], "--truepeak") == 0)
+      if (strcmp (argv[in], "--dcoffset") == 0)
 	{
-	  truepeak = 1;
+	  dcoffset = 1;
 	  in++;
-	  printf ("True Peak value will be shown.\n");
+	  printf ("Show DC offset per channel.\n");
 	  continue;
 
 	}
-      if (strcmp (argv[in], "--oversampling") == 0)
+      if (strcmp (argv[in], "--dcthreshold") == 0)
 	{
 	  if (checkargvalue (argv[in + 1]))
 	    return 1;
-	  oversamp_ratio = atoi (argv[in + 1]);
+	  dcthreshold = atof (argv[in + 1]);
+	  dcoffset = 1;
 	  in += 2;
-	  if (truepeak == 0)
-	    truepeak = 1;
 	  printf
-	    ("Oversampling ratio for truepeak set to %d. Also true peak reporting switched on.\n",
-	     oversamp_ratio);
+	    ("DC offset warning threshold set to %.1f dBFS. Also DC offset reporting switched on.\n",
+	     dcthreshold);
 	  continue;
 
 	}
-#ifdef DI
-      if (strcmp (argv[in], "--agsthreshold") == 0)
+#ifdef FFMPEG
+      if (strcmp (argv[in], "--noskip") == 0)
 	{
-	  if (checkargvalue (argv[in + 1]))
-	    return 1;
-	  agsthreshold = atof (argv[in + 1]);
-	  in += 2;
-	  printf ("Adaptive gate selection threshold set to %0.2f %%.\n",
-		  agsthreshold);
+	  noskip = 1;
+	  in++;
+	  printf
+	    ("Encoder priming and padding samples will be measured, not trimmed.\n");
 	  continue;
 
 	}
 #endif
-
-      if (strcmp (argv[in], "--chgateconf") == 0)
+      if (strcmp (argv[in], "--statlevels") == 0)
 	{
-	  /* as the order of parameter is free I have to postpone 
-	     the check for consistency with the number of channels.
-	     So first create a temporary array, whose number of element will be checked after 
-	     the parsing of the command line parameters is finished. 
-	   */
+	  statlevels = 1;
+	  shortterm = 1;
+	  in++;
+	  printf
+	    ("Show statistical levels L10, L50 and L90 over buffersize windows.\n");
+	  continue;
 
+	}
+      if (strcmp (argv[in], "--timeabove") == 0)
+	{
+	  ntimeabove = 0;
 	  in++;
-	  for (;;)
+	  while (in < argc && ntimeabove < 16
+		 && (isdigit (argv[in][0]) || argv[in][0] == '.'))
 	    {
-	      if (in < argc)
-		{
-		  //if (!(strncmp(argv[in], "-", 1) == 0)) { //changed this to allow negative numbers
-		  if (isdigit (argv[in][0])
-		      && ((atoi (argv[in]) == 0) || (atoi (argv[in]) == 1)
-			  || (atoi (argv[in]) == 2)))
-		    {		// 0 = no gate, 1 = level gate and 2 = dialogue gate. Level gate threasholds in dB are given on another array 
-		      tempchgate[numgateconfread++] = atoi (argv[in++]);
-		    }
-		  else
-		    break;
-		}
-	      else
-		break;
-
-	    }			//for
-
+	      timeabovethresholds[ntimeabove++] = atof (argv[in++]);
+	    }
+	  if (ntimeabove == 0)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  shortterm = 1;
+	  printf ("Show time above %d Leq(M) threshold(s).\n", ntimeabove);
 	  continue;
 	}
-
-      if (strcmp (argv[in], "--timing") == 0)
+      if (strcmp (argv[in], "--histogram") == 0)
 	{
-	  timing = 1;
-	  in++;
-	  printf ("Execution time will be measured.\n");
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  histogrambin = atof (argv[in + 1]);
+	  if (!(histogrambin > 0.0))
+	    {
+	      printf ("Please provide a positive bin width in dB.\n");
+	      return 1;
+	    }
+	  shortterm = 1;
+	  in += 2;
+	  printf ("Show histogram of window Leq(M) with %.2f dB bins.\n",
+		  histogrambin);
 	  continue;
-
 	}
-
-#ifdef DI
-      if (strcmp (argv[in], "--dolbydi") == 0)
+      if (strcmp (argv[in], "--maxwindow") == 0)
 	{
-	  dolbydi = 1;
-	  in++;
-	  printf ("Gating with Dolby Dialogue Intelligence.\n");
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  maxwindow = atof (argv[in + 1]);
+	  if (!(maxwindow > 0.0))
+	    {
+	      printf ("Please provide a positive window length in seconds.\n");
+	      return 1;
+	    }
+	  shortterm = 1;
+	  in += 2;
+	  printf ("Show maximum Leq(M) over any %.1f s window.\n", maxwindow);
 	  continue;
-
 	}
-
-      if (strcmp (argv[in], "--printdiinfo") == 0)
+      if (strcmp (argv[in], "--silence") == 0)
 	{
-	  printdiinfo = 1;
+	  silence = max (silence, 1);
+	  shortterm = 1;
 	  in++;
-	  printf
-	    ("Detailed speech intelligence information will be shown.\n");
+	  printf ("Show silence.\n");
 	  continue;
-
 	}
-
-#endif
-      if (strcmp (argv[in], "--lkfs") == 0)
+      if (strcmp (argv[in], "--gate-silence") == 0)
 	{
-	  lkfs = 1;
+	  silence = 2;
+	  shortterm = 1;
 	  in++;
-	  printf ("Show ITU 1770-4 LKFS result.\n");
+	  printf ("Silence left out of the measurement.\n");
 	  continue;
-
 	}
-      /*
-         if (strcmp (argv[in], "--leqmdi") == 0)
-         {
-         lkfs = 1;
-         in++;
-         printf ("Show Leq(M,DI) measurement.\n");
-         continue;
-
-         } */
-
-      /*
-         if (strcmp (argv[in], "--polynomial") == 0)
-         {
-         poly = 1;
-         in++;
-         printf
-         ("Using polynomial filter instead of convolution for M weighting.\n");
-         continue;
-
-         } */
-      if (strcmp (argv[in], "--version") == 0)
+      if (strcmp (argv[in], "--silencethreshold") == 0)
 	{
-	  in++;
-	  printf ("This is leqm-nrt version %s.\n", VERSION);
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  silencethreshold = pow (10, atof (argv[in + 1]) / 20);
+	  in += 2;
+	  printf ("Silence threshold set to %.1f dBFS.\n",
+		  20 * log10 (silencethreshold));
 	  continue;
-
 	}
-      if (strcmp (argv[in], "--help") == 0)
+      if (strcmp (argv[in], "--linetone") == 0)
 	{
+	  linetone = max (linetone, 1);
+	  shortterm = 1;
 	  in++;
-	  printf (helptext);
+	  printf ("Look for a line-up tone.\n");
 	  continue;
-
 	}
-
-      if (strcmp (argv[in], "--logleqm10") == 0)
+      if (strcmp (argv[in], "--exclude-linetone") == 0)
 	{
-	  leqm10 = 1;
+	  linetone = 2;
+	  shortterm = 1;
 	  in++;
-	  printf ("Leq(M,10m) data will be logged to the file leqm10.txt\n");
+	  printf ("Line-up tone left out of the measurement.\n");
 	  continue;
-
 	}
-      if (strcmp (argv[in], "--logleqm") == 0)
+      if (strcmp (argv[in], "--correlation") == 0)
 	{
-	  leqmlog = 1;
+	  correlation = 1;
+	  shortterm = 1;
 	  in++;
-	  printf ("Leq(M) data will be logged to the file leqmlog.txt\n");
+	  printf ("Show stereo phase correlation.\n");
 	  continue;
-
 	}
-
-      if (strcmp (argv[in], "--leqnw") == 0)
+      if (strcmp (argv[in], "--vad") == 0)
 	{
-	  leqnw = 1;
+	  vad = 1;
+	  shortterm = 1;
 	  in++;
-	  printf ("Leq(nW) - unweighted -  will be outputted.\n");
+	  printf ("Show speech gated Leq(M).\n");
 	  continue;
-
 	}
-
-      if (strcmp (argv[in], "--buffersize") == 0)
+      if (strcmp (argv[in], "--start") == 0)
 	{
 	  if (checkargvalue (argv[in + 1]))
 	    return 1;
-	  buffersizems = atoi (argv[in + 1]);
+	  trimstart = parse_clocktime (argv[in + 1]);
+	  if (trimstart < 0.0)
+	    {
+	      printf
+		("Please provide the start as seconds or hh:mm:ss[.sss].\n");
+	      return 1;
+	    }
 	  in += 2;
-	  printf ("Buffersize will be set to %d milliseconds.\n",
-		  buffersizems);
+	  printf ("Measurement starts at %.3f s.\n", trimstart);
 	  continue;
-
 	}
-
-      if (strcmp (argv[in], "--agsthreshold") == 0)
+      if (strcmp (argv[in], "--duration") == 0)
 	{
 	  if (checkargvalue (argv[in + 1]))
 	    return 1;
-	  agsthreshold = atof (argv[in + 1]);
+	  trimduration = parse_clocktime (argv[in + 1]);
+	  if (!(trimduration > 0.0))
+	    {
+	      printf
+		("Please provide a positive duration as seconds or hh:mm:ss[.sss].\n");
+	      return 1;
+	    }
 	  in += 2;
-	  printf
-	    ("Adaptive gate selection based on speech percentage:  %.4f %%.\n",
-	     agsthreshold);
+	  printf ("Measurement lasts %.3f s.\n", trimduration);
 	  continue;
 	}
-
-      if (strcmp (argv[in], "--levelgate") == 0)
+      if (strcmp (argv[in], "--in") == 0)
 	{
 	  if (checkargvalue (argv[in + 1]))
 	    return 1;
-	  levelgatedthreshold = atof (argv[in + 1]);
+	  tcin = argv[in + 1];
 	  in += 2;
-	  levelgated = 1;
-	  printf
-	    ("Level gating threshold. This will force switching off speech gating and even adaptive gate selection. Specified threshold is %.4f Leq(M)\n",
-	     levelgatedthreshold);
+	  printf ("Measurement starts at timecode %s.\n", tcin);
 	  continue;
 	}
-      if (strcmp (argv[in], "--threshold") == 0)
+      if (strcmp (argv[in], "--out") == 0)
 	{
 	  if (checkargvalue (argv[in + 1]))
 	    return 1;
-	  threshold = atof (argv[in + 1]);
+	  tcout = argv[in + 1];
 	  in += 2;
-	  printf ("Threshold for Allen metric set to %f Leq(M).\n",
-		  threshold);
+	  printf ("Measurement stops at timecode %s.\n", tcout);
 	  continue;
-
 	}
-      if (strcmp (argv[in], "--longperiod") == 0)
+      if (strcmp (argv[in], "--starttc") == 0)
 	{
 	  if (checkargvalue (argv[in + 1]))
 	    return 1;
-	  longperiod = atof (argv[in + 1]);
+	  tcstart = argv[in + 1];
 	  in += 2;
-	  printf ("Longperiod for Leq(M)X set to %f minutes.\n", longperiod);
+	  printf ("Timecode of the first sample set to %s.\n", tcstart);
 	  continue;
-
 	}
-
-      if (parameterstate == 0)
+      if (strcmp (argv[in], "--tcrate") == 0)
 	{
-	  printf ("The command line switch you typed is not valid: %s\n",
-		  argv[in]);
-	  return -1;
-	  break;
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  tcrate = atof (argv[in + 1]);
+	  if (!(tcrate > 0.0))
+	    {
+	      printf ("Please provide a positive frame rate.\n");
+	      return 1;
+	    }
+	  in += 2;
+	  printf ("Timecode frame rate set to %g fps.\n", tcrate);
+	  continue;
 	}
-
-
-    }				/* for (int in=1; in < argc;) */
-  // Open audio file
-
-  //postprocessing parameters
-
-#ifdef SNDFILELIB
-
-  if (numcalread == sfinfo.channels)
-    {
-      for (int cind = 0; cind < sfinfo.channels; cind++)
+      if (strcmp (argv[in], "--channels") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (tempchcal[cind]);
-
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  nchannelselection =
+	    parse_channellist (argv[in + 1], channelselection, 64);
+	  if (nchannelselection <= 0)
+	    {
+	      printf
+		("Please provide the channels to measure like 3 or 1,2,3 (from 1).\n");
+	      return 1;
+	    }
+	  in += 2;
+	  printf ("Only channel(s) %s will be measured.\n", argv[in - 1]);
+	  continue;
 	}
-    }
-  else if ((numcalread == 0) && (sfinfo.channels == 2))
-    {
-      double conf20[2] = { 0, 0 };
-      for (int cind = 0; cind < sfinfo.channels; cind++)
+      if (strcmp (argv[in], "--exclude-lfe") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (conf20[cind]);
+	  excludelfe = 1;
+	  in++;
+	  printf ("LFE channel excluded from the measurement.\n");
+	  continue;
 	}
-      printf
-	("Using input channel calibration for 2.0 configuration:\n0 0\n");
-    }
-  else if ((numcalread == 0) && (sfinfo.channels == 6))
-    {
-      double conf51[6] = { 0, 0, 0, 0, -3, -3 };
-      for (int cind = 0; cind < sfinfo.channels; cind++)
+      if (strcmp (argv[in], "--lfe-compare") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (conf51[cind]);
+	  lfecompare = 1;
+	  in++;
+	  printf ("Show Leq(M) with and without LFE.\n");
+	  continue;
 	}
-      printf
-	("Using input channel calibration for 5.1 configuration:\n0 0 0 0 -3 -3\n");
-    }
-  else if ((numcalread == 0) && (sfinfo.channels == 8))
-    {
-      double conf71[8] = { 0, 0, 0, 0, -3, -3, -3, -3 };
-      for (int cind = 0; cind < sfinfo.channels; cind++)
+      if (strcmp (argv[in], "--centre") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (conf71[cind]);
+	  centrereport = 1;
+	  in++;
+	  printf ("Show Leq(M) of the centre channel.\n");
+	  continue;
 	}
-      printf
-	("Using input channel calibration for 7.1 configuration:\n0 0 0 0 -3 -3 -3 -3\n");
-
-    }
-
-#elif defined FFMPEG
-
-  if (numcalread == codecContext->channels)
-    {
-      for (int cind = 0; cind < codecContext->channels; cind++)
+      if (strcmp (argv[in], "--balance") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (tempchcal[cind]);
+	  balance = 1;
+	  in++;
+	  printf ("Show channel balance.\n");
+	  continue;
 	}
-    }
-
-  else if ((numcalread == 0) && (codecContext->channels == 2))
-    {
-      double conf20[2] = { 0, 0 };
-      for (int cind = 0; cind < codecContext->channels; cind++)
+      if (strcmp (argv[in], "--downmix") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (conf20[cind]);
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  if (strcmp (argv[in + 1], "stereo") == 0)
+	    downmix = 2;
+	  else if (strcmp (argv[in + 1], "mono") == 0)
+	    downmix = 1;
+	  else
+	    {
+	      printf ("Unknown downmix %s, use stereo or mono.\n",
+		      argv[in + 1]);
+	      return 1;
+	    }
+	  in += 2;
+	  printf ("The %s downmix will be measured.\n", argv[in - 1]);
+	  continue;
 	}
-      printf
-	("Using input channel calibration for 2.0 configuration:\n0 0\n");
-    }
-  else if ((numcalread == 0) && (codecContext->channels == 6))
-    {
-      double conf51[6] = { 0, 0, 0, 0, -3, -3 };
-      for (int cind = 0; cind < codecContext->channels; cind++)
+      if (strcmp (argv[in], "--adm") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (conf51[cind]);
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  if (strcmp (argv[in + 1], "beds") == 0)
+	    admmode = 1;
+	  else if (strcmp (argv[in + 1], "objects") == 0)
+	    admmode = 3;
+	  else if (strcmp (argv[in + 1], "all") == 0)
+	    admmode = 0;
+	  else
+	    {
+	      printf ("Unknown ADM tracks %s, use beds, objects or all.\n",
+		      argv[in + 1]);
+	      return 1;
+	    }
+	  in += 2;
+	  printf ("ADM files: the %s will be measured.\n",
+		  admmode == 0 ? "tracks" : argv[in - 1]);
+	  continue;
 	}
-      printf
-	("Using input channel calibration for 5.1 configuration:\n0 0 0 0 -3 -3\n");
-    }
-  else if ((numcalread == 0) && (codecContext->channels == 8))
-    {
-      double conf71[8] = { 0, 0, 0, 0, -3, -3, -3, -3 };
-      for (int cind = 0; cind < codecContext->channels; cind++)
+      if (strcmp (argv[in], "--segment") == 0)
 	{
-	  channelconfcalvector[cind] = convloglin_single (conf71[cind]);
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  nsegmentlengths =
+	    parse_segmentlengths (argv[in + 1], segmentlengths, 64);
+	  if (nsegmentlengths <= 0)
+	    {
+	      printf
+		("Please provide segment lengths like 60s, 20m or 1180,1204,1150 (seconds).\n");
+	      return 1;
+	    }
+	  shortterm = 1;
+	  in += 2;
+	  printf ("Show Leq(M) per segment (%d length(s)).\n",
+		  nsegmentlengths);
+	  continue;
 	}
-      printf
-	("Using input channel calibration for 7.1 configuration:\n0 0 0 0 -3 -3 -3 -3\n");
-    }
-#endif
-  else
-    {
-
-      printf
-	("Either you specified a different number of calibration than number of channels in the file or you do not indicate any calibration and the program cannot infer one from the number of channels. Please specify a channel calibration on the command line.\n");
-
-      free (channelconfcalvector);
-      channelconfcalvector = NULL;
-      return 0;
-    }
-
-  if (truepeak)
-    {
-      int filtertaps = 12 * oversamp_ratio;
-#ifdef SNDFILELIB
-      switch (sfinfo.samplerate)
-#elif defined FFMPEG
-      switch (codecContext->sample_rate)
-#endif
+      if (strcmp (argv[in], "--raw") == 0)
 	{
-	case 44100:
-	  oversamp_ratio = oversamp_ratio;
-	  filtertaps = filtertaps;
-	  break;
-	case 48000:
-	  oversamp_ratio = oversamp_ratio;
-	  filtertaps = filtertaps;
-	  break;
-	case 96000:
-	  oversamp_ratio = oversamp_ratio / 2;
-	  filtertaps = filtertaps / 2;
-	  break;
-	default:
-	  oversamp_ratio = 1;	// no oversampling for theoretical higher sampling rate
-	  filtertaps = filtertaps / 4;	// would this work? filter should not execute ! 
-	  break;
+	  // the format was taken before opening the file
+	  in += 4;
+	  printf ("Raw PCM input: %s, %d Hz, %d channels.\n",
+		  rawformatnames[rawformat], rawrate, rawchannels);
+	  continue;
 	}
-
-
-      //initialize oversampling filter
-#ifdef FFMPEG
-      truepeak_ctx =
-	init_truepeak_ctx (codecContext->channels, oversamp_ratio,
-			   filtertaps);
-      truepeak_ctx->filter_coeffs =
-	calc_lp_os_coeffs (codecContext->sample_rate, oversamp_ratio,
-			   filtertaps);
-
-#elif defined SNDFILELIB
-      truepeak_ctx =
-	init_truepeak_ctx (sfinfo.channels, oversamp_ratio, filtertaps);
-      truepeak_ctx->filter_coeffs =
-	calc_lp_os_coeffs (sfinfo.samplerate, oversamp_ratio, filtertaps);
-#endif
-    }
-
-
-
-  if (leqm10)
-    {
-      char tempstring[2048];
-      strcpy (tempstring, soundfilename);
-      strcat (tempstring, ".leqm10.txt");
-      leqm10logfile = fopen (tempstring, "w");
-      if (leqm10logfile == NULL)
+      if (strcmp (argv[in], "--dsdrate") == 0)
 	{
-	  printf ("Could not open file to write log leqm10 data!\n");
+	  // the rate was taken before opening the file
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  if (dsdrate < 8000)
+	    {
+	      printf ("Please provide a PCM sample rate for DSD files.\n");
+	      return 1;
+	    }
+	  in += 2;
+	  continue;
 	}
-    }
-
-#ifdef DI
-  if (dolbydi)
-    {
-      if (tempchgate[0] == -1)
+      if (strcmp (argv[in], "--concat") == 0)
 	{
-	  printf
-	    ("Dolby Dialog Intelligence is active for channel L C R. Please\nuse --chgateconf <0|1|2> ... for other configurations.\n");
-#ifdef SNDFILELIB
-	  if ((sfinfo.channels == 6) || (sfinfo.channels < 3))
-	    {
-#elif defined FFMPEG
-	  if ((codecContext->channels == 6) || (codecContext->channels < 3))
+	  // the files were collected before opening the first one
+	  in++;
+	  while (in < argc && strncmp (argv[in], "-", 1) != 0)
+	    in++;
+	  if (nconcat == 0)
 	    {
+	      printf
+		("Please provide the files following the first one after --concat.\n");
+	      return 1;
+	    }
+	  shortterm = 1;
+	  printf ("Measure %d files as one program.\n", nconcat + 1);
+	  continue;
+	}
+      if (strcmp (argv[in], "--multimono") == 0)
+	{
+	  // the files were collected before opening the first one
+	  in++;
+	  while (in < argc && strncmp (argv[in], "-", 1) != 0)
+	    in++;
+#ifdef FFMPEG
+	  printf ("--multimono is only available with libsndfile.\n");
+	  return 1;
 #endif
-	      tempchgate[0] = 2;
-	      tempchgate[1] = 2;
-	      tempchgate[2] = 2;
-	      tempchgate[3] = 0;
-	      tempchgate[4] = 0;
-	      tempchgate[5] = 0;
-
-#ifdef SNDFILELIB
+	  if (nmono == 0)
+	    {
+	      printf
+		("Please provide the stems following the first one after --multimono.\n");
+	      return 1;
 	    }
-	  else if (sfinfo.channels == 8)
+	  printf ("Measure %d mono stems as one program.\n", nmono + 1);
+	  continue;
+	}
+      if (strcmp (argv[in], "--cue") == 0)
+	{
+	  if (argv[in + 1] == NULL)
 	    {
-#elif defined FFMPEG
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
 	    }
-	  else if (codecContext->channels == 8)
+	  cuefile = argv[in + 1];
+	  shortterm = 1;
+	  in += 2;
+	  printf ("Show Leq(M) per track of the CUE sheet.\n");
+	  continue;
+	}
+#ifdef FFMPEG
+      if (strcmp (argv[in], "--stream") == 0)
+	{
+	  // the track was taken before opening the file
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  if (audiotrack <= 0)
 	    {
-#endif
-	      tempchgate[0] = 2;
-	      tempchgate[1] = 2;
-	      tempchgate[2] = 2;
-	      tempchgate[3] = 0;
-	      tempchgate[4] = 0;
-	      tempchgate[5] = 0;
-	      tempchgate[6] = 0;
-	      tempchgate[7] = 0;
-
+	      printf ("Please provide an audio track number from 1.\n");
+	      return 1;
 	    }
-	  else
+	  in += 2;
+	  printf ("Measure audio track %d of the file.\n", audiotrack);
+	  continue;
+	}
+      if (strcmp (argv[in], "--capture") == 0)
+	{
+	  // taken before opening the device
+	  in += 2;
+	  if (trimduration <= 0.0)
 	    {
-	      printf
-		("Please specify which channel(s) should go through Dialog Intelligence.\n");
-	      return 0;
+	      printf ("Please give the length of the capture with --duration.\n");
+	      return 1;
 	    }
+	  printf ("Capture from %s device %s.\n", captureformat,
+		  soundfilename);
+	  continue;
 	}
-    }
-
-
-#endif
-
-
-  if (leqmlog)
-    {
-      char tempstring[2048];
-      strcpy (tempstring, soundfilename);
-      strcat (tempstring, ".leqmlog.txt");
-      leqmlogfile = fopen (tempstring, "w");
-      if (leqmlogfile == NULL)
+      if (strcmp (argv[in], "--follow") == 0)
 	{
-	  printf ("Could not open file to write log leqm data!\n");
+	  // taken before opening the file
+	  in++;
+	  printf
+	    ("Follow the file while it is written, until it stops growing for %d s.\n",
+	     followidle);
+	  continue;
 	}
-    }
-
-
-  if (timing)
-    {
-
-      clock_gettime (CLOCK_MONOTONIC, &starttime);
-    }
-
-  if (convpointsset)
-    {
-      poly = 0;
-      printf ("Using convolution instead of polynomial filtering.\n");
-    }
-
-  if (lkfs)
-    {
-      printf
-	("Setting buffersize to 400ms as per ITU 1770-4 requirements for LKFS measurement.\n");
-      buffersizems = 400;
-      //initialize coeff struct and calculates coefficients for K filter stage 1 and 2
-      coeffs = malloc (sizeof (coeff));
-#ifdef SNDFILELIB
-      precalculate_coeffs_K_filter (coeffs, sfinfo.samplerate);
-#elif defined FFMPEG
-      precalculate_coeffs_K_filter (coeffs, codecContext->sample_rate);
-#endif
-
-
-    }
-
-
-
-  // reading to a double or float buffer with sndfile take care of normalization
-  /*
-     static double  buffer[BUFFER_LEN]; // it seems this must be static. I don't know why
-   */
-  double *buffer;
-#ifdef FFMPEG
-  double *remainbuffer;
-#endif
-  // buffer = new double [BUFFER_LEN];
-  //buffersizesamples = (sfinfo.samplerate*sfinfo.channels*buffersizems)/1000;
-
-#ifdef SNDFILELIB
-  if ((sfinfo.samplerate * buffersizems) % 1000)
-    {
-#elif defined FFMPEG
-  if ((codecContext->sample_rate * buffersizems) % 1000)
-    {
-#endif
-      printf
-	("Please fine tune the buffersize according to the sampling rate\n");
-      //close file
-      // free memory
-      // write a function to do that 
-      return 1;
-    }
-
-
-#ifdef SNDFILELIB
-  buffersizesamples =
-    (sfinfo.samplerate * sfinfo.channels * buffersizems) / 1000;
-  buffer = malloc (sizeof (double) * buffersizesamples);
-  buffersizesamplesdi = (sfinfo.samplerate * buffersizems) / 1000;
-  samplingfreq = sfinfo.samplerate;
-
-#ifdef DI
-  if (leqm10 || leqmlog || dolbydi)
-    {
-#else
-  if (leqm10 || leqmlog)
-    {
-#endif
-
-#ifdef DI
-      //if duration < 10 mm exit
-      if (leqm10)
+      if (strcmp (argv[in], "--followidle") == 0)
 	{
-#endif
-	  double featdursec = sfinfo.frames / sfinfo.samplerate;
-	  if ((featdursec / 60.0) < longperiod)
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  if (followidle <= 0)
 	    {
-	      printf ("The audio file is too short to measure Leq(m10).\n");
-	      //return 0;
+	      printf ("Please provide a number of seconds from 1.\n");
+	      return 1;
 	    }
-#ifdef DI
+	  in += 2;
+	  continue;
 	}
-#endif
-
-      //how many short periods in overall duration //ATTENTION this calculation may return 0  for buffer sizes of less than 10 ms.
-      //Maybe cast to double!!
-      //Also remember that this is necessary also for dolbydi
-      int remainderl =
-	sfinfo.frames % (sfinfo.samplerate * buffersizems / 1000);
-      if (remainderl == 0)
-	numbershortperiods =
-	  sfinfo.frames / (sfinfo.samplerate * buffersizems / 1000);
-      else
-	numbershortperiods =
-	  sfinfo.frames / (sfinfo.samplerate * buffersizems / 1000) + 1;
-
-      //allocate array // well the first is wrong
-
-      shorttermaveragedarray =
-	malloc (sizeof (*shorttermaveragedarray) * numbershortperiods);
-#ifdef DI
-      if (dolbydi)
+      if (strcmp (argv[in], "--chapters") == 0)
 	{
-	  shorttermdidecisionarray = allocatedidecisionarray (sfinfo.channels, numbershortperiods);	/* Allocate DI array for all channels */
-	  sc_shorttermaveragedarray =
-	    allocatesc_shorttermarray (sfinfo.channels, numbershortperiods);
+	  chapters = 1;
+	  shortterm = 1;
+	  in++;
+	  printf ("Show Leq(M) per chapter of the container.\n");
+	  continue;
 	}
-#endif
-    }				/* if (leqm10) */
-
-
-
-
-#elif defined FFMPEG
-  buffersizesamples =
-    (codecContext->sample_rate * codecContext->channels * buffersizems) /
-    1000;
-  buffer = malloc (sizeof (double) * buffersizesamples);
-  remainbuffer = malloc (sizeof (double) * buffersizesamples);
-  buffersizesamplesdi = (codecContext->sample_rate * buffersizems) / 1000;
-  samplingfreq = codecContext->sample_rate;
-  // postpone this because I cannot get duration or number of frames
-  // but I cannot postpone this!!
-  //it seems I cannot get total number of audio frames in ffmpeg so I will simply allocate enough
-  //memory for a 5 hours feature, ok?
-#ifdef DI
-  if (leqm10 || leqmlog || dolbydi)
-    {
 #else
-  if (leqm10 || leqmlog)
-    {
-#endif
-      //numbershortperiods = (int) (180000.00 / (((double) codecContext->sample_rate) * (double) buffersizems/1000.00) + 1); //this is wrong, because 180000 cannot be be number of frames, also why should we devide by the sample rate if 18000 is just seconds?
-      numbershortperiods =
-	(int) (18000.00 / ((double) buffersizems / 1000.00) + 1);
-      shorttermaveragedarray =
-	malloc (sizeof (*shorttermaveragedarray) * numbershortperiods);
-#ifdef DI
-      if (dolbydi)
+      if (strcmp (argv[in], "--follow") == 0)
 	{
-	  shorttermdidecisionarray = allocatedidecisionarray (codecContext->channels, numbershortperiods);	/* Allocate DI array for all channels */
-	  sc_shorttermaveragedarray =
-	    allocatesc_shorttermarray (codecContext->channels,
-				       numbershortperiods);
+	  printf ("--follow is only available with ffmpeg.\n");
+	  return 1;
 	}
 #endif
-    }				/* if (leqm10) */
-
-#endif
-
-
-  if (lkfs)
-    {
-
-      LGCtx = malloc (sizeof (LG));	// this must be freed
-      LGCtx->overlap = 75.0;	//pecentage overlap. should become a command line switch later, default to this value as ITU 1770-4.
-      LGCtx->stepcounter = 0;
-      LGCtx->gatingThresholdFix = -70.0;
-      LGCtx->relativeThresholdNegativeOffset = -10.0;
-      //LGCtx->serialcheckstatus = 0;
-
-#ifdef SNDFILELIB
-      //calculate step offset from percent overlap
-      LGCtx->ops =
-	calcSampleStepLG (LGCtx->overlap, sfinfo.samplerate, buffersizems);
-      LGCtx->gblocksize = (sfinfo.samplerate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
-
-
-
-
-      //first calculate or guestimate total step number, see stepcounter in LG 
-      int remainder = sfinfo.frames % LGCtx->ops;
-
-      /* total step calculation */
-
-      if (remainder == 0)
+      if (strcmp (argv[in], "--timeseries") == 0)
 	{
-	  LGCtx->totalsteps = sfinfo.frames / LGCtx->ops;
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  timeseriesfile = argv[in + 1];
+	  shortterm = 1;
+	  in += 2;
+	  printf ("Leq(M) and Leq(noW) per window will be written to %s\n",
+		  timeseriesfile);
+	  continue;
 	}
-      else
-	LGCtx->totalsteps = sfinfo.frames / LGCtx->ops + 1;
-
-      remainder = LGCtx->gblocksize % LGCtx->ops;
-
-      if (!(remainder))
+      if (strcmp (argv[in], "--verbose") == 0)
 	{
-	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops;
-	  //LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
+	  verbose = 1;
+	  in++;
+	  continue;
+
 	}
-      else
+      if (strcmp (argv[in], "--bandwidth") == 0)
 	{
-	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops + 1;
-	  //  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
-	}
+	  bandwidth = 1;
+	  in++;
+	  printf ("Show estimated audio bandwidth.\n");
+	  continue;
 
-      remainder = LGCtx->totalsteps % LGCtx->subdivs;
-      if (!remainder)
-	{
-	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
 	}
-      else
+      if (strcmp (argv[in], "--clipping") == 0)
 	{
+	  clipping = 1;
+	  in++;
+	  printf ("Show clipping per channel.\n");
+	  continue;
 
-	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
 	}
-
-      LGCtx->LGresultarray = allocateLGresultarray (sfinfo.channels, LGCtx->shortperiods, LGCtx->subdivs);	//numbershortperiods is not the real length of the data, see above
-      LGCtx->chgainconf = malloc (sizeof (double) * sfinfo.channels);
-      LGCtx->chgateconf = malloc (sizeof (double) * sfinfo.channels);
-      //maybe
-      //other speaker configurations?
-      if (sfinfo.channels == 6)
+      if (strcmp (argv[in], "--clipthreshold") == 0)
 	{
-	  LGCtx->chgainconf[0] = 1;
-	  LGCtx->chgainconf[1] = 1;
-	  LGCtx->chgainconf[2] = 1;
-	  LGCtx->chgainconf[3] = 0;
-	  LGCtx->chgainconf[4] = 1.41;
-	  LGCtx->chgainconf[5] = 1.41;
-
-	  LGCtx->chgateconf[0] = 3;
-	  LGCtx->chgateconf[1] = 3;
-	  LGCtx->chgateconf[2] = 3;
-	  LGCtx->chgateconf[3] = 0;
-	  LGCtx->chgateconf[4] = 3;
-	  LGCtx->chgateconf[5] = 3;
-
-
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  clipthreshold = pow (10, atof (argv[in + 1]) / 20);
+	  clipping = 1;
+	  in += 2;
+	  printf
+	    ("Clipping threshold set to %.4f dBFS. Also clipping reporting switched on.\n",
+	     atof (argv[in - 1]));
+	  continue;
 
 	}
-      else
+      if (strcmp (argv[in], "--cliprun") == 0)
 	{
-	  for (int i = 0; i < sfinfo.channels; i++)
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  if (atoi (argv[in + 1]) < 1)
 	    {
-	      LGCtx->chgainconf[i] = 1;
-	      if (i != 3)
-		{
-		  LGCtx->chgateconf[i] = 3;
-		}
-	      else
-		{
-		  LGCtx->chgateconf[i] = 0;
-		}
+	      printf ("Please provide a run length of at least one sample.\n");
+	      return 1;
 	    }
-	}
-      //first calculate or guestimate total step number, see stepcounter in LG
-      //allocate overlap result array, see olresultarrey in LG
-
-
-
-#elif defined FFMPEG
-
-      //calculate step offset from percent overlap
-      LGCtx->ops =
-	calcSampleStepLG (LGCtx->overlap, codecContext->sample_rate,
-			  buffersizems);
-      LGCtx->gblocksize = (codecContext->sample_rate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
-      //first calculate or guestimate total step number, see stepcounter in LG 
-      LGCtx->totalsteps =
-	((int)
-	 (18000.00 /
-	  (((double) LGCtx->ops) / ((double) codecContext->sample_rate)))) +
-	1;
+	  cliprun = atoi (argv[in + 1]);
+	  clipping = 1;
+	  in += 2;
+	  printf
+	    ("Counting clips from %d consecutive samples. Also clipping reporting switched on.\n",
+	     cliprun);
+	  continue;
 
-      int remainder = LGCtx->gblocksize % LGCtx->ops;
-      /*subdivs */
-      if (!(remainder))
-	{
-	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops;
 	}
-      else
+      if (strcmp (argv[in], "--replaygain") == 0)
 	{
-	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops + 1;
+	  replaygain = 1;
+	  lkfs = 1;
+	  truepeak = 1;
+	  in++;
+	  printf ("Show ReplayGain 2.0 track gain and peak.\n");
+	  continue;
 	}
-      /* shortperiods */
-
-      remainder = LGCtx->totalsteps % LGCtx->subdivs;
-      if (!remainder)
+      if (strcmp (argv[in], "--soundcheck") == 0)
 	{
-	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
+	  soundcheck = 1;
+	  lkfs = 1;
+	  truepeak = 1;
+	  in++;
+	  printf ("Show Apple Sound Check value.\n");
+	  continue;
 	}
-      else
+      if (strcmp (argv[in], "--truepeak") == 0)
 	{
-	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
+	  truepeak = 1;
+	  in++;
+	  printf ("True Peak value will be shown.\n");
+	  continue;
 
 	}
-      LGCtx->LGresultarray = allocateLGresultarray (codecContext->channels, LGCtx->shortperiods, LGCtx->subdivs);	//numbershortperiods is not the real length of data
-      //first calculate or guestimate total step number, see stepcounter in LG
-      //allocate overlap result array, see olresultarrey in LG
-
-      LGCtx->chgainconf = malloc (sizeof (double) * codecContext->channels);
-      LGCtx->chgateconf = malloc (sizeof (double) * codecContext->channels);
-      //maybe 
-      if (codecContext->channels == 6)
+      if (strcmp (argv[in], "--oversampling") == 0)
 	{
-	  LGCtx->chgainconf[0] = 1;
-	  LGCtx->chgainconf[1] = 1;
-	  LGCtx->chgainconf[2] = 1;
-	  LGCtx->chgainconf[3] = 0;
-	  LGCtx->chgainconf[4] = 1.41;
-	  LGCtx->chgainconf[5] = 1.41;
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  oversamp_ratio = atoi (argv[in + 1]);
+	  in += 2;
+	  if (truepeak == 0)
+	    truepeak = 1;
+	  printf
+	    ("Oversampling ratio for truepeak set to %d. Also true peak reporting switched on.\n",
+	     oversamp_ratio);
+	  continue;
 
-	  LGCtx->chgateconf[0] = 3;
-	  LGCtx->chgateconf[1] = 3;
-	  LGCtx->chgateconf[2] = 3;
-	  LGCtx->chgateconf[3] = 0;
-	  LGCtx->chgateconf[4] = 3;
-	  LGCtx->chgateconf[5] = 3;
+	}
+#ifdef DI
+      if (strcmp (argv[in], "--agsthreshold") == 0)
+	{
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  agsthreshold = atof (argv[in + 1]);
+	  in += 2;
+	  printf ("Adaptive gate selection threshold set to %0.2f %%.\n",
+		  agsthreshold);
+	  continue;
 
-	  //remember to costrain buffersizems to 400ms in case lkfs is used
 	}
-      else
+#endif
+
+      if (strcmp (argv[in], "--chgateconf") == 0)
 	{
-	  for (int i = 0; i < codecContext->channels; i++)
+	  /* as the order of parameter is free I have to postpone 
+	     the check for consistency with the number of channels.
+	     So first create a temporary array, whose number of element will be checked after 
+	     the parsing of the command line parameters is finished. 
+	   */
+
+	  in++;
+	  for (;;)
 	    {
-	      LGCtx->chgainconf[i] = 1;
-	      if (i != 3)
+	      if (in < argc)
 		{
-		  LGCtx->chgateconf[i] = 3;
+		  //if (!(strncmp(argv[in], "-", 1) == 0)) { //changed this to allow negative numbers
+		  if (isdigit (argv[in][0])
+		      && ((atoi (argv[in]) == 0) || (atoi (argv[in]) == 1)
+			  || (atoi (argv[in]) == 2)))
+		    {		// 0 = no gate, 1 = level gate and 2 = dialogue gate. Level gate threasholds in dB are given on another array 
+		      tempchgate[numgateconfread++] = atoi (argv[in++]);
+		    }
+		  else
+		    break;
 		}
 	      else
-		{
-		  LGCtx->chgateconf[i] = 0;
-		}
-	    }
+		break;
+
+	    }			//for
+
+	  continue;
 	}
-#endif
 
-#ifdef SNDFILELIB
-      //LGCtx->oldBufferBackup = malloc (sizeof (double *) * sfinfo.channels);
-      LGCtx->oldBufferBackup = malloc (sizeof (double *) * numCPU);
-      //for (int i = 0; i < sfinfo.channels; i++)
-      for (int i = 0; i < numCPU; i++)
+      if (strcmp (argv[in], "--quiet") == 0)
 	{
-	  LGCtx->oldBufferBackup[i] =
-	    //malloc (sizeof (double) * LGCtx->gblocksize);
-	    malloc (sizeof (double) * LGCtx->gblocksize * sfinfo.channels);
+	  progressbar = 0;
+	  in++;
+	  continue;
 	}
-#elif defined FFMPEG
-      //LGCtx->oldBufferBackup =
-      //  malloc (sizeof (double *) * codecContext->channels);
-      LGCtx->oldBufferBackup = malloc (sizeof (double *) * numCPU);
-
-      //    for (int i = 0; i < codecContext->channels; i++)
-      for (int i = 0; i < numCPU; i++)
+      if (strcmp (argv[in], "--progress-json") == 0)
 	{
-	  *(LGCtx->oldBufferBackup + i) =
-	    malloc (sizeof (double) * LGCtx->gblocksize *
-		    codecContext->channels);
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  progressinterval = atof (argv[in + 1]);
+	  if (!(progressinterval > 0.0))
+	    {
+	      printf ("Please provide a progress interval in seconds.\n");
+	      return 1;
+	    }
+	  in += 2;
+	  printf ("Progress as JSON on stderr every %.1f s.\n",
+		  progressinterval);
+	  continue;
 	}
-#endif
-    }				/* if (lkfs) */
-
-#ifdef DI
-  /* LEQMDI Insert */
-
-
-  if (dolbydi)
-    {
-
-      LGCtxLeqMDI = malloc (sizeof (LGLeqM));	// this must be freed
-      LGCtxLeqMDI->overlap = 75.0;	//pecentage overlap. should become a command line switch later, default to this value as ITU 1770-4.
-      LGCtxLeqMDI->stepcounter = 0;
-      LGCtxLeqMDI->gatingThresholdFix = -70.0;
-      LGCtxLeqMDI->relativeThresholdNegativeOffset = -10.0;
-
-
-#ifdef SNDFILELIB
-      //calculate step offset from percent overlap
-      LGCtxLeqMDI->ops =
-	calcSampleStepLG (LGCtxLeqMDI->overlap, sfinfo.samplerate,
-			  buffersizems);
-      LGCtxLeqMDI->gblocksize = (sfinfo.samplerate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
-
-
+      if (strcmp (argv[in], "--meter") == 0)
+	{
+	  in++;
+	  if (!isatty (fileno (stderr)))
+	    {
+	      printf ("--meter needs a terminal on stderr, left out.\n");
+	      continue;
+	    }
+	  meter = 1;
+	  continue;
+	}
+      if (strcmp (argv[in], "--timing") == 0)
+	{
+	  timing = 1;
+	  in++;
+	  printf ("Execution time will be measured.\n");
+	  continue;
 
+	}
 
-      //first calculate or guestimate total step number, see stepcounter in LG 
-      int remainder = sfinfo.frames % LGCtxLeqMDI->ops;
+#ifdef DI
+      if (strcmp (argv[in], "--dolbydi") == 0)
+	{
+	  dolbydi = 1;
+	  in++;
+	  printf ("Gating with Dolby Dialogue Intelligence.\n");
+	  continue;
 
-      /* total step calculation */
+	}
 
-      if (remainder == 0)
+      if (strcmp (argv[in], "--printdiinfo") == 0)
 	{
-	  LGCtxLeqMDI->totalsteps = sfinfo.frames / LGCtxLeqMDI->ops;
-	}
-      else
-	LGCtxLeqMDI->totalsteps = sfinfo.frames / LGCtxLeqMDI->ops + 1;
+	  printdiinfo = 1;
+	  in++;
+	  printf
+	    ("Detailed speech intelligence information will be shown.\n");
+	  continue;
 
-      remainder = LGCtxLeqMDI->gblocksize % LGCtxLeqMDI->ops;
+	}
 
-      if (!(remainder))
+#endif
+      if ((strcmp (argv[in], "--lkfs") == 0)
+	  || (strcmp (argv[in], "--lufs") == 0))
 	{
-	  LGCtxLeqMDI->subdivs = LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops;
-	  //LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
+	  lkfs = 1;
+	  in++;
+	  printf ("Show ITU 1770-4 LKFS result.\n");
+	  continue;
+
 	}
-      else
+      if (strcmp (argv[in], "--lra") == 0)
 	{
-	  LGCtxLeqMDI->subdivs =
-	    LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops + 1;
-	  //  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
-	}
+	  lkfs = 1;
+	  lra = 1;
+	  in++;
+	  printf ("Show EBU Tech 3342 Loudness Range (implies --lkfs).\n");
+	  continue;
 
-      remainder = LGCtxLeqMDI->totalsteps % LGCtxLeqMDI->subdivs;
-      if (!remainder)
-	{
-	  LGCtxLeqMDI->shortperiods =
-	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs;
 	}
-      else
+      if (strcmp (argv[in], "--maxloudness") == 0)
 	{
+	  lkfs = 1;
+	  maxloudness = 1;
+	  in++;
+	  printf
+	    ("Show max momentary and short-term loudness (implies --lkfs).\n");
+	  continue;
 
-	  LGCtxLeqMDI->shortperiods =
-	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs + 1;
 	}
+      /*
+         if (strcmp (argv[in], "--leqmdi") == 0)
+         {
+         lkfs = 1;
+         in++;
+         printf ("Show Leq(M,DI) measurement.\n");
+         continue;
 
-      LGCtxLeqMDI->LGresultarray = allocateLGresultarray (sfinfo.channels, LGCtxLeqMDI->shortperiods, LGCtxLeqMDI->subdivs);	//numbershortperiods is not the real length of the data, see above
-      LGCtxLeqMDI->chgainconf = malloc (sizeof (double) * sfinfo.channels);
-      LGCtxLeqMDI->chgateconf = malloc (sizeof (double) * sfinfo.channels);
-      //maybe
-      //other speaker configurations?
-      if (sfinfo.channels == 6)
-	{
-	  LGCtxLeqMDI->chgainconf[0] = 1;
-	  LGCtxLeqMDI->chgainconf[1] = 1;
-	  LGCtxLeqMDI->chgainconf[2] = 1;
-	  LGCtxLeqMDI->chgainconf[3] = 0;
-	  LGCtxLeqMDI->chgainconf[4] = 1;
-	  LGCtxLeqMDI->chgainconf[5] = 1;
-
-	  LGCtxLeqMDI->chgateconf[0] = 3;
-	  LGCtxLeqMDI->chgateconf[1] = 3;
-	  LGCtxLeqMDI->chgateconf[2] = 3;
-	  LGCtxLeqMDI->chgateconf[3] = 0;
-	  LGCtxLeqMDI->chgateconf[4] = 3;
-	  LGCtxLeqMDI->chgateconf[5] = 3;
+         } */
 
+      /*
+         if (strcmp (argv[in], "--polynomial") == 0)
+         {
+         poly = 1;
+         in++;
+         printf
+         ("Using polynomial filter instead of convolution for M weighting.\n");
+         continue;
 
+         } */
+      if (strcmp (argv[in], "--version") == 0)
+	{
+	  in++;
+	  printf ("This is leqm-nrt version %s.\n", VERSION);
+	  continue;
 
 	}
-      else
+      if (strcmp (argv[in], "--help") == 0)
 	{
-	  for (int i = 0; i < sfinfo.channels; i++)
-	    {
-	      LGCtxLeqMDI->chgainconf[i] = 1;
-	      if (i != 3)
-		{
-		  LGCtxLeqMDI->chgateconf[i] = 3;
-		}
-	      else
-		{
-		  LGCtxLeqMDI->chgateconf[i] = 0;
-		}
-	    }
-	}
-      //first calculate or guestimate total step number, see stepcounter in LG
-      //allocate overlap result array, see olresultarrey in LG
-
-
-
-#elif defined FFMPEG
+	  in++;
+	  printf (helptext);
+	  continue;
 
-      //calculate step offset from percent overlap
-      LGCtxLeqMDI->ops =
-	calcSampleStepLG (LGCtxLeqMDI->overlap, codecContext->sample_rate,
-			  buffersizems);
-      LGCtxLeqMDI->gblocksize = (codecContext->sample_rate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
-      //first calculate or guestimate total step number, see stepcounter in LG 
-      LGCtxLeqMDI->totalsteps =
-	((int)
-	 (18000.00 /
-	  (((double) LGCtxLeqMDI->ops) /
-	   ((double) codecContext->sample_rate)))) + 1;
+	}
 
-      int remainder = LGCtxLeqMDI->gblocksize % LGCtxLeqMDI->ops;
-      /*subdivs */
-      if (!(remainder))
+      if (strcmp (argv[in], "--logleqm10") == 0)
 	{
-	  LGCtxLeqMDI->subdivs = LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops;
+	  leqm10 = 1;
+	  in++;
+	  printf ("Leq(M,10m) data will be logged to the file leqm10.txt\n");
+	  continue;
+
 	}
-      else
+      if (strcmp (argv[in], "--logleqm") == 0)
 	{
-	  LGCtxLeqMDI->subdivs =
-	    LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops + 1;
+	  leqmlog = 1;
+	  in++;
+	  printf ("Leq(M) data will be logged to the file leqmlog.txt\n");
+	  continue;
+
 	}
-      /* shortperiods */
 
-      remainder = LGCtxLeqMDI->totalsteps % LGCtxLeqMDI->subdivs;
-      if (!remainder)
+      if (strcmp (argv[in], "--leqnw") == 0)
 	{
-	  LGCtxLeqMDI->shortperiods =
-	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs;
+	  leqnw = 1;
+	  in++;
+	  printf ("Leq(nW) - unweighted -  will be outputted.\n");
+	  continue;
+
 	}
-      else
+
+      if (strcmp (argv[in], "--buffersize") == 0)
 	{
-	  LGCtxLeqMDI->shortperiods =
-	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs + 1;
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  buffersizems = atoi (argv[in + 1]);
+	  in += 2;
+	  printf ("Buffersize will be set to %d milliseconds.\n",
+		  buffersizems);
+	  continue;
 
 	}
-      LGCtxLeqMDI->LGresultarray = allocateLGresultarray (codecContext->channels, LGCtxLeqMDI->shortperiods, LGCtxLeqMDI->subdivs);	//numbershortperiods is not the real length of data
-      //first calculate or guestimate total step number, see stepcounter in LG
-      //allocate overlap result array, see olresultarrey in LG
 
-      LGCtxLeqMDI->chgainconf =
-	malloc (sizeof (double) * codecContext->channels);
-      LGCtxLeqMDI->chgateconf =
-	malloc (sizeof (double) * codecContext->channels);
-      //maybe 
-      if (codecContext->channels == 6)
+      if (strcmp (argv[in], "--agsthreshold") == 0)
 	{
-	  LGCtxLeqMDI->chgainconf[0] = 1;
-	  LGCtxLeqMDI->chgainconf[1] = 1;
-	  LGCtxLeqMDI->chgainconf[2] = 1;
-	  LGCtxLeqMDI->chgainconf[3] = 0;
-	  LGCtxLeqMDI->chgainconf[4] = 1;
-	  LGCtxLeqMDI->chgainconf[5] = 1;
-
-	  LGCtxLeqMDI->chgateconf[0] = 3;
-	  LGCtxLeqMDI->chgateconf[1] = 3;
-	  LGCtxLeqMDI->chgateconf[2] = 3;
-	  LGCtxLeqMDI->chgateconf[3] = 0;
-	  LGCtxLeqMDI->chgateconf[4] = 3;
-	  LGCtxLeqMDI->chgateconf[5] = 3;
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  agsthreshold = atof (argv[in + 1]);
+	  in += 2;
+	  printf
+	    ("Adaptive gate selection based on speech percentage:  %.4f %%.\n",
+	     agsthreshold);
+	  continue;
+	}
 
-	  //remember to costrain buffersizems to 400ms in case lkfs is used
+      if (strcmp (argv[in], "--levelgate") == 0)
+	{
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  levelgatedthreshold = atof (argv[in + 1]);
+	  in += 2;
+	  levelgated = 1;
+	  printf
+	    ("Level gating threshold. This will force switching off speech gating and even adaptive gate selection. Specified threshold is %.4f Leq(M)\n",
+	     levelgatedthreshold);
+	  continue;
 	}
-      else
+      if (strcmp (argv[in], "--target") == 0)
 	{
-	  for (int i = 0; i < codecContext->channels; i++)
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  targetleq = atof (argv[in + 1]);
+	  target = 1;
+	  in += 2;
+	  printf ("Target Leq(M) set to %.4f.\n", targetleq);
+	  continue;
+	}
+      if (strcmp (argv[in], "--normalize") == 0)
+	{
+	  if (argv[in + 1] == NULL)
 	    {
-	      LGCtxLeqMDI->chgainconf[i] = 1;
-	      if (i != 3)
-		{
-		  LGCtxLeqMDI->chgateconf[i] = 3;
-		}
-	      else
-		{
-		  LGCtxLeqMDI->chgateconf[i] = 0;
-		}
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
 	    }
+	  normalizefile = argv[in + 1];
+	  in += 2;
+	  printf ("Normalized copy will be written to %s.\n", normalizefile);
+	  continue;
 	}
-#endif
-
-#ifdef SNDFILELIB
-      //LGCtxLeqMDI->oldBufferBackup = malloc (sizeof (double *) * sfinfo.channels);
-      LGCtxLeqMDI->oldBufferBackup = malloc (sizeof (double *) * numCPU);
-      //for (int i = 0; i < sfinfo.channels; i++)
-      for (int i = 0; i < numCPU; i++)
+      if (strcmp (argv[in], "--foldcheck") == 0)
 	{
-	  LGCtxLeqMDI->oldBufferBackup[i] =
-	    //malloc (sizeof (double) * LGCtxLeqMDI->gblocksize);
-	    malloc (sizeof (double) * LGCtxLeqMDI->gblocksize *
-		    sfinfo.channels);
+	  if (argv[in + 1] == NULL)
+	    {
+	      printf ("Please provide required value after argument switch!\n");
+	      return 1;
+	    }
+	  foldfile = argv[in + 1];
+	  in += 2;
+	  printf
+	    ("Stereo fold-down %s will be checked against the 5.1 program.\n",
+	     foldfile);
+	  continue;
 	}
-#elif defined FFMPEG
-      //LGCtxLeqMDI->oldBufferBackup =
-      //  malloc (sizeof (double *) * codecContext->channels);
-      LGCtxLeqMDI->oldBufferBackup = malloc (sizeof (double *) * numCPU);
-      //for (int i = 0; i < codecContext->channels; i++)
-      for (int i = 0; i < numCPU; i++)
+      if (strcmp (argv[in], "--foldtolerance") == 0)
 	{
-	  *(LGCtxLeqMDI->oldBufferBackup + i) =
-	    malloc (sizeof (double) * LGCtxLeqMDI->gblocksize *
-		    codecContext->channels);
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  foldtolerance = atof (argv[in + 1]);
+	  in += 2;
+	  printf ("Fold-down tolerance set to %.2f dB\n", foldtolerance);
+	  continue;
 	}
-#endif
-    }				/* if (lkfs) */
-
-  /* END LEQMDI INSERT */
-
-#endif //this closes #ifdef DI
-
-  if (!poly)
-    {
-
-      //End opening audio file
+      if (strcmp (argv[in], "--threshold") == 0)
+	{
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  threshold = atof (argv[in + 1]);
+	  in += 2;
+	  printf ("Threshold for Allen metric set to %f Leq(M).\n",
+		  threshold);
+	  continue;
 
+	}
+      if (strcmp (argv[in], "--longperiod") == 0)
+	{
+	  if (checkargvalue (argv[in + 1]))
+	    return 1;
+	  longperiod = atof (argv[in + 1]);
+	  in += 2;
+	  printf ("Longperiod for Leq(M)X set to %f minutes.\n", longperiod);
+	  continue;
 
-      eqfreqresp_db = malloc (sizeof (*eqfreqresp_db) * npoints);
+	}
 
+      if (parameterstate == 0)
+	{
+	  printf ("The command line switch you typed is not valid: %s\n",
+		  argv[in]);
+	  return -1;
+	  break;
+	}
 
-      eqfreqsamples = malloc (sizeof (*eqfreqsamples) * npoints);
 
-      eqfreqresp = malloc (sizeof (*eqfreqresp) * npoints);
+    }				/* for (int in=1; in < argc;) */
+  // Open audio file
 
-      ir = malloc (sizeof (*ir) * npoints * 2);
+#ifdef FFMPEG
+  if (noskip)
+    {
+      // the decoder then leaves priming and padding in the decoded frames
+      codecContext->flags2 |= AV_CODEC_FLAG2_SKIP_MANUAL;
+    }
+#endif
 
-    }				// if(!poly)
-  // And what to do for floating point sample coding?
 #ifdef SNDFILELIB
-  switch (sfinfo.format & SF_FORMAT_SUBMASK)
+  SF_BROADCAST_INFO bext;
+  memset (&bext, 0, sizeof (bext));
+  if (sf_command (file, SFC_GET_BROADCAST_INFO, &bext, sizeof (bext)) ==
+      SF_TRUE)
     {
-      // all signed bitdepth
-    case 0x0001:
-      bitdepth = 8;
-      break;
-    case 0x0002:
-      bitdepth = 16;
-      break;
-    case 0x0003:
-      bitdepth = 24;
-      break;
-    case 0x0004:
-      bitdepth = 32;
-      break;
-    default:
-      printf ("No known bitdepth! Exiting ...\n");
-      return -1;
+      // fixed size fields, not terminated when full
+      char description[257], originator[33], reference[33], date[11],
+	time[9];
+      snprintf (description, sizeof (description), "%.*s",
+		(int) sizeof (bext.description), bext.description);
+      snprintf (originator, sizeof (originator), "%.*s",
+		(int) sizeof (bext.originator), bext.originator);
+      snprintf (reference, sizeof (reference), "%.*s",
+		(int) sizeof (bext.originator_reference),
+		bext.originator_reference);
+      snprintf (date, sizeof (date), "%.*s",
+		(int) sizeof (bext.origination_date), bext.origination_date);
+      snprintf (time, sizeof (time), "%.*s",
+		(int) sizeof (bext.origination_time), bext.origination_time);
+      posthookjson =
+	append_json (posthookjson,
+		     bext_report (description, originator, reference, date,
+				  time,
+				  bext.time_reference_low |
+				  (unsigned long long) bext.time_reference_high
+				  << 32, sfinfo.samplerate, tcrate));
     }
-
 #elif defined FFMPEG
-  bitdepth = av_get_exact_bits_per_sample (codecContext->codec_id);
-#ifdef DEBUG
-  printf ("ffmpeg report %d bitdepth for the file.\n", bitdepth);
-#endif
-
+  // the wav demuxer puts the bext chunk in the metadata
+  if (av_dict_get (formatContext->metadata, "time_reference", NULL, 0) !=
+      NULL)
+    {
+      const char *keys[6] = { "description", "originator",
+	"originator_reference", "origination_date", "origination_time",
+	"time_reference"
+      };
+      const char *values[6];
+      for (int i = 0; i < 6; i++)
+	{
+	  AVDictionaryEntry *entry =
+	    av_dict_get (formatContext->metadata, keys[i], NULL, 0);
+	  values[i] = entry != NULL ? entry->value : "";
+	}
+      posthookjson =
+	append_json (posthookjson,
+		     bext_report (values[0], values[1], values[2], values[3],
+				  values[4], strtoull (values[5], NULL, 10),
+				  codecContext->sample_rate, tcrate));
+    }
+#ifdef DI
+  if (dolbydi && (is_pipe (soundfilename) || follow
+		  || captureformat != NULL))
+    {
+      printf
+	("--dolbydi reads the file twice, not possible with stdin, a FIFO, --follow or --capture.\n");
+      return 1;
+    }
 #endif
-
-  if (!poly)
+  if (codecContext->codec_id == AV_CODEC_ID_AC3
+      || codecContext->codec_id == AV_CODEC_ID_EAC3)
     {
-      equalinterval3 (freqsamples, freqresp_db, eqfreqsamples, eqfreqresp_db,
-		      npoints, samplingfreq, origpoints, bitdepth);
-      convloglin (eqfreqresp_db, eqfreqresp, npoints);
-
-#ifdef DEBUG
-      for (int i = 0; i < npoints; i++)
+      dialnorm = ac3_dialnorm (soundfilename, audioStream->index);
+      if (dialnorm != 0)
 	{
-	  printf ("%d\t%.2f\t%.2f\t%.2f\n", i, eqfreqsamples[i],
-		  eqfreqresp_db[i], eqfreqresp[i]);
+	  char *json = malloc (32);
+	  printf ("Dialnorm: %d dB\n", dialnorm);
+	  snprintf (json, 32, ", \"dialnorm\": %d", dialnorm);
+	  posthookjson = append_json (posthookjson, json);
 	}
+    }
 #endif
+  if (rawformat < 0)
+    {
+      char *ixml = read_wav_chunk (soundfilename, "iXML", NULL);
+      if (ixml != NULL)
+	{
+	  posthookjson = append_json (posthookjson, ixml_report (ixml));
+	  free (ixml);
+	}
+    }
 
-      inversefft2 (eqfreqresp, ir, npoints);
-    }				// if (!poly)
-  // read through the entire file
-
-  struct Sum *totsum;
-  totsum = malloc (sizeof (struct Sum));
-  totsum->csum = 0.0;
-  totsum->sum = 0.0;
-  totsum->nsamples = 0;
-  totsum->cmean = 0.0;
-  totsum->mean = 0.0;		// Do I write anything here?
-  totsum->leqm = 0.0;
-  totsum->rms = 0.0;
-#ifdef SNDFILELIB
-  sf_count_t samples_read = 0;
-
-
-
+  // reported timecodes start from --starttc, --start and --in are added below
+  tcoffset = parse_timecode (tcstart, tcrate);
+  if (tcoffset < 0.0)
+    {
+      printf ("Please provide timecodes as hh:mm:ss:ff (non-drop frame).\n");
+      return 1;
+    }
+  if (tcin != NULL || tcout != NULL)
+    {
+      double offset = tcoffset;
+      double tcinsec = tcin != NULL ? parse_timecode (tcin, tcrate) : offset;
+      double tcoutsec = tcout != NULL ? parse_timecode (tcout, tcrate) : 0.0;
+      if (tcinsec < 0.0 || tcoutsec < 0.0)
+	{
+	  printf
+	    ("Please provide timecodes as hh:mm:ss:ff (non-drop frame).\n");
+	  return 1;
+	}
+      if (tcinsec < offset)
+	{
+	  printf ("The in point is before the start timecode %s.\n", tcstart);
+	  return 1;
+	}
+      if (tcout != NULL && tcoutsec <= tcinsec)
+	{
+	  printf ("The out point must come after the in point.\n");
+	  return 1;
+	}
+      trimstart = tcinsec - offset;
+      if (tcout != NULL)
+	trimduration = tcoutsec - tcinsec;
+    }
 
+  if (cuefile != NULL)
+    {
+      char cuepath[2048];
+      if (strcmp (cuefile, "auto") == 0)
+	{
+	  // song.wav -> song.cue
+	  char *dot = strrchr (soundfilename, '.');
+	  int stemlength = dot != NULL
+	    && strchr (dot, '/') == NULL ? (int) (dot - soundfilename) :
+	    (int) strlen (soundfilename);
+	  snprintf (cuepath, sizeof (cuepath), "%.*s.cue", stemlength,
+		    soundfilename);
+	}
+      else
+	{
+	  snprintf (cuepath, sizeof (cuepath), "%s", cuefile);
+	}
+      if (trimstart > 0.0 || trimduration > 0.0)
+	{
+	  printf
+	    ("--cue cannot be combined with --start, --duration, --in or --out.\n");
+	  return 1;
+	}
+      ncuetracks = read_cuesheet (cuepath, cuestarts, cuetitles, 99);
+      if (ncuetracks < 0)
+	{
+	  printf ("Could not read the CUE sheet %s.\n", cuepath);
+	  return 1;
+	}
+      printf ("CUE sheet %s: %d track(s).\n", cuepath, ncuetracks);
+    }
 
-#elif defined FFMPEG
-  int samples_read = 0;
-  int nextsample = 0;
-  int dsindex = 0;
-  int remaindertot = 0;
+#ifdef FFMPEG
+  if (chapters)
+    {
+      if (trimstart > 0.0 || trimduration > 0.0)
+	{
+	  printf
+	    ("--chapters cannot be combined with --start, --duration, --in or --out.\n");
+	  return 1;
+	}
+      for (unsigned int i = 0; i < formatContext->nb_chapters && i < 99; i++)
+	{
+	  AVChapter *chapter = formatContext->chapters[i];
+	  AVDictionaryEntry *title =
+	    av_dict_get (chapter->metadata, "title", NULL, 0);
+	  chapterstarts[nchapters] =
+	    chapter->start * av_q2d (chapter->time_base);
+	  chaptertitles[nchapters] =
+	    title != NULL ? strdup (title->value) : NULL;
+	  nchapters++;
+	}
+      if (nchapters == 0)
+	printf ("The file has no chapters, only the total is reported.\n");
+      else
+	printf ("Chapters: %d.\n", nchapters);
+    }
 #endif
 
-  int nchannels;
-  int samplerate;
 #ifdef SNDFILELIB
-  nchannels = sfinfo.channels;
-  samplerate = sfinfo.samplerate;
-#elif defined FFMPEG
-  nchannels = codecContext->channels;
-  samplerate = codecContext->sample_rate;
+  sndfiles[0] = file;
 #endif
-
-  // Main loop through audio file
-
-  int worker_id = 0;
-  pthread_t tid[numCPU];
-  struct WorkerArgs **WorkerArgsArray;
-  WorkerArgsArray = malloc (sizeof (struct WorkerArgs *) * numCPU);
-  int staindex = 0;		//shorttermarrayindex
-
-#ifdef DI
-  if (dolbydi)
+  if (nconcat && nmono)
     {
-      //at present audio file must be opened two times. First time just for di to preprocess and collect dialogue information
-      //do something here
-      // put this later
-
-      /* if dolbydi than buffer size will be fixed at 2048 milliseconds */
-      //not necessarily it seems
-      //Well my understanding is that internally do DI work like that with 75% overlapping
-      size_t num_bytes;		/* Number of bytes */
-      unsigned int is_eof_array[nchannels];
-      unsigned int buffered_samples_array[nchannels];
-      unsigned int samples_read_array[nchannels];
-
-      /* initzialize to 0 */
-      //shouldn't do it with memset?
-
-      for (int i = 0; i < nchannels; i++)
+      printf ("--concat cannot be combined with --multimono.\n");
+      return 1;
+    }
+  if (normalizefile != NULL && (!target || nconcat || nmono))
+    {
+      printf
+	("--normalize needs --target and cannot be combined with --concat or --multimono.\n");
+      return 1;
+    }
+  // the gain is measured on the selection and applied to the whole file
+  if (normalizefile != NULL
+      && (trimstart > 0.0 || trimduration > 0.0 || nchannelselection > 0
+	  || excludelfe || downmix || silence == 2 || linetone == 2))
+    {
+      printf
+	("--normalize cannot be combined with --start, --duration, --in, --out, --channels,\n--exclude-lfe, --downmix, --gate-silence or --exclude-linetone.\n");
+      return 1;
+    }
+#ifdef FFMPEG
+  // the ffmpeg program would read the input again
+  if (normalizefile != NULL
+      && (is_pipe (soundfilename) || captureformat != NULL))
+    {
+      printf
+	("--normalize cannot be used with the standard input, a FIFO or a capture device.\n");
+      return 1;
+    }
+#endif
+  if (nconcat)
+    {
+      if (trimstart > 0.0 || trimduration > 0.0 || cuefile != NULL
+#ifdef FFMPEG
+	  || chapters
+#endif
+	)
 	{
-	  is_eof_array[i] = 0;
-	  buffered_samples_array[i] = 0;
-	  samples_read_array[i] = 0;
+	  printf
+	    ("--concat cannot be combined with --start, --duration, --in, --out, --cue or --chapters.\n");
+	  return 1;
 	}
-      /* allocate the decision array */
-
-      //allocatedidecisionarray(nchannels, numbershortperiods, shorttermdidecisionarray); //already done at this point
-
-      /* inizialize array of DI instances, as many as channels */
-      void *di_array[nchannels];
-      num_bytes = di_query_mem_size (samplerate, buffersizesamplesdi);
-      for (int i = 0; i < nchannels; i++)
+      concatstarts[0] = 0.0;
+      concattitles[0] = strdup (soundfilename);
+#ifdef SNDFILELIB
+      sf_count_t programframes = sfinfo.frames;
+      for (int i = 0; i < nconcat; i++)
 	{
-	  is_eof_array[i] = 0;
-	  buffered_samples_array[i] = 0;
-	  samples_read_array[i] = 0;
-	  di_array[i] = (void *) malloc (num_bytes);
-	}
-
-
-      /* Check for errors  and configure Dialogue Intelligence */
-      for (int i = 0; i < nchannels; i++)
+	  SF_INFO concatinfo;
+	  memset (&concatinfo, 0, sizeof (concatinfo));
+	  sndfiles[i + 1] = open_soundfile (concatfiles[i], &concatinfo);
+	  if (sndfiles[i + 1] == NULL)
+	    {
+	      printf ("Error while opening audio file, could not open %s.\n",
+		      concatfiles[i]);
+	      return 1;
+	    }
+	  if (concatinfo.samplerate != sfinfo.samplerate
+	      || concatinfo.channels != sfinfo.channels)
+	    {
+	      printf
+		("%s has %d channels at %d Hz, the first file %d at %d Hz.\n",
+		 concatfiles[i], concatinfo.channels, concatinfo.samplerate,
+		 sfinfo.channels, sfinfo.samplerate);
+	      return 1;
+	    }
+	  concattitles[i + 1] = strdup (concatfiles[i]);
+	  concatframes[i + 1] = concatinfo.frames;
+	}
+      // the range played of each file (DCP reels, IMF resources)
+      concatframes[0] = programframes;
+      programframes = 0;
+      for (int i = 0; i <= nconcat; i++)
+	{
+	  concatfirst[i] = llround (concatentry[i] * sfinfo.samplerate);
+	  if (concatfirst[i] > concatframes[i])
+	    concatfirst[i] = concatframes[i];
+	  concatframes[i] -= concatfirst[i];
+	  if (concatlength[i] > 0.0
+	      && llround (concatlength[i] * sfinfo.samplerate) <
+	      concatframes[i])
+	    concatframes[i] = llround (concatlength[i] * sfinfo.samplerate);
+	  concatleft[i] = concatframes[i];
+	  sf_seek (sndfiles[i], concatfirst[i], SEEK_SET);
+	  concatstarts[i] = (double) programframes / sfinfo.samplerate;
+	  programframes += concatframes[i];
+	}
+      // everything below sees one long file
+      sfinfo.frames = programframes;
+#elif defined FFMPEG
+      double programduration = 0.0;
+      for (int i = 0; i <= nconcat; i++)
 	{
-	  if (di_array[i] == NULL)
+	  const char *path = i == 0 ? soundfilename : concatfiles[i - 1];
+	  int concatrate = 0, concatchannels = 0;
+	  double duration = probe_audio (path, &concatrate, &concatchannels);
+	  if (duration < 0.0)
 	    {
-	      fprintf (stderr, "ERROR: Memory allocation failed.\n");
-	      // (void) fclose(p_input);
-	      //(void) fclose(p_output);
-	      return ERR_CANNOT_ALLOCATE_MEMORY;
+	      printf ("Could not read the duration of %s.\n", path);
+	      return 1;
 	    }
-	  if (di_init
-	      (di_array[i], num_bytes, samplerate, buffersizesamplesdi) < 0)
+	  if (concatrate != codecContext->sample_rate
+	      || concatchannels != codecContext->channels)
 	    {
-	      fprintf (stderr,
-		       "ERROR: Dialogue Intelligence initialization failed.\n");
-	      free (di_array[i]);
-	      //(void) fclose(p_input);
-	      //(void) fclose(p_output);
-	      return ERR_INITIALIZATION_FAILED;
-
+	      printf
+		("%s has %d channels at %d Hz, the first file %d at %d Hz.\n",
+		 path, concatchannels, concatrate, codecContext->channels,
+		 codecContext->sample_rate);
+	      return 1;
 	    }
+	  // the range played of DCP reels and IMF resources
+	  duration -= concatentry[i];
+	  if (concatlength[i] > 0.0 && concatlength[i] < duration)
+	    duration = concatlength[i];
+	  concatstarts[i] = programduration;
+	  concattitles[i] = strdup (path);
+	  programduration += duration;
 	}
+#endif
+    }
 
-
-      /* so many instances as channels will be running in parallel */
-
-
-      //<-- START PREPROCESSING WEGEN DOLBYDI
-
-      pthread_attr_t attr;
-      pthread_attr_init (&attr);
-
+  if (trimstart > 0.0 || trimduration > 0.0)
+    {
+#ifdef FFMPEG
+      double trimrate = codecContext->sample_rate;
+#elif defined SNDFILELIB
+      double trimrate = sfinfo.samplerate;
+#endif
+      trimstartframe = llround (trimstart * trimrate);
+      if (trimduration > 0.0)
+	trimendframe = trimstartframe + llround (trimduration * trimrate);
 #ifdef SNDFILELIB
-
-      //src_data.end_of_input = 0;/* Set this later. */
-
-      /* Start with zero to force load in while loop. */
-      //src_data.input_frames = 0 ;
-      //src_data.data_in = buffer ;
-
-      //src_data.src_ratio = src_ratio ; //this could be done a separate parameter
-
-      //src_data.data_out = src_output ;
-      //src_data.output_frames = BUFFER_LEN /channels ;
-
-
-      while ((samples_read =
-	      sf_read_double (file, buffer, buffersizesamples)) > 0)
+      if (trimstartframe >= sfinfo.frames)
 	{
+	  printf ("The start is past the end of the audio file.\n");
+	  return 1;
+	}
+      if (trimendframe < 0 || trimendframe > sfinfo.frames)
+	trimendframe = sfinfo.frames;
+      sf_seek (file, trimstartframe, SEEK_SET);
+      for (int i = 1; i <= nmono; i++)
+	sf_seek (monosf[i], trimstartframe, SEEK_SET);
+      // everything below only sees the selected range
+      sfinfo.frames = trimendframe - trimstartframe;
+#endif
+      tcoffset += trimstartframe / trimrate;
+      printf ("Measuring from %.3f s", trimstartframe / trimrate);
+      if (trimendframe >= 0)
+	printf (" to %.3f s", trimendframe / trimrate);
+      printf (", reported times are relative to the start.\n");
+    }
+#ifdef SNDFILELIB
+  sf_count_t framesleft = sfinfo.frames;
+#endif
 
-#elif defined FFMPEG
-
-      AVPacket readingPacket;
-      av_init_packet (&readingPacket);
-      int data_size = 0;
-      int copiedsamples = 0;	//also pointer to position  wherein to copy into the buffer
-
+  //postprocessing parameters
 
-      //int myloopcounter = 0;
+  if (powersum && numcalread != 0)
+    {
+      printf ("--sumlaw power cannot be combined with --chconfcal.\n");
+      return 1;
+    }
+#ifdef SNDFILELIB
 
-      while (av_read_frame (formatContext, &readingPacket) == 0)
+  if (powersum)
+    {
+      for (int cind = 0; cind < sfinfo.channels; cind++)
 	{
+	  channelconfcalvector[cind] = 1.0;
+	}
+      printf
+	("Using straight power sum, input channel calibration 0 dB for all channels.\n");
+    }
+  else if (numcalread == sfinfo.channels)
+    {
+      for (int cind = 0; cind < sfinfo.channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (tempchcal[cind]);
 
-	  //printf("External loop %d\n", myloopcounter++);
-
+	}
+    }
+  else if ((numcalread == 0) && (sfinfo.channels == 2))
+    {
+      double conf20[2] = { 0, 0 };
+      for (int cind = 0; cind < sfinfo.channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (conf20[cind]);
+	}
+      printf
+	("Using input channel calibration for 2.0 configuration:\n0 0\n");
+    }
+  else if ((numcalread == 0) && (sfinfo.channels == 6))
+    {
+      double conf51[6] = { 0, 0, 0, 0, -3, -3 };
+      for (int cind = 0; cind < sfinfo.channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (conf51[cind]);
+	}
+      printf
+	("Using input channel calibration for 5.1 configuration:\n0 0 0 0 -3 -3\n");
+    }
+  else if ((numcalread == 0) && (sfinfo.channels == 8))
+    {
+      double conf71[8] = { 0, 0, 0, 0, -3, -3, -3, -3 };
+      for (int cind = 0; cind < sfinfo.channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (conf71[cind]);
+	}
+      printf
+	("Using input channel calibration for 7.1 configuration:\n0 0 0 0 -3 -3 -3 -3\n");
+
+    }
+  else if ((numcalread == 0) && (sfinfo.channels == 16))
+    {
+      double confdc16[16] =
+	{ 0, 0, 0, 0, -3, -3, 0, 0, 0, 0, -3, -3, 0, 0, 0, 0 };
+      for (int cind = 0; cind < sfinfo.channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (confdc16[cind]);
+	}
+      printf
+	("Using input channel calibration for D-Cinema 16-channel configuration:\n0 0 0 0 -3 -3 0 0 0 0 -3 -3 0 0 0 0\n");
+    }
+
+#elif defined FFMPEG
+
+  if (powersum)
+    {
+      for (int cind = 0; cind < codecContext->channels; cind++)
+	{
+	  channelconfcalvector[cind] = 1.0;
+	}
+      printf
+	("Using straight power sum, input channel calibration 0 dB for all channels.\n");
+    }
+  else if (numcalread == codecContext->channels)
+    {
+      for (int cind = 0; cind < codecContext->channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (tempchcal[cind]);
+	}
+    }
+
+  else if ((numcalread == 0) && (codecContext->channels == 2))
+    {
+      double conf20[2] = { 0, 0 };
+      for (int cind = 0; cind < codecContext->channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (conf20[cind]);
+	}
+      printf
+	("Using input channel calibration for 2.0 configuration:\n0 0\n");
+    }
+  else if ((numcalread == 0) && (codecContext->channels == 6))
+    {
+      double conf51[6] = { 0, 0, 0, 0, -3, -3 };
+      for (int cind = 0; cind < codecContext->channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (conf51[cind]);
+	}
+      printf
+	("Using input channel calibration for 5.1 configuration:\n0 0 0 0 -3 -3\n");
+    }
+  else if ((numcalread == 0) && (codecContext->channels == 8))
+    {
+      double conf71[8] = { 0, 0, 0, 0, -3, -3, -3, -3 };
+      for (int cind = 0; cind < codecContext->channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (conf71[cind]);
+	}
+      printf
+	("Using input channel calibration for 7.1 configuration:\n0 0 0 0 -3 -3 -3 -3\n");
+    }
+  else if ((numcalread == 0) && (codecContext->channels == 16))
+    {
+      double confdc16[16] =
+	{ 0, 0, 0, 0, -3, -3, 0, 0, 0, 0, -3, -3, 0, 0, 0, 0 };
+      for (int cind = 0; cind < codecContext->channels; cind++)
+	{
+	  channelconfcalvector[cind] = convloglin_single (confdc16[cind]);
+	}
+      printf
+	("Using input channel calibration for D-Cinema 16-channel configuration:\n0 0 0 0 -3 -3 0 0 0 0 -3 -3 0 0 0 0\n");
+    }
+#endif
+  else
+    {
+
+      printf
+	("Either you specified a different number of calibration than number of channels in the file or you do not indicate any calibration and the program cannot infer one from the number of channels. Please specify a channel calibration on the command line.\n");
+
+      free (channelconfcalvector);
+      channelconfcalvector = NULL;
+      return 0;
+    }
+
+#ifdef SNDFILELIB
+  int nchannels = sfinfo.channels;
+#elif defined FFMPEG
+  int nchannels = codecContext->channels;
+#endif
+  channelsumvector = calloc (nchannels, sizeof (double));
+  channelexcludevector = calloc (nchannels, sizeof (int));
+  if (meter)
+    meterstate.lastchsum = calloc (nchannels, sizeof (double));
+  if (dcoffset)
+    {
+      channeldcvector = calloc (nchannels, sizeof (double));
+    }
+  if (centrereport)
+    {
+      channelnwsumvector = calloc (nchannels, sizeof (double));
+    }
+  if (clipping)
+    {
+      clip_ctx = init_clip_ctx (nchannels, clipthreshold, cliprun);
+    }
+  for (int i = 0; i < nplugins; i++)
+    {
+#ifdef SNDFILELIB
+      pluginpipes[i] = start_plugin (plugins[i], sfinfo.samplerate,
+				     nchannels);
+#elif defined FFMPEG
+      pluginpipes[i] = start_plugin (plugins[i], codecContext->sample_rate,
+				     nchannels);
+#endif
+      if (pluginpipes[i] == NULL)
+	{
+	  printf ("Could not run plugin %s.\n", plugins[i]);
+	  return 1;
+	}
+    }
+  if (bandwidth)
+    {
+      spectrumvector = calloc (SPECTRUMPOINTS / 2 + 1, sizeof (double));
+    }
+  channelnames = calloc (nchannels, sizeof (char *));
+  if (rawformat < 0)
+    admtypes = adm_tracks (soundfilename, nchannels, channelnames);
+  if (admtypes != NULL)
+    {
+      int nmeasured = 0;
+      for (int i = 0; i < nchannels; i++)
+	{
+	  channelexcludevector[i] = admmode != 0 && admtypes[i] != admmode;
+	  nmeasured += !channelexcludevector[i];
+	}
+      if (nmeasured == 0)
+	{
+	  printf ("No ADM %s in this file.\n",
+		  admmode == 1 ? "bed channels" : "objects");
+	  return 1;
+	}
+      // objects are summed as they are, not rendered to a layout
+      printf ("Measuring %d ADM %s.\n", nmeasured,
+	      admmode == 1 ? "bed channels" : admmode ==
+	      3 ? "objects (unrendered)" : "tracks");
+    }
+  else if (nchannels == 16)
+    {
+      /* HI and VI-N sit on channels 7 and 8 as in 8-channel DCP audio */
+      accessibility = 1;
+      printf ("Using the D-Cinema 16-channel layout:\n");
+      for (int i = 0; i < 16; i++)
+	{
+	  channelexcludevector[i] = (dcinema16roles[i] != 1);
+	  if (dcinema16roles[i] == 0)
+	    {
+	      printf ("Ch %d: %s, not audio, excluded from the measurement\n",
+		      i + 1, dcinema16names[i]);
+	    }
+	  else if (dcinema16roles[i] == 2)
+	    {
+	      printf ("Ch %d: %s, measured separately\n", i + 1,
+		      dcinema16names[i]);
+	    }
+	  else
+	    {
+	      printf ("Ch %d: %s\n", i + 1, dcinema16names[i]);
+	    }
+	}
+    }
+  else if (accessibility && nchannels != 8)
+    {
+      printf
+	("HI and VI-N are only defined for 8-channel DCP audio, --accessibility ignored.\n");
+      accessibility = 0;
+    }
+  if (accessibility && nchannels == 8)
+    {
+      // DCP 8-channel: L R C LFE Ls Rs HI VI-N
+      channelexcludevector[6] = 1;
+      channelexcludevector[7] = 1;
+      if (numcalread == 0)
+	{
+	  // the 7.1 default would attenuate HI and VI-N like surrounds
+	  channelconfcalvector[6] = 1.0;
+	  channelconfcalvector[7] = 1.0;
+	  printf
+	    ("Using input channel calibration 0 dB for HI and VI-N instead:\n0 0 0 0 -3 -3 0 0\n");
+	}
+    }
+  if (nchannelselection)
+    {
+      for (int i = 0; i < nchannels; i++)
+	channelexcludevector[i] = 1;
+      for (int i = 0; i < nchannelselection; i++)
+	{
+	  if (channelselection[i] > nchannels)
+	    {
+	      printf ("Channel %d selected, but the file has %d channels.\n",
+		      channelselection[i], nchannels);
+	      return 1;
+	    }
+	  channelexcludevector[channelselection[i] - 1] = 0;
+	}
+    }
+  if (admtypes == NULL)
+    {
+#ifdef SNDFILELIB
+      channel_names (file, nchannels, channelnames);
+#elif defined FFMPEG
+      channel_names (codecContext, channelnames);
+#endif
+    }
+  if (accessibility && nchannels == 8)
+    {
+      channelnames[6] = "HI";
+      channelnames[7] = "VI-N";
+    }
+  if (verbose && channelnames[0] != NULL)
+    {
+      printf ("Channel layout:");
+      for (int i = 0; i < nchannels; i++)
+	printf (" %s", channelnames[i] != NULL ? channelnames[i] : "?");
+      printf ("\n");
+    }
+  for (int i = 0; i < nchannels; i++)
+    {
+      if (channelnames[i] != NULL && strcmp (channelnames[i], "LFE") == 0)
+	lfechannel = i;
+      if (channelnames[i] != NULL && strcmp (channelnames[i], "C") == 0)
+	centrechannel = i;
+    }
+  if (downmix)
+    {
+      if (nchannelselection)
+	{
+	  printf ("--downmix cannot be combined with --channels.\n");
+	  return 1;
+	}
+      downmixmatrix = downmix_matrix (channelnames, nchannels, downmix);
+      if (downmixmatrix == NULL)
+	{
+	  printf
+	    ("The downmix needs to know every channel, but the layout of this file is incomplete.\n");
+	  return 1;
+	}
+      // then measured like a plain stereo or mono file
+      for (int i = 0; i < nchannels; i++)
+	channelconfcalvector[i] = 1.0;
+      for (int i = downmix; i < nchannels; i++)
+	channelnames[i] = "folded";
+      channelnames[0] = (downmix == 2) ? "Lo" : "M";
+      if (downmix == 2)
+	channelnames[1] = "Ro";
+      printf
+	("Downmix (ITU-R BS.775, LFE dropped) to channel%s 0%s, input channel calibration 0 dB.\n",
+	 downmix == 2 ? "s" : "", downmix == 2 ? " and 1" : "");
+    }
+  if (correlation && nchannels != 2)
+    {
+      printf ("--correlation needs a 2 channel file, ignored.\n");
+      correlation = 0;
+    }
+  if (centrereport)
+    {
+      if (centrechannel < 0)
+	{
+	  printf
+	    ("No centre channel in the layout of this file, --centre ignored.\n");
+	  centrereport = 0;
+	}
+      else
+	{
+	  printf ("Centre is channel %d.\n", centrechannel + 1);
+	}
+    }
+  if (excludelfe || lfecompare)
+    {
+      if (lfechannel < 0)
+	{
+	  printf
+	    ("No LFE channel in the layout of this file, --exclude-lfe and --lfe-compare ignored.\n");
+	  excludelfe = 0;
+	  lfecompare = 0;
+	}
+      else
+	{
+	  printf ("LFE is channel %d.\n", lfechannel + 1);
+	  if (excludelfe)
+	    channelexcludevector[lfechannel] = 1;
+	}
+    }
+
+  if (truepeak)
+    {
+      int filtertaps = 12 * oversamp_ratio;
+#ifdef SNDFILELIB
+      switch (sfinfo.samplerate)
+#elif defined FFMPEG
+      switch (codecContext->sample_rate)
+#endif
+	{
+	case 44100:
+	  oversamp_ratio = oversamp_ratio;
+	  filtertaps = filtertaps;
+	  break;
+	case 48000:
+	  oversamp_ratio = oversamp_ratio;
+	  filtertaps = filtertaps;
+	  break;
+	case 96000:
+	  oversamp_ratio = oversamp_ratio / 2;
+	  filtertaps = filtertaps / 2;
+	  break;
+	default:
+	  oversamp_ratio = 1;	// no oversampling for theoretical higher sampling rate
+	  filtertaps = filtertaps / 4;	// would this work? filter should not execute ! 
+	  break;
+	}
+
+
+      //initialize oversampling filter
+#ifdef FFMPEG
+      truepeak_ctx =
+	init_truepeak_ctx (codecContext->channels, oversamp_ratio,
+			   filtertaps);
+      truepeak_ctx->filter_coeffs =
+	calc_lp_os_coeffs (codecContext->sample_rate, oversamp_ratio,
+			   filtertaps);
+
+#elif defined SNDFILELIB
+      truepeak_ctx =
+	init_truepeak_ctx (sfinfo.channels, oversamp_ratio, filtertaps);
+      truepeak_ctx->filter_coeffs =
+	calc_lp_os_coeffs (sfinfo.samplerate, oversamp_ratio, filtertaps);
+#endif
+    }
+
+
+
+  if (leqm10)
+    {
+      char tempstring[2048];
+      strcpy (tempstring, soundfilename);
+      strcat (tempstring, ".leqm10.txt");
+      leqm10logfile = fopen (tempstring, "w");
+      if (leqm10logfile == NULL)
+	{
+	  printf ("Could not open file to write log leqm10 data!\n");
+	}
+    }
+
+#ifdef DI
+  if (dolbydi)
+    {
+      if (tempchgate[0] == -1)
+	{
+	  printf
+	    ("Dolby Dialog Intelligence is active for channel L C R. Please\nuse --chgateconf <0|1|2> ... for other configurations.\n");
+#ifdef SNDFILELIB
+	  if ((sfinfo.channels == 6) || (sfinfo.channels < 3))
+	    {
+#elif defined FFMPEG
+	  if ((codecContext->channels == 6) || (codecContext->channels < 3))
+	    {
+#endif
+	      tempchgate[0] = 2;
+	      tempchgate[1] = 2;
+	      tempchgate[2] = 2;
+	      tempchgate[3] = 0;
+	      tempchgate[4] = 0;
+	      tempchgate[5] = 0;
+
+#ifdef SNDFILELIB
+	    }
+	  else if (sfinfo.channels == 8)
+	    {
+#elif defined FFMPEG
+	    }
+	  else if (codecContext->channels == 8)
+	    {
+#endif
+	      tempchgate[0] = 2;
+	      tempchgate[1] = 2;
+	      tempchgate[2] = 2;
+	      tempchgate[3] = 0;
+	      tempchgate[4] = 0;
+	      tempchgate[5] = 0;
+	      tempchgate[6] = 0;
+	      tempchgate[7] = 0;
+
+	    }
+	  else
+	    {
+	      printf
+		("Please specify which channel(s) should go through Dialog Intelligence.\n");
+	      return 0;
+	    }
+	}
+    }
+
+
+#endif
+
+
+  if (leqmlog)
+    {
+      char tempstring[2048];
+      strcpy (tempstring, soundfilename);
+      strcat (tempstring, ".leqmlog.txt");
+      leqmlogfile = fopen (tempstring, "w");
+      if (leqmlogfile == NULL)
+	{
+	  printf ("Could not open file to write log leqm data!\n");
+	}
+    }
+
+
+  if (printid)
+    {
+      /* every input file and then the settings the results depend on,
+         as text so that the ID is the same on every platform. 0 when
+         some content cannot be read a second time */
+#ifdef FFMPEG
+      int idchannels = codecContext->channels;
+#elif defined SNDFILELIB
+      int idchannels = sfinfo.channels;
+#endif
+      char settings[16384];
+      int len = 0;
+      unsigned long long id = idpath[0] != '\0' ?
+	content_id (14695981039346656037ULL, idpath) : 0;
+      for (int i = 0; i < nconcat && id != 0; i++)
+	id = content_id (id, concatfiles[i]);
+      for (int i = 0; i < nmono && id != 0; i++)
+	id = content_id (id, monofiles[i]);
+      len += snprintf (settings + len, sizeof (settings) - len,
+		       "weighting %d range %lld %lld buffer %d filter %d %d sum %d downmix %d silence %d tone %d raw %d %d %d dsd %d",
+		       weighting, trimstartframe, trimendframe, buffersizems,
+		       poly, poly ? 0 : npoints, powersum, downmix,
+		       silence == 2, linetone == 2, rawformat, rawrate,
+		       rawchannels, dsdrate);
+#ifdef FFMPEG
+      len += snprintf (settings + len, sizeof (settings) - len,
+		       " stream %d noskip %d", audiotrack, noskip);
+#endif
+      for (int i = 0; i < idchannels && i < 128; i++)
+	len += snprintf (settings + len, sizeof (settings) - len,
+			 " channel %.6f %d", channelconfcalvector[i],
+			 channelexcludevector[i]);
+      for (int i = 0; i < numlkfsgainread; i++)
+	len += snprintf (settings + len, sizeof (settings) - len,
+			 " lkfsgain %.6f", templkfsgain[i]);
+      for (int i = 0; i <= nconcat && i < 65; i++)
+	len += snprintf (settings + len, sizeof (settings) - len,
+			 " part %.6f %.6f", concatentry[i], concatlength[i]);
+      if (id != 0)
+	id = fnv1a (id, settings, strlen (settings));
+      if (id == 0)
+	{
+	  printf
+	    ("No measurement ID for %s, its content cannot be read again (standard input,\nFIFO, capture device or stream).\n",
+	     inputname);
+	  return 1;
+	}
+      snprintf (measurementid, sizeof (measurementid), "%016llx", id);
+      printf ("Measurement ID: %s\n", measurementid);
+    }
+
+  if (timing || progressinterval > 0.0 || progressbar)
+    {
+
+      clock_gettime (CLOCK_MONOTONIC, &starttime);
+    }
+
+  if (weighting != WEIGHTING_M)
+    {
+      if (convpointsset)
+	{
+	  printf
+	    ("Convolution is only available for M weighting, using polynomial filtering.\n");
+	}
+      wcoeffs = malloc (sizeof (mcoeff));
+#ifdef SNDFILELIB
+      if (weighting == WEIGHTING_A)
+	precalculate_coeffs_A_filter (wcoeffs, sfinfo.samplerate);
+      else
+	precalculate_coeffs_C_filter (wcoeffs, sfinfo.samplerate);
+#elif defined FFMPEG
+      if (weighting == WEIGHTING_A)
+	precalculate_coeffs_A_filter (wcoeffs, codecContext->sample_rate);
+      else
+	precalculate_coeffs_C_filter (wcoeffs, codecContext->sample_rate);
+#endif
+      printf ("%s filter designed for %d Hz from the analog prototype:\n",
+	      weightinglabel, wcoeffs->samplerate);
+      printf ("%s filter b:", weightinglabel);
+      for (int k = 0; k < wcoeffs->nb; k++)
+	{
+	  printf (" %.17g", wcoeffs->b[k]);
+	}
+      printf ("\n%s filter a:", weightinglabel);
+      for (int k = 0; k < wcoeffs->na; k++)
+	{
+	  printf (" %.17g", wcoeffs->a[k]);
+	}
+      printf ("\n");
+    }
+  else if (convpointsset)
+    {
+      poly = 0;
+      printf ("Using convolution instead of polynomial filtering.\n");
+    }
+#ifdef SNDFILELIB
+  else if (!M_filter_supported (sfinfo.samplerate))
+    {
+#elif defined FFMPEG
+  else if (!M_filter_supported (codecContext->sample_rate))
+    {
+#endif
+      mcoeffs = malloc (sizeof (mcoeff));
+#ifdef SNDFILELIB
+      precalculate_coeffs_M_filter (mcoeffs, sfinfo.samplerate);
+#elif defined FFMPEG
+      precalculate_coeffs_M_filter (mcoeffs, codecContext->sample_rate);
+#endif
+      printf
+	("No shipped M filter for %d Hz, designed from the CCIR 468 analog prototype:\n",
+	 mcoeffs->samplerate);
+      printf ("M filter b:");
+      for (int k = 0; k < mcoeffs->nb; k++)
+	{
+	  printf (" %.17g", mcoeffs->b[k]);
+	}
+      printf ("\nM filter a:");
+      for (int k = 0; k < mcoeffs->na; k++)
+	{
+	  printf (" %.17g", mcoeffs->a[k]);
+	}
+      printf ("\n");
+      int outside = M_filter_selftest (mcoeffs->samplerate, 0);
+      if (outside)
+	{
+	  printf
+	    ("Warning: this filter is out of the CCIR 468 tolerance at %d frequenc%s\n(see --selftest %d), Leq(M) is only approximate.\n",
+	     outside, outside == 1 ? "y" : "ies", mcoeffs->samplerate);
+	}
+    }
+
+  if (lkfs)
+    {
+      printf
+	("Setting buffersize to 400ms as per ITU 1770-4 requirements for LKFS measurement.\n");
+      buffersizems = 400;
+      //initialize coeff struct and calculates coefficients for K filter stage 1 and 2
+      coeffs = malloc (sizeof (coeff));
+#ifdef SNDFILELIB
+      precalculate_coeffs_K_filter (coeffs, sfinfo.samplerate);
+#elif defined FFMPEG
+      precalculate_coeffs_K_filter (coeffs, codecContext->sample_rate);
+#endif
+
+
+    }
+
+
+
+  // reading to a double or float buffer with sndfile take care of normalization
+  /*
+     static double  buffer[BUFFER_LEN]; // it seems this must be static. I don't know why
+   */
+  double *buffer;
+#ifdef FFMPEG
+  double *remainbuffer;
+#endif
+  // buffer = new double [BUFFER_LEN];
+  //buffersizesamples = (sfinfo.samplerate*sfinfo.channels*buffersizems)/1000;
+
+#ifdef SNDFILELIB
+  if ((sfinfo.samplerate * buffersizems) % 1000)
+    {
+#elif defined FFMPEG
+  if ((codecContext->sample_rate * buffersizems) % 1000)
+    {
+#endif
+      printf
+	("Please fine tune the buffersize according to the sampling rate\n");
+      //close file
+      // free memory
+      // write a function to do that 
+      return 1;
+    }
+
+
+#ifdef SNDFILELIB
+  buffersizesamples =
+    (sfinfo.samplerate * sfinfo.channels * buffersizems) / 1000;
+  buffer = malloc (sizeof (double) * buffersizesamples);
+  if (nmono)
+    monoscratch =
+      malloc (sizeof (double) * (buffersizesamples / sfinfo.channels));
+  buffersizesamplesdi = (sfinfo.samplerate * buffersizems) / 1000;
+  samplingfreq = sfinfo.samplerate;
+
+#ifdef DI
+  if (leqm10 || leqmlog || shortterm || dolbydi)
+    {
+#else
+  if (leqm10 || leqmlog || shortterm)
+    {
+#endif
+
+      //if duration < 10 mm exit
+      if (leqm10)
+	{
+	  double featdursec = sfinfo.frames / sfinfo.samplerate;
+	  if ((featdursec / 60.0) < longperiod)
+	    {
+	      printf ("The audio file is too short to measure Leq(m10).\n");
+	      //return 0;
+	    }
+	}
+
+      //how many short periods in overall duration //ATTENTION this calculation may return 0  for buffer sizes of less than 10 ms.
+      //Maybe cast to double!!
+      //Also remember that this is necessary also for dolbydi
+      int remainderl =
+	sfinfo.frames % (sfinfo.samplerate * buffersizems / 1000);
+      if (remainderl == 0)
+	numbershortperiods =
+	  sfinfo.frames / (sfinfo.samplerate * buffersizems / 1000);
+      else
+	numbershortperiods =
+	  sfinfo.frames / (sfinfo.samplerate * buffersizems / 1000) + 1;
+
+      //allocate array // well the first is wrong
+
+      shorttermaveragedarray =
+	malloc (sizeof (*shorttermaveragedarray) * numbershortperiods);
+      if (timeseriesfile != NULL || silence == 2 || linetone == 2)
+	{
+	  shorttermnwarray =
+	    malloc (sizeof (*shorttermnwarray) * numbershortperiods);
+	}
+      if (vad)
+	{
+	  speecharray = malloc (sizeof (*speecharray) * numbershortperiods);
+	}
+      if (correlation)
+	{
+	  correlationarray =
+	    malloc (sizeof (*correlationarray) * numbershortperiods);
+	}
+      if (silence)
+	{
+	  silencearray = malloc (sizeof (*silencearray) * numbershortperiods);
+	}
+      if (linetone)
+	{
+	  tonearray = malloc (sizeof (*tonearray) * numbershortperiods);
+	}
+#ifdef DI
+      if (dolbydi)
+	{
+	  shorttermdidecisionarray = allocatedidecisionarray (sfinfo.channels, numbershortperiods);	/* Allocate DI array for all channels */
+	  sc_shorttermaveragedarray =
+	    allocatesc_shorttermarray (sfinfo.channels, numbershortperiods);
+	}
+#endif
+    }				/* if (leqm10) */
+
+
+
+
+#elif defined FFMPEG
+  buffersizesamples =
+    (codecContext->sample_rate * codecContext->channels * buffersizems) /
+    1000;
+  buffer = malloc (sizeof (double) * buffersizesamples);
+  remainbuffer = malloc (sizeof (double) * buffersizesamples);
+  buffersizesamplesdi = (codecContext->sample_rate * buffersizems) / 1000;
+  samplingfreq = codecContext->sample_rate;
+  // postpone this because I cannot get duration or number of frames
+  // but I cannot postpone this!!
+  //it seems I cannot get total number of audio frames in ffmpeg so I will simply allocate enough
+  //memory for a 5 hours feature, ok?
+#ifdef DI
+  if (leqm10 || leqmlog || shortterm || dolbydi)
+    {
+#else
+  if (leqm10 || leqmlog || shortterm)
+    {
+#endif
+      //numbershortperiods = (int) (180000.00 / (((double) codecContext->sample_rate) * (double) buffersizems/1000.00) + 1); //this is wrong, because 180000 cannot be be number of frames, also why should we devide by the sample rate if 18000 is just seconds?
+      numbershortperiods =
+	(int) (18000.00 / ((double) buffersizems / 1000.00) + 1);
+      shorttermaveragedarray =
+	malloc (sizeof (*shorttermaveragedarray) * numbershortperiods);
+      if (timeseriesfile != NULL || silence == 2 || linetone == 2)
+	{
+	  shorttermnwarray =
+	    malloc (sizeof (*shorttermnwarray) * numbershortperiods);
+	}
+      if (vad)
+	{
+	  speecharray = malloc (sizeof (*speecharray) * numbershortperiods);
+	}
+      if (correlation)
+	{
+	  correlationarray =
+	    malloc (sizeof (*correlationarray) * numbershortperiods);
+	}
+      if (silence)
+	{
+	  silencearray = malloc (sizeof (*silencearray) * numbershortperiods);
+	}
+      if (linetone)
+	{
+	  tonearray = malloc (sizeof (*tonearray) * numbershortperiods);
+	}
+#ifdef DI
+      if (dolbydi)
+	{
+	  shorttermdidecisionarray = allocatedidecisionarray (codecContext->channels, numbershortperiods);	/* Allocate DI array for all channels */
+	  sc_shorttermaveragedarray =
+	    allocatesc_shorttermarray (codecContext->channels,
+				       numbershortperiods);
+	}
+#endif
+    }				/* if (leqm10) */
+
+#endif
+
+
+  if (lkfs)
+    {
+
+      LGCtx = malloc (sizeof (LG));	// this must be freed
+      LGCtx->overlap = 75.0;	//pecentage overlap. should become a command line switch later, default to this value as ITU 1770-4.
+      LGCtx->stepcounter = 0;
+      LGCtx->gatingThresholdFix = -70.0;
+      LGCtx->relativeThresholdNegativeOffset = -10.0;
+      //LGCtx->serialcheckstatus = 0;
+
+#ifdef SNDFILELIB
+      //calculate step offset from percent overlap
+      LGCtx->ops =
+	calcSampleStepLG (LGCtx->overlap, sfinfo.samplerate, buffersizems);
+      LGCtx->gblocksize = (sfinfo.samplerate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
+
+
+
+
+      //first calculate or guestimate total step number, see stepcounter in LG 
+      int remainder = sfinfo.frames % LGCtx->ops;
+
+      /* total step calculation */
+
+      if (remainder == 0)
+	{
+	  LGCtx->totalsteps = sfinfo.frames / LGCtx->ops;
+	}
+      else
+	LGCtx->totalsteps = sfinfo.frames / LGCtx->ops + 1;
+
+      remainder = LGCtx->gblocksize % LGCtx->ops;
+
+      if (!(remainder))
+	{
+	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops;
+	  //LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
+	}
+      else
+	{
+	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops + 1;
+	  //  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
+	}
+
+      remainder = LGCtx->totalsteps % LGCtx->subdivs;
+      if (!remainder)
+	{
+	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
+	}
+      else
+	{
+
+	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
+	}
+
+      LGCtx->LGresultarray = allocateLGresultarray (sfinfo.channels, LGCtx->shortperiods, LGCtx->subdivs);	//numbershortperiods is not the real length of the data, see above
+      LGCtx->chgainconf = malloc (sizeof (double) * sfinfo.channels);
+      LGCtx->chgateconf = malloc (sizeof (double) * sfinfo.channels);
+      //maybe
+      //other speaker configurations?
+      if (sfinfo.channels == 6)
+	{
+	  LGCtx->chgainconf[0] = 1;
+	  LGCtx->chgainconf[1] = 1;
+	  LGCtx->chgainconf[2] = 1;
+	  LGCtx->chgainconf[3] = 0;
+	  LGCtx->chgainconf[4] = 1.41;
+	  LGCtx->chgainconf[5] = 1.41;
+
+	  LGCtx->chgateconf[0] = 3;
+	  LGCtx->chgateconf[1] = 3;
+	  LGCtx->chgateconf[2] = 3;
+	  LGCtx->chgateconf[3] = 0;
+	  LGCtx->chgateconf[4] = 3;
+	  LGCtx->chgateconf[5] = 3;
+
+
+
+	}
+      else if (sfinfo.channels == 8 || sfinfo.channels == 16)
+	{
+	  /* 7.1 as L R C LFE Lss Rss Lrs Rrs: ITU-R BS.1770-4 weights
+	     only the channels between 60 and 120 degrees azimuth. In the
+	     D-Cinema 16-channel layout Ls and Rs are at the same place */
+	  for (int i = 0; i < sfinfo.channels; i++)
+	    {
+	      LGCtx->chgainconf[i] = (i == 4 || i == 5) ? 1.41 : 1;
+	      LGCtx->chgateconf[i] = 3;
+	    }
+	  LGCtx->chgainconf[3] = 0;
+	  LGCtx->chgateconf[3] = 0;
+	}
+      else
+	{
+	  for (int i = 0; i < sfinfo.channels; i++)
+	    {
+	      LGCtx->chgainconf[i] = 1;
+	      if (i != 3)
+		{
+		  LGCtx->chgateconf[i] = 3;
+		}
+	      else
+		{
+		  LGCtx->chgateconf[i] = 0;
+		}
+	    }
+	}
+      if (numlkfsgainread == sfinfo.channels)
+	{
+	  for (int i = 0; i < sfinfo.channels; i++)
+	    {
+	      LGCtx->chgainconf[i] = templkfsgain[i];
+	    }
+	}
+      else if (numlkfsgainread != 0)
+	{
+	  printf
+	    ("Number of LKFS channel gains differs from the number of channels, using the defaults.\n");
+	}
+      for (int i = 0; i < sfinfo.channels; i++)
+	{
+	  if (channelexcludevector[i])
+	    {
+	      LGCtx->chgainconf[i] = 0;
+	      LGCtx->chgateconf[i] = 0;
+	    }
+	}
+      printf ("LKFS channel gains:");
+      for (int i = 0; i < sfinfo.channels; i++)
+	{
+	  printf (" %.2f", LGCtx->chgainconf[i]);
+	}
+      printf ("\n");
+      //first calculate or guestimate total step number, see stepcounter in LG
+      //allocate overlap result array, see olresultarrey in LG
+
+
+
+#elif defined FFMPEG
+
+      //calculate step offset from percent overlap
+      LGCtx->ops =
+	calcSampleStepLG (LGCtx->overlap, codecContext->sample_rate,
+			  buffersizems);
+      LGCtx->gblocksize = (codecContext->sample_rate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
+      //first calculate or guestimate total step number, see stepcounter in LG 
+      LGCtx->totalsteps =
+	((int)
+	 (18000.00 /
+	  (((double) LGCtx->ops) / ((double) codecContext->sample_rate)))) +
+	1;
+
+      int remainder = LGCtx->gblocksize % LGCtx->ops;
+      /*subdivs */
+      if (!(remainder))
+	{
+	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops;
+	}
+      else
+	{
+	  LGCtx->subdivs = LGCtx->gblocksize / LGCtx->ops + 1;
+	}
+      /* shortperiods */
+
+      remainder = LGCtx->totalsteps % LGCtx->subdivs;
+      if (!remainder)
+	{
+	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
+	}
+      else
+	{
+	  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
+
+	}
+      LGCtx->LGresultarray = allocateLGresultarray (codecContext->channels, LGCtx->shortperiods, LGCtx->subdivs);	//numbershortperiods is not the real length of data
+      //first calculate or guestimate total step number, see stepcounter in LG
+      //allocate overlap result array, see olresultarrey in LG
+
+      LGCtx->chgainconf = malloc (sizeof (double) * codecContext->channels);
+      LGCtx->chgateconf = malloc (sizeof (double) * codecContext->channels);
+      //maybe 
+      if (codecContext->channels == 6)
+	{
+	  LGCtx->chgainconf[0] = 1;
+	  LGCtx->chgainconf[1] = 1;
+	  LGCtx->chgainconf[2] = 1;
+	  LGCtx->chgainconf[3] = 0;
+	  LGCtx->chgainconf[4] = 1.41;
+	  LGCtx->chgainconf[5] = 1.41;
+
+	  LGCtx->chgateconf[0] = 3;
+	  LGCtx->chgateconf[1] = 3;
+	  LGCtx->chgateconf[2] = 3;
+	  LGCtx->chgateconf[3] = 0;
+	  LGCtx->chgateconf[4] = 3;
+	  LGCtx->chgateconf[5] = 3;
+
+	  //remember to costrain buffersizems to 400ms in case lkfs is used
+	}
+      else if (codecContext->channels == 8 || codecContext->channels == 16)
+	{
+	  /* 7.1 as L R C LFE Lss Rss Lrs Rrs: ITU-R BS.1770-4 weights
+	     only the channels between 60 and 120 degrees azimuth. In the
+	     D-Cinema 16-channel layout Ls and Rs are at the same place */
+	  for (int i = 0; i < codecContext->channels; i++)
+	    {
+	      LGCtx->chgainconf[i] = (i == 4 || i == 5) ? 1.41 : 1;
+	      LGCtx->chgateconf[i] = 3;
+	    }
+	  LGCtx->chgainconf[3] = 0;
+	  LGCtx->chgateconf[3] = 0;
+	}
+      else
+	{
+	  for (int i = 0; i < codecContext->channels; i++)
+	    {
+	      LGCtx->chgainconf[i] = 1;
+	      if (i != 3)
+		{
+		  LGCtx->chgateconf[i] = 3;
+		}
+	      else
+		{
+		  LGCtx->chgateconf[i] = 0;
+		}
+	    }
+	}
+      if (numlkfsgainread == codecContext->channels)
+	{
+	  for (int i = 0; i < codecContext->channels; i++)
+	    {
+	      LGCtx->chgainconf[i] = templkfsgain[i];
+	    }
+	}
+      else if (numlkfsgainread != 0)
+	{
+	  printf
+	    ("Number of LKFS channel gains differs from the number of channels, using the defaults.\n");
+	}
+      for (int i = 0; i < codecContext->channels; i++)
+	{
+	  if (channelexcludevector[i])
+	    {
+	      LGCtx->chgainconf[i] = 0;
+	      LGCtx->chgateconf[i] = 0;
+	    }
+	}
+      printf ("LKFS channel gains:");
+      for (int i = 0; i < codecContext->channels; i++)
+	{
+	  printf (" %.2f", LGCtx->chgainconf[i]);
+	}
+      printf ("\n");
+#endif
+
+#ifdef SNDFILELIB
+      //LGCtx->oldBufferBackup = malloc (sizeof (double *) * sfinfo.channels);
+      LGCtx->oldBufferBackup = malloc (sizeof (double *) * numCPU);
+      //for (int i = 0; i < sfinfo.channels; i++)
+      for (int i = 0; i < numCPU; i++)
+	{
+	  LGCtx->oldBufferBackup[i] =
+	    //malloc (sizeof (double) * LGCtx->gblocksize);
+	    malloc (sizeof (double) * LGCtx->gblocksize * sfinfo.channels);
+	}
+#elif defined FFMPEG
+      //LGCtx->oldBufferBackup =
+      //  malloc (sizeof (double *) * codecContext->channels);
+      LGCtx->oldBufferBackup = malloc (sizeof (double *) * numCPU);
+
+      //    for (int i = 0; i < codecContext->channels; i++)
+      for (int i = 0; i < numCPU; i++)
+	{
+	  *(LGCtx->oldBufferBackup + i) =
+	    malloc (sizeof (double) * LGCtx->gblocksize *
+		    codecContext->channels);
+	}
+#endif
+    }				/* if (lkfs) */
+
+#ifdef DI
+  /* LEQMDI Insert */
+
+
+  if (dolbydi)
+    {
+
+      LGCtxLeqMDI = malloc (sizeof (LGLeqM));	// this must be freed
+      LGCtxLeqMDI->overlap = 75.0;	//pecentage overlap. should become a command line switch later, default to this value as ITU 1770-4.
+      LGCtxLeqMDI->stepcounter = 0;
+      LGCtxLeqMDI->gatingThresholdFix = -70.0;
+      LGCtxLeqMDI->relativeThresholdNegativeOffset = -10.0;
+
+
+#ifdef SNDFILELIB
+      //calculate step offset from percent overlap
+      LGCtxLeqMDI->ops =
+	calcSampleStepLG (LGCtxLeqMDI->overlap, sfinfo.samplerate,
+			  buffersizems);
+      LGCtxLeqMDI->gblocksize = (sfinfo.samplerate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
+
+
+
+
+      //first calculate or guestimate total step number, see stepcounter in LG 
+      int remainder = sfinfo.frames % LGCtxLeqMDI->ops;
+
+      /* total step calculation */
+
+      if (remainder == 0)
+	{
+	  LGCtxLeqMDI->totalsteps = sfinfo.frames / LGCtxLeqMDI->ops;
+	}
+      else
+	LGCtxLeqMDI->totalsteps = sfinfo.frames / LGCtxLeqMDI->ops + 1;
+
+      remainder = LGCtxLeqMDI->gblocksize % LGCtxLeqMDI->ops;
+
+      if (!(remainder))
+	{
+	  LGCtxLeqMDI->subdivs = LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops;
+	  //LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs;
+	}
+      else
+	{
+	  LGCtxLeqMDI->subdivs =
+	    LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops + 1;
+	  //  LGCtx->shortperiods = LGCtx->totalsteps / LGCtx->subdivs + 1;
+	}
+
+      remainder = LGCtxLeqMDI->totalsteps % LGCtxLeqMDI->subdivs;
+      if (!remainder)
+	{
+	  LGCtxLeqMDI->shortperiods =
+	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs;
+	}
+      else
+	{
+
+	  LGCtxLeqMDI->shortperiods =
+	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs + 1;
+	}
+
+      LGCtxLeqMDI->LGresultarray = allocateLGresultarray (sfinfo.channels, LGCtxLeqMDI->shortperiods, LGCtxLeqMDI->subdivs);	//numbershortperiods is not the real length of the data, see above
+      LGCtxLeqMDI->chgainconf = malloc (sizeof (double) * sfinfo.channels);
+      LGCtxLeqMDI->chgateconf = malloc (sizeof (double) * sfinfo.channels);
+      //maybe
+      //other speaker configurations?
+      if (sfinfo.channels == 6)
+	{
+	  LGCtxLeqMDI->chgainconf[0] = 1;
+	  LGCtxLeqMDI->chgainconf[1] = 1;
+	  LGCtxLeqMDI->chgainconf[2] = 1;
+	  LGCtxLeqMDI->chgainconf[3] = 0;
+	  LGCtxLeqMDI->chgainconf[4] = 1;
+	  LGCtxLeqMDI->chgainconf[5] = 1;
+
+	  LGCtxLeqMDI->chgateconf[0] = 3;
+	  LGCtxLeqMDI->chgateconf[1] = 3;
+	  LGCtxLeqMDI->chgateconf[2] = 3;
+	  LGCtxLeqMDI->chgateconf[3] = 0;
+	  LGCtxLeqMDI->chgateconf[4] = 3;
+	  LGCtxLeqMDI->chgateconf[5] = 3;
+
+
+
+	}
+      else
+	{
+	  for (int i = 0; i < sfinfo.channels; i++)
+	    {
+	      LGCtxLeqMDI->chgainconf[i] = 1;
+	      if (i != 3)
+		{
+		  LGCtxLeqMDI->chgateconf[i] = 3;
+		}
+	      else
+		{
+		  LGCtxLeqMDI->chgateconf[i] = 0;
+		}
+	    }
+	}
+      //first calculate or guestimate total step number, see stepcounter in LG
+      //allocate overlap result array, see olresultarrey in LG
+
+
+
+#elif defined FFMPEG
+
+      //calculate step offset from percent overlap
+      LGCtxLeqMDI->ops =
+	calcSampleStepLG (LGCtxLeqMDI->overlap, codecContext->sample_rate,
+			  buffersizems);
+      LGCtxLeqMDI->gblocksize = (codecContext->sample_rate * buffersizems / 1000);	//At present this is the same as buffersizems, but in samples (no interleaving)
+      //first calculate or guestimate total step number, see stepcounter in LG 
+      LGCtxLeqMDI->totalsteps =
+	((int)
+	 (18000.00 /
+	  (((double) LGCtxLeqMDI->ops) /
+	   ((double) codecContext->sample_rate)))) + 1;
+
+      int remainder = LGCtxLeqMDI->gblocksize % LGCtxLeqMDI->ops;
+      /*subdivs */
+      if (!(remainder))
+	{
+	  LGCtxLeqMDI->subdivs = LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops;
+	}
+      else
+	{
+	  LGCtxLeqMDI->subdivs =
+	    LGCtxLeqMDI->gblocksize / LGCtxLeqMDI->ops + 1;
+	}
+      /* shortperiods */
+
+      remainder = LGCtxLeqMDI->totalsteps % LGCtxLeqMDI->subdivs;
+      if (!remainder)
+	{
+	  LGCtxLeqMDI->shortperiods =
+	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs;
+	}
+      else
+	{
+	  LGCtxLeqMDI->shortperiods =
+	    LGCtxLeqMDI->totalsteps / LGCtxLeqMDI->subdivs + 1;
+
+	}
+      LGCtxLeqMDI->LGresultarray = allocateLGresultarray (codecContext->channels, LGCtxLeqMDI->shortperiods, LGCtxLeqMDI->subdivs);	//numbershortperiods is not the real length of data
+      //first calculate or guestimate total step number, see stepcounter in LG
+      //allocate overlap result array, see olresultarrey in LG
+
+      LGCtxLeqMDI->chgainconf =
+	malloc (sizeof (double) * codecContext->channels);
+      LGCtxLeqMDI->chgateconf =
+	malloc (sizeof (double) * codecContext->channels);
+      //maybe 
+      if (codecContext->channels == 6)
+	{
+	  LGCtxLeqMDI->chgainconf[0] = 1;
+	  LGCtxLeqMDI->chgainconf[1] = 1;
+	  LGCtxLeqMDI->chgainconf[2] = 1;
+	  LGCtxLeqMDI->chgainconf[3] = 0;
+	  LGCtxLeqMDI->chgainconf[4] = 1;
+	  LGCtxLeqMDI->chgainconf[5] = 1;
+
+	  LGCtxLeqMDI->chgateconf[0] = 3;
+	  LGCtxLeqMDI->chgateconf[1] = 3;
+	  LGCtxLeqMDI->chgateconf[2] = 3;
+	  LGCtxLeqMDI->chgateconf[3] = 0;
+	  LGCtxLeqMDI->chgateconf[4] = 3;
+	  LGCtxLeqMDI->chgateconf[5] = 3;
+
+	  //remember to costrain buffersizems to 400ms in case lkfs is used
+	}
+      else
+	{
+	  for (int i = 0; i < codecContext->channels; i++)
+	    {
+	      LGCtxLeqMDI->chgainconf[i] = 1;
+	      if (i != 3)
+		{
+		  LGCtxLeqMDI->chgateconf[i] = 3;
+		}
+	      else
+		{
+		  LGCtxLeqMDI->chgateconf[i] = 0;
+		}
+	    }
+	}
+#endif
+
+#ifdef SNDFILELIB
+      //LGCtxLeqMDI->oldBufferBackup = malloc (sizeof (double *) * sfinfo.channels);
+      LGCtxLeqMDI->oldBufferBackup = malloc (sizeof (double *) * numCPU);
+      //for (int i = 0; i < sfinfo.channels; i++)
+      for (int i = 0; i < numCPU; i++)
+	{
+	  LGCtxLeqMDI->oldBufferBackup[i] =
+	    //malloc (sizeof (double) * LGCtxLeqMDI->gblocksize);
+	    malloc (sizeof (double) * LGCtxLeqMDI->gblocksize *
+		    sfinfo.channels);
+	}
+#elif defined FFMPEG
+      //LGCtxLeqMDI->oldBufferBackup =
+      //  malloc (sizeof (double *) * codecContext->channels);
+      LGCtxLeqMDI->oldBufferBackup = malloc (sizeof (double *) * numCPU);
+      //for (int i = 0; i < codecContext->channels; i++)
+      for (int i = 0; i < numCPU; i++)
+	{
+	  *(LGCtxLeqMDI->oldBufferBackup + i) =
+	    malloc (sizeof (double) * LGCtxLeqMDI->gblocksize *
+		    codecContext->channels);
+	}
+#endif
+    }				/* if (lkfs) */
+
+  /* END LEQMDI INSERT */
+
+#endif //this closes #ifdef DI
+
+  if (!poly)
+    {
+
+      //End opening audio file
+
+
+      eqfreqresp_db = malloc (sizeof (*eqfreqresp_db) * npoints);
+
+
+      eqfreqsamples = malloc (sizeof (*eqfreqsamples) * npoints);
+
+      eqfreqresp = malloc (sizeof (*eqfreqresp) * npoints);
+
+      ir = malloc (sizeof (*ir) * npoints * 2);
+
+    }				// if(!poly)
+  // And what to do for floating point sample coding?
+#ifdef SNDFILELIB
+  switch (sfinfo.format & SF_FORMAT_SUBMASK)
+    {
+      // all signed bitdepth
+    case 0x0001:
+      bitdepth = 8;
+      break;
+    case 0x0002:
+      bitdepth = 16;
+      break;
+    case 0x0003:
+      bitdepth = 24;
+      break;
+    case 0x0004:
+      bitdepth = 32;
+      break;
+    case 0x0005:		// unsigned
+      bitdepth = 8;
+      break;
+    case 0x0006:
+      bitdepth = 32;
+      floatsamples = 1;
+      break;
+    case 0x0007:
+      bitdepth = 64;
+      floatsamples = 1;
+      break;
+    default:
+      printf ("No known bitdepth! Exiting ...\n");
+      return -1;
+    }
+
+#elif defined FFMPEG
+  bitdepth = av_get_exact_bits_per_sample (codecContext->codec_id);
+  floatsamples = codecContext->codec_id == AV_CODEC_ID_PCM_F32LE
+    || codecContext->codec_id == AV_CODEC_ID_PCM_F32BE
+    || codecContext->codec_id == AV_CODEC_ID_PCM_F64LE
+    || codecContext->codec_id == AV_CODEC_ID_PCM_F64BE;
+#ifdef DEBUG
+  printf ("ffmpeg report %d bitdepth for the file.\n", bitdepth);
+#endif
+
+#endif
+  // 0 for compressed codecs
+  if (bitdepth > 0)
+    {
+      char *json = malloc (64);
+      if (verbose)
+	printf ("Bit depth: %d%s\n", bitdepth,
+		floatsamples ? " float" : "");
+      snprintf (json, 64, ", \"bit_depth\": %d, \"float\": %s", bitdepth,
+		floatsamples ? "true" : "false");
+      posthookjson = append_json (posthookjson, json);
+    }
+
+  if (!poly)
+    {
+      equalinterval3 (freqsamples, freqresp_db, eqfreqsamples, eqfreqresp_db,
+		      npoints, samplingfreq, origpoints, bitdepth);
+      convloglin (eqfreqresp_db, eqfreqresp, npoints);
+
+#ifdef DEBUG
+      for (int i = 0; i < npoints; i++)
+	{
+	  printf ("%d\t%.2f\t%.2f\t%.2f\n", i, eqfreqsamples[i],
+		  eqfreqresp_db[i], eqfreqresp[i]);
+	}
+#endif
+
+      inversefft2 (eqfreqresp, ir, npoints);
+    }				// if (!poly)
+  // read through the entire file
+
+  struct Sum *totsum;
+  totsum = malloc (sizeof (struct Sum));
+  totsum->csum = 0.0;
+  totsum->sum = 0.0;
+  totsum->nsamples = 0;
+  totsum->cmean = 0.0;
+  totsum->mean = 0.0;		// Do I write anything here?
+  totsum->leqm = 0.0;
+  totsum->rms = 0.0;
+#ifdef SNDFILELIB
+  sf_count_t samples_read = 0;
+
+
+
+
+
+#elif defined FFMPEG
+  int samples_read = 0;
+  int nextsample = 0;
+  int dsindex = 0;
+  int remaindertot = 0;
+#endif
+
+  int samplerate;
+#ifdef SNDFILELIB
+  nchannels = sfinfo.channels;
+  samplerate = sfinfo.samplerate;
+#elif defined FFMPEG
+  nchannels = codecContext->channels;
+  samplerate = codecContext->sample_rate;
+#endif
+
+  // Main loop through audio file
+
+  int worker_id = 0;
+  pthread_t tid[numCPU];
+  struct WorkerArgs **WorkerArgsArray;
+  WorkerArgsArray = malloc (sizeof (struct WorkerArgs *) * numCPU);
+  int staindex = 0;		//shorttermarrayindex
+
+#ifdef DI
+  if (dolbydi)
+    {
+      //at present audio file must be opened two times. First time just for di to preprocess and collect dialogue information
+      //do something here
+      // put this later
+
+      /* if dolbydi than buffer size will be fixed at 2048 milliseconds */
+      //not necessarily it seems
+      //Well my understanding is that internally do DI work like that with 75% overlapping
+      size_t num_bytes;		/* Number of bytes */
+      unsigned int is_eof_array[nchannels];
+      unsigned int buffered_samples_array[nchannels];
+      unsigned int samples_read_array[nchannels];
+
+      /* initzialize to 0 */
+      //shouldn't do it with memset?
+
+      for (int i = 0; i < nchannels; i++)
+	{
+	  is_eof_array[i] = 0;
+	  buffered_samples_array[i] = 0;
+	  samples_read_array[i] = 0;
+	}
+      /* allocate the decision array */
+
+      //allocatedidecisionarray(nchannels, numbershortperiods, shorttermdidecisionarray); //already done at this point
+
+      /* inizialize array of DI instances, as many as channels */
+      void *di_array[nchannels];
+      num_bytes = di_query_mem_size (samplerate, buffersizesamplesdi);
+      for (int i = 0; i < nchannels; i++)
+	{
+	  is_eof_array[i] = 0;
+	  buffered_samples_array[i] = 0;
+	  samples_read_array[i] = 0;
+	  di_array[i] = (void *) malloc (num_bytes);
+	}
+
+
+      /* Check for errors  and configure Dialogue Intelligence */
+      for (int i = 0; i < nchannels; i++)
+	{
+	  if (di_array[i] == NULL)
+	    {
+	      fprintf (stderr, "ERROR: Memory allocation failed.\n");
+	      // (void) fclose(p_input);
+	      //(void) fclose(p_output);
+	      return ERR_CANNOT_ALLOCATE_MEMORY;
+	    }
+	  if (di_init
+	      (di_array[i], num_bytes, samplerate, buffersizesamplesdi) < 0)
+	    {
+	      fprintf (stderr,
+		       "ERROR: Dialogue Intelligence initialization failed.\n");
+	      free (di_array[i]);
+	      //(void) fclose(p_input);
+	      //(void) fclose(p_output);
+	      return ERR_INITIALIZATION_FAILED;
+
+	    }
+	}
+
+
+      /* so many instances as channels will be running in parallel */
+
+
+      //<-- START PREPROCESSING WEGEN DOLBYDI
+
+      pthread_attr_t attr;
+      pthread_attr_init (&attr);
+
+#ifdef SNDFILELIB
+
+      //src_data.end_of_input = 0;/* Set this later. */
+
+      /* Start with zero to force load in while loop. */
+      //src_data.input_frames = 0 ;
+      //src_data.data_in = buffer ;
+
+      //src_data.src_ratio = src_ratio ; //this could be done a separate parameter
+
+      //src_data.data_out = src_output ;
+      //src_data.output_frames = BUFFER_LEN /channels ;
+
+
+      while ((samples_read = nmono ?
+	      read_multimono (monosf, nmono + 1, buffer, monoscratch,
+			      buffersizesamples, &framesleft) :
+	      read_program (sndfiles, nconcat ? concatleft : NULL,
+			    nconcat + 1, &currentsndfile, buffer,
+			    buffersizesamples, sfinfo.channels,
+			    &framesleft)) > 0)
+	{
+
+#elif defined FFMPEG
+
+      AVPacket readingPacket;
+      av_init_packet (&readingPacket);
+      int data_size = 0;
+      int copiedsamples = 0;	//also pointer to position  wherein to copy into the buffer
+
+
+      //int myloopcounter = 0;
+
+      while (av_read_frame (formatContext, &readingPacket) == 0)
+	{
+
+	  //printf("External loop %d\n", myloopcounter++);
+
+
+	  if (readingPacket.stream_index == audioStream->index)
+	    {
+	      //AVPacket decodingPacket = readingPacket;
+	      int result;
+
+	      result = avcodec_send_packet (codecContext, &readingPacket);
+
+	      if (result < 0)
+		{
+		  printf ("Error submitting packet to the decoder\n");
+		  exit (1);
+		}
+
+	      // Audio packets can have multiple audio frames in a single packet
+	      while (readingPacket.size > 0)
+		{
+
+		  // printf("Internal 1 loop  %d\n", myloopcounter++);
+		  // Try to decode the packet into a frame
+		  // Some frames rely on multiple packets, so we have to make sure the frame is finished before
+		  // we can use it
+		  int gotFrame = 0;
+		  //int result = avcodec_decode_audio4 (codecContext, frame, &gotFrame,
+		  //                                    &decodingPacket);
+
+
+		  result = avcodec_receive_frame (codecContext, frame);
+		  if (result == 0)
+		    {
+		      gotFrame = 1;
+
+		    }
+
+		  if ((result == AVERROR (EAGAIN)) || (result == AVERROR_EOF))
+		    continue;	// it was return in the ffmpeg example as it was in a function
+		  else if (result < 0)
+		    {
+		      printf ("Error during deconding\n");
+		      exit (1);
+		    }
+
+
+
+		  if (result >= 0 && gotFrame)
+		    {
+		      readingPacket.size -= readingPacket.size;
+		      //readingPacket.data += result;
+		      readingPacket.data += readingPacket.size;
+
+		      // We now have a fully decoded audio frame
+		      /*
+		         #ifdef DEBUG
+		         printAudioFrameInfo(codecContext, frame);
+		         #endif
+		       */
+		      //here goes the copying to the multithreaded buffer
+		      //but this buffer is in milliseconds and could be less oder more
+		      //probably greater than the single frame
+
+		      //copy as much samples as there is room in the buffer
+
+		      if (trim_frame (frame, codecContext, &decodedframes,
+				      trimstartframe, trimendframe) == 0)
+			gotFrame = 0;
+		      if (gotFrame)
+			{
+			  data_size =	//this is in bytes
+			    av_samples_get_buffer_size
+			    (NULL,
+			     codecContext->channels,
+			     frame->nb_samples, codecContext->sample_fmt, 1);
+			  // check if copying frame data will overflow the buffer
+			  // and copy only the samples necessary to completely fill the buffer
+			  // save the remaining for the next copy
+			  // write a function that uses get to change data to double and copy in worker buffer
+
+			  copiedsamples +=
+			    (frame->nb_samples * frame->channels);
+			  //         memcpy((char) ((void *) buffer), frame.data[0], data_size);          
+			  //transfer_decoded_data(frame, WorkerArgsArray, worker_id, codecContext);
+			  // nextsample is next sample of frame to be copied
+			  nextsample =
+			    transfer_decoded_samples (frame, buffer,
+						      codecContext,
+						      buffersizesamples,
+						      &dsindex);
+			  /*
+			     #ifdef DEBUG
+			     printf("Next sample index: %d\n", nextsample);
+			     #endif
+			   */
+			  //// From here execute only if buffer is full of data
+
+			  //if (copiedsamples >= buffersizesamples) {
+			  while (copiedsamples >= buffersizesamples)
+			    {
+			      //printf("Internal 2 loop %d\n", myloopcounter++);
+			      realnumbershortperiods++;
+
+			      dsindex = 0;
+			      //remaindertot = copiedsamples - buffersizesamples;
+			      //copiedsamples = 0;
+
+			      // store rest in another buffer
+			      if (copiedsamples > buffersizesamples)
+				{
+				  //copiedsamples = transfer_remaining_decoded_samples(frame, remainbuffer, codecContext, nextsample, &dsindex)*frame->channels;
+				  transfer_remaining_decoded_samples (frame,
+								      remainbuffer,
+								      codecContext,
+								      nextsample,
+								      &dsindex)
+				    * frame->channels;
+				}
+			      else
+				{
+				  copiedsamples = 0;
+				}
+
+			      if (copiedsamples > buffersizesamples)
+				{	//mistake here because I updated copiedsamples, it is no more the intended one
+				  //once buffer copied, copy rest if present in buffer for next cycle
+				  //but I have to update dsindex otherwise I will overwrite data on the next cycle
+				  //ACHTUNG: the buffer must be the one of the next worker!
+				  // ALSO: I have to account for n_samples if buffer is not full on the last buffer
+				  memcpy (buffer, remainbuffer, sizeof (double) * (copiedsamples - buffersizesamples));	//here I should copy only copiedsamples-buffersizesamples
+				  dsindex = copiedsamples - buffersizesamples;	//added
+				  copiedsamples =
+				    copiedsamples - buffersizesamples;
+				  //samples_read = buffersizesamples; //pertains DI
+				  //is_eof = 0; //pertains DI
+				  //buffered_samples = copiedsaamples - buffersizesamples;
+				  //copiedsamples already initialized to the right value
+				}
+
+			      /* Loop through channels in a short period. This loop is happening in the single threads wenn actual measuring processing takes place */
+			      /* My understanding is that DI cannot use a 75% overlap of the samples, so one cannot really parallelize inside a single channel, but only between the channels. So the parallelization should be limited by the number of channels! Is it so at present? */
+
+			      for (int ch_index = 0; ch_index < nchannels; //cannot be more than channel because per di_instance data must be coming serially
+				   ch_index++)
+				{
+				  //printf("Internal 3 loop %d\n", myloopcounter++);
+				  WorkerArgsArray[worker_id] =
+				    malloc (sizeof (struct WorkerArgs));
+				  WorkerArgsArray[worker_id]->
+				    fullbuffer_nsamples = buffersizesamplesdi;
+				  WorkerArgsArray[worker_id]->nsamples =
+				    buffersizesamplesdi;
+				  WorkerArgsArray[worker_id]->nch =
+				    codecContext->channels;
+				  WorkerArgsArray[worker_id]->npoints =
+				    npoints;
+				  WorkerArgsArray[worker_id]->ir = ir;
+				  WorkerArgsArray[worker_id]->ptrtotsum =
+				    totsum;
+
+				  WorkerArgsArray[worker_id]->chconf =
+				    channelconfcalvector;
+				  /* if ((leqm10) || (dolbydi)) { */
+				  WorkerArgsArray[worker_id]->shorttermindex = staindex;	// <- This was altered
+				  /* if (leqm10)
+				     {
+				     WorkerArgsArray[worker_id]->leqm10flag = 1;  // this only if leqm10
+				     WorkerArgsArray[worker_id]->shorttermarray =
+				     shorttermaveragedarray;
+				     //WorkerArgsArray[worker_id]->shorttermarray_di = NULL; //Do not do that just in case of leqm10 AND dolbydi
+				     } */
+				  /*if (dolbydi) { *///already in an if (dolbydi)
+				  WorkerArgsArray[worker_id]->is_eof_array = is_eof_array;	// so later I need to reset this - only for DI
+				  WorkerArgsArray[worker_id]->buffered_samples_array = buffered_samples_array;	// so later I need to reset this - only for DI
+				  WorkerArgsArray[worker_id]->samples_read_array = samples_read_array;	// so later I need to reset this - only for DI
+				  //WorkerArgsArray[worker_id]->leqm10flag = 0; // this only if leqm10 but do not do that just in case of multiple choises
+				  //WorkerArgsArray[worker_id]->shorttermarray = NULL;  
+				  WorkerArgsArray[worker_id]->
+				    shorttermarray_di =
+				    shorttermdidecisionarray;
+				  WorkerArgsArray[worker_id]->
+				    sc_shorttermarray =
+				    sc_shorttermaveragedarray;
+				  WorkerArgsArray[worker_id]->di_array =
+				    di_array;
+				  WorkerArgsArray[worker_id]->channel =
+				    ch_index;
+				  WorkerArgsArray[worker_id]->chgate =
+				    channelgateconfvector;
+				  /*} */
+				  /*
+				     } else {
+				     WorkerArgsArray[worker_id]->shorttermindex = 0;
+				     WorkerArgsArray[worker_id]->leqm10flag = 0;
+				     } *///should never get here
+				  /* The following will be different for preprocessing with DI and for actual measurement. Also shorter */
+				  WorkerArgsArray[worker_id]->di_argbuffer =
+				    malloc (sizeof (float) *
+					    buffersizesamplesdi);
+				  WorkerArgsArray[worker_id]->
+				    samples_read_array[ch_index] =
+				    (unsigned int)
+				    deintsamples (WorkerArgsArray[worker_id]->
+						  di_argbuffer,
+						  buffersizesamplesdi, buffer, //buffersizesamplesdi, buffer,
+						  ch_index, nchannels);
+				  //memcpy(WorkerArgsArray[worker_id]->argbuffer, (void *)buffer, buffersizesamples*sizeof(double));
+				  //pthread_attr_t attr;
+				  //pthread_attr_init (&attr);
+				  pthread_create (&tid[worker_id], &attr,
+						  di_worker_function,
+						  WorkerArgsArray[worker_id]);
+
+				  worker_id++;
+
+
+				  //   if (worker_id == numCPU) { //<-- No, see above, this cannot work like that! it must be limited by channel number not CPUs
+				  if (worker_id == min(nchannels, numCPU))
+				    {
+				      
+				      //maybe here wait for all cores to output before going on
+				      // for (int idxcpu = 0; idxcpu < numCPU; idxcpu++) { //<-- Here the same!
+				      for (int idxcpu = 0;
+					   idxcpu < min (nchannels, numCPU);
+					   idxcpu++)
+					{
+					  pthread_join (tid[idxcpu], NULL);
+					  free (WorkerArgsArray[idxcpu]->
+						di_argbuffer);
+					  WorkerArgsArray[idxcpu]->
+					    di_argbuffer = NULL;
+					  free (WorkerArgsArray[idxcpu]);
+					  WorkerArgsArray[idxcpu] = NULL;
+					}
+				      worker_id = 0;
+				    }	//if (worker_id == nchannels)
+
+				}	// loop through channels for preprocessing with DI
+
+			      staindex++;	//added out of the channel loop DI
+
+			    }	/// till here if buffer is full, but if not? It will never start doing calculations
+			}	//if (gotFrame)
+		      if (data_size <= 0)
+			{
+			  // No data yet, get more frames 
+			  continue;
+			}
+		      // We have data, return it and come back for more later 
+		      //return data_size;
+		      //} //if (gotFrame)
+
+
+		      /* print samples */
+
+		      /*
+		         for ( int ch_index = 0; ch_index < frame->channels; ch_index++) {
+		         printf("Channel %d\n", ch_index);
+		         for (int smpl_index = 0; smpl_index< frame->nb_samples; smpl_index++) {
+
+		         printf("%0.6f\n", get(frame->data, ch_index, smpl_index, frame->channels, codecContext->sample_fmt));
+		         // end print samples 
+		         } //for nb_samples
+		         } //for channels
+
+		       */
+		    }		//if result >= 0 && gotFrame
+		  else
+		    {
+		      readingPacket.size = 0;
+		      readingPacket.data = NULL;
+		    }
+
+
+
+
+		}		//while decodingPacket.size
+
+
+	    }			// if readingPaket.stream
+
+	  // You *must* call av_free_packet() after each call to av_read_frame() or else you'll leak memory
+	  //av_packet_unref(&decodingPacket);
+	  av_packet_unref (&readingPacket);
+	  if (trimendframe >= 0 && decodedframes >= trimendframe)
+	    break;
+
+
+
+
+	  //end while worker_id
+	  /// End looping cores
+	}			/* while (av_read_frame(formatContext, &readingPacket) */// main loop through file
+
+
+
+      if (worker_id != 0)
+	{
+
+
+	  //maybe here wait for all cores to output before going on
+
+	  for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
+	    {
+	      pthread_join (tid[idxcpu], NULL);
+	      free (WorkerArgsArray[idxcpu]->di_argbuffer);
+	      WorkerArgsArray[idxcpu]->di_argbuffer = NULL;
+	      free (WorkerArgsArray[idxcpu]);
+	      WorkerArgsArray[idxcpu] = NULL;
+	    }
+
+
+	  worker_id = 0;
+
+
+
+
+	}			//if (worker_id != 0)
+
+
+      /* Adding insert for last samples at the end of the file - v. 28 */
+      if (copiedsamples < buffersizesamples)
+	{
+	  realnumbershortperiods++;
+
+	  for (int ch_index = 0; ch_index < nchannels; ch_index++)
+	    {
+
+	      worker_id = 0;	//this should have been already like that
+	      WorkerArgsArray[worker_id] =
+		malloc (sizeof (struct WorkerArgs));
+	      WorkerArgsArray[worker_id]->nsamples = copiedsamples / codecContext->channels;	//is this correct?
+	      WorkerArgsArray[worker_id]->fullbuffer_nsamples =
+		buffersizesamplesdi;
+	      WorkerArgsArray[worker_id]->nch = codecContext->channels;
+	      WorkerArgsArray[worker_id]->npoints = npoints;
+	      WorkerArgsArray[worker_id]->ir = ir;
+	      WorkerArgsArray[worker_id]->ptrtotsum = totsum;
 
-	  if (readingPacket.stream_index == audioStream->index)
+	      WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
+
+	      /*  if ((leqm10) || (dolbydi)) { */
+
+	      WorkerArgsArray[worker_id]->shorttermindex = staindex;	// <- This cannot be anymore in this loop FIXME
+	      /*if (leqm10)
+	         {
+	         WorkerArgsArray[worker_id]->leqm10flag = 1;  // this only if leqm10
+	         WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
+	         //WorkerArgsArray[worker_id]->shorttermarray_di = NULL;
+	         } */
+	      /* 
+	         if (dolbydi) { *///Already in an if (dolby)
+	      WorkerArgsArray[worker_id]->is_eof_array = is_eof_array;	// so later I need to reset this
+	      WorkerArgsArray[worker_id]->buffered_samples_array = buffered_samples_array;	// so later I need to reset this
+	      WorkerArgsArray[worker_id]->samples_read_array = samples_read_array;	// so later I need to reset this
+	      //WorkerArgsArray[worker_id]->leqm10flag = 0; // this only if leqm10
+	      //WorkerArgsArray[worker_id]->shorttermarray = NULL;
+	      WorkerArgsArray[worker_id]->shorttermarray_di =
+		shorttermdidecisionarray;
+	      WorkerArgsArray[worker_id]->sc_shorttermarray =
+		sc_shorttermaveragedarray;
+	      WorkerArgsArray[worker_id]->di_array = di_array;
+	      WorkerArgsArray[worker_id]->channel = ch_index;
+	      WorkerArgsArray[worker_id]->chgate = channelgateconfvector;
+	      /*
+	         }
+	       *//*
+	         } else {
+	         WorkerArgsArray[worker_id]->shorttermindex = 0;
+	         WorkerArgsArray[worker_id]->leqm10flag = 0;
+	         } *///but should never get here
+	      dsindex = 0;
+	      //remaindertot = copiedsamples - buffersizesamples;
+	      //copiedsamples = 0;
+	      WorkerArgsArray[worker_id]->di_argbuffer =
+		malloc (sizeof (double) * buffersizesamplesdi);
+	      WorkerArgsArray[worker_id]->samples_read_array[ch_index] =
+		(unsigned int)
+		deintsamples (WorkerArgsArray[worker_id]->di_argbuffer,
+			      buffersizesamplesdi, buffer, ch_index, //buffersizesamplesdi, buffer, ch_index,
+			      nchannels);
+	      //   memcpy(WorkerArgsArray[worker_id]->argbuffer, (void *)buffer, copiedsamples*sizeof(double));
+	      //pthread_attr_t attr;
+	      //pthread_attr_init (&attr);
+	      pthread_create (&tid[worker_id], &attr, di_worker_function,
+			      WorkerArgsArray[worker_id]);
+
+
+	      pthread_join (tid[worker_id], NULL);
+	      free (WorkerArgsArray[worker_id]->di_argbuffer);
+	      WorkerArgsArray[worker_id]->di_argbuffer = NULL;
+	      free (WorkerArgsArray[worker_id]);
+	      WorkerArgsArray[worker_id] = NULL;
+
+	    }			// loop through channels for preprocessing with DI
+
+	  staindex++;
+
+	}			/*if (copiedsamples < buffersizesamples) */
+
+
+
+
+
+      // Some codecs will cause frames to be buffered up in the decoding process. If the CODEC_CAP_DELAY flag
+      // is set, there can be buffered up frames that need to be flushed, so we'll do that
+      if (codecContext->codec->capabilities & AV_CODEC_CAP_DELAY)
+	{
+	  av_init_packet (&readingPacket);
+	  // Decode all the remaining frames in the buffer, until the end is reached
+	  int gotFrame = 0;
+	  while (avcodec_decode_audio4
+		 (codecContext, frame, &gotFrame, &readingPacket) >= 0
+		 && gotFrame)
 	    {
-	      //AVPacket decodingPacket = readingPacket;
-	      int result;
+	      // We now have a fully decoded audio frame
+	      // so I also need to process this
+	      /*
+	         #ifdef DEBUG
+	         printAudioFrameInfo(codecContext, frame);
+	         #endif
+	       */
+	    }
+	  av_packet_unref (&readingPacket);
+	}
 
-	      result = avcodec_send_packet (codecContext, &readingPacket);
+#endif
 
-	      if (result < 0)
+
+#ifdef SNDFILELIB
+
+      for (int ch_index = 0; ch_index < nchannels; ch_index++)
+	{
+
+	  WorkerArgsArray[worker_id] = malloc (sizeof (struct WorkerArgs));
+	  WorkerArgsArray[worker_id]->fullbuffer_nsamples =
+	    buffersizesamplesdi;
+	  WorkerArgsArray[worker_id]->nsamples = buffersizesamplesdi;
+	  WorkerArgsArray[worker_id]->nch = sfinfo.channels;
+	  WorkerArgsArray[worker_id]->npoints = npoints;
+	  WorkerArgsArray[worker_id]->ir = ir;
+	  WorkerArgsArray[worker_id]->ptrtotsum = totsum;
+
+	  WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
+	  /*if (leqm10)
+	     { */
+	  WorkerArgsArray[worker_id]->shorttermindex = staindex;
+	  /*  //FOLLOWING IF ELSE SHOULD BE ELIMINATED
+	     if (leqm10) {
+	     WorkerArgsArray[worker_id]->leqm10flag = 1;
+	     WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
+	     }      
+	     else
+	     {
+	     //WorkerArgsArray[worker_id]->shorttermindex = 0;
+	     WorkerArgsArray[worker_id]->leqm10flag = 0;
+	     } */
+
+	  WorkerArgsArray[worker_id]->is_eof_array = is_eof_array;	// so later I need to reset this - only for DI
+	  WorkerArgsArray[worker_id]->buffered_samples_array = buffered_samples_array;	// so later I need to reset this - only for DI
+	  WorkerArgsArray[worker_id]->samples_read_array = samples_read_array;	// so later I need to reset this - only for DI
+	  //WorkerArgsArray[worker_id]->leqm10flag = 0; // this only if leqm10 but do not do that just in case of multiple choises
+	  //WorkerArgsArray[worker_id]->shorttermarray = NULL;  
+	  WorkerArgsArray[worker_id]->shorttermarray_di =
+	    shorttermdidecisionarray;
+	  WorkerArgsArray[worker_id]->sc_shorttermarray =
+	    sc_shorttermaveragedarray;
+	  WorkerArgsArray[worker_id]->di_array = di_array;
+	  WorkerArgsArray[worker_id]->channel = ch_index;
+	  WorkerArgsArray[worker_id]->chgate = channelgateconfvector;
+
+	  WorkerArgsArray[worker_id]->di_argbuffer =	//THIS MUST BE WRONG
+	    malloc (sizeof (float) * buffersizesamplesdi);
+	  //   WorkerArgsArray[worder_id]->src_output = malloc(sizeof(double)*buffersizesamples); // this is for sample rate conversion, not yet used
+	  //memcpy (WorkerArgsArray[worker_id]->di_argbuffer, buffer,
+	  //          samples_read * sizeof (double));
+	  WorkerArgsArray[worker_id]->samples_read_array[ch_index] =
+	    (unsigned int)
+	    deintsamples (WorkerArgsArray[worker_id]->di_argbuffer,
+			  buffersizesamplesdi, buffer, ch_index, nchannels); //buffersizesamplesdi, buffer, ch_index, nchannels);
+	  //pthread_attr_t attr;
+	  //pthread_attr_init (&attr);
+	  /*
+	     if (dolbydi) { //we are already in an iif (dolbydi)
+	     pthread_create(&tid[worker_id], &attr, di_worker_function, WorkerArgsArray[worker_id]);
+	     } else {
+	   */
+
+	  pthread_create (&tid[worker_id], &attr, di_worker_function,
+			  WorkerArgsArray[worker_id]);
+	  /*
+	     }
+	   */
+	  worker_id++;
+
+	  //if (worker_id == numCPU) { <-- See above!
+	  if (worker_id == min(nchannels,numCPU)) //this will present channel deserialization at thread level but also the possibility that numCPU < nchannels
+	    {
+	     
+	      //maybe here wait for all cores to output before going on
+	      //for (int idxcpu = 0; idxcpu < numCPU; idxcpu++) { <-- See above
+	      for (int idxcpu = 0; idxcpu < min (nchannels, numCPU); idxcpu++)
 		{
-		  printf ("Error submitting packet to the decoder\n");
-		  exit (1);
+		  pthread_join (tid[idxcpu], NULL);
+		  free (WorkerArgsArray[idxcpu]->di_argbuffer);
+		  WorkerArgsArray[idxcpu]->di_argbuffer = NULL;
+		  free (WorkerArgsArray[idxcpu]);
+		  WorkerArgsArray[idxcpu] = NULL;
 		}
+	      worker_id = 0;
+	    }			// if (worker_id == numCPU)
 
-	      // Audio packets can have multiple audio frames in a single packet
-	      while (readingPacket.size > 0)
-		{
 
-		  // printf("Internal 1 loop  %d\n", myloopcounter++);
-		  // Try to decode the packet into a frame
-		  // Some frames rely on multiple packets, so we have to make sure the frame is finished before
-		  // we can use it
-		  int gotFrame = 0;
-		  //int result = avcodec_decode_audio4 (codecContext, frame, &gotFrame,
-		  //                                    &decodingPacket);
+	}			// loop through channels for preprocessing with DI
 
+      staindex++;
 
-		  result = avcodec_receive_frame (codecContext, frame);
-		  if (result == 0)
-		    {
-		      gotFrame = 1;
+      //end while worker_id
+      /// End looping cores
+    }				// main loop through file
 
-		    }
 
-		  if ((result == AVERROR (EAGAIN)) || (result == AVERROR_EOF))
-		    continue;	// it was return in the ffmpeg example as it was in a function
-		  else if (result < 0)
-		    {
-		      printf ("Error during deconding\n");
-		      exit (1);
-		    }
 
+#endif
 
+  //here I should wait for rest workers (< numcpu)
+  //but I need to dispose of thread id.
+  if (worker_id != 0)
+    {				// worker_id == 0 means the number of samples was divisible through the number of cpus
+      for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
+	{			//worker_id is at this point one unit more than threads launched
+	  pthread_join (tid[idxcpu], NULL);
+	  free (WorkerArgsArray[idxcpu]->di_argbuffer);
+	  WorkerArgsArray[idxcpu]->di_argbuffer = NULL;
+	  free (WorkerArgsArray[idxcpu]);
+	  WorkerArgsArray[idxcpu] = NULL;
+	}
 
-		  if (result >= 0 && gotFrame)
-		    {
-		      readingPacket.size -= readingPacket.size;
-		      //readingPacket.data += result;
-		      readingPacket.data += readingPacket.size;
+      worker_id = 0;
 
-		      // We now have a fully decoded audio frame
-		      /*
-		         #ifdef DEBUG
-		         printAudioFrameInfo(codecContext, frame);
-		         #endif
-		       */
-		      //here goes the copying to the multithreaded buffer
-		      //but this buffer is in milliseconds and could be less oder more
-		      //probably greater than the single frame
+    }				// if (worker_id != 0)
+
+
+
+  //<-- HERE ENDS PREPROCESSING THROUGH FILE
+
+  pthread_attr_destroy (&attr);
+  //free DI Instances
+
+  for (int i = 0; i < nchannels; i++)
+    {
+      free (di_array[i]);
+      di_array[i] = NULL;
+    }
+
+  // Some re-initializations
+
+
+
+
+  staindex = 0;			//shorttermarrayindex
+#ifdef SNDFILELIB
+  samples_read = 0;
 
-		      //copy as much samples as there is room in the buffer
 
-		      if (gotFrame)
-			{
-			  data_size =	//this is in bytes
-			    av_samples_get_buffer_size
-			    (NULL,
-			     codecContext->channels,
-			     frame->nb_samples, codecContext->sample_fmt, 1);
-			  // check if copying frame data will overflow the buffer
-			  // and copy only the samples necessary to completely fill the buffer
-			  // save the remaining for the next copy
-			  // write a function that uses get to change data to double and copy in worker buffer
+  //add seeking at the beginning of the file
+  sf_seek (file, nconcat ? concatfirst[0] : trimstartframe, SEEK_SET);	//never tested til now
+  for (int i = 1; i <= nconcat; i++)
+    sf_seek (sndfiles[i], concatfirst[i], SEEK_SET);
+  memcpy (concatleft, concatframes, sizeof (concatleft));
+  for (int i = 1; i <= nmono; i++)
+    sf_seek (monosf[i], trimstartframe, SEEK_SET);
+  currentsndfile = 0;
+  framesleft = sfinfo.frames;
 
-			  copiedsamples +=
-			    (frame->nb_samples * frame->channels);
-			  //         memcpy((char) ((void *) buffer), frame.data[0], data_size);          
-			  //transfer_decoded_data(frame, WorkerArgsArray, worker_id, codecContext);
-			  // nextsample is next sample of frame to be copied
-			  nextsample =
-			    transfer_decoded_samples (frame, buffer,
-						      codecContext,
-						      buffersizesamples,
-						      &dsindex);
-			  /*
-			     #ifdef DEBUG
-			     printf("Next sample index: %d\n", nextsample);
-			     #endif
-			   */
-			  //// From here execute only if buffer is full of data
+#elif defined FFMPEG
+  samples_read = 0;
+  nextsample = 0;
+  dsindex = 0;
+  remaindertot = 0;
+  //av_flush_buffer();
+  // it seems this method is based on time stamps so I do not know if it will work
+  av_seek_frame (formatContext, audioStream->index, 0, AVSEEK_FLAG_BACKWARD);
+  decodedframes = 0;
+#endif
+  if (printdiinfo)
+    {
+#ifdef FFMPEG
+      print_di (codecContext->channels, realnumbershortperiods,
+		shorttermdidecisionarray);
+#elif defined SNDFILELIB
+      print_di (sfinfo.channels, numbershortperiods,
+		shorttermdidecisionarray);
+#endif
+    }
+}				// if (dolbydi)
 
-			  //if (copiedsamples >= buffersizesamples) {
-			  while (copiedsamples >= buffersizesamples)
-			    {
-			      //printf("Internal 2 loop %d\n", myloopcounter++);
-			      realnumbershortperiods++;
+#endif //this start before "if (dolby)"
 
-			      dsindex = 0;
-			      //remaindertot = copiedsamples - buffersizesamples;
-			      //copiedsamples = 0;
+															// <--- HERE STARTS AGAIN for Leq(M)
 
-			      // store rest in another buffer
-			      if (copiedsamples > buffersizesamples)
-				{
-				  //copiedsamples = transfer_remaining_decoded_samples(frame, remainbuffer, codecContext, nextsample, &dsindex)*frame->channels;
-				  transfer_remaining_decoded_samples (frame,
-								      remainbuffer,
-								      codecContext,
-								      nextsample,
-								      &dsindex)
-				    * frame->channels;
-				}
-			      else
-				{
-				  copiedsamples = 0;
-				}
 
-			      if (copiedsamples > buffersizesamples)
-				{	//mistake here because I updated copiedsamples, it is no more the intended one
-				  //once buffer copied, copy rest if present in buffer for next cycle
-				  //but I have to update dsindex otherwise I will overwrite data on the next cycle
-				  //ACHTUNG: the buffer must be the one of the next worker!
-				  // ALSO: I have to account for n_samples if buffer is not full on the last buffer
-				  memcpy (buffer, remainbuffer, sizeof (double) * (copiedsamples - buffersizesamples));	//here I should copy only copiedsamples-buffersizesamples
-				  dsindex = copiedsamples - buffersizesamples;	//added
-				  copiedsamples =
-				    copiedsamples - buffersizesamples;
-				  //samples_read = buffersizesamples; //pertains DI
-				  //is_eof = 0; //pertains DI
-				  //buffered_samples = copiedsaamples - buffersizesamples;
-				  //copiedsamples already initialized to the right value
-				}
 
-			      /* Loop through channels in a short period. This loop is happening in the single threads wenn actual measuring processing takes place */
-			      /* My understanding is that DI cannot use a 75% overlap of the samples, so one cannot really parallelize inside a single channel, but only between the channels. So the parallelization should be limited by the number of channels! Is it so at present? */
 
-			      for (int ch_index = 0; ch_index < nchannels; //cannot be more than channel because per di_instance data must be coming serially
-				   ch_index++)
-				{
-				  //printf("Internal 3 loop %d\n", myloopcounter++);
-				  WorkerArgsArray[worker_id] =
-				    malloc (sizeof (struct WorkerArgs));
-				  WorkerArgsArray[worker_id]->
-				    fullbuffer_nsamples = buffersizesamplesdi;
-				  WorkerArgsArray[worker_id]->nsamples =
-				    buffersizesamplesdi;
-				  WorkerArgsArray[worker_id]->nch =
-				    codecContext->channels;
-				  WorkerArgsArray[worker_id]->npoints =
-				    npoints;
-				  WorkerArgsArray[worker_id]->ir = ir;
-				  WorkerArgsArray[worker_id]->ptrtotsum =
-				    totsum;
 
-				  WorkerArgsArray[worker_id]->chconf =
-				    channelconfcalvector;
-				  /* if ((leqm10) || (dolbydi)) { */
-				  WorkerArgsArray[worker_id]->shorttermindex = staindex;	// <- This was altered
-				  /* if (leqm10)
-				     {
-				     WorkerArgsArray[worker_id]->leqm10flag = 1;  // this only if leqm10
-				     WorkerArgsArray[worker_id]->shorttermarray =
-				     shorttermaveragedarray;
-				     //WorkerArgsArray[worker_id]->shorttermarray_di = NULL; //Do not do that just in case of leqm10 AND dolbydi
-				     } */
-				  /*if (dolbydi) { *///already in an if (dolbydi)
-				  WorkerArgsArray[worker_id]->is_eof_array = is_eof_array;	// so later I need to reset this - only for DI
-				  WorkerArgsArray[worker_id]->buffered_samples_array = buffered_samples_array;	// so later I need to reset this - only for DI
-				  WorkerArgsArray[worker_id]->samples_read_array = samples_read_array;	// so later I need to reset this - only for DI
-				  //WorkerArgsArray[worker_id]->leqm10flag = 0; // this only if leqm10 but do not do that just in case of multiple choises
-				  //WorkerArgsArray[worker_id]->shorttermarray = NULL;  
-				  WorkerArgsArray[worker_id]->
-				    shorttermarray_di =
-				    shorttermdidecisionarray;
-				  WorkerArgsArray[worker_id]->
-				    sc_shorttermarray =
-				    sc_shorttermaveragedarray;
-				  WorkerArgsArray[worker_id]->di_array =
-				    di_array;
-				  WorkerArgsArray[worker_id]->channel =
-				    ch_index;
-				  WorkerArgsArray[worker_id]->chgate =
-				    channelgateconfvector;
-				  /*} */
-				  /*
-				     } else {
-				     WorkerArgsArray[worker_id]->shorttermindex = 0;
-				     WorkerArgsArray[worker_id]->leqm10flag = 0;
-				     } *///should never get here
-				  /* The following will be different for preprocessing with DI and for actual measurement. Also shorter */
-				  WorkerArgsArray[worker_id]->di_argbuffer =
-				    malloc (sizeof (float) *
-					    buffersizesamplesdi);
-				  WorkerArgsArray[worker_id]->
-				    samples_read_array[ch_index] =
-				    (unsigned int)
-				    deintsamples (WorkerArgsArray[worker_id]->
-						  di_argbuffer,
-						  buffersizesamplesdi, buffer, //buffersizesamplesdi, buffer,
-						  ch_index, nchannels);
-				  //memcpy(WorkerArgsArray[worker_id]->argbuffer, (void *)buffer, buffersizesamples*sizeof(double));
-				  //pthread_attr_t attr;
-				  //pthread_attr_init (&attr);
-				  pthread_create (&tid[worker_id], &attr,
-						  di_worker_function,
-						  WorkerArgsArray[worker_id]);
+int pthreaditer = 0;
+#ifdef SNDFILELIB
+double *nextworkerbufferbackup =
+malloc (sizeof (double) * buffersizesamples * sfinfo.channels);
+double *nextworkerbufferbackup_leqmdi =
+malloc (sizeof (double) * buffersizesamples * sfinfo.channels);
+#elif defined FFMPEG
+double *nextworkerbufferbackup =
+malloc (sizeof (double) * buffersizesamples * codecContext->channels);
+double *nextworkerbufferbackup_leqmdi =
+malloc (sizeof (double) * buffersizesamples * codecContext->channels);
+#endif
 
-				  worker_id++;
 
 
-				  //   if (worker_id == numCPU) { //<-- No, see above, this cannot work like that! it must be limited by channel number not CPUs
-				  if (worker_id == min(nchannels, numCPU))
-				    {
-				      
-				      //maybe here wait for all cores to output before going on
-				      // for (int idxcpu = 0; idxcpu < numCPU; idxcpu++) { //<-- Here the same!
-				      for (int idxcpu = 0;
-					   idxcpu < min (nchannels, numCPU);
-					   idxcpu++)
-					{
-					  pthread_join (tid[idxcpu], NULL);
-					  free (WorkerArgsArray[idxcpu]->
-						di_argbuffer);
-					  WorkerArgsArray[idxcpu]->
-					    di_argbuffer = NULL;
-					  free (WorkerArgsArray[idxcpu]);
-					  WorkerArgsArray[idxcpu] = NULL;
-					}
-				      worker_id = 0;
-				    }	//if (worker_id == nchannels)
+#ifdef FFMPEG
+realnumbershortperiods = 0;	// why resetting this?
+#endif
 
-				}	// loop through channels for preprocessing with DI
+// the live meter shows the time itself
+if (meter)
+  progressbar = 0;
+#ifdef FFMPEG
+if (trimendframe >= 0)
+  progressframes = trimendframe - trimstartframe;
+else if (formatContext->duration != AV_NOPTS_VALUE)
+  progressframes =
+    formatContext->duration * codecContext->sample_rate / AV_TIME_BASE -
+    (trimstartframe > 0 ? trimstartframe : 0);
+#elif defined SNDFILELIB
+progressframes = sfinfo.frames;
+#endif
 
-			      staindex++;	//added out of the channel loop DI
 
-			    }	/// till here if buffer is full, but if not? It will never start doing calculations
-			}	//if (gotFrame)
-		      if (data_size <= 0)
-			{
-			  // No data yet, get more frames 
-			  continue;
-			}
-		      // We have data, return it and come back for more later 
-		      //return data_size;
-		      //} //if (gotFrame)
 
 
-		      /* print samples */
+pthread_attr_t attr;
+pthread_attr_init (&attr);
 
-		      /*
-		         for ( int ch_index = 0; ch_index < frame->channels; ch_index++) {
-		         printf("Channel %d\n", ch_index);
-		         for (int smpl_index = 0; smpl_index< frame->nb_samples; smpl_index++) {
+#ifdef SNDFILELIB
 
-		         printf("%0.6f\n", get(frame->data, ch_index, smpl_index, frame->channels, codecContext->sample_fmt));
-		         // end print samples 
-		         } //for nb_samples
-		         } //for channels
+															//src_data.end_of_input = 0;/* Set this later. */
 
-		       */
-		    }		//if result >= 0 && gotFrame
-		  else
-		    {
-		      readingPacket.size = 0;
-		      readingPacket.data = NULL;
-		    }
+															/* Start with zero to force load in while loop. */
+															//     src_data.input_frames = 0 ;
+															//     src_data.data_in = buffer ;
 
+															//     src_data.src_ratio = src_ratio ; //this could be done a separate parameter
 
+															//     src_data.data_out = src_output ;
+															//     src_data.output_frames = BUFFER_LEN / sfinfo.channels ;
 
+while ((samples_read = nmono ?
+	read_multimono (monosf, nmono + 1, buffer, monoscratch,
+			buffersizesamples, &framesleft) :
+	read_program (sndfiles, nconcat ? concatleft : NULL, nconcat + 1,
+		      &currentsndfile, buffer, buffersizesamples,
+		      sfinfo.channels, &framesleft)) > 0)
+  {
 
-		}		//while decodingPacket.size
 
 
-	    }			// if readingPaket.stream
+#elif defined FFMPEG
+
+
+																// int myloopcounter = 0;
 
-	  // You *must* call av_free_packet() after each call to av_read_frame() or else you'll leak memory
-	  //av_packet_unref(&decodingPacket);
-	  av_packet_unref (&readingPacket);
 
+AVPacket readingPacket;
+av_init_packet (&readingPacket);
+int data_size = 0;
+int copiedsamples = 0;		//also pointer to position  wherein to copy into the buffer
 
+while (av_read_frame (formatContext, &readingPacket) == 0)
+  {
+
+    //printf("Internal 1 loop %d\n", myloopcounter++);
 
 
-	  //end while worker_id
-	  /// End looping cores
-	}			/* while (av_read_frame(formatContext, &readingPacket) */// main loop through file
+    if (readingPacket.stream_index == audioStream->index)
+      {
+	//AVPacket decodingPacket = readingPacket;
+	int result;
+	int skipsize = 0;
+	uint8_t *skipdata = av_packet_get_side_data (&readingPacket,
+						     AV_PKT_DATA_SKIP_SAMPLES,
+						     &skipsize);
+	if (skipdata != NULL && skipsize >= 8)
+	  {
+	    //the decoder drops these itself unless AV_CODEC_FLAG2_SKIP_MANUAL
+	    primingskipped += AV_RL32 (skipdata);
+	    paddingskipped += AV_RL32 (skipdata + 4);
+	  }
 
+	result = avcodec_send_packet (codecContext, &readingPacket);
 
+	if (result < 0)
+	  {
+	    printf ("Error submitting packet to the decoder\n");
+	    exit (1);
+	  }
 
-      if (worker_id != 0)
-	{
 
 
-	  //maybe here wait for all cores to output before going on
 
-	  for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
-	    {
-	      pthread_join (tid[idxcpu], NULL);
-	      free (WorkerArgsArray[idxcpu]->di_argbuffer);
-	      WorkerArgsArray[idxcpu]->di_argbuffer = NULL;
-	      free (WorkerArgsArray[idxcpu]);
-	      WorkerArgsArray[idxcpu] = NULL;
-	    }
 
 
-	  worker_id = 0;
+	// Audio packets can have multiple audio frames in a single packet
+	while (readingPacket.size > 0)
 
+	  //while (result >= 0)
+	  {
+	    // Try to decode the packet into a frame
+	    // Some frames rely on multiple packets, so we have to make sure the frame is finished before
+	    // we can use it
+	    int gotFrame = 0;
+	    //  int result;
+	    //int result = avcodec_decode_audio4 (codecContext, frame, &gotFrame,
+	    //                                        &decodingPacket);
+	    //printf("Internal 2 loop %d\n", myloopcounter++);
 
 
+	    result = avcodec_receive_frame (codecContext, frame);
+	    if (result == 0)
+	      {
+		gotFrame = 1;
 
-	}			//if (worker_id != 0)
+	      }
 
+	    if ((result == AVERROR (EAGAIN)) || (result == AVERROR_EOF))
+	      {
+		printf ("Got here!!");
+		continue;	//in the example would be return 
+	      }
+	    else if (result < 0)
+	      {
+		printf ("Error during deconding\n");
+		exit (1);
+	      }
 
-      /* Adding insert for last samples at the end of the file - v. 28 */
-      if (copiedsamples < buffersizesamples)
-	{
-	  realnumbershortperiods++;
 
-	  for (int ch_index = 0; ch_index < nchannels; ch_index++)
-	    {
 
-	      worker_id = 0;	//this should have been already like that
-	      WorkerArgsArray[worker_id] =
-		malloc (sizeof (struct WorkerArgs));
-	      WorkerArgsArray[worker_id]->nsamples = copiedsamples / codecContext->channels;	//is this correct?
-	      WorkerArgsArray[worker_id]->fullbuffer_nsamples =
-		buffersizesamplesdi;
-	      WorkerArgsArray[worker_id]->nch = codecContext->channels;
-	      WorkerArgsArray[worker_id]->npoints = npoints;
-	      WorkerArgsArray[worker_id]->ir = ir;
-	      WorkerArgsArray[worker_id]->ptrtotsum = totsum;
 
-	      WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
 
-	      /*  if ((leqm10) || (dolbydi)) { */
 
-	      WorkerArgsArray[worker_id]->shorttermindex = staindex;	// <- This cannot be anymore in this loop FIXME
-	      /*if (leqm10)
-	         {
-	         WorkerArgsArray[worker_id]->leqm10flag = 1;  // this only if leqm10
-	         WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
-	         //WorkerArgsArray[worker_id]->shorttermarray_di = NULL;
-	         } */
-	      /* 
-	         if (dolbydi) { *///Already in an if (dolby)
-	      WorkerArgsArray[worker_id]->is_eof_array = is_eof_array;	// so later I need to reset this
-	      WorkerArgsArray[worker_id]->buffered_samples_array = buffered_samples_array;	// so later I need to reset this
-	      WorkerArgsArray[worker_id]->samples_read_array = samples_read_array;	// so later I need to reset this
-	      //WorkerArgsArray[worker_id]->leqm10flag = 0; // this only if leqm10
-	      //WorkerArgsArray[worker_id]->shorttermarray = NULL;
-	      WorkerArgsArray[worker_id]->shorttermarray_di =
-		shorttermdidecisionarray;
-	      WorkerArgsArray[worker_id]->sc_shorttermarray =
-		sc_shorttermaveragedarray;
-	      WorkerArgsArray[worker_id]->di_array = di_array;
-	      WorkerArgsArray[worker_id]->channel = ch_index;
-	      WorkerArgsArray[worker_id]->chgate = channelgateconfvector;
-	      /*
-	         }
-	       *//*
-	         } else {
-	         WorkerArgsArray[worker_id]->shorttermindex = 0;
-	         WorkerArgsArray[worker_id]->leqm10flag = 0;
-	         } *///but should never get here
-	      dsindex = 0;
-	      //remaindertot = copiedsamples - buffersizesamples;
-	      //copiedsamples = 0;
-	      WorkerArgsArray[worker_id]->di_argbuffer =
-		malloc (sizeof (double) * buffersizesamplesdi);
-	      WorkerArgsArray[worker_id]->samples_read_array[ch_index] =
-		(unsigned int)
-		deintsamples (WorkerArgsArray[worker_id]->di_argbuffer,
-			      buffersizesamplesdi, buffer, ch_index, //buffersizesamplesdi, buffer, ch_index,
-			      nchannels);
-	      //   memcpy(WorkerArgsArray[worker_id]->argbuffer, (void *)buffer, copiedsamples*sizeof(double));
-	      //pthread_attr_t attr;
-	      //pthread_attr_init (&attr);
-	      pthread_create (&tid[worker_id], &attr, di_worker_function,
-			      WorkerArgsArray[worker_id]);
 
+	    if (result >= 0 && gotFrame)
+	      {
+		readingPacket.size -= readingPacket.size;
+		//readingPacket.data += result;
+		readingPacket.data += readingPacket.size;
 
-	      pthread_join (tid[worker_id], NULL);
-	      free (WorkerArgsArray[worker_id]->di_argbuffer);
-	      WorkerArgsArray[worker_id]->di_argbuffer = NULL;
-	      free (WorkerArgsArray[worker_id]);
-	      WorkerArgsArray[worker_id] = NULL;
+		// We now have a fully decoded audio frame
+		/*
+		   #ifdef DEBUG
+		   printAudioFrameInfo(codecContext, frame);
+		   #endif
+		 */
+		//here goes the copying to the multithreaded buffer
+		//but this buffer is in milliseconds and could be less oder more
+		//probably greater than the single frame
 
-	    }			// loop through channels for preprocessing with DI
+		//copy as much samples as there is room in the buffer
 
-	  staindex++;
+		if (trim_frame (frame, codecContext, &decodedframes,
+				trimstartframe, trimendframe) == 0)
+		  gotFrame = 0;
+		if (gotFrame)
+		  {
+		    data_size =	//this is in bytes
+		      av_samples_get_buffer_size
+		      (NULL,
+		       codecContext->channels,
+		       frame->nb_samples, codecContext->sample_fmt, 1);
+		    // check if copying frame data will overflow the buffer
+		    // and copy only the samples necessary to completely fill the buffer
+		    // save the remaining for the next copy
+		    // write a function that uses get to change data to double and copy in worker buffer
 
-	}			/*if (copiedsamples < buffersizesamples) */
+		    copiedsamples += (frame->nb_samples * frame->channels);
+		    //         memcpy((char) ((void *) buffer), frame.data[0], data_size);          
+		    //transfer_decoded_data(frame, WorkerArgsArray, worker_id, codecContext);
+		    // nextsample is next sample of frame to be copied
+		    nextsample =
+		      transfer_decoded_samples (frame, buffer, codecContext,
+						buffersizesamples, &dsindex);
+		    /*
+		       #ifdef DEBUG
+		       printf("Next sample index: %d\n", nextsample);
+		       #endif
+		     */
+		    //// From here execute only if buffer is full of data
 
+		    //if (copiedsamples >= buffersizesamples) {
+		    while (copiedsamples >= buffersizesamples)
+		      {
+			realnumbershortperiods++;
+			WorkerArgsArray[worker_id] =
+			  malloc (sizeof (struct WorkerArgs));
+			WorkerArgsArray[worker_id]->nsamples =
+			  buffersizesamples;
+			WorkerArgsArray[worker_id]->nch =
+			  codecContext->channels;
+			WorkerArgsArray[worker_id]->sample_rate =
+			  codecContext->sample_rate;
+			WorkerArgsArray[worker_id]->npoints = npoints;
+			WorkerArgsArray[worker_id]->ir = ir;
+			WorkerArgsArray[worker_id]->ptrtotsum = totsum;
 
+			WorkerArgsArray[worker_id]->chconf =
+			  channelconfcalvector;
+			WorkerArgsArray[worker_id]->chsum =
+			  channelsumvector;
+			WorkerArgsArray[worker_id]->chsumnw =
+			  channelnwsumvector;
+			WorkerArgsArray[worker_id]->chexclude =
+			  channelexcludevector;
+			WorkerArgsArray[worker_id]->chdc = channeldcvector;
+			WorkerArgsArray[worker_id]->shorttermnwarray =
+			  shorttermnwarray;
+			WorkerArgsArray[worker_id]->firstframe =
+			  (long long) staindex *(buffersizesamples /
+						 codecContext->channels);
+			WorkerArgsArray[worker_id]->bufferindex = staindex;
+			WorkerArgsArray[worker_id]->clip = clip_ctx;
+			WorkerArgsArray[worker_id]->spectrum =
+			  spectrumvector;
+			WorkerArgsArray[worker_id]->speech = speecharray;
+			WorkerArgsArray[worker_id]->correlation =
+			  correlationarray;
+			WorkerArgsArray[worker_id]->silence = silencearray;
+			WorkerArgsArray[worker_id]->silencethreshold =
+			  silencethreshold;
+			WorkerArgsArray[worker_id]->tone = tonearray;
+			//new
+			WorkerArgsArray[worker_id]->pthread_iteration =
+			  pthreaditer;
+			WorkerArgsArray[worker_id]->ncpus = numCPU;
+			WorkerArgsArray[worker_id]->worker_id = worker_id;
+			//
+			if (truepeak)
+			  {
+			    WorkerArgsArray[worker_id]->truepeakflag = 1;
+			    WorkerArgsArray[worker_id]->truepeak =
+			      truepeak_ctx;
+			  }
+			else
+			  {
+			    WorkerArgsArray[worker_id]->truepeakflag = 0;
+			  }
 
+#ifdef DI
+			if ((leqm10) || (leqmlog) || (shortterm) || (dolbydi))
+			  {
+#else
+			if ((leqm10) || (leqmlog) || (shortterm))
+			  {
+#endif
+			    WorkerArgsArray[worker_id]->shorttermindex =
+			      staindex;
+			    WorkerArgsArray[worker_id]->leqm10flag =
+			      (leqm10 ? 1 : 0);
+			    WorkerArgsArray[worker_id]->leqmlogflag =
+			      (leqmlog ? 1 : 0);
+			    WorkerArgsArray[worker_id]->shorttermflag =
+			      (shortterm ? 1 : 0);
+			    WorkerArgsArray[worker_id]->shorttermarray =
+			      shorttermaveragedarray;
+#ifdef DI
+			    if (dolbydi)
+			      {
+				WorkerArgsArray[worker_id]->
+				  sc_shorttermarray =
+				  sc_shorttermaveragedarray;
+			      }
+#endif
 
+			  }
+			else
+			  {
+			    WorkerArgsArray[worker_id]->shorttermindex = 0;
+			    WorkerArgsArray[worker_id]->leqm10flag = 0;
+			    WorkerArgsArray[worker_id]->leqmlogflag = 0;
+			    WorkerArgsArray[worker_id]->shorttermflag = 0;
 
-      // Some codecs will cause frames to be buffered up in the decoding process. If the CODEC_CAP_DELAY flag
-      // is set, there can be buffered up frames that need to be flushed, so we'll do that
-      if (codecContext->codec->capabilities & AV_CODEC_CAP_DELAY)
-	{
-	  av_init_packet (&readingPacket);
-	  // Decode all the remaining frames in the buffer, until the end is reached
-	  int gotFrame = 0;
-	  while (avcodec_decode_audio4
-		 (codecContext, frame, &gotFrame, &readingPacket) >= 0
-		 && gotFrame)
-	    {
-	      // We now have a fully decoded audio frame
-	      // so I also need to process this
-	      /*
-	         #ifdef DEBUG
-	         printAudioFrameInfo(codecContext, frame);
-	         #endif
-	       */
-	    }
-	  av_packet_unref (&readingPacket);
-	}
+			  }
 
+			if (lkfs)
+			  {
+			    WorkerArgsArray[worker_id]->Kcoeffs = coeffs;
+#ifdef DI
+			    if ((leqm10) || (leqmlog) || (shortterm) || (dolbydi))
+			      {
+				WorkerArgsArray[worker_id]->shorttermindex =
+				  staindex;
+			      }
+			    else
+			      {
+#endif
+				WorkerArgsArray[worker_id]->shorttermindex =
+				  staindex;
+#ifdef DI
+			      }
 #endif
+			    WorkerArgsArray[worker_id]->lg_ctx = LGCtx;
+			    WorkerArgsArray[worker_id]->lkfsflag = 1;
+			    WorkerArgsArray[worker_id]->lg_buffers =
+			      allocateLGBuffer (LGCtx->gblocksize);
+			    WorkerArgsArray[worker_id]->lg_buffers->counter =
+			      staindex;
+			  }
+			else
+			  {
+			    WorkerArgsArray[worker_id]->lkfsflag = 0;
+			  }
 
+#ifdef DI
+			/* LEQMDI INSERT */
 
-#ifdef SNDFILELIB
-
-      for (int ch_index = 0; ch_index < nchannels; ch_index++)
-	{
-
-	  WorkerArgsArray[worker_id] = malloc (sizeof (struct WorkerArgs));
-	  WorkerArgsArray[worker_id]->fullbuffer_nsamples =
-	    buffersizesamplesdi;
-	  WorkerArgsArray[worker_id]->nsamples = buffersizesamplesdi;
-	  WorkerArgsArray[worker_id]->nch = sfinfo.channels;
-	  WorkerArgsArray[worker_id]->npoints = npoints;
-	  WorkerArgsArray[worker_id]->ir = ir;
-	  WorkerArgsArray[worker_id]->ptrtotsum = totsum;
 
-	  WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
-	  /*if (leqm10)
-	     { */
-	  WorkerArgsArray[worker_id]->shorttermindex = staindex;
-	  /*  //FOLLOWING IF ELSE SHOULD BE ELIMINATED
-	     if (leqm10) {
-	     WorkerArgsArray[worker_id]->leqm10flag = 1;
-	     WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
-	     }      
-	     else
-	     {
-	     //WorkerArgsArray[worker_id]->shorttermindex = 0;
-	     WorkerArgsArray[worker_id]->leqm10flag = 0;
-	     } */
+			if (dolbydi)
+			  {
+			    WorkerArgsArray[worker_id]->shorttermindex = staindex;	// but where is this counter incremented if no lkfs or leqm10, see also preceding if
+			    WorkerArgsArray[worker_id]->lg_ctx_leqmdi =
+			      LGCtxLeqMDI;
+			    WorkerArgsArray[worker_id]->leqmdiflag = 1;
+			    WorkerArgsArray[worker_id]->lg_buffers_leqmdi =
+			      allocateLGBuffer (LGCtxLeqMDI->gblocksize);
+			    WorkerArgsArray[worker_id]->lg_buffers_leqmdi->
+			      counter = staindex;
+			  }
+			else
+			  {
+			    WorkerArgsArray[worker_id]->leqmdiflag = 0;
+			  }
+			/* END LEQMDI INSERT */
+#endif
 
-	  WorkerArgsArray[worker_id]->is_eof_array = is_eof_array;	// so later I need to reset this - only for DI
-	  WorkerArgsArray[worker_id]->buffered_samples_array = buffered_samples_array;	// so later I need to reset this - only for DI
-	  WorkerArgsArray[worker_id]->samples_read_array = samples_read_array;	// so later I need to reset this - only for DI
-	  //WorkerArgsArray[worker_id]->leqm10flag = 0; // this only if leqm10 but do not do that just in case of multiple choises
-	  //WorkerArgsArray[worker_id]->shorttermarray = NULL;  
-	  WorkerArgsArray[worker_id]->shorttermarray_di =
-	    shorttermdidecisionarray;
-	  WorkerArgsArray[worker_id]->sc_shorttermarray =
-	    sc_shorttermaveragedarray;
-	  WorkerArgsArray[worker_id]->di_array = di_array;
-	  WorkerArgsArray[worker_id]->channel = ch_index;
-	  WorkerArgsArray[worker_id]->chgate = channelgateconfvector;
 
-	  WorkerArgsArray[worker_id]->di_argbuffer =	//THIS MUST BE WRONG
-	    malloc (sizeof (float) * buffersizesamplesdi);
-	  //   WorkerArgsArray[worder_id]->src_output = malloc(sizeof(double)*buffersizesamples); // this is for sample rate conversion, not yet used
-	  //memcpy (WorkerArgsArray[worker_id]->di_argbuffer, buffer,
-	  //          samples_read * sizeof (double));
-	  WorkerArgsArray[worker_id]->samples_read_array[ch_index] =
-	    (unsigned int)
-	    deintsamples (WorkerArgsArray[worker_id]->di_argbuffer,
-			  buffersizesamplesdi, buffer, ch_index, nchannels); //buffersizesamplesdi, buffer, ch_index, nchannels);
-	  //pthread_attr_t attr;
-	  //pthread_attr_init (&attr);
-	  /*
-	     if (dolbydi) { //we are already in an iif (dolbydi)
-	     pthread_create(&tid[worker_id], &attr, di_worker_function, WorkerArgsArray[worker_id]);
-	     } else {
-	   */
+			if (poly)
+			  {
+			    WorkerArgsArray[worker_id]->polyflag = 1;
+			  }
+			else
+			  {
+			    WorkerArgsArray[worker_id]->polyflag = 0;
+			  }
+			dsindex = 0;
+			// store rest in another buffer
+			if (copiedsamples > buffersizesamples)
+			  {
+			    //copiedsamples = transfer_remaining_decoded_samples(frame, remainbuffer, codecContext, nextsample, &dsindex)*frame->channels;
+			    transfer_remaining_decoded_samples (frame,
+								remainbuffer,
+								codecContext,
+								nextsample,
+								&dsindex) *
+			      frame->channels;
+			  }
+			else
+			  {
+			    copiedsamples = 0;
+			  }
+			//remaindertot = copiedsamples - buffersizesamples;
+			//copiedsamples = 0;
+			WorkerArgsArray[worker_id]->argbuffer =
+			  malloc (sizeof (double) * buffersizesamples);
+			if (downmixmatrix != NULL)
+			  downmix_buffer (buffer, buffersizesamples,
+					  nchannels, downmixmatrix);
+			memcpy (WorkerArgsArray[worker_id]->argbuffer,
+				(void *) buffer,
+				buffersizesamples * sizeof (double));
+			for (int i = 0; i < nplugins; i++)
+			  {
+			    plugin_write (pluginpipes[i], buffer,
+					  buffersizesamples,
+					  codecContext->channels);
+			  }
+			if (lkfs)
+			  {
 
-	  pthread_create (&tid[worker_id], &attr, di_worker_function,
-			  WorkerArgsArray[worker_id]);
-	  /*
-	     }
-	   */
-	  worker_id++;
+			    memcpy (WorkerArgsArray[worker_id]->lg_ctx->
+				    oldBufferBackup[worker_id],
+				    (void *) nextworkerbufferbackup,
+				    buffersizesamples * sizeof (double));
+			    memcpy (nextworkerbufferbackup, (void *) buffer,
+				    buffersizesamples * sizeof (double));
+			    //            memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
+			    //                  (void *) buffer, buffersizesamples * sizeof (double));
 
-	  //if (worker_id == numCPU) { <-- See above!
-	  if (worker_id == min(nchannels,numCPU)) //this will present channel deserialization at thread level but also the possibility that numCPU < nchannels
-	    {
-	     
-	      //maybe here wait for all cores to output before going on
-	      //for (int idxcpu = 0; idxcpu < numCPU; idxcpu++) { <-- See above
-	      for (int idxcpu = 0; idxcpu < min (nchannels, numCPU); idxcpu++)
-		{
-		  pthread_join (tid[idxcpu], NULL);
-		  free (WorkerArgsArray[idxcpu]->di_argbuffer);
-		  WorkerArgsArray[idxcpu]->di_argbuffer = NULL;
-		  free (WorkerArgsArray[idxcpu]);
-		  WorkerArgsArray[idxcpu] = NULL;
-		}
-	      worker_id = 0;
-	    }			// if (worker_id == numCPU)
+			  }
+			if (dolbydi)
+			  {
 
+			    memcpy (WorkerArgsArray[worker_id]->
+				    lg_ctx_leqmdi->oldBufferBackup[worker_id],
+				    (void *) nextworkerbufferbackup_leqmdi,
+				    buffersizesamples * sizeof (double));
+			    memcpy (nextworkerbufferbackup_leqmdi, (void *) buffer,
+				    buffersizesamples * sizeof (double));
+			    //            memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
+			    //                  (void *) buffer, buffersizesamples * sizeof (double));
 
-	}			// loop through channels for preprocessing with DI
+			  }
+			if (copiedsamples > buffersizesamples)
+			  {	//mistake here because I updated copiedsamples, it is no more the intended one
+			    //once buffer copied, copy rest if present in buffer for next cycle
+			    //but I have to update dsindex otherwise I will overwrite data on the next cycle
+			    //ACHTUNG: the buffer must be the one of the next worker!
+			    // ALSO: I have to account for n_samples if buffer is not full on the last buffer
+			    memcpy (buffer, remainbuffer, sizeof (double) * (copiedsamples - buffersizesamples));	//here I should copy only copiedsamples-buffersizesamples
+			    dsindex = copiedsamples - buffersizesamples;	//added
+			    copiedsamples = copiedsamples - buffersizesamples;
+			    //copiedsamples already initialized to the right value
+			  }
+			//pthread_attr_t attr;
+			//pthread_attr_init (&attr);
+#ifdef DI
+			if (dolbydi)
+			  {
+			    pthread_create (&tid[worker_id], &attr,
+					    worker_function_gated2,
+					    WorkerArgsArray[worker_id]);
+			  }
+			else
+			  {
+#endif
+			    pthread_create (&tid[worker_id], &attr,
+					    worker_function,
+					    WorkerArgsArray[worker_id]);
+#ifdef DI
+			  }
+#endif
+			worker_id++;
 
-      staindex++;
+/*
+#ifdef DEBUG
+			printf ("Worker: %d\n", worker_id);
+#endif
+*/
 
-      //end while worker_id
-      /// End looping cores
-    }				// main loop through file
 
+			if (worker_id == numCPU)	// add condition if buffer is full and file is at the end
+			  {
+			    worker_id = 0;
+			    pthreaditer++;
+			    //maybe here wait for all cores to output before going on
+			    for (int idxcpu = 0; idxcpu < numCPU; idxcpu++)
+			      {
+				pthread_join (tid[idxcpu], NULL);
+				free (WorkerArgsArray[idxcpu]->argbuffer);
+				WorkerArgsArray[idxcpu]->argbuffer = NULL;
+				if (lkfs)
+				  {
+				    WorkerArgsArray[idxcpu]->lg_ctx = NULL;	//here index was worker_id but it must have been wrong!
+				    freeLGBuffer (WorkerArgsArray[idxcpu]->
+						  lg_buffers);
+				  }
+				if (dolbydi)
+				  {
+				    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi =
+				      NULL;
+				    freeLGBuffer (WorkerArgsArray[idxcpu]->
+						  lg_buffers_leqmdi);
+				  }
+				free (WorkerArgsArray[idxcpu]);
+				WorkerArgsArray[idxcpu] = NULL;
 
 
-#endif
+			      }
+			    if (follow
+				&& (staindex + 1) * buffersizems / 1000.0 >=
+				nextfollowreport)
+			      {
+				// all workers are done with their buffers
+				struct Sum running = *totsum;
+				meanoverduration (&running);
+				printf ("Running Leq(M) at %.0f s: %.4f\n",
+					nextfollowreport,
+					rounddb (running.leqm, 4));
+				fflush (stdout);
+				nextfollowreport += 10.0;
+			      }
+			    if (meter)
+			      draw_meter (&meterstate, totsum,
+					  channelsumvector, nchannels,
+					  channelnames,
+					  truepeak ? truepeak_ctx->vector :
+					  NULL, codecContext->sample_rate, 0);
+			    if (progressinterval > 0.0)
+			      progress_json (totsum,
+					     codecContext->sample_rate,
+					     &starttime, progressinterval,
+					     &lastprogress, 0);
+			    if (progressbar)
+			      draw_progress (totsum->nsamples, progressframes,
+					     &starttime, &lastprogressbar, 0);
+			  }	//if (worker_id == numCPU)
 
-  //here I should wait for rest workers (< numcpu)
-  //but I need to dispose of thread id.
-  if (worker_id != 0)
-    {				// worker_id == 0 means the number of samples was divisible through the number of cpus
-      for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
-	{			//worker_id is at this point one unit more than threads launched
-	  pthread_join (tid[idxcpu], NULL);
-	  free (WorkerArgsArray[idxcpu]->di_argbuffer);
-	  WorkerArgsArray[idxcpu]->di_argbuffer = NULL;
-	  free (WorkerArgsArray[idxcpu]);
-	  WorkerArgsArray[idxcpu] = NULL;
-	}
+			staindex++;
+		      }		/// till here if buffer is full, but if not? It will never start doing calculations
+		  }		//if (gotFrame)
+		if (data_size <= 0)
+		  {
+		    // No data yet, get more frames 
+		    continue;
+		  }
+		// We have data, return it and come back for more later 
+		//return data_size;
+		//} //if (gotFrame)
 
-      worker_id = 0;
 
-    }				// if (worker_id != 0)
+		/* print samples */
 
+		/*
+		   for ( int ch_index = 0; ch_index < frame->channels; ch_index++) {
+		   printf("Channel %d\n", ch_index);
+		   for (int smpl_index = 0; smpl_index< frame->nb_samples; smpl_index++) {
 
+		   printf("%0.6f\n", get(frame->data, ch_index, smpl_index, frame->channels, codecContext->sample_fmt));
+		   // end print samples 
+		   } //for nb_samples
+		   } //for channels
 
-  //<-- HERE ENDS PREPROCESSING THROUGH FILE
+		 */
+	      }			//if result >= 0 && gotFrame
+	    else
+	      {
+		readingPacket.size = 0;
+		readingPacket.data = NULL;
+	      }
+	  }			//while decodingPacket.size
 
-  pthread_attr_destroy (&attr);
-  //free DI Instances
+      }				// if readingPaket.stream
 
-  for (int i = 0; i < nchannels; i++)
-    {
-      free (di_array[i]);
-      di_array[i] = NULL;
-    }
+    // You *must* call av_free_packet() after each call to av_read_frame() or else you'll leak memory
+    //av_packet_unref (&decodingPacket);
+    av_packet_unref (&readingPacket);
+    if (trimendframe >= 0 && decodedframes >= trimendframe)
+      break;
 
-  // Some re-initializations
 
 
 
+    //end while worker_id
+    /// End looping cores
+  }				/* while (av_read_frame(formatContext, &readingPacket) */// main loop through file
 
-  staindex = 0;			//shorttermarrayindex
-#ifdef SNDFILELIB
-  samples_read = 0;
+// ffmpeg gives no length to check --start against before decoding
+if (trimstartframe > 0 && decodedframes <= trimstartframe)
+  {
+    printf ("The start is past the end of the audio file.\n");
+    return 1;
+  }
 
+#ifdef DEBUG
 
-  //add seeking at the beginning of the file
-  sf_seek (file, 0, SEEK_SET);	//never tested til now
+printf
+  ("Situation at the end: work_id %d, copiedsamples %d, buffersizesamples %d\n",
+   worker_id, copiedsamples, buffersizesamples);
 
-#elif defined FFMPEG
-  samples_read = 0;
-  nextsample = 0;
-  dsindex = 0;
-  remaindertot = 0;
-  //av_flush_buffer();
-  // it seems this method is based on time stamps so I do not know if it will work
-  av_seek_frame (formatContext, audioStream->index, 0, AVSEEK_FLAG_BACKWARD);
-#endif
-  if (printdiinfo)
-    {
-#ifdef FFMPEG
-      print_di (codecContext->channels, realnumbershortperiods,
-		shorttermdidecisionarray);
-#elif defined SNDFILELIB
-      print_di (sfinfo.channels, numbershortperiods,
-		shorttermdidecisionarray);
 #endif
-    }
-}				// if (dolbydi)
+																	/* Adding insert for last samples at the end of the file - v. 28 */
 
-#endif //this start before "if (dolby)"
+if (worker_id != 0)
+  {
 
-															// <--- HERE STARTS AGAIN for Leq(M)
 
 
+    //maybe here wait for all cores to output before going on
+    for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
+      {
+	pthread_join (tid[idxcpu], NULL);
+	free (WorkerArgsArray[idxcpu]->argbuffer);
+	WorkerArgsArray[idxcpu]->argbuffer = NULL;
+	if (lkfs)
+	  {
+	    WorkerArgsArray[idxcpu]->lg_ctx = NULL;	//here index was worker_id but it must have been wrong!
+	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers);
+	  }
+	if (dolbydi)
+	  {
+	    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi = NULL;
+	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers_leqmdi);
+	  }
+	free (WorkerArgsArray[idxcpu]);
+	WorkerArgsArray[idxcpu] = NULL;
 
 
 
-int pthreaditer = 0;
-#ifdef SNDFILELIB
-double *nextworkerbufferbackup =
-malloc (sizeof (double) * buffersizesamples * sfinfo.channels);
-double *nextworkerbufferbackup_leqmdi =
-malloc (sizeof (double) * buffersizesamples * sfinfo.channels);
-#elif defined FFMPEG
-double *nextworkerbufferbackup =
-malloc (sizeof (double) * buffersizesamples * codecContext->channels);
-double *nextworkerbufferbackup_leqmdi =
-malloc (sizeof (double) * buffersizesamples * codecContext->channels);
-#endif
+      }
 
+    //worker_id = 0;
 
 
-#ifdef FFMPEG
-realnumbershortperiods = 0;	// why resetting this?
-#endif
+  }				//if (worker_id != 0)
 
 
+if (copiedsamples < buffersizesamples)
+  {
 
+    realnumbershortperiods++;
+    //worker_id = 0;		//this should have been already like that
+    WorkerArgsArray[worker_id] = malloc (sizeof (struct WorkerArgs));
+    WorkerArgsArray[worker_id]->nsamples = copiedsamples;	//is this correct?
+    WorkerArgsArray[worker_id]->nch = codecContext->channels;
+    WorkerArgsArray[worker_id]->sample_rate = codecContext->sample_rate;
+    WorkerArgsArray[worker_id]->npoints = npoints;
+    WorkerArgsArray[worker_id]->ir = ir;
+    WorkerArgsArray[worker_id]->ptrtotsum = totsum;
+    //new
+    WorkerArgsArray[worker_id]->pthread_iteration = pthreaditer;
+    WorkerArgsArray[worker_id]->ncpus = numCPU;
+    WorkerArgsArray[worker_id]->worker_id = worker_id;
+    //
 
-pthread_attr_t attr;
-pthread_attr_init (&attr);
+    WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
+    WorkerArgsArray[worker_id]->chsum = channelsumvector;
+    WorkerArgsArray[worker_id]->chsumnw = channelnwsumvector;
+    WorkerArgsArray[worker_id]->chexclude = channelexcludevector;
+    WorkerArgsArray[worker_id]->chdc = channeldcvector;
+    WorkerArgsArray[worker_id]->shorttermnwarray = shorttermnwarray;
+    WorkerArgsArray[worker_id]->firstframe =
+      (long long) staindex *(buffersizesamples / codecContext->channels);
+    WorkerArgsArray[worker_id]->bufferindex = staindex;
+    WorkerArgsArray[worker_id]->clip = clip_ctx;
+    WorkerArgsArray[worker_id]->spectrum = spectrumvector;
+    WorkerArgsArray[worker_id]->speech = speecharray;
+    WorkerArgsArray[worker_id]->correlation = correlationarray;
+    WorkerArgsArray[worker_id]->silence = silencearray;
+    WorkerArgsArray[worker_id]->silencethreshold = silencethreshold;
+    WorkerArgsArray[worker_id]->tone = tonearray;
+    if (truepeak)
+      {
+	WorkerArgsArray[worker_id]->truepeakflag = 1;
+	WorkerArgsArray[worker_id]->truepeak = truepeak_ctx;
+      }
+    else
+      {
+	WorkerArgsArray[worker_id]->truepeakflag = 0;
+      }
 
-#ifdef SNDFILELIB
 
-															//src_data.end_of_input = 0;/* Set this later. */
 
-															/* Start with zero to force load in while loop. */
-															//     src_data.input_frames = 0 ;
-															//     src_data.data_in = buffer ;
+#ifdef DI
+    if ((leqm10) || (leqmlog) || (shortterm) || (dolbydi))
+      {
+#else
+    if ((leqm10) || (leqmlog) || (shortterm))
+      {
+#endif
+	WorkerArgsArray[worker_id]->shorttermindex = staindex;
+	WorkerArgsArray[worker_id]->leqm10flag = (leqm10 ? 1 : 0);
+	WorkerArgsArray[worker_id]->leqmlogflag = (leqmlog ? 1 : 0);
+	WorkerArgsArray[worker_id]->shorttermflag = (shortterm ? 1 : 0);
+	WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
+#ifdef DI
+	if (dolbydi)
+	  {
+	    WorkerArgsArray[worker_id]->sc_shorttermarray =
+	      sc_shorttermaveragedarray;
+	  }
+#endif
+      }
+    else
+      {
+	WorkerArgsArray[worker_id]->shorttermindex = 0;
+	WorkerArgsArray[worker_id]->leqm10flag = 0;
+	WorkerArgsArray[worker_id]->leqmlogflag = 0;
+	WorkerArgsArray[worker_id]->shorttermflag = 0;
+      }
+    if (lkfs)
+      {
+	WorkerArgsArray[worker_id]->Kcoeffs = coeffs;
+#ifdef DI
+	if ((leqm10) || (leqmlog) || (shortterm) || (dolbydi))
+	  {
+	    WorkerArgsArray[worker_id]->shorttermindex = staindex;
+	  }
+	else
+	  {
+#endif
 
-															//     src_data.src_ratio = src_ratio ; //this could be done a separate parameter
+	    WorkerArgsArray[worker_id]->shorttermindex = staindex;
+#ifdef DI
+	  }
+#endif
 
-															//     src_data.data_out = src_output ;
-															//     src_data.output_frames = BUFFER_LEN / sfinfo.channels ;
 
-while ((samples_read = sf_read_double (file, buffer, buffersizesamples)) > 0)
-  {
 
+	WorkerArgsArray[worker_id]->lg_ctx = LGCtx;
+	WorkerArgsArray[worker_id]->lkfsflag = 1;
+	//WorkerArgsArray[worker_id]->lg_buffers = allocateLGBuffer(LGCtx->gblocksize);
+	WorkerArgsArray[worker_id]->lg_buffers =
+	  allocateLGBuffer (copiedsamples / codecContext->channels);
+	WorkerArgsArray[worker_id]->lg_buffers->counter = staindex;
+      }
+    else
+      {
+	WorkerArgsArray[worker_id]->lkfsflag = 0;
+      }
+
+#ifdef DI
+    /* LEQMDI INSERT */
 
 
-#elif defined FFMPEG
+    if (dolbydi)
+      {
+	WorkerArgsArray[worker_id]->shorttermindex = staindex;	// but where is this counter incremented if no lkfs or leqm10, see also preceding if
+	WorkerArgsArray[worker_id]->lg_ctx_leqmdi = LGCtxLeqMDI;
+	WorkerArgsArray[worker_id]->leqmdiflag = 1;
+	WorkerArgsArray[worker_id]->lg_buffers_leqmdi =
+	  //	  allocateLGBuffer (LGCtxLeqMDI->gblocksize); //is this causing the difference?
+	  allocateLGBuffer (copiedsamples/codecContext->channels);	  
+	WorkerArgsArray[worker_id]->lg_buffers_leqmdi->counter = staindex;
+      }
+    else
+      {
+	WorkerArgsArray[worker_id]->leqmdiflag = 0;
+      }
+    /* END LEQMDI INSERT */
+#endif
 
+    staindex++;
+    if (poly)
+      {
+	WorkerArgsArray[worker_id]->polyflag = 1;
+      }
+    else
+      {
+	WorkerArgsArray[worker_id]->polyflag = 0;
+      }
+    dsindex = 0;
+    //remaindertot = copiedsamples - buffersizesamples;
+    //copiedsamples = 0;
+    WorkerArgsArray[worker_id]->argbuffer =
+      malloc (sizeof (double) * copiedsamples);
+    if (downmixmatrix != NULL)
+      downmix_buffer (buffer, copiedsamples, nchannels, downmixmatrix);
+    memcpy (WorkerArgsArray[worker_id]->argbuffer, (void *) buffer,
+	    copiedsamples * sizeof (double));
+    for (int i = 0; i < nplugins; i++)
+      {
+	plugin_write (pluginpipes[i], buffer, copiedsamples,
+		      codecContext->channels);
+      }
 
-																// int myloopcounter = 0;
+    if (lkfs)
+      {
 
+	memcpy (WorkerArgsArray[worker_id]->lg_ctx->
+		oldBufferBackup[worker_id], (void *) nextworkerbufferbackup,
+		copiedsamples * sizeof (double));
+	memcpy (nextworkerbufferbackup, (void *) buffer,
+		copiedsamples * sizeof (double));
+	//memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
+	//          (void *) buffer, copiedsamples * sizeof (double));
 
-AVPacket readingPacket;
-av_init_packet (&readingPacket);
-int data_size = 0;
-int copiedsamples = 0;		//also pointer to position  wherein to copy into the buffer
+      }
+    if (dolbydi)
+      {
 
-while (av_read_frame (formatContext, &readingPacket) == 0)
-  {
+	memcpy (WorkerArgsArray[worker_id]->lg_ctx_leqmdi->
+		oldBufferBackup[worker_id], (void *) nextworkerbufferbackup_leqmdi,
+		copiedsamples * sizeof (double));
+	memcpy (nextworkerbufferbackup_leqmdi, (void *) buffer,
+		copiedsamples * sizeof (double));
 
-    //printf("Internal 1 loop %d\n", myloopcounter++);
+      }
 
 
-    if (readingPacket.stream_index == audioStream->index)
+
+    //pthread_attr_t attr;
+    //pthread_attr_init (&attr);
+#ifdef DI
+    if (dolbydi)
       {
-	//AVPacket decodingPacket = readingPacket;
-	int result;
+	pthread_create (&tid[worker_id], &attr, worker_function_gated2,
+			WorkerArgsArray[worker_id]);
+      }
+    else
+      {
+#endif
 
-	result = avcodec_send_packet (codecContext, &readingPacket);
+	pthread_create (&tid[worker_id], &attr, worker_function,
+			WorkerArgsArray[worker_id]);
+#ifdef DI
+      }
+#endif
+    pthread_join (tid[worker_id], NULL);
+    free (WorkerArgsArray[worker_id]->argbuffer);
+    WorkerArgsArray[worker_id]->argbuffer = NULL;
+    if (lkfs)
+      {
+	WorkerArgsArray[worker_id]->lg_ctx = NULL;
+	freeLGBuffer (WorkerArgsArray[worker_id]->lg_buffers);
+      }
+    if (dolbydi)
+      {
+	WorkerArgsArray[worker_id]->lg_ctx_leqmdi = NULL;
+	freeLGBuffer (WorkerArgsArray[worker_id]->lg_buffers_leqmdi);
+      }
+    free (WorkerArgsArray[worker_id]);
+    WorkerArgsArray[worker_id] = NULL;
 
-	if (result < 0)
-	  {
-	    printf ("Error submitting packet to the decoder\n");
-	    exit (1);
-	  }
 
 
+    //Store number of frames of last non full buffer
+    totsum->remainder_samples = copiedsamples;
 
 
+  }				/*if (copiedsamples < buffersizesamples) */
 
 
-	// Audio packets can have multiple audio frames in a single packet
-	while (readingPacket.size > 0)
 
-	  //while (result >= 0)
-	  {
-	    // Try to decode the packet into a frame
-	    // Some frames rely on multiple packets, so we have to make sure the frame is finished before
-	    // we can use it
-	    int gotFrame = 0;
-	    //  int result;
-	    //int result = avcodec_decode_audio4 (codecContext, frame, &gotFrame,
-	    //                                        &decodingPacket);
-	    //printf("Internal 2 loop %d\n", myloopcounter++);
 
 
-	    result = avcodec_receive_frame (codecContext, frame);
-	    if (result == 0)
-	      {
-		gotFrame = 1;
+																		// Some codecs will cause frames to be buffered up in the decoding process. If the CODEC_CAP_DELAY flag
+																		// is set, there can be buffered up frames that need to be flushed, so we'll do that
+if (codecContext->codec->capabilities & AV_CODEC_CAP_DELAY)
+  {
+    av_init_packet (&readingPacket);
+    // Decode all the remaining frames in the buffer, until the end is reached
+    int gotFrame = 0;
+    while (avcodec_decode_audio4
+	   (codecContext, frame, &gotFrame, &readingPacket) >= 0 && gotFrame)
+      {
+	// We now have a fully decoded audio frame
+	// so I also need to process this
+	/*
+	   #ifdef DEBUG
+	   printAudioFrameInfo(codecContext, frame);
+	   #endif
+	 */
+      }
+    av_packet_unref (&readingPacket);
+  }
+#endif
+#ifdef SNDFILELIB
+WorkerArgsArray[worker_id] = malloc (sizeof (struct WorkerArgs));
+WorkerArgsArray[worker_id]->nsamples = samples_read;
+WorkerArgsArray[worker_id]->nch = sfinfo.channels;
+WorkerArgsArray[worker_id]->sample_rate = sfinfo.samplerate;
+WorkerArgsArray[worker_id]->npoints = npoints;
+WorkerArgsArray[worker_id]->ir = ir;
+WorkerArgsArray[worker_id]->ptrtotsum = totsum;
+																		//new
+WorkerArgsArray[worker_id]->pthread_iteration = pthreaditer;
+WorkerArgsArray[worker_id]->ncpus = numCPU;
+WorkerArgsArray[worker_id]->worker_id = worker_id;
+																		//
 
-	      }
+WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
+WorkerArgsArray[worker_id]->chsum = channelsumvector;
+WorkerArgsArray[worker_id]->chsumnw = channelnwsumvector;
+WorkerArgsArray[worker_id]->chexclude = channelexcludevector;
+WorkerArgsArray[worker_id]->chdc = channeldcvector;
+WorkerArgsArray[worker_id]->shorttermnwarray = shorttermnwarray;
+WorkerArgsArray[worker_id]->firstframe =
+  (long long) staindex *(buffersizesamples / sfinfo.channels);
+WorkerArgsArray[worker_id]->bufferindex = staindex;
+WorkerArgsArray[worker_id]->clip = clip_ctx;
+WorkerArgsArray[worker_id]->spectrum = spectrumvector;
+WorkerArgsArray[worker_id]->speech = speecharray;
+WorkerArgsArray[worker_id]->correlation = correlationarray;
+WorkerArgsArray[worker_id]->silence = silencearray;
+WorkerArgsArray[worker_id]->silencethreshold = silencethreshold;
+WorkerArgsArray[worker_id]->tone = tonearray;
+if (truepeak)
+  {
+    WorkerArgsArray[worker_id]->truepeakflag = 1;
+    WorkerArgsArray[worker_id]->truepeak = truepeak_ctx;
+  }
+else
+  {
+    WorkerArgsArray[worker_id]->truepeakflag = 0;
+  }
 
-	    if ((result == AVERROR (EAGAIN)) || (result == AVERROR_EOF))
-	      {
-		printf ("Got here!!");
-		continue;	//in the example would be return 
-	      }
-	    else if (result < 0)
-	      {
-		printf ("Error during deconding\n");
-		exit (1);
-	      }
 
 
+#ifdef DI
+if ((leqm10) || (leqmlog) || (shortterm) || (dolbydi))
+  {
+#else
+if ((leqm10) || (leqmlog) || (shortterm))
+  {
+#endif
+    WorkerArgsArray[worker_id]->shorttermindex = staindex;
+    WorkerArgsArray[worker_id]->leqm10flag = (leqm10 ? 1 : 0);
+    WorkerArgsArray[worker_id]->leqmlogflag = (leqmlog ? 1 : 0);
+    WorkerArgsArray[worker_id]->shorttermflag = (shortterm ? 1 : 0);
+    WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
+#ifdef DI
+    if (dolbydi)
+      {
+	WorkerArgsArray[worker_id]->sc_shorttermarray =
+	  sc_shorttermaveragedarray;
+      }
+#endif
+  }
+else
+  {
+    WorkerArgsArray[worker_id]->shorttermindex = 0;
+    WorkerArgsArray[worker_id]->leqm10flag = 0;
+    WorkerArgsArray[worker_id]->leqmlogflag = 0;
+    WorkerArgsArray[worker_id]->shorttermflag = 0;
+  }
 
+if (lkfs)
+  {
+    WorkerArgsArray[worker_id]->Kcoeffs = coeffs;
+#ifdef DI
+    if ((leqm10) || (leqmlog) || (shortterm) || (dolbydi))
+      {
+#else
+    if ((leqm10) || (leqmlog) || (shortterm))
+      {
+#endif
+	WorkerArgsArray[worker_id]->shorttermindex = staindex;
+      }
+    else
+      {
+	WorkerArgsArray[worker_id]->shorttermindex = staindex;
+      }
+    WorkerArgsArray[worker_id]->lg_ctx = LGCtx;
+    WorkerArgsArray[worker_id]->lkfsflag = 1;
+    WorkerArgsArray[worker_id]->lg_buffers =
+      allocateLGBuffer (LGCtx->gblocksize);
+    WorkerArgsArray[worker_id]->lg_buffers->counter = staindex;
+  }
+else
+  {
+    WorkerArgsArray[worker_id]->lkfsflag = 0;
+  }
 
 
+#ifdef DI
+/* LEQMDI INSERT */
 
 
-	    if (result >= 0 && gotFrame)
-	      {
-		readingPacket.size -= readingPacket.size;
-		//readingPacket.data += result;
-		readingPacket.data += readingPacket.size;
+if (dolbydi)
+  {
+    WorkerArgsArray[worker_id]->shorttermindex = staindex;	// but where is this counter incremented if no lkfs or leqm10, see also preceding if
+    WorkerArgsArray[worker_id]->lg_ctx_leqmdi = LGCtxLeqMDI;
+    WorkerArgsArray[worker_id]->leqmdiflag = 1;
+    WorkerArgsArray[worker_id]->lg_buffers_leqmdi =
+      allocateLGBuffer (LGCtxLeqMDI->gblocksize);
+    WorkerArgsArray[worker_id]->lg_buffers_leqmdi->counter = staindex;
+  }
+else
+  {
+    WorkerArgsArray[worker_id]->leqmdiflag = 0;
+  }
 
-		// We now have a fully decoded audio frame
-		/*
-		   #ifdef DEBUG
-		   printAudioFrameInfo(codecContext, frame);
-		   #endif
-		 */
-		//here goes the copying to the multithreaded buffer
-		//but this buffer is in milliseconds and could be less oder more
-		//probably greater than the single frame
+																				/* END LEQMDI INSERT */
+#endif
 
-		//copy as much samples as there is room in the buffer
 
-		if (gotFrame)
-		  {
-		    data_size =	//this is in bytes
-		      av_samples_get_buffer_size
-		      (NULL,
-		       codecContext->channels,
-		       frame->nb_samples, codecContext->sample_fmt, 1);
-		    // check if copying frame data will overflow the buffer
-		    // and copy only the samples necessary to completely fill the buffer
-		    // save the remaining for the next copy
-		    // write a function that uses get to change data to double and copy in worker buffer
+if (poly)
+  {
+    WorkerArgsArray[worker_id]->polyflag = 1;
+  }
+else
+  {
+    WorkerArgsArray[worker_id]->polyflag = 0;
+  }
 
-		    copiedsamples += (frame->nb_samples * frame->channels);
-		    //         memcpy((char) ((void *) buffer), frame.data[0], data_size);          
-		    //transfer_decoded_data(frame, WorkerArgsArray, worker_id, codecContext);
-		    // nextsample is next sample of frame to be copied
-		    nextsample =
-		      transfer_decoded_samples (frame, buffer, codecContext,
-						buffersizesamples, &dsindex);
-		    /*
-		       #ifdef DEBUG
-		       printf("Next sample index: %d\n", nextsample);
-		       #endif
-		     */
-		    //// From here execute only if buffer is full of data
+WorkerArgsArray[worker_id]->argbuffer =
+malloc (sizeof (double) * buffersizesamples);
+																				//   WorkerArgsArray[worder_id]->src_output = malloc(sizeof(double)*buffersizesamples); // this is for sample rate conversion, not yet used
+if (downmixmatrix != NULL)
+  downmix_buffer (buffer, samples_read, nchannels, downmixmatrix);
+memcpy (WorkerArgsArray[worker_id]->argbuffer, buffer,
+	samples_read * sizeof (double));
+for (int i = 0; i < nplugins; i++)
+  {
+    plugin_write (pluginpipes[i], buffer, samples_read, sfinfo.channels);
+  }
+if (lkfs)
+  {
 
-		    //if (copiedsamples >= buffersizesamples) {
-		    while (copiedsamples >= buffersizesamples)
-		      {
-			realnumbershortperiods++;
-			WorkerArgsArray[worker_id] =
-			  malloc (sizeof (struct WorkerArgs));
-			WorkerArgsArray[worker_id]->nsamples =
-			  buffersizesamples;
-			WorkerArgsArray[worker_id]->nch =
-			  codecContext->channels;
-			WorkerArgsArray[worker_id]->sample_rate =
-			  codecContext->sample_rate;
-			WorkerArgsArray[worker_id]->npoints = npoints;
-			WorkerArgsArray[worker_id]->ir = ir;
-			WorkerArgsArray[worker_id]->ptrtotsum = totsum;
+    memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
+	    (void *) nextworkerbufferbackup, samples_read * sizeof (double));
+    memcpy (nextworkerbufferbackup, (void *) buffer,
+	    samples_read * sizeof (double));
+    // memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
+    //          buffer, samples_read * sizeof (double));
+
+  }
+if (dolbydi)
+  {
+    memcpy (WorkerArgsArray[worker_id]->lg_ctx_leqmdi->
+	    oldBufferBackup[worker_id], (void *) nextworkerbufferbackup_leqmdi,
+	    samples_read * sizeof (double));
+    memcpy (nextworkerbufferbackup_leqmdi, (void *) buffer,
+	    samples_read * sizeof (double));
+
+  }
 
-			WorkerArgsArray[worker_id]->chconf =
-			  channelconfcalvector;
-			//new
-			WorkerArgsArray[worker_id]->pthread_iteration =
-			  pthreaditer;
-			WorkerArgsArray[worker_id]->ncpus = numCPU;
-			WorkerArgsArray[worker_id]->worker_id = worker_id;
-			//
-			if (truepeak)
-			  {
-			    WorkerArgsArray[worker_id]->truepeakflag = 1;
-			    WorkerArgsArray[worker_id]->truepeak =
-			      truepeak_ctx;
-			  }
-			else
-			  {
-			    WorkerArgsArray[worker_id]->truepeakflag = 0;
-			  }
 
+																				//pthread_attr_t attr;
+																				//pthread_attr_init (&attr);
 #ifdef DI
-			if ((leqm10) || (leqmlog) || (dolbydi))
-			  {
-#else
-			if ((leqm10) || (leqmlog))
-			  {
+if (dolbydi)
+  {
+    pthread_create (&tid[worker_id], &attr, worker_function_gated2,
+		    WorkerArgsArray[worker_id]);
+  }
+else
+  {
 #endif
-			    WorkerArgsArray[worker_id]->shorttermindex =
-			      staindex;
-			    WorkerArgsArray[worker_id]->leqm10flag =
-			      (leqm10 ? 1 : 0);
-			    WorkerArgsArray[worker_id]->leqmlogflag =
-			      (leqmlog ? 1 : 0);
-			    WorkerArgsArray[worker_id]->shorttermarray =
-			      shorttermaveragedarray;
+    pthread_create (&tid[worker_id], &attr, worker_function,
+		    WorkerArgsArray[worker_id]);
 #ifdef DI
-			    if (dolbydi)
-			      {
-				WorkerArgsArray[worker_id]->
-				  sc_shorttermarray =
-				  sc_shorttermaveragedarray;
-			      }
+  }
 #endif
+worker_id++;
 
-			  }
-			else
-			  {
-			    WorkerArgsArray[worker_id]->shorttermindex = 0;
-			    WorkerArgsArray[worker_id]->leqm10flag = 0;
-			    WorkerArgsArray[worker_id]->leqmlogflag = 0;
 
-			  }
+staindex++;
 
-			if (lkfs)
-			  {
-			    WorkerArgsArray[worker_id]->Kcoeffs = coeffs;
-#ifdef DI
-			    if ((leqm10) || (leqmlog) || (dolbydi))
-			      {
-				WorkerArgsArray[worker_id]->shorttermindex =
-				  staindex;
-			      }
-			    else
-			      {
-#endif
-				WorkerArgsArray[worker_id]->shorttermindex =
-				  staindex;
-#ifdef DI
-			      }
-#endif
-			    WorkerArgsArray[worker_id]->lg_ctx = LGCtx;
-			    WorkerArgsArray[worker_id]->lkfsflag = 1;
-			    WorkerArgsArray[worker_id]->lg_buffers =
-			      allocateLGBuffer (LGCtx->gblocksize);
-			    WorkerArgsArray[worker_id]->lg_buffers->counter =
-			      staindex;
-			  }
-			else
-			  {
-			    WorkerArgsArray[worker_id]->lkfsflag = 0;
-			  }
 
-#ifdef DI
-			/* LEQMDI INSERT */
+if (worker_id == numCPU)
+  {
+    worker_id = 0;
+    pthreaditer++;
+    //maybe here wait for all cores to output before going on
+    for (int idxcpu = 0; idxcpu < numCPU; idxcpu++)
+      {
+	pthread_join (tid[idxcpu], NULL);
+	free (WorkerArgsArray[idxcpu]->argbuffer);
+	WorkerArgsArray[idxcpu]->argbuffer = NULL;
+	if (lkfs)
+	  {
+	    WorkerArgsArray[idxcpu]->lg_ctx = NULL;
+	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers);
+	  }
+	if (dolbydi)
+	  {
+	    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi = NULL;
+	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers_leqmdi);
+	  }
+	free (WorkerArgsArray[idxcpu]);
+	WorkerArgsArray[idxcpu] = NULL;
 
 
-			if (dolbydi)
-			  {
-			    WorkerArgsArray[worker_id]->shorttermindex = staindex;	// but where is this counter incremented if no lkfs or leqm10, see also preceding if
-			    WorkerArgsArray[worker_id]->lg_ctx_leqmdi =
-			      LGCtxLeqMDI;
-			    WorkerArgsArray[worker_id]->leqmdiflag = 1;
-			    WorkerArgsArray[worker_id]->lg_buffers_leqmdi =
-			      allocateLGBuffer (LGCtxLeqMDI->gblocksize);
-			    WorkerArgsArray[worker_id]->lg_buffers_leqmdi->
-			      counter = staindex;
-			  }
-			else
-			  {
-			    WorkerArgsArray[worker_id]->leqmdiflag = 0;
-			  }
-			/* END LEQMDI INSERT */
-#endif
+      }
+    if (meter)
+      draw_meter (&meterstate, totsum, channelsumvector, nchannels,
+		  channelnames, truepeak ? truepeak_ctx->vector : NULL,
+		  sfinfo.samplerate, 0);
+    if (progressinterval > 0.0)
+      progress_json (totsum, sfinfo.samplerate, &starttime,
+		     progressinterval, &lastprogress, 0);
+    if (progressbar)
+      draw_progress (totsum->nsamples, progressframes, &starttime,
+		     &lastprogressbar, 0);
+  }
 
+																				//end while worker_id
+																				// End looping cores
+//Store number for frames in the last non full buffer
+totsum->remainder_samples = samples_read;
+}		// main loop through file //while ((samples_read = sf_read_double (file, buffer, buffersizesamples)) > 0)
 
-			if (poly)
-			  {
-			    WorkerArgsArray[worker_id]->polyflag = 1;
-			  }
-			else
-			  {
-			    WorkerArgsArray[worker_id]->polyflag = 0;
-			  }
-			dsindex = 0;
-			// store rest in another buffer
-			if (copiedsamples > buffersizesamples)
-			  {
-			    //copiedsamples = transfer_remaining_decoded_samples(frame, remainbuffer, codecContext, nextsample, &dsindex)*frame->channels;
-			    transfer_remaining_decoded_samples (frame,
-								remainbuffer,
-								codecContext,
-								nextsample,
-								&dsindex) *
-			      frame->channels;
-			  }
-			else
-			  {
-			    copiedsamples = 0;
-			  }
-			//remaindertot = copiedsamples - buffersizesamples;
-			//copiedsamples = 0;
-			WorkerArgsArray[worker_id]->argbuffer =
-			  malloc (sizeof (double) * buffersizesamples);
-			memcpy (WorkerArgsArray[worker_id]->argbuffer,
-				(void *) buffer,
-				buffersizesamples * sizeof (double));
-			if (lkfs)
-			  {
 
-			    memcpy (WorkerArgsArray[worker_id]->lg_ctx->
-				    oldBufferBackup[worker_id],
-				    (void *) nextworkerbufferbackup,
-				    buffersizesamples * sizeof (double));
-			    memcpy (nextworkerbufferbackup, (void *) buffer,
-				    buffersizesamples * sizeof (double));
-			    //            memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
-			    //                  (void *) buffer, buffersizesamples * sizeof (double));
 
-			  }
-			if (dolbydi)
-			  {
 
-			    memcpy (WorkerArgsArray[worker_id]->
-				    lg_ctx_leqmdi->oldBufferBackup[worker_id],
-				    (void *) nextworkerbufferbackup_leqmdi,
-				    buffersizesamples * sizeof (double));
-			    memcpy (nextworkerbufferbackup_leqmdi, (void *) buffer,
-				    buffersizesamples * sizeof (double));
-			    //            memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
-			    //                  (void *) buffer, buffersizesamples * sizeof (double));
 
-			  }
-			if (copiedsamples > buffersizesamples)
-			  {	//mistake here because I updated copiedsamples, it is no more the intended one
-			    //once buffer copied, copy rest if present in buffer for next cycle
-			    //but I have to update dsindex otherwise I will overwrite data on the next cycle
-			    //ACHTUNG: the buffer must be the one of the next worker!
-			    // ALSO: I have to account for n_samples if buffer is not full on the last buffer
-			    memcpy (buffer, remainbuffer, sizeof (double) * (copiedsamples - buffersizesamples));	//here I should copy only copiedsamples-buffersizesamples
-			    dsindex = copiedsamples - buffersizesamples;	//added
-			    copiedsamples = copiedsamples - buffersizesamples;
-			    //copiedsamples already initialized to the right value
-			  }
-			//pthread_attr_t attr;
-			//pthread_attr_init (&attr);
-#ifdef DI
-			if (dolbydi)
-			  {
-			    pthread_create (&tid[worker_id], &attr,
-					    worker_function_gated2,
-					    WorkerArgsArray[worker_id]);
-			  }
-			else
-			  {
-#endif
-			    pthread_create (&tid[worker_id], &attr,
-					    worker_function,
-					    WorkerArgsArray[worker_id]);
-#ifdef DI
-			  }
-#endif
-			worker_id++;
+																			//here I should wait for rest workers (< numcpu)
+																			//but I need to dispose of thread id.
+if (worker_id != 0)
+  {				// worker_id == 0 means the number of samples was divisible through the number of cpus
+    for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
+      {				//worker_id is at this point one unit more than threads launched
+	pthread_join (tid[idxcpu], NULL);
+	free (WorkerArgsArray[idxcpu]->argbuffer);
+	WorkerArgsArray[idxcpu]->argbuffer = NULL;
+	if (lkfs)
+	  {
+	    WorkerArgsArray[idxcpu]->lg_ctx = NULL;
+	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers);
+	  }
+	if (dolbydi)
+	  {
+	    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi = NULL;
+	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers_leqmdi);
+	  }
+
+	free (WorkerArgsArray[idxcpu]);
+	WorkerArgsArray[idxcpu] = NULL;
+
+
+      }
+
+    //worker_id = 0;
+
+  }
+
 
-/*
-#ifdef DEBUG
-			printf ("Worker: %d\n", worker_id);
-#endif
-*/
 
 
-			if (worker_id == numCPU)	// add condition if buffer is full and file is at the end
-			  {
-			    worker_id = 0;
-			    pthreaditer++;
-			    //maybe here wait for all cores to output before going on
-			    for (int idxcpu = 0; idxcpu < numCPU; idxcpu++)
-			      {
-				pthread_join (tid[idxcpu], NULL);
-				free (WorkerArgsArray[idxcpu]->argbuffer);
-				WorkerArgsArray[idxcpu]->argbuffer = NULL;
-				if (lkfs)
-				  {
-				    WorkerArgsArray[idxcpu]->lg_ctx = NULL;	//here index was worker_id but it must have been wrong!
-				    freeLGBuffer (WorkerArgsArray[idxcpu]->
-						  lg_buffers);
-				  }
-				if (dolbydi)
-				  {
-				    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi =
-				      NULL;
-				    freeLGBuffer (WorkerArgsArray[idxcpu]->
-						  lg_buffers_leqmdi);
-				  }
-				free (WorkerArgsArray[idxcpu]);
-				WorkerArgsArray[idxcpu] = NULL;
 
+#endif
 
-			      }
-			  }	//if (worker_id == numCPU)
 
-			staindex++;
-		      }		/// till here if buffer is full, but if not? It will never start doing calculations
-		  }		//if (gotFrame)
-		if (data_size <= 0)
-		  {
-		    // No data yet, get more frames 
-		    continue;
-		  }
-		// We have data, return it and come back for more later 
-		//return data_size;
-		//} //if (gotFrame)
+free (nextworkerbufferbackup);
 
+free(nextworkerbufferbackup_leqmdi);
 
-		/* print samples */
+																			/* HERE ENDS REAL PROCESSING AFTER DI PREPROCESSING OR NOT */
 
-		/*
-		   for ( int ch_index = 0; ch_index < frame->channels; ch_index++) {
-		   printf("Channel %d\n", ch_index);
-		   for (int smpl_index = 0; smpl_index< frame->nb_samples; smpl_index++) {
 
-		   printf("%0.6f\n", get(frame->data, ch_index, smpl_index, frame->channels, codecContext->sample_fmt));
-		   // end print samples 
-		   } //for nb_samples
-		   } //for channels
 
-		 */
-	      }			//if result >= 0 && gotFrame
-	    else
-	      {
-		readingPacket.size = 0;
-		readingPacket.data = NULL;
-	      }
-	  }			//while decodingPacket.size
 
-      }				// if readingPaket.stream
+																			// mean of scalar sum over duration
+#ifdef DI
+if (dolbydi)
+  {
+#ifdef FFMPEG
 
-    // You *must* call av_free_packet() after each call to av_read_frame() or else you'll leak memory
-    //av_packet_unref (&decodingPacket);
-    av_packet_unref (&readingPacket);
 
+    dolbydifinalcomputation2 (LGCtxLeqMDI, LGCtxLeqMDI->chgateconf,
+			      codecContext->channels,
+			      shorttermdidecisionarray, agsthreshold);
+
+#elif defined SNDFILELIB
+    dolbydifinalcomputation2 (LGCtxLeqMDI, LGCtxLeqMDI->chgateconf,
+			      sfinfo.channels,
+			      shorttermdidecisionarray, agsthreshold);
+#endif
 
+  }
+else if (dolbydialt)
+  {
 
+#ifdef FFMPEG
+    dolbydifinalcomputation (sc_shorttermaveragedarray,
+			     shorttermdidecisionarray, codecContext->channels,
+			     realnumbershortperiods, tempchgate, totsum);
+#elif defined SNDFILELIB
 
-    //end while worker_id
-    /// End looping cores
-  }				/* while (av_read_frame(formatContext, &readingPacket) */// main loop through file
+    dolbydifinalcomputation (sc_shorttermaveragedarray,
+			     shorttermdidecisionarray, sfinfo.channels,
+			     numbershortperiods, tempchgate, totsum);
+#endif
 
+    if (levelgated)
+      {
+#ifdef FFMPEG
+	levelgatefinalcomputation (sc_shorttermaveragedarray,
+				   leqmtosum (levelgatedthreshold, 0.000020),
+				   codecContext->channels,
+				   realnumbershortperiods, totsum);
+#elif defined SNDFILELIB
+	levelgatefinalcomputation (sc_shorttermaveragedarray,
+				   leqmtosum (levelgatedthreshold, 0.000020),
+				   sfinfo.channels, numbershortperiods,
+				   totsum);
+#endif
+	printf ("Leq(%s,LG): %.4f\n", weightinglabel,
+		rounddb (totsum->lgleqm, 4));
+      }
+    printf ("Leq(%s,DI): %.4f\n", weightinglabel,
+	    rounddb (totsum->dgleqm, 4));
+    printf ("Program dialogue percentage is %.2f%% \n",
+	    totsum->dialoguepercentual);
 
-#ifdef DEBUG
+    meanoverduration (totsum);
+    if (leqnw)
+      {
+	printf ("Leq(noW): %.4f\n", rounddb (totsum->rms, 4));	// Leq(no Weighting)
+      }
+    printf ("Leq(%s): %.4f\n", weightinglabel, rounddb (totsum->leqm, 4));
+  }				// if (dolbydi) else if (dolbydialt)
 
-printf
-  ("Situation at the end: work_id %d, copiedsamples %d, buffersizesamples %d\n",
-   worker_id, copiedsamples, buffersizesamples);
+#endif
+if (progressbar)
+  draw_progress (totsum->nsamples, progressframes, &starttime,
+		 &lastprogressbar, 1);
+if (meter)
+  {
+#ifdef FFMPEG
+    draw_meter (&meterstate, totsum, channelsumvector, nchannels,
+		channelnames, truepeak ? truepeak_ctx->vector : NULL,
+		codecContext->sample_rate, 1);
+#elif defined SNDFILELIB
+    draw_meter (&meterstate, totsum, channelsumvector, nchannels,
+		channelnames, truepeak ? truepeak_ctx->vector : NULL,
+		sfinfo.samplerate, 1);
+#endif
+    free (meterstate.lastchsum);
+  }
+if (progressinterval > 0.0)
+  {
+#ifdef FFMPEG
+    progress_json (totsum, codecContext->sample_rate, &starttime,
+		   progressinterval, &lastprogress, 1);
+#elif defined SNDFILELIB
+    progress_json (totsum, sfinfo.samplerate, &starttime,
+		   progressinterval, &lastprogress, 1);
+#endif
+  }
+meanoverduration (totsum);
+if (silence || linetone)
+  {
+    int bufferframes = buffersizesamples / nchannels;
+#ifdef FFMPEG
+    int nperiods = realnumbershortperiods;
+    double samplerate = codecContext->sample_rate;
+#elif defined SNDFILELIB
+    int nperiods = numbershortperiods;
+    double samplerate = sfinfo.samplerate;
+#endif
+    double buffersec = bufferframes / samplerate;
+    double lastbuffersec =
+      (totsum->nsamples - (nperiods - 1) * (double) bufferframes) /
+      samplerate;
+    int *gate = calloc (nperiods > 0 ? nperiods : 1, sizeof (int));
+    int ngated = 0;
+    if (linetone)
+      {
+	tone_finalcomputation (tonearray, nperiods, buffersec, lastbuffersec,
+			       linetone == 2 ? gate : NULL);
+	free (tonearray);
+	tonearray = NULL;
+      }
+    if (silence)
+      {
+	silence_finalcomputation (silencearray, nperiods, buffersec,
+				  lastbuffersec, silence == 2 ? gate : NULL);
+	free (silencearray);
+	silencearray = NULL;
+      }
+    for (int i = 0; i < nperiods; i++)
+      ngated += gate[i];
+    if (ngated > 0 && ngated < nperiods)
+      {
+	// the same sums as meanoverduration, over the buffers kept
+	double csum = 0.0, sum = 0.0, duration = 0.0;
+	for (int i = 0; i < nperiods; i++)
+	  {
+	    double d = (i == nperiods - 1) ? lastbuffersec : buffersec;
+	    if (gate[i])
+	      continue;
+	    csum += shorttermaveragedarray[i] * d;
+	    sum += shorttermnwarray[i] * d;
+	    duration += d;
+	  }
+	totsum->leqm = max (10 * log10 (csum / duration) + 108.010299957, 0.0);
+	totsum->rms = max (10 * log10 (sum / duration) + 108.010299957, 0.0);
+	printf ("Leq(%s) and Leq(noW) below are over the remaining %.3f s.\n",
+		weightinglabel, duration);
+      }
+    else if (ngated > 0)
+      {
+	printf ("Nothing would be left, Leq(%s) is over the whole program.\n",
+		weightinglabel);
+      }
+    free (gate);
+    if (timeseriesfile == NULL)
+      {
+	free (shorttermnwarray);
+	shorttermnwarray = NULL;
+      }
+  }
+if (truepeak)
+  {
+    printf ("True Peak Full Scale per channel:\n");
+#ifdef FFMPEG
+    for (int i = 0; i < codecContext->channels; i++)
+      {
+#elif defined SNDFILELIB
+    for (int i = 0; i < sfinfo.channels; i++)
+      {
 
 #endif
-																	/* Adding insert for last samples at the end of the file - v. 28 */
-
-if (worker_id != 0)
+#ifdef FFMPEG
+	double peaktime =
+	  truepeak_ctx->position[i] / (double) codecContext->sample_rate;
+#elif defined SNDFILELIB
+	double peaktime =
+	  truepeak_ctx->position[i] / (double) sfinfo.samplerate;
+#endif
+	char peaktc[16];
+	format_timecode (peaktc, sizeof (peaktc), tcoffset + peaktime, tcrate);
+	char chlabel[32];
+	channel_label (chlabel, sizeof (chlabel), i, channelnames);
+	printf ("%s: %.4f dBFS\n", chlabel, rounddb (log10 (truepeak_ctx->vector[i]) * 10 + 12.04, 4));	// *10 because its power due to rectification
+	// on a line of its own, scripts read the one above
+	printf ("%s true peak position: %.3f s (%s)\n", chlabel, peaktime,
+		peaktc);
+      }
+  }
+if (leqnw)
+  {
+    printf ("Leq(noW): %.4f\n", rounddb (totsum->rms, 4));	// Leq(no Weighting)
+  }
+if (lkfs)
+  {
+#ifdef DI
+    if (dolbydi)
+      {
+#ifdef FFMPEG
+	lkfs_finalcomputation_withdolbydi (LGCtx, LGCtx->chgateconf,
+					   codecContext->channels,
+					   shorttermdidecisionarray,
+					   agsthreshold);
+#elif defined SNDFILELIB
+	lkfs_finalcomputation_withdolbydi (LGCtx, LGCtx->chgateconf,
+					   sfinfo.channels,
+					   shorttermdidecisionarray,
+					   agsthreshold);
+#endif
+      }
+    else
+      {
+#endif
+#ifdef FFMPEG
+	lkfsvalue = lkfs_finalcomputation (LGCtx, LGCtx->chgateconf,
+					   codecContext->channels);
+#elif defined SNDFILELIB
+	lkfsvalue =
+	  lkfs_finalcomputation (LGCtx, LGCtx->chgateconf, sfinfo.channels);
+#endif
+#ifdef DI
+      }
+#endif
+    if (lra)
+      {
+#ifdef FFMPEG
+	lra_finalcomputation (LGCtx, codecContext->channels,
+			      codecContext->sample_rate);
+#elif defined SNDFILELIB
+	lra_finalcomputation (LGCtx, sfinfo.channels, sfinfo.samplerate);
+#endif
+      }
+    if (maxloudness)
+      {
+#ifdef FFMPEG
+	maxloudness_finalcomputation (LGCtx, codecContext->channels,
+				      codecContext->sample_rate,
+				      channelnames);
+#elif defined SNDFILELIB
+	maxloudness_finalcomputation (LGCtx, sfinfo.channels,
+				      sfinfo.samplerate, channelnames);
+#endif
+      }
+  }				// if (lkfs)
+if (replaygain)
+  {
+    if (isnan (lkfsvalue))
+      {
+	printf ("ReplayGain: not available without the plain LKFS result.\n");
+      }
+    else
+      {
+	// ReplayGain 2.0 is EBU R128 loudness against -18 LUFS
+	double rggain = -18.0 - lkfsvalue;
+	double rgpeak = 0.0;
+	char *json = malloc (96);
+	for (int i = 0; i < nchannels; i++)
+	  rgpeak = max (truepeak_ctx->vector[i], rgpeak);
+	rgpeak = pow (10, (log10 (rgpeak) * 10 + 12.04) / 20);
+	printf ("REPLAYGAIN_TRACK_GAIN: %+.2f dB\n", rounddb (rggain, 2));
+	printf ("REPLAYGAIN_TRACK_PEAK: %.6f\n", rgpeak);
+	snprintf (json, 96,
+		  ", \"replaygain_track_gain\": %.2f, \"replaygain_track_peak\": %.6f",
+		  rounddb (rggain, 2), rgpeak);
+	posthookjson = append_json (posthookjson, json);
+      }
+  }
+if (dialnorm != 0)
+  {
+    if (isnan (lkfsvalue))
+      {
+	printf ("Dialnorm: not compared without the plain LKFS result.\n");
+      }
+    else
+      {
+	// a program matching its metadata has its loudness at the dialnorm
+	double delta = lkfsvalue - dialnorm;
+	char *json = malloc (48);
+	printf ("Loudness vs dialnorm: %+.1f dB\n", rounddb (delta, 1));
+	snprintf (json, 48, ", \"dialnorm_delta\": %.1f", rounddb (delta, 1));
+	posthookjson = append_json (posthookjson, json);
+      }
+  }
+if (soundcheck)
+  {
+    if (isnan (lkfsvalue))
+      {
+	printf
+	  ("Sound Check: not available without the plain LKFS result.\n");
+      }
+    else
+      {
+	/* iTunNORM: the gain as 1/1000 and 1/2500 W references for left
+	   and right (capped at 65534), then the peak in 16 bit sample units.
+	   The unknown statistics fields are left at 0. */
+	double scgain = -16.0 - lkfsvalue;
+	double scpeak = 0.0;
+	char itunnorm[96];
+	char *json = malloc (192);
+	for (int i = 0; i < nchannels; i++)
+	  scpeak = max (truepeak_ctx->vector[i], scpeak);
+	scpeak = pow (10, (log10 (scpeak) * 10 + 12.04) / 20);
+	unsigned long w1000 =
+	  (unsigned long) min (round (1000 * pow (10, -scgain / 10)), 65534.0);
+	unsigned long w2500 =
+	  (unsigned long) min (round (2500 * pow (10, -scgain / 10)), 65534.0);
+	unsigned long peak = (unsigned long) min (round (scpeak * 32768), 65535.0);
+	snprintf (itunnorm, sizeof (itunnorm),
+		  " %08lX %08lX %08lX %08lX %08X %08X %08lX %08lX %08X %08X",
+		  w1000, w1000, w2500, w2500, 0, 0, peak, peak, 0, 0);
+	printf ("Sound Check gain: %+.2f dB\n", rounddb (scgain, 2));
+	printf ("iTunNORM:%s\n", itunnorm);
+	snprintf (json, 192, ", \"soundcheck_gain\": %.2f, \"itunnorm\": \"%s\"",
+		  rounddb (scgain, 2), itunnorm);
+	posthookjson = append_json (posthookjson, json);
+      }
+  }
+if (nchannelselection)
+  {
+    char *json = malloc (32 + 8 * nchannelselection);
+    int jsonlen = sprintf (json, ", \"channels\": [");
+    printf ("Channels measured:");
+    for (int i = 0; i < nchannelselection; i++)
+      {
+	printf (" %d", channelselection[i]);
+	jsonlen += sprintf (json + jsonlen, "%s%d", i ? ", " : "",
+			    channelselection[i]);
+      }
+    printf ("\n");
+    sprintf (json + jsonlen, "]");
+    posthookjson = append_json (posthookjson, json);
+  }
+if (lfecompare)
+  {
+    double withlfe = 0.0;
+    double withoutlfe = 0.0;
+    for (int i = 0; i < nchannels; i++)
+      {
+	if (i == lfechannel)
+	  {
+	    withlfe += channelsumvector[i];
+	  }
+	else if (!channelexcludevector[i])
+	  {
+	    withlfe += channelsumvector[i];
+	    withoutlfe += channelsumvector[i];
+	  }
+      }
+    printf ("Leq(%s) with LFE: %.4f\n", weightinglabel,
+	    rounddb (channelleq (withlfe, totsum->nsamples), 4));
+    printf ("Leq(%s) without LFE: %.4f\n", weightinglabel,
+	    rounddb (channelleq (withoutlfe, totsum->nsamples), 4));
+  }
+if (centrereport)
+  {
+    double centrerms =
+      10 * log10 (channelnwsumvector[centrechannel] /
+		  ((double) totsum->nsamples));
+    printf ("Centre channel Leq(%s): %.4f\n", weightinglabel,
+	    rounddb (channelleq
+		     (channelsumvector[centrechannel], totsum->nsamples), 4));
+    printf ("Centre channel RMS level: %.4f dBFS\n",
+	    rounddb (centrerms > -200.0 ? centrerms : -200.0, 4));
+    free (channelnwsumvector);
+    channelnwsumvector = NULL;
+  }
+if (balance)
+  {
+    balance_finalcomputation (channelsumvector, channelconfcalvector,
+			      channelexcludevector, channelnames, nchannels);
+  }
+printf ("Leq(%s): %.4f\n", weightinglabel, rounddb (totsum->leqm, 4));
+if (target)
+  {
+    double gain = targetleq - totsum->leqm;
+    char *json = malloc (64);
+    printf ("Gain to target Leq(%s) %.4f: %+.4f dB\n", weightinglabel,
+	    targetleq, rounddb (gain, 4));
+    if (truepeak)
+      {
+	double peak = 0.0;
+	for (int i = 0; i < nchannels; i++)
+	  peak = max (truepeak_ctx->vector[i], peak);
+	double peakdb = log10 (peak) * 10 + 12.04 + gain;
+	printf ("True peak after gain: %.4f dBFS\n", rounddb (peakdb, 4));
+	if (peakdb > 0.0)
+	  {
+	    printf
+	      ("Warning: the gain would clip, a limiter or a lower target is needed.\n");
+	  }
+      }
+    snprintf (json, 64, ", \"gain_to_target\": %.4f", rounddb (gain, 4));
+    posthookjson = append_json (posthookjson, json);
+    if (normalizefile != NULL)
+      {
+	if (write_normalized (soundfilename, normalizefile, gain) == 0)
+	  printf ("Wrote %s with %+.4f dB gain.\n", normalizefile,
+		  rounddb (gain, 4));
+	else
+	  printf ("Could not write %s.\n", normalizefile);
+      }
+  }
+if (statlevels)
+  {
+#ifdef FFMPEG
+    statlevels_finalcomputation (shorttermaveragedarray,
+				 realnumbershortperiods, buffersizems,
+				 weightinglabel);
+#elif defined SNDFILELIB
+    statlevels_finalcomputation (shorttermaveragedarray, numbershortperiods,
+				 buffersizems, weightinglabel);
+#endif
+  }
+if (histogrambin > 0.0)
+  {
+#ifdef FFMPEG
+    posthookjson = append_json (posthookjson,
+				histogram_finalcomputation
+				(shorttermaveragedarray,
+				 realnumbershortperiods, histogrambin,
+				 weightinglabel));
+#elif defined SNDFILELIB
+    posthookjson = append_json (posthookjson,
+				histogram_finalcomputation
+				(shorttermaveragedarray, numbershortperiods,
+				 histogrambin, weightinglabel));
+#endif
+  }
+if (ntimeabove || timeseriesfile != NULL || maxwindow > 0.0 || vad
+    || correlation
+    || nsegmentlengths || ncuetracks || nconcat
+#ifdef FFMPEG
+    || nchapters
+#endif
+  )
   {
+    int bufferframes = buffersizesamples / nchannels;
+#ifdef FFMPEG
+    int nperiods = realnumbershortperiods;
+    double samplerate = codecContext->sample_rate;
+#elif defined SNDFILELIB
+    int nperiods = numbershortperiods;
+    double samplerate = sfinfo.samplerate;
+#endif
+    double buffersec = bufferframes / samplerate;
+    double lastbuffersec =
+      (totsum->nsamples - (nperiods - 1) * (double) bufferframes) /
+      samplerate;
+    if (nsegmentlengths)
+      {
+	segment_finalcomputation (shorttermaveragedarray, nperiods,
+				  buffersec, lastbuffersec, segmentlengths,
+				  nsegmentlengths, "Segment", NULL,
+				  weightinglabel);
+      }
+    if (ncuetracks)
+      {
+	tracks_finalcomputation (shorttermaveragedarray, nperiods,
+				 buffersec, lastbuffersec, cuestarts,
+				 cuetitles, ncuetracks, "Track",
+				 weightinglabel);
+	for (int i = 0; i < ncuetracks; i++)
+	  free (cuetitles[i]);
+      }
+    if (nconcat)
+      {
+	tracks_finalcomputation (shorttermaveragedarray, nperiods,
+				 buffersec, lastbuffersec, concatstarts,
+				 concattitles, nconcat + 1, concatlabel,
+				 weightinglabel);
+	for (int i = 0; i <= nconcat; i++)
+	  free (concattitles[i]);
+      }
+#ifdef FFMPEG
+    if (nchapters)
+      {
+	tracks_finalcomputation (shorttermaveragedarray, nperiods,
+				 buffersec, lastbuffersec, chapterstarts,
+				 chaptertitles, nchapters, "Chapter",
+				 weightinglabel);
+	for (int i = 0; i < nchapters; i++)
+	  free (chaptertitles[i]);
+      }
+#endif
+    if (maxwindow > 0.0)
+      {
+	maxwindow_finalcomputation (shorttermaveragedarray, nperiods,
+				    buffersec, lastbuffersec, maxwindow,
+				    weightinglabel);
+      }
+    if (vad)
+      {
+	vad_finalcomputation (shorttermaveragedarray, speecharray, nperiods,
+			      buffersec, lastbuffersec, weightinglabel);
+	free (speecharray);
+	speecharray = NULL;
+      }
+    if (correlation)
+      {
+	correlation_finalcomputation (correlationarray, nperiods, buffersec,
+				      lastbuffersec);
+	free (correlationarray);
+	correlationarray = NULL;
+      }
+    if (ntimeabove)
+      {
+	timeabove_finalcomputation (shorttermaveragedarray, nperiods,
+				    buffersec, lastbuffersec,
+				    timeabovethresholds, ntimeabove,
+				    weightinglabel);
+      }
+    if (timeseriesfile != NULL)
+      {
+	write_timeseries (timeseriesfile, shorttermaveragedarray,
+			  shorttermnwarray, nperiods, buffersec,
+			  lastbuffersec, weightinglabel);
+	free (shorttermnwarray);
+	shorttermnwarray = NULL;
+      }
+  }
+if (accessibility)
+  {
+    printf ("Accessibility tracks (not included above):\n");
+    printf ("HI Leq(%s): %.4f\n", weightinglabel,
+	    rounddb (channelleq (channelsumvector[6], totsum->nsamples), 4));
+    printf ("VI-N Leq(%s): %.4f\n", weightinglabel,
+	    rounddb (channelleq (channelsumvector[7], totsum->nsamples), 4));
+  }
+#ifdef FFMPEG
+if (primingskipped || paddingskipped)
+  {
+    printf
+      ("Encoder delay: %lld priming and %lld padding samples per channel %s.\n",
+       primingskipped, paddingskipped,
+       noskip ? "included in the measurement" :
+       "trimmed as signalled by the container");
+  }
+#endif
+if (bandwidth)
+  {
+#ifdef FFMPEG
+    bandwidth_finalcomputation (spectrumvector, codecContext->sample_rate);
+#elif defined SNDFILELIB
+    bandwidth_finalcomputation (spectrumvector, sfinfo.samplerate);
+#endif
+    free (spectrumvector);
+    spectrumvector = NULL;
+  }
+if (clipping)
+  {
+    printf
+      ("Clipping per channel (runs of %d or more samples at or above %.4f dBFS):\n",
+       cliprun, rounddb (20 * log10 (clipthreshold), 4));
+    if (clip_finalcomputation (clip_ctx, channelnames))
+      {
+	printf ("Warning: clipped samples found.\n");
+      }
+    freeclip (clip_ctx);
+    clip_ctx = NULL;
+  }
+if (foldfile != NULL)
+  {
+#ifdef FFMPEG
+    int programrate = codecContext->sample_rate;
+#elif defined SNDFILELIB
+    int programrate = sfinfo.samplerate;
+#endif
+    int foldrate = 0;
+    int foldchannels = 0;
+    double foldmeasured;
 
-
-
-    //maybe here wait for all cores to output before going on
-    for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
+    if (nchannels != 6)
       {
-	pthread_join (tid[idxcpu], NULL);
-	free (WorkerArgsArray[idxcpu]->argbuffer);
-	WorkerArgsArray[idxcpu]->argbuffer = NULL;
-	if (lkfs)
+	printf ("Fold-down check needs a 5.1 program, --foldcheck ignored.\n");
+      }
+    else if ((foldmeasured =
+	      measure_file_leq (foldfile, buffersizems, &foldrate,
+				&foldchannels)) < 0.0)
+      {
+	printf ("Could not measure the fold-down %s.\n", foldfile);
+      }
+    else if (foldchannels != 2 || foldrate != programrate)
+      {
+	printf
+	  ("The fold-down %s must be stereo at %d Hz like the program, --foldcheck ignored.\n",
+	   foldfile, programrate);
+      }
+    else
+      {
+	/* ITU-R BS.775 fold-down Lo = L + 0.707 C + 0.707 Ls, Ro likewise,
+	   LFE dropped. Channels are taken as uncorrelated so energies add.
+	   The input calibration is undone, the stereo file is measured at 0 dB. */
+	double foldgain[6] = { 1.0, 1.0, 1.0, 0.0, 0.5, 0.5 };	// C goes to both sides at 0.5 energy each
+	double foldsum = 0.0;
+	for (int i = 0; i < 6; i++)
 	  {
-	    WorkerArgsArray[idxcpu]->lg_ctx = NULL;	//here index was worker_id but it must have been wrong!
-	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers);
+	    foldsum += foldgain[i] * channelsumvector[i] /
+	      (channelconfcalvector[i] * channelconfcalvector[i]);
 	  }
-	if (dolbydi)
+	double foldexpected = channelleq (foldsum, totsum->nsamples);
+	printf ("Stereo fold-down Leq(%s): %.4f\n", weightinglabel,
+		rounddb (foldmeasured, 4));
+	printf ("Expected stereo fold-down Leq(%s): %.4f\n", weightinglabel,
+		rounddb (foldexpected, 4));
+	printf ("Fold-down difference (measured - expected): %.4f dB\n",
+		rounddb (foldmeasured - foldexpected, 4));
+	if (fabs (foldmeasured - foldexpected) > foldtolerance)
 	  {
-	    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi = NULL;
-	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers_leqmdi);
+	    printf
+	      ("Warning: stereo fold-down level differs from the 5.1 program by more than %.2f dB.\n",
+	       foldtolerance);
 	  }
-	free (WorkerArgsArray[idxcpu]);
-	WorkerArgsArray[idxcpu] = NULL;
-
-
-
       }
-
-    //worker_id = 0;
-
-
-  }				//if (worker_id != 0)
+  }
+if (dcoffset)
+  {
+    printf ("DC offset per channel:\n");
+    for (int i = 0; i < nchannels; i++)
+      {
+	double dc = channeldcvector[i] / ((double) totsum->nsamples);
+	char chlabel[32];
+	channel_label (chlabel, sizeof (chlabel), i, channelnames);
+	if (dc == 0.0)
+	  {
+	    printf ("%s: 0\n", chlabel);
+	    continue;
+	  }
+	double dcdb = 20 * log10 (fabs (dc));
+	printf ("%s: %.8f (%.4f dBFS)\n", chlabel, dc, rounddb (dcdb, 4));
+	if (dcdb > dcthreshold)
+	  {
+	    printf ("Warning: DC offset on %s is above %.1f dBFS.\n",
+		    chlabel, dcthreshold);
+	  }
+      }
+    free (channeldcvector);
+    channeldcvector = NULL;
+  }
 
 
-if (copiedsamples < buffersizesamples)
+for (int i = 0; i < nplugins; i++)
   {
+    printf ("Plugin %s:\n", plugins[i]);
+    finish_plugin (pluginpipes[i], plugins[i]);
+  }
 
-    realnumbershortperiods++;
-    //worker_id = 0;		//this should have been already like that
-    WorkerArgsArray[worker_id] = malloc (sizeof (struct WorkerArgs));
-    WorkerArgsArray[worker_id]->nsamples = copiedsamples;	//is this correct?
-    WorkerArgsArray[worker_id]->nch = codecContext->channels;
-    WorkerArgsArray[worker_id]->sample_rate = codecContext->sample_rate;
-    WorkerArgsArray[worker_id]->npoints = npoints;
-    WorkerArgsArray[worker_id]->ir = ir;
-    WorkerArgsArray[worker_id]->ptrtotsum = totsum;
-    //new
-    WorkerArgsArray[worker_id]->pthread_iteration = pthreaditer;
-    WorkerArgsArray[worker_id]->ncpus = numCPU;
-    WorkerArgsArray[worker_id]->worker_id = worker_id;
-    //
+if (timing)
+  {
+    struct timespec stoptime;
+    long stoptimenanoseconds;
+    long executionnanoseconds;
+    clock_gettime (CLOCK_MONOTONIC, &stoptime);
 
-    WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
-    if (truepeak)
+    if (stoptime.tv_nsec < starttime.tv_nsec)
       {
-	WorkerArgsArray[worker_id]->truepeakflag = 1;
-	WorkerArgsArray[worker_id]->truepeak = truepeak_ctx;
+	stoptimenanoseconds = 1000000000 + stoptime.tv_nsec;
       }
     else
       {
-	WorkerArgsArray[worker_id]->truepeakflag = 0;
+	stoptimenanoseconds = stoptime.tv_nsec;
+      }
+    executionnanoseconds = stoptimenanoseconds - starttime.tv_nsec;
+    double executionseconds =
+      ((double) stoptime.tv_sec) - ((double) starttime.tv_sec) +
+      ((double) executionnanoseconds / 1000000000.00);
+    printf ("Total execution time is %.6f seconds\n", executionseconds);
+#ifdef FFMPEG
+    double audioseconds = totsum->nsamples / (double) codecContext->sample_rate;
+#elif defined SNDFILELIB
+    double audioseconds = totsum->nsamples / (double) sfinfo.samplerate;
+#endif
+    // what a performance report needs besides the time
+    printf ("Speed: %.1f times real time\n", audioseconds / executionseconds);
+#ifndef _WIN32
+    struct rusage usage;
+    if (getrusage (RUSAGE_SELF, &usage) == 0)
+      {
+	printf ("CPU time: %.3f s user, %.3f s system\n",
+		usage.ru_utime.tv_sec + usage.ru_utime.tv_usec / 1e6,
+		usage.ru_stime.tv_sec + usage.ru_stime.tv_usec / 1e6);
+#ifdef __APPLE__
+	printf ("Peak memory: %.1f MB\n", usage.ru_maxrss / 1048576.0);
+#else
+	printf ("Peak memory: %.1f MB\n", usage.ru_maxrss / 1024.0);
+#endif
       }
+#endif
+  }
 
+int posthookstatus = 0;
+if (posthook != NULL)
+  {
+    posthookstatus =
+      run_posthook (posthook, inputname,
+		    measurementid[0] != '\0' ? measurementid : NULL, totsum,
+		    posthookjson);
+  }
+free (posthookjson);
+posthookjson = NULL;
 
 
-#ifdef DI
-    if ((leqm10) || (leqmlog) || (dolbydi))
+if (leqm10)
+  {
+    //count shorttimeperiods through iterations!
+#ifdef FFMPEG
+    printf ("Number short period buffers is: %d.\n", realnumbershortperiods);
+    double duration =
+      ((double) realnumbershortperiods) * ((double) buffersizems / 1000.0);
+#elif defined SNDFILELIB
+    printf ("Number short period buffers is: %d.\n", numbershortperiods);
+    double duration =
+      ((double) numbershortperiods) * ((double) buffersizems / 1000.0);
+#endif
+    //add remainder in samples!
+    //this is not precise, because the last buffer will not be full
+    //Take the array with the short term accumulators
+    //double interval = 10.0;
+    //create a rolling average according to rolling interval
+    int rollint;		// in short 10*60 = 600 sec 600/0.850 
+
+    //how many element of the array to consider for the rollint?
+    //that is how many buffersizems in the interval - interval could be parameterized(?)
+    double tempint = 60.0 * longperiod / (((double) buffersizems) / 1000.0);
+    rollint = (int) tempint;
+    //dispose of the rest
+    if (tempint - ((double) rollint) > 0)
       {
-#else
-    if ((leqm10) || (leqmlog))
+	rollint += 1;
+      }
+
+
+    printf ("Total duration in minutes is %.0f.\n", duration / 60.0);
+    if ((duration / 60.0) < longperiod)
       {
-#endif
-	WorkerArgsArray[worker_id]->shorttermindex = staindex;
-	WorkerArgsArray[worker_id]->leqm10flag = (leqm10 ? 1 : 0);
-	WorkerArgsArray[worker_id]->leqmlogflag = (leqmlog ? 1 : 0);
-	WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
-#ifdef DI
-	if (dolbydi)
+	printf ("The audio file is too short to measure Leq(M,10m).\n");
+	fclose (leqm10logfile);
+
+	if (!leqmlog)
 	  {
-	    WorkerArgsArray[worker_id]->sc_shorttermarray =
-	      sc_shorttermaveragedarray;
+	    free (shorttermaveragedarray);
+	    shorttermaveragedarray = NULL;
 	  }
-#endif
+
+	goto skipleqm10;	//but if I really want to exit here I should free memory
       }
-    else
+
+    //to be doubled for SNDFILELIB
+
+    //numbershortperiods = (int) (180000.00 / (((double) codecContext->sample_rate) * (double) buffersizems/1000.00) + 1); //this is wrong, because 180000 cannot be be number of frames, also why should we devide by the sample rate if 18000 is just seconds?
+
+    //shorttermaveragedarray = malloc(sizeof(*shorttermaveragedarray)*numbershortperiods);
+
+
+#ifdef FFMPEG
+    double *allenmetricarray =
+      malloc (sizeof (*allenmetricarray) *
+	      (realnumbershortperiods - rollint));
+#elif defined SNDFILELIB
+    double *allenmetricarray =
+      malloc (sizeof (*allenmetricarray) * (numbershortperiods - rollint));
+#endif
+
+    //two loops
+    //external loop
+    int indexlong = 0;
+    double temp_leqm10 = 0.0;
+
+#ifdef FFMPEG
+    while (indexlong < (realnumbershortperiods - rollint))
       {
-	WorkerArgsArray[worker_id]->shorttermindex = 0;
-	WorkerArgsArray[worker_id]->leqm10flag = 0;
-	WorkerArgsArray[worker_id]->leqmlogflag = 0;
-      }
-    if (lkfs)
+#elif defined SNDFILELIB
+    while (indexlong < (numbershortperiods - rollint))
       {
-	WorkerArgsArray[worker_id]->Kcoeffs = coeffs;
-#ifdef DI
-	if ((leqm10) || (leqmlog) || (dolbydi))
+#endif
+	double accumulator = 0;
+	//internal loop
+	double averagedaccumulator = 0;
+	for (int indexshort = 0; indexshort < rollint; indexshort++)
 	  {
-	    WorkerArgsArray[worker_id]->shorttermindex = staindex;
+
+	    accumulator += shorttermaveragedarray[indexshort + indexlong];
+	  }			//end internal loop
+	averagedaccumulator = accumulator / ((double) rollint);
+	temp_leqm10 =
+	  logleqm10 (leqm10logfile,
+		     ((double) (indexlong + rollint)) *
+		     ((double) buffersizems / 1000.0), averagedaccumulator);
+	if (temp_leqm10 > threshold)
+	  {			//See Allen article, this seems quite high...
+	    allenmetricarray[indexlong] = temp_leqm10;
 	  }
 	else
 	  {
-#endif
-
-	    WorkerArgsArray[worker_id]->shorttermindex = staindex;
-#ifdef DI
+	    allenmetricarray[indexlong] = 0.0;
 	  }
-#endif
-
-
+	indexlong++;
+      }				/* while (indexlong < < (realnumbershortperiods - rollint)) *///end external loop
 
-	WorkerArgsArray[worker_id]->lg_ctx = LGCtx;
-	WorkerArgsArray[worker_id]->lkfsflag = 1;
-	//WorkerArgsArray[worker_id]->lg_buffers = allocateLGBuffer(LGCtx->gblocksize);
-	WorkerArgsArray[worker_id]->lg_buffers =
-	  allocateLGBuffer (copiedsamples / codecContext->channels);
-	WorkerArgsArray[worker_id]->lg_buffers->counter = staindex;
+    double thresholdedsum = 0;
+#ifdef FFMPEG
+    for (int i = 0; i < (realnumbershortperiods - rollint); i++)
+      {
+#elif defined SNDFILELIB
+    for (int i = 0; i < (numbershortperiods - rollint); i++)
+      {
+#endif
+	thresholdedsum += allenmetricarray[i];
       }
-    else
+    //printf("Allen Metric: %d", (int) (thresholdedsum / ((double) numbershortperiods)); // But Ioan Allen seems to require minutes as unites.
+    printf ("Allen metric: %d.\n", (int) (thresholdedsum / (duration / 60.0)));	// But Ioan Allen seems to require minutes as unites. But considering that the buffers are set to 750 ms it will be essentially the same, simply spreaded out times 80.
+    fclose (leqm10logfile);
+    if (!leqmlog)
       {
-	WorkerArgsArray[worker_id]->lkfsflag = 0;
+	free (shorttermaveragedarray);
+	shorttermaveragedarray = NULL;
       }
+    free (allenmetricarray);
+    allenmetricarray = NULL;
+  }
 
-#ifdef DI
-    /* LEQMDI INSERT */
 
 
-    if (dolbydi)
-      {
-	WorkerArgsArray[worker_id]->shorttermindex = staindex;	// but where is this counter incremented if no lkfs or leqm10, see also preceding if
-	WorkerArgsArray[worker_id]->lg_ctx_leqmdi = LGCtxLeqMDI;
-	WorkerArgsArray[worker_id]->leqmdiflag = 1;
-	WorkerArgsArray[worker_id]->lg_buffers_leqmdi =
-	  //	  allocateLGBuffer (LGCtxLeqMDI->gblocksize); //is this causing the difference?
-	  allocateLGBuffer (copiedsamples/codecContext->channels);	  
-	WorkerArgsArray[worker_id]->lg_buffers_leqmdi->counter = staindex;
-      }
-    else
-      {
-	WorkerArgsArray[worker_id]->leqmdiflag = 0;
-      }
-    /* END LEQMDI INSERT */
+skipleqm10:
+
+																						/*  NEW LOGLEQM */
+
+
+if (leqmlog)
+  {
+    //count shorttimeperiods through iterations!
+#ifdef FFMPEG
+    printf ("Number short period buffers for Leq(M) log is: %d.\n",
+	    realnumbershortperiods);
+    double duration =
+      ((double) realnumbershortperiods) * ((double) buffersizems / 1000.0);
+#elif defined SNDFILELIB
+    printf ("Number short period buffers for Leq(M) log is: %d.\n",
+	    numbershortperiods);
+    double duration =
+      ((double) numbershortperiods) * ((double) buffersizems / 1000.0);
 #endif
 
-    staindex++;
-    if (poly)
+    printf ("Total duration of Leq(M) log  in minutes is %.0f.\n",
+	    duration / 60.0);
+    double accumulator = 0.0;
+    double averagedaccumulator = 0.0;
+    //long int samplesacc = 0;
+    
+#ifdef FFMPEG
+    for (int i = 0; i < realnumbershortperiods; i++)
       {
-	WorkerArgsArray[worker_id]->polyflag = 1;
-      }
-    else
+#elif defined SNDFILELIB
+    for (int i = 0; i < numbershortperiods; i++)
       {
-	WorkerArgsArray[worker_id]->polyflag = 0;
+#endif
+	accumulator += shorttermaveragedarray[i];
+	averagedaccumulator = accumulator / ((double) i + 1);
+	logleqm (leqmlogfile,
+		 (((double) buffersizems) * ((double) i + 1) / 1000.00),
+		 averagedaccumulator);
+	//samplesacc += buffersizesamples;
       }
-    dsindex = 0;
-    //remaindertot = copiedsamples - buffersizesamples;
-    //copiedsamples = 0;
-    WorkerArgsArray[worker_id]->argbuffer =
-      malloc (sizeof (double) * copiedsamples);
-    memcpy (WorkerArgsArray[worker_id]->argbuffer, (void *) buffer,
-	    copiedsamples * sizeof (double));
 
-    if (lkfs)
-      {
 
-	memcpy (WorkerArgsArray[worker_id]->lg_ctx->
-		oldBufferBackup[worker_id], (void *) nextworkerbufferbackup,
-		copiedsamples * sizeof (double));
-	memcpy (nextworkerbufferbackup, (void *) buffer,
-		copiedsamples * sizeof (double));
-	//memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
-	//          (void *) buffer, copiedsamples * sizeof (double));
+    /* As far as all buffers are the same number of samples I should get the same result like accumulating in parallel 
+       Still it would be nice to check. I should simply store the number of samples in the last buffer.
+       For sndfile I can calculate this straight off at the beginning. But also for ffmpeg I should have it at the end.
+     */
 
-      }
-    if (dolbydi)
-      {
 
-	memcpy (WorkerArgsArray[worker_id]->lg_ctx_leqmdi->
-		oldBufferBackup[worker_id], (void *) nextworkerbufferbackup_leqmdi,
-		copiedsamples * sizeof (double));
-	memcpy (nextworkerbufferbackup_leqmdi, (void *) buffer,
-		copiedsamples * sizeof (double));
+  /*
+ * FIXME the last log in leqm log is not correct if the last buffer is not full, also there and in the check I should account for the possibility of 0 remainder
+ *
+ * */
+
+#ifdef DEBUG
+#ifdef FFMPEG
+    double checkleqm = 10 * log10( accumulator / (((double) (realnumbershortperiods  - 1)) + ((double) totsum->remainder_samples) / buffersizesamples)) + 108.010299957;
+    printf ("Buffersize in samples per channel is: %d\n", buffersizesamples / codecContext->channels);
+    printf  ("Remainder samples in the last buffer are: %d\n", totsum->remainder_samples / codecContext->channels);
+    printf ("Number of short period (buffers including last not full one) is: %d\n", realnumbershortperiods);
+#elif defined SNDFILELIB
+    double checkleqm = 10 * log10( accumulator / (((double) (numbershortperiods  - 1)) + ((double) totsum->remainder_samples) / buffersizesamples)) + 108.010299957;
+    printf ("Buffersize in samples per channel is: %d\n", buffersizesamples / sfinfo.channels);
+    printf  ("Remainder samples in the last buffer are: %d\n", (int) (totsum->remainder_samples / sfinfo.channels));
+    printf ("Number of short period (buffers including last not full one) is: %d\n", numbershortperiods);
+#endif
+    printf ("Check Leq(M) from short term discrete accumulation: %.4f\n", checkleqm);
+
+#endif
+
+}
+																							/* END NEW LOGLEQM */
+
 
-      }
 
 
 
-    //pthread_attr_t attr;
-    //pthread_attr_init (&attr);
 #ifdef DI
-    if (dolbydi)
+if (dolbydi)
+  {
+    //the following is in case dolbydi was called without leqm10 
+    if (shorttermaveragedarray != NULL)
       {
-	pthread_create (&tid[worker_id], &attr, worker_function_gated2,
-			WorkerArgsArray[worker_id]);
+	free (shorttermaveragedarray);
+	shorttermaveragedarray = NULL;
       }
-    else
-      {
-#endif
+    //allenmetricarray = NULL;
+#ifdef FFMPEG
+    freedidecisionarray (codecContext->channels, shorttermdidecisionarray);
+    freesc_shorttermarray (codecContext->channels, sc_shorttermaveragedarray);
+#elif defined SNDFILELIB
+    freedidecisionarray (sfinfo.channels, shorttermdidecisionarray);
+    freesc_shorttermarray (sfinfo.channels, sc_shorttermaveragedarray);
 
-	pthread_create (&tid[worker_id], &attr, worker_function,
-			WorkerArgsArray[worker_id]);
-#ifdef DI
-      }
 #endif
-    pthread_join (tid[worker_id], NULL);
-    free (WorkerArgsArray[worker_id]->argbuffer);
-    WorkerArgsArray[worker_id]->argbuffer = NULL;
-    if (lkfs)
+  }
+#endif
+
+if (lkfs)
+  {
+    /*
+       #ifdef SNDFILELIB
+       for (int i = 0; i < sfinfo.channels; i++)
+       {
+       #elif defined FFMPEG
+       for (int i = 0; i < codecContext->channels; i++) */
+#ifdef SNDFILELIB
+    for (int i = 0; i < numCPU; i++)
       {
-	WorkerArgsArray[worker_id]->lg_ctx = NULL;
-	freeLGBuffer (WorkerArgsArray[worker_id]->lg_buffers);
-      }
-    if (dolbydi)
+#elif defined FFMPEG
+    for (int i = 0; i < numCPU; i++)
+
       {
-	WorkerArgsArray[worker_id]->lg_ctx_leqmdi = NULL;
-	freeLGBuffer (WorkerArgsArray[worker_id]->lg_buffers_leqmdi);
+#endif
+	free (LGCtx->oldBufferBackup[i]);
+	LGCtx->oldBufferBackup[i] = NULL;
       }
-    free (WorkerArgsArray[worker_id]);
-    WorkerArgsArray[worker_id] = NULL;
-
-
-
-    //Store number of frames of last non full buffer
-    totsum->remainder_samples = copiedsamples;
-
-
-  }				/*if (copiedsamples < buffersizesamples) */
-
 
+    free (LGCtx->oldBufferBackup);
+    LGCtx->oldBufferBackup = NULL;
+#ifdef SNDFILELIB
+    freeLGresultarray (sfinfo.channels, LGCtx->shortperiods,
+		       LGCtx->LGresultarray);
+#elif defined FFMPEG
+    freeLGresultarray (codecContext->channels, LGCtx->shortperiods,
+		       LGCtx->LGresultarray);
+#endif
+    free (LGCtx->chgainconf);
+    LGCtx->chgainconf = NULL;
+    free (LGCtx->chgateconf);
+    LGCtx->chgateconf = NULL;
+    free (LGCtx);
+    LGCtx = NULL;
+    free (coeffs);
+    coeffs = NULL;
 
+  }
 
+#ifdef DI
+																								/* LEQMDI INSERT */
 
-																		// Some codecs will cause frames to be buffered up in the decoding process. If the CODEC_CAP_DELAY flag
-																		// is set, there can be buffered up frames that need to be flushed, so we'll do that
-if (codecContext->codec->capabilities & AV_CODEC_CAP_DELAY)
+if (dolbydi)
   {
-    av_init_packet (&readingPacket);
-    // Decode all the remaining frames in the buffer, until the end is reached
-    int gotFrame = 0;
-    while (avcodec_decode_audio4
-	   (codecContext, frame, &gotFrame, &readingPacket) >= 0 && gotFrame)
+    /*
+       #ifdef SNDFILELIB
+       for (int i = 0; i < sfinfo.channels; i++)
+       {
+       #elif defined FFMPEG
+       for (int i = 0; i < codecContext->channels; i++)
+     */
+#ifdef SNDFILELIB
+    for (int i = 0; i < numCPU; i++)
       {
-	// We now have a fully decoded audio frame
-	// so I also need to process this
-	/*
-	   #ifdef DEBUG
-	   printAudioFrameInfo(codecContext, frame);
-	   #endif
-	 */
+#elif defined FFMPEG
+    for (int i = 0; i < numCPU; i++)
+
+      {
+#endif
+	free (LGCtxLeqMDI->oldBufferBackup[i]);
+	LGCtxLeqMDI->oldBufferBackup[i] = NULL;
       }
-    av_packet_unref (&readingPacket);
+
+    free (LGCtxLeqMDI->oldBufferBackup);
+    LGCtxLeqMDI->oldBufferBackup = NULL;
+#ifdef SNDFILELIB
+    freeLGresultarray (sfinfo.channels, LGCtxLeqMDI->shortperiods,
+		       LGCtxLeqMDI->LGresultarray);
+#elif defined FFMPEG
+    freeLGresultarray (codecContext->channels, LGCtxLeqMDI->shortperiods,
+		       LGCtxLeqMDI->LGresultarray);
+#endif
+    free (LGCtxLeqMDI->chgainconf);
+    LGCtxLeqMDI->chgainconf = NULL;
+    free (LGCtxLeqMDI->chgateconf);
+    LGCtxLeqMDI->chgateconf = NULL;
+    free (LGCtxLeqMDI);
+    LGCtxLeqMDI = NULL;
+
   }
+
+
+																									/* END LEQMDI INSERT */
 #endif
-#ifdef SNDFILELIB
-WorkerArgsArray[worker_id] = malloc (sizeof (struct WorkerArgs));
-WorkerArgsArray[worker_id]->nsamples = samples_read;
-WorkerArgsArray[worker_id]->nch = sfinfo.channels;
-WorkerArgsArray[worker_id]->sample_rate = sfinfo.samplerate;
-WorkerArgsArray[worker_id]->npoints = npoints;
-WorkerArgsArray[worker_id]->ir = ir;
-WorkerArgsArray[worker_id]->ptrtotsum = totsum;
-																		//new
-WorkerArgsArray[worker_id]->pthread_iteration = pthreaditer;
-WorkerArgsArray[worker_id]->ncpus = numCPU;
-WorkerArgsArray[worker_id]->worker_id = worker_id;
-																		//
 
-WorkerArgsArray[worker_id]->chconf = channelconfcalvector;
 if (truepeak)
   {
-    WorkerArgsArray[worker_id]->truepeakflag = 1;
-    WorkerArgsArray[worker_id]->truepeak = truepeak_ctx;
-  }
-else
-  {
-    WorkerArgsArray[worker_id]->truepeakflag = 0;
+    freetruepeak (truepeak_ctx);
+    truepeak_ctx = NULL;
   }
 
 
 
-#ifdef DI
-if ((leqm10) || (leqmlog) || (dolbydi))
-  {
-#else
-if ((leqm10) || (leqmlog))
-  {
-#endif
-    WorkerArgsArray[worker_id]->shorttermindex = staindex;
-    WorkerArgsArray[worker_id]->leqm10flag = (leqm10 ? 1 : 0);
-    WorkerArgsArray[worker_id]->leqmlogflag = (leqmlog ? 1 : 0);
-    WorkerArgsArray[worker_id]->shorttermarray = shorttermaveragedarray;
-#ifdef DI
-    if (dolbydi)
-      {
-	WorkerArgsArray[worker_id]->sc_shorttermarray =
-	  sc_shorttermaveragedarray;
-      }
-#endif
-  }
-else
+if (!poly)
   {
-    WorkerArgsArray[worker_id]->shorttermindex = 0;
-    WorkerArgsArray[worker_id]->leqm10flag = 0;
-    WorkerArgsArray[worker_id]->leqmlogflag = 0;
-  }
+    free (eqfreqsamples);
+    eqfreqsamples = NULL;
+    free (eqfreqresp_db);
+    eqfreqresp_db = NULL;
+    free (eqfreqresp);
+    eqfreqresp = NULL;
+    free (ir);
+    ir = NULL;
+  }				// if (!poly)
+free (channelconfcalvector);
+channelconfcalvector = NULL;
+free (WorkerArgsArray);
+WorkerArgsArray = NULL;
 
-if (lkfs)
-  {
-    WorkerArgsArray[worker_id]->Kcoeffs = coeffs;
-#ifdef DI
-    if ((leqm10) || (leqmlog) || (dolbydi))
-      {
-#else
-    if ((leqm10) || (leqmlog))
-      {
+free (totsum);
+totsum = NULL;
+free (buffer);
+buffer = NULL;
+free (channelnames);
+channelnames = NULL;
+free (admtypes);
+admtypes = NULL;
+free (downmixmatrix);
+downmixmatrix = NULL;
+#ifdef FFMPEG
+free (remainbuffer);
+remainbuffer = NULL;
 #endif
-	WorkerArgsArray[worker_id]->shorttermindex = staindex;
-      }
-    else
-      {
-	WorkerArgsArray[worker_id]->shorttermindex = staindex;
-      }
-    WorkerArgsArray[worker_id]->lg_ctx = LGCtx;
-    WorkerArgsArray[worker_id]->lkfsflag = 1;
-    WorkerArgsArray[worker_id]->lg_buffers =
-      allocateLGBuffer (LGCtx->gblocksize);
-    WorkerArgsArray[worker_id]->lg_buffers->counter = staindex;
-  }
-else
-  {
-    WorkerArgsArray[worker_id]->lkfsflag = 0;
-  }
+#ifdef SNDFILELIB
+sf_close (file);
+for (int i = 1; i <= nconcat; i++)
+  sf_close (sndfiles[i]);
+for (int i = 1; i <= nmono; i++)
+  sf_close (monosf[i]);
+free (monoscratch);
+#elif defined FFMPEG
+av_frame_free (&frame);
+avcodec_close (codecContext);
+avcodec_free_context (&codecContext);
+avformat_close_input (&formatContext);
+#endif
+if (dsdpath[0] != '\0')
+  remove (dsdpath);
+if (spoolpath[0] != '\0')
+  remove (spoolpath);
 
 
-#ifdef DI
-/* LEQMDI INSERT */
 
+pthread_mutex_destroy (&mutex);
+pthread_attr_destroy (&attr);
+pthread_cond_destroy (&serialsignal);
+// a failed post-hook fails the run, pthread_exit would exit with status 0
+if (posthookstatus != 0)
+  exit (1);
+pthread_exit (NULL);
 
-if (dolbydi)
-  {
-    WorkerArgsArray[worker_id]->shorttermindex = staindex;	// but where is this counter incremented if no lkfs or leqm10, see also preceding if
-    WorkerArgsArray[worker_id]->lg_ctx_leqmdi = LGCtxLeqMDI;
-    WorkerArgsArray[worker_id]->leqmdiflag = 1;
-    WorkerArgsArray[worker_id]->lg_buffers_leqmdi =
-      allocateLGBuffer (LGCtxLeqMDI->gblocksize);
-    WorkerArgsArray[worker_id]->lg_buffers_leqmdi->counter = staindex;
-  }
-else
-  {
-    WorkerArgsArray[worker_id]->leqmdiflag = 0;
-  }
+return 0;
+}				// int main(...)
 
-																				/* END LEQMDI INSERT */
-#endif
 
 
-if (poly)
-  {
-    WorkerArgsArray[worker_id]->polyflag = 1;
-  }
-else
-  {
-    WorkerArgsArray[worker_id]->polyflag = 0;
-  }
 
-WorkerArgsArray[worker_id]->argbuffer =
-malloc (sizeof (double) * buffersizesamples);
-																				//   WorkerArgsArray[worder_id]->src_output = malloc(sizeof(double)*buffersizesamples); // this is for sample rate conversion, not yet used
-memcpy (WorkerArgsArray[worker_id]->argbuffer, buffer,
-	samples_read * sizeof (double));
-if (lkfs)
-  {
 
-    memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
-	    (void *) nextworkerbufferbackup, samples_read * sizeof (double));
-    memcpy (nextworkerbufferbackup, (void *) buffer,
-	    samples_read * sizeof (double));
-    // memcpy (WorkerArgsArray[worker_id]->lg_ctx->oldBufferBackup[worker_id],
-    //          buffer, samples_read * sizeof (double));
+void *
+worker_function (void *argstruct)
+{
 
-  }
-if (dolbydi)
-  {
-    memcpy (WorkerArgsArray[worker_id]->lg_ctx_leqmdi->
-	    oldBufferBackup[worker_id], (void *) nextworkerbufferbackup_leqmdi,
-	    samples_read * sizeof (double));
-    memcpy (nextworkerbufferbackup_leqmdi, (void *) buffer,
-	    samples_read * sizeof (double));
+  struct WorkerArgs *thisWorkerArgs = (struct WorkerArgs *) argstruct;
 
-  }
+  double *sumandsquarebuffer;
+  double *csumandsquarebuffer;
+  double *chsumaccumulator_norm;
+  double *chsumaccumulator_conv;
 
+  int copy_stepcounter;
 
-																				//pthread_attr_t attr;
-																				//pthread_attr_init (&attr);
-#ifdef DI
-if (dolbydi)
-  {
-    pthread_create (&tid[worker_id], &attr, worker_function_gated2,
-		    WorkerArgsArray[worker_id]);
-  }
-else
-  {
-#endif
-    pthread_create (&tid[worker_id], &attr, worker_function,
-		    WorkerArgsArray[worker_id]);
-#ifdef DI
-  }
-#endif
-worker_id++;
+  sumandsquarebuffer =
+    malloc (sizeof (double) *
+	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
 
 
-staindex++;
+  csumandsquarebuffer =
+    malloc (sizeof (double) *
+	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
 
+  chsumaccumulator_norm =
+    malloc (sizeof (double) *
+	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
 
-if (worker_id == numCPU)
-  {
-    worker_id = 0;
-    pthreaditer++;
-    //maybe here wait for all cores to output before going on
-    for (int idxcpu = 0; idxcpu < numCPU; idxcpu++)
-      {
-	pthread_join (tid[idxcpu], NULL);
-	free (WorkerArgsArray[idxcpu]->argbuffer);
-	WorkerArgsArray[idxcpu]->argbuffer = NULL;
-	if (lkfs)
-	  {
-	    WorkerArgsArray[idxcpu]->lg_ctx = NULL;
-	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers);
-	  }
-	if (dolbydi)
-	  {
-	    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi = NULL;
-	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers_leqmdi);
-	  }
-	free (WorkerArgsArray[idxcpu]);
-	WorkerArgsArray[idxcpu] = NULL;
+  chsumaccumulator_conv =
+    malloc (sizeof (double) *
+	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
 
 
-      }
-  }
 
-																				//end while worker_id
-																				// End looping cores
-//Store number for frames in the last non full buffer
-totsum->remainder_samples = samples_read;
-}		// main loop through file //while ((samples_read = sf_read_double (file, buffer, buffersizesamples)) > 0)
+  for (int i = 0; i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
+    {
+      sumandsquarebuffer[i] = 0.0;
+      csumandsquarebuffer[i] = 0.0;
+      chsumaccumulator_norm[i] = 0.0;
+      chsumaccumulator_conv[i] = 0.0;
+    }
 
 
+  for (int ch = 0; ch < thisWorkerArgs->nch; ch++)
+    {
 
+      if (thisWorkerArgs->lkfsflag)
+	{
 
 
-																			//here I should wait for rest workers (< numcpu)
-																			//but I need to dispose of thread id.
-if (worker_id != 0)
-  {				// worker_id == 0 means the number of samples was divisible through the number of cpus
-    for (int idxcpu = 0; idxcpu < worker_id; idxcpu++)
-      {				//worker_id is at this point one unit more than threads launched
-	pthread_join (tid[idxcpu], NULL);
-	free (WorkerArgsArray[idxcpu]->argbuffer);
-	WorkerArgsArray[idxcpu]->argbuffer = NULL;
-	if (lkfs)
-	  {
-	    WorkerArgsArray[idxcpu]->lg_ctx = NULL;
-	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers);
-	  }
-	if (dolbydi)
-	  {
-	    WorkerArgsArray[idxcpu]->lg_ctx_leqmdi = NULL;
-	    freeLGBuffer (WorkerArgsArray[idxcpu]->lg_buffers_leqmdi);
-	  }
+	  copy_stepcounter =
+	    thisWorkerArgs->pthread_iteration * thisWorkerArgs->ncpus *
+	    thisWorkerArgs->lg_ctx->subdivs +
+	    thisWorkerArgs->worker_id * thisWorkerArgs->lg_ctx->subdivs;
 
-	free (WorkerArgsArray[idxcpu]);
-	WorkerArgsArray[idxcpu] = NULL;
+	}
 
+      double *normalizedbuffer;
+      double *convolvedbuffer;
 
-      }
 
-    //worker_id = 0;
+      normalizedbuffer =
+	malloc (sizeof (double) *
+		(thisWorkerArgs->nsamples / thisWorkerArgs->nch));
 
-  }
+      convolvedbuffer =
+	malloc (sizeof (double) *
+		(thisWorkerArgs->nsamples / thisWorkerArgs->nch));
 
 
+      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
+	   n += thisWorkerArgs->nch, m++)
+	{
+	  // use this for calibration depending on channel config for ex. chconf[6] = {1.0, 1.0, 1.0, 1.0, 0.707945784, 0.707945784} could be the default for 5.1 soundtracks
+	  //so not normalized but calibrated
+	  normalizedbuffer[m] = thisWorkerArgs->argbuffer[n] * thisWorkerArgs->chconf[ch];	//this scale amplitude according to specified calibration
 
+	}
 
+      if (thisWorkerArgs->lkfsflag)
+	{
 
-#endif
+	  //this is quite an interesting solution because so one avoids to read thisWorkerArgs->lg_ctx->stepcounter and consequently to devise strategies to mantain seriality of reading, which is quite difficult
+	  //on the contrary it will not be necessary to have any particular precaution writing
 
 
-free (nextworkerbufferbackup);
+	  for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
+	       n += thisWorkerArgs->nch, m++)
+	    {
+	      //populate bufferA -- deinterleave
+	      thisWorkerArgs->lg_buffers->bufferA[m] = thisWorkerArgs->argbuffer[n];	//
+	    }
 
-free(nextworkerbufferbackup_leqmdi);
 
-																			/* HERE ENDS REAL PROCESSING AFTER DI PREPROCESSING OR NOT */
 
 
+	  if (copy_stepcounter == 0)
+	    {
+	      //for (int n=ch, m= 0; n < thisWorkerArgs->nsamples; n += thisWorkerArgs->nch, m++) {
+	      //for (int i=0; i < thisWorkerArgs->lg_ctx->gblocksize; i++) {
+	      for (int i = 0;
+		   i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
+		{		//this is for the case that gblocksize is incomplete like at the end of a file
+		  thisWorkerArgs->lg_buffers->bufferB[i] = 0.0;	//This is for the first level gate block
+		}
+	    }
+	  else
+	    {
 
+	      //MUTEX SHOULDN'T BE NEEDED AT THIS POINT - also copy no more needed, but deinterleaving of channels
 
-																			// mean of scalar sum over duration
-#ifdef DI
-if (dolbydi)
-  {
-#ifdef FFMPEG
 
+	      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
+		   n += thisWorkerArgs->nch, m++)
+		{
+		  thisWorkerArgs->lg_buffers->bufferB[m] =
+		    thisWorkerArgs->lg_ctx->oldBufferBackup[thisWorkerArgs->
+							    worker_id][n];
 
-    dolbydifinalcomputation2 (LGCtxLeqMDI, LGCtxLeqMDI->chgateconf,
-			      codecContext->channels,
-			      shorttermdidecisionarray, agsthreshold);
+		}
 
-#elif defined SNDFILELIB
-    dolbydifinalcomputation2 (LGCtxLeqMDI, LGCtxLeqMDI->chgateconf,
-			      sfinfo.channels,
-			      shorttermdidecisionarray, agsthreshold);
-#endif
+	    }
 
-  }
-else if (dolbydialt)
-  {
+	}			/*  <--   if (thisWorkerArgs->lkfsflag) */
 
-#ifdef FFMPEG
-    dolbydifinalcomputation (sc_shorttermaveragedarray,
-			     shorttermdidecisionarray, codecContext->channels,
-			     realnumbershortperiods, tempchgate, totsum);
-#elif defined SNDFILELIB
 
-    dolbydifinalcomputation (sc_shorttermaveragedarray,
-			     shorttermdidecisionarray, sfinfo.channels,
-			     numbershortperiods, tempchgate, totsum);
-#endif
 
-    if (levelgated)
-      {
-#ifdef FFMPEG
-	levelgatefinalcomputation (sc_shorttermaveragedarray,
-				   leqmtosum (levelgatedthreshold, 0.000020),
-				   codecContext->channels,
-				   realnumbershortperiods, totsum);
-#elif defined SNDFILELIB
-	levelgatefinalcomputation (sc_shorttermaveragedarray,
-				   leqmtosum (levelgatedthreshold, 0.000020),
-				   sfinfo.channels, numbershortperiods,
-				   totsum);
-#endif
-	printf ("Leq(M,LG): %.4f\n", totsum->lgleqm);
-      }
-    printf ("Leq(M,DI): %.4f\n", totsum->dgleqm);
-    printf ("Program dialogue percentage is %.2f%% \n",
-	    totsum->dialoguepercentual);
 
-    meanoverduration (totsum);
-    if (leqnw)
-      {
-	printf ("Leq(noW): %.4f\n", totsum->rms);	// Leq(no Weighting)
-      }
-    printf ("Leq(M): %.4f\n", totsum->leqm);
-  }				// if (dolbydi) else if (dolbydialt)
 
-#endif
-meanoverduration (totsum);
-if (truepeak)
-  {
-    printf ("True Peak Full Scale per channel:\n");
-#ifdef FFMPEG
-    for (int i = 0; i < codecContext->channels; i++)
-      {
-#elif defined SNDFILELIB
-    for (int i = 0; i < sfinfo.channels; i++)
-      {
 
-#endif
-	printf ("Ch %d: %.4f dBFS\n", i, log10 (truepeak_ctx->vector[i]) * 10 + 12.04);	// *10 because its power due to rectification
-      }
-  }
-if (leqnw)
-  {
-    printf ("Leq(noW): %.4f\n", totsum->rms);	// Leq(no Weighting)
-  }
-if (lkfs)
-  {
-#ifdef DI
-    if (dolbydi)
-      {
-#ifdef FFMPEG
-	lkfs_finalcomputation_withdolbydi (LGCtx, LGCtx->chgateconf,
-					   codecContext->channels,
-					   shorttermdidecisionarray,
-					   agsthreshold);
-#elif defined SNDFILELIB
-	lkfs_finalcomputation_withdolbydi (LGCtx, LGCtx->chgateconf,
-					   sfinfo.channels,
-					   shorttermdidecisionarray,
-					   agsthreshold);
-#endif
-      }
-    else
-      {
-#endif
-#ifdef FFMPEG
-	lkfs_finalcomputation (LGCtx, LGCtx->chgateconf,
-			       codecContext->channels);
-#elif defined SNDFILELIB
-	lkfs_finalcomputation (LGCtx, LGCtx->chgateconf, sfinfo.channels);
-#endif
-#ifdef DI
-      }
-#endif
-  }				// if (lkfs)
-printf ("Leq(M): %.4f\n", totsum->leqm);
 
+      /* New True Peak */
 
-if (timing)
-  {
-    struct timespec stoptime;
-    long stoptimenanoseconds;
-    long executionnanoseconds;
-    clock_gettime (CLOCK_MONOTONIC, &stoptime);
+      if (thisWorkerArgs->truepeakflag)
+	{
+	  double *pt_buffer;
+	  if (thisWorkerArgs->lkfsflag)
+	    {
 
-    if (stoptime.tv_nsec < starttime.tv_nsec)
-      {
-	stoptimenanoseconds = 1000000000 + stoptime.tv_nsec;
-      }
-    else
-      {
-	stoptimenanoseconds = stoptime.tv_nsec;
-      }
-    executionnanoseconds = stoptimenanoseconds - starttime.tv_nsec;
-    printf ("Total execution time is %.6f seconds\n",
-	    ((double) stoptime.tv_sec) - ((double) starttime.tv_sec) +
-	    ((double) executionnanoseconds / 1000000000.00));
-  }
+	      pt_buffer = thisWorkerArgs->lg_buffers->bufferA;
 
+	    }
+	  else
+	    {
+	      pt_buffer = malloc (sizeof (double) * thisWorkerArgs->nsamples);
 
-if (leqm10)
-  {
-    //count shorttimeperiods through iterations!
-#ifdef FFMPEG
-    printf ("Number short period buffers is: %d.\n", realnumbershortperiods);
-    double duration =
-      ((double) realnumbershortperiods) * ((double) buffersizems / 1000.0);
-#elif defined SNDFILELIB
-    printf ("Number short period buffers is: %d.\n", numbershortperiods);
-    double duration =
-      ((double) numbershortperiods) * ((double) buffersizems / 1000.0);
-#endif
-    //add remainder in samples!
-    //this is not precise, because the last buffer will not be full
-    //Take the array with the short term accumulators
-    //double interval = 10.0;
-    //create a rolling average according to rolling interval
-    int rollint;		// in short 10*60 = 600 sec 600/0.850 
+	      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
+		   n += thisWorkerArgs->nch, m++)
+		{
+		  //populate bufferA -- deinterleave
+		  pt_buffer[m] = thisWorkerArgs->argbuffer[n];	//
+		}
 
-    //how many element of the array to consider for the rollint?
-    //that is how many buffersizems in the interval - interval could be parameterized(?)
-    double tempint = 60.0 * longperiod / (((double) buffersizems) / 1000.0);
-    rollint = (int) tempint;
-    //dispose of the rest
-    if (tempint - ((double) rollint) > 0)
-      {
-	rollint += 1;
-      }
 
+	    }
 
-    printf ("Total duration in minutes is %.0f.\n", duration / 60.0);
-    if ((duration / 60.0) < longperiod)
-      {
-	printf ("The audio file is too short to measure Leq(M,10m).\n");
-	fclose (leqm10logfile);
+	  pthread_mutex_lock (&mutex);
+	  double temp_truepeak = thisWorkerArgs->truepeak->vector[ch];
+	  pthread_mutex_unlock (&mutex);
 
-	if (!leqmlog)
-	  {
-	    free (shorttermaveragedarray);
-	    shorttermaveragedarray = NULL;
-	  }
+	  int peakframe = -1;
+	  temp_truepeak =
+	    truepeakcheck (pt_buffer,
+			   thisWorkerArgs->nsamples / thisWorkerArgs->nch,
+			   temp_truepeak,
+			   thisWorkerArgs->truepeak->oversampling_ratio,
+			   thisWorkerArgs->truepeak->filtertaps,
+			   thisWorkerArgs->truepeak->filter_coeffs,
+			   &peakframe);
 
-	goto skipleqm10;	//but if I really want to exit here I should free memory
-      }
 
-    //to be doubled for SNDFILELIB
+	  pthread_mutex_lock (&mutex);
+	  if (temp_truepeak > thisWorkerArgs->truepeak->vector[ch])	// compare againt actual value, another thread may have found a higher peak meanwhile
+	    {
+	      thisWorkerArgs->truepeak->vector[ch] = temp_truepeak;
+	      thisWorkerArgs->truepeak->position[ch] =
+		thisWorkerArgs->firstframe + peakframe;
+	    }
+	  pthread_mutex_unlock (&mutex);
 
-    //numbershortperiods = (int) (180000.00 / (((double) codecContext->sample_rate) * (double) buffersizems/1000.00) + 1); //this is wrong, because 180000 cannot be be number of frames, also why should we devide by the sample rate if 18000 is just seconds?
 
-    //shorttermaveragedarray = malloc(sizeof(*shorttermaveragedarray)*numbershortperiods);
+	  if (!thisWorkerArgs->lkfsflag)
+	    {
+	      free (pt_buffer);
+	      pt_buffer = NULL;
+	    }
+	}
+
+      /* END INSERT */
+
 
 
-#ifdef FFMPEG
-    double *allenmetricarray =
-      malloc (sizeof (*allenmetricarray) *
-	      (realnumbershortperiods - rollint));
-#elif defined SNDFILELIB
-    double *allenmetricarray =
-      malloc (sizeof (*allenmetricarray) * (numbershortperiods - rollint));
-#endif
 
-    //two loops
-    //external loop
-    int indexlong = 0;
-    double temp_leqm10 = 0.0;
 
-#ifdef FFMPEG
-    while (indexlong < (realnumbershortperiods - rollint))
-      {
-#elif defined SNDFILELIB
-    while (indexlong < (numbershortperiods - rollint))
-      {
-#endif
-	double accumulator = 0;
-	//internal loop
-	double averagedaccumulator = 0;
-	for (int indexshort = 0; indexshort < rollint; indexshort++)
-	  {
 
-	    accumulator += shorttermaveragedarray[indexshort + indexlong];
-	  }			//end internal loop
-	averagedaccumulator = accumulator / ((double) rollint);
-	temp_leqm10 =
-	  logleqm10 (leqm10logfile,
-		     ((double) (indexlong + rollint)) *
-		     ((double) buffersizems / 1000.0), averagedaccumulator);
-	if (temp_leqm10 > threshold)
-	  {			//See Allen article, this seems quite high...
-	    allenmetricarray[indexlong] = temp_leqm10;
-	  }
-	else
-	  {
-	    allenmetricarray[indexlong] = 0.0;
-	  }
-	indexlong++;
-      }				/* while (indexlong < < (realnumbershortperiods - rollint)) *///end external loop
 
-    double thresholdedsum = 0;
-#ifdef FFMPEG
-    for (int i = 0; i < (realnumbershortperiods - rollint); i++)
-      {
-#elif defined SNDFILELIB
-    for (int i = 0; i < (numbershortperiods - rollint); i++)
-      {
-#endif
-	thresholdedsum += allenmetricarray[i];
-      }
-    //printf("Allen Metric: %d", (int) (thresholdedsum / ((double) numbershortperiods)); // But Ioan Allen seems to require minutes as unites.
-    printf ("Allen metric: %d.\n", (int) (thresholdedsum / (duration / 60.0)));	// But Ioan Allen seems to require minutes as unites. But considering that the buffers are set to 750 ms it will be essentially the same, simply spreaded out times 80.
-    fclose (leqm10logfile);
-    if (!leqmlog)
-      {
-	free (shorttermaveragedarray);
-	shorttermaveragedarray = NULL;
-      }
-    free (allenmetricarray);
-    allenmetricarray = NULL;
-  }
 
 
 
-skipleqm10:
+      if (thisWorkerArgs->polyflag == 1)
+	{
+	  //M_filter instead of convolution
+	  weighting_filter (convolvedbuffer, normalizedbuffer,
+			    thisWorkerArgs->nsamples / thisWorkerArgs->nch,
+			    thisWorkerArgs->sample_rate);
+	}
+      else
+	{
+	  //convolution M ir
+	  convolv_buff (normalizedbuffer, convolvedbuffer, thisWorkerArgs->ir,
+			thisWorkerArgs->nsamples / thisWorkerArgs->nch,
+			thisWorkerArgs->npoints * 2);
+	}
 
-																						/*  NEW LOGLEQM */
+      //rectify, square und sum
+      rectify (csumandsquarebuffer, convolvedbuffer,
+	       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+      rectify (sumandsquarebuffer, normalizedbuffer,
+	       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
 
 
-if (leqmlog)
-  {
-    //count shorttimeperiods through iterations!
-#ifdef FFMPEG
-    printf ("Number short period buffers for Leq(M) log is: %d.\n",
-	    realnumbershortperiods);
-    double duration =
-      ((double) realnumbershortperiods) * ((double) buffersizems / 1000.0);
-#elif defined SNDFILELIB
-    printf ("Number short period buffers for Leq(M) log is: %d.\n",
-	    numbershortperiods);
-    double duration =
-      ((double) numbershortperiods) * ((double) buffersizems / 1000.0);
-#endif
 
-    printf ("Total duration of Leq(M) log  in minutes is %.0f.\n",
-	    duration / 60.0);
-    double accumulator = 0.0;
-    double averagedaccumulator = 0.0;
-    //long int samplesacc = 0;
-    
-#ifdef FFMPEG
-    for (int i = 0; i < realnumbershortperiods; i++)
-      {
-#elif defined SNDFILELIB
-    for (int i = 0; i < numbershortperiods; i++)
-      {
-#endif
-	accumulator += shorttermaveragedarray[i];
-	averagedaccumulator = accumulator / ((double) i + 1);
-	logleqm (leqmlogfile,
-		 (((double) buffersizems) * ((double) i + 1) / 1000.00),
-		 averagedaccumulator);
-	//samplesacc += buffersizesamples;
-      }
+      accumulatechenergy (thisWorkerArgs->chsum, ch, csumandsquarebuffer,
+			  thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+      if (thisWorkerArgs->chsumnw != NULL)
+	{
+	  accumulatechenergy (thisWorkerArgs->chsumnw, ch, sumandsquarebuffer,
+			      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->chdc != NULL)
+	{
+	  accumulatechdc (thisWorkerArgs->chdc, ch, thisWorkerArgs->argbuffer,
+			  thisWorkerArgs->nsamples, thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->clip != NULL)
+	{
+	  clipcheck (thisWorkerArgs->clip, thisWorkerArgs->bufferindex, ch,
+		     thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+		     thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->spectrum != NULL)
+	{
+	  accumulatespectrum (thisWorkerArgs->spectrum, ch,
+			      thisWorkerArgs->argbuffer,
+			      thisWorkerArgs->nsamples, thisWorkerArgs->nch);
+	}
+      if (!thisWorkerArgs->chexclude[ch])
+	{
+	  accumulatech (chsumaccumulator_norm, sumandsquarebuffer,
+			thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	  accumulatech (chsumaccumulator_conv, csumandsquarebuffer,
+			thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	}
 
 
-    /* As far as all buffers are the same number of samples I should get the same result like accumulating in parallel 
-       Still it would be nice to check. I should simply store the number of samples in the last buffer.
-       For sndfile I can calculate this straight off at the beginning. But also for ffmpeg I should have it at the end.
-     */
+      free (normalizedbuffer);
+      normalizedbuffer = NULL;
 
+      free (convolvedbuffer);
+      convolvedbuffer = NULL;
 
-  /*
- * FIXME the last log in leqm log is not correct if the last buffer is not full, also there and in the check I should account for the possibility of 0 remainder
- *
- * */
+      if (thisWorkerArgs->lkfsflag)
+	{
 
-#ifdef DEBUG
-#ifdef FFMPEG
-    double checkleqm = 10 * log10( accumulator / (((double) (realnumbershortperiods  - 1)) + ((double) totsum->remainder_samples) / buffersizesamples)) + 108.010299957;
-    printf ("Buffersize in samples per channel is: %d\n", buffersizesamples / codecContext->channels);
-    printf  ("Remainder samples in the last buffer are: %d\n", totsum->remainder_samples / codecContext->channels);
-    printf ("Number of short period (buffers including last not full one) is: %d\n", realnumbershortperiods);
-#elif defined SNDFILELIB
-    double checkleqm = 10 * log10( accumulator / (((double) (numbershortperiods  - 1)) + ((double) totsum->remainder_samples) / buffersizesamples)) + 108.010299957;
-    printf ("Buffersize in samples per channel is: %d\n", buffersizesamples / sfinfo.channels);
-    printf  ("Remainder samples in the last buffer are: %d\n", (int) (totsum->remainder_samples / sfinfo.channels));
-    printf ("Number of short period (buffers including last not full one) is: %d\n", numbershortperiods);
-#endif
-    printf ("Check Leq(M) from short term discrete accumulation: %.4f\n", checkleqm);
+	  int stepi = thisWorkerArgs->lg_ctx->ops;
+	  //internal copy of step_counter
 
-#endif
+	  //put together samples
+	  while (stepi <= thisWorkerArgs->nsamples / thisWorkerArgs->nch)
+	    {			//instead of thisWorkerArgs->lg_ctx->gblocksize for block less the gblocksize at the end of file
 
-}
-																							/* END NEW LOGLEQM */
+	      /* // Where should I put this?
 
+	         if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi) < thisWorkerArgs->lg_ctx->ops)  { // pad buffer
 
+	         memcpy(thisWorkerArgs->lg_buffers->bufferLG, thisWorkerArgs->lg_buffers->bufferB + stepi, sizeof(double)*(thisWorkerArgs->lg_ctx->gblocksize - stepi)); //copy samples til boundary of bufferB
+	         memcpy(thisWorkerArgs->lg_buffers->bufferLG + thisWorkerArgs->lg_ctx->gblocksize - stepi, thisWorkerArgs->lg_buffers->bufferA, sizeof(double)*(thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi);
 
+	         }
 
+	       */
+	      if (copy_stepcounter > 0)
+		{		//that must  not be the first gate block 
 
-#ifdef DI
-if (dolbydi)
-  {
-    //the following is in case dolbydi was called without leqm10 
-    if (shorttermaveragedarray != NULL)
-      {
-	free (shorttermaveragedarray);
-	shorttermaveragedarray = NULL;
-      }
-    //allenmetricarray = NULL;
-#ifdef FFMPEG
-    freedidecisionarray (codecContext->channels, shorttermdidecisionarray);
-    freesc_shorttermarray (codecContext->channels, sc_shorttermaveragedarray);
-#elif defined SNDFILELIB
-    freedidecisionarray (sfinfo.channels, shorttermdidecisionarray);
-    freesc_shorttermarray (sfinfo.channels, sc_shorttermaveragedarray);
+		  memcpy (thisWorkerArgs->lg_buffers->bufferLG, thisWorkerArgs->lg_buffers->bufferB + stepi, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//copy samples til boundary of bufferB
+		  memcpy (thisWorkerArgs->lg_buffers->bufferLG +
+			  thisWorkerArgs->nsamples / thisWorkerArgs->nch -
+			  stepi, thisWorkerArgs->lg_buffers->bufferA,
+			  sizeof (double) * stepi);
 
-#endif
-  }
-#endif
+		}
+	      else
+		{
 
-if (lkfs)
-  {
-    /*
-       #ifdef SNDFILELIB
-       for (int i = 0; i < sfinfo.channels; i++)
-       {
-       #elif defined FFMPEG
-       for (int i = 0; i < codecContext->channels; i++) */
-#ifdef SNDFILELIB
-    for (int i = 0; i < numCPU; i++)
-      {
-#elif defined FFMPEG
-    for (int i = 0; i < numCPU; i++)
+		  memcpy (thisWorkerArgs->lg_buffers->bufferLG,
+			  thisWorkerArgs->lg_buffers->bufferA,
+			  sizeof (double) * stepi);
+		  memset (thisWorkerArgs->lg_buffers->bufferLG + stepi, 0, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//Check if this correct
 
-      {
-#endif
-	free (LGCtx->oldBufferBackup[i]);
-	LGCtx->oldBufferBackup[i] = NULL;
-      }
+		  //for the case this is the first ... but preferably another solution
+		}
 
-    free (LGCtx->oldBufferBackup);
-    LGCtx->oldBufferBackup = NULL;
-#ifdef SNDFILELIB
-    freeLGresultarray (sfinfo.channels, LGCtx->shortperiods,
-		       LGCtx->LGresultarray);
-#elif defined FFMPEG
-    freeLGresultarray (codecContext->channels, LGCtx->shortperiods,
-		       LGCtx->LGresultarray);
-#endif
-    free (LGCtx->chgainconf);
-    LGCtx->chgainconf = NULL;
-    free (LGCtx->chgateconf);
-    LGCtx->chgateconf = NULL;
-    free (LGCtx);
-    LGCtx = NULL;
-    free (coeffs);
-    coeffs = NULL;
 
-  }
+	      /* Filtering stage one and two */
+	      K_filter_stage1 (thisWorkerArgs->lg_buffers->bufferSwap,
+			       thisWorkerArgs->lg_buffers->bufferLG,
+			       thisWorkerArgs->nsamples / thisWorkerArgs->nch,
+			       thisWorkerArgs->Kcoeffs);
+	      K_filter_stage2 (thisWorkerArgs->lg_buffers->bufferLG,
+			       thisWorkerArgs->lg_buffers->bufferSwap,
+			       thisWorkerArgs->nsamples / thisWorkerArgs->nch,
+			       thisWorkerArgs->Kcoeffs);
+	      rectify (thisWorkerArgs->lg_buffers->bufferSwap,
+		       thisWorkerArgs->lg_buffers->bufferLG,
+		       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	      double tmp_sum =
+		msaccumulate (thisWorkerArgs->lg_buffers->bufferSwap,
+			      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+
+	      //pthread_mutex_lock (&mutex); //THIS ALSO SHOULD NOT BE NECESSARY
+	      // this should be done under mutex conditions -> shared resources!
+	      // assign provisional measure of leq (not yet gated)
+	      /*
+	         #ifdef DEBUG
+	         printf
+	         ("LG block index: %d\t Channel: %d\t Sample sum: %.20f\n",
+	         copy_stepcounter, ch, tmp_sum);
+	         #endif
+	       */
+	      thisWorkerArgs->lg_ctx->LGresultarray[ch][thisWorkerArgs->shorttermindex][copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs] = tmp_sum;	//<- if below relative threshold, but postpone gating for the finale calculation
+	      //pthread_mutex_unlock (&mutex);
+	      copy_stepcounter++;
+	      stepi += thisWorkerArgs->lg_ctx->ops;
+	    }			/* while(stepi <= LGCtx->gblocksize)  */
+
 
-#ifdef DI
-																								/* LEQMDI INSERT */
 
-if (dolbydi)
-  {
-    /*
-       #ifdef SNDFILELIB
-       for (int i = 0; i < sfinfo.channels; i++)
-       {
-       #elif defined FFMPEG
-       for (int i = 0; i < codecContext->channels; i++)
-     */
-#ifdef SNDFILELIB
-    for (int i = 0; i < numCPU; i++)
-      {
-#elif defined FFMPEG
-    for (int i = 0; i < numCPU; i++)
 
-      {
-#endif
-	free (LGCtxLeqMDI->oldBufferBackup[i]);
-	LGCtxLeqMDI->oldBufferBackup[i] = NULL;
-      }
+	}			/* if (thisWorkerArgs->lkfsflag) */
 
-    free (LGCtxLeqMDI->oldBufferBackup);
-    LGCtxLeqMDI->oldBufferBackup = NULL;
-#ifdef SNDFILELIB
-    freeLGresultarray (sfinfo.channels, LGCtxLeqMDI->shortperiods,
-		       LGCtxLeqMDI->LGresultarray);
-#elif defined FFMPEG
-    freeLGresultarray (codecContext->channels, LGCtxLeqMDI->shortperiods,
-		       LGCtxLeqMDI->LGresultarray);
-#endif
-    free (LGCtxLeqMDI->chgainconf);
-    LGCtxLeqMDI->chgainconf = NULL;
-    free (LGCtxLeqMDI->chgateconf);
-    LGCtxLeqMDI->chgateconf = NULL;
-    free (LGCtxLeqMDI);
-    LGCtxLeqMDI = NULL;
 
-  }
 
+    }				// loop through channels
 
-																									/* END LEQMDI INSERT */
-#endif
 
-if (truepeak)
-  {
-    freetruepeak (truepeak_ctx);
-    truepeak_ctx = NULL;
-  }
 
 
 
-if (!poly)
-  {
-    free (eqfreqsamples);
-    eqfreqsamples = NULL;
-    free (eqfreqresp_db);
-    eqfreqresp_db = NULL;
-    free (eqfreqresp);
-    eqfreqresp = NULL;
-    free (ir);
-    ir = NULL;
-  }				// if (!poly)
-free (channelconfcalvector);
-channelconfcalvector = NULL;
-free (WorkerArgsArray);
-WorkerArgsArray = NULL;
+  if (thisWorkerArgs->lkfsflag)
+    {
+      /* following if is to avoid incrementing stepcounter in case there where not enough samples to fill a gating block */
+      if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) >=
+	  thisWorkerArgs->lg_ctx->ops)
+	{
 
-free (totsum);
-totsum = NULL;
-free (buffer);
-buffer = NULL;
-#ifdef FFMPEG
-free (remainbuffer);
-remainbuffer = NULL;
-#endif
-#ifdef SNDFILELIB
-sf_close (file);
-#elif defined FFMPEG
-av_frame_free (&frame);
-avcodec_close (codecContext);
-avcodec_free_context (&codecContext);
-avformat_close_input (&formatContext);
+	  pthread_mutex_lock (&mutex);
+
+	  if (copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs == 0)
+	    {
+	      thisWorkerArgs->lg_ctx->stepcounter +=
+		thisWorkerArgs->lg_ctx->subdivs;
+	    }
+	  else
+	    {
+	      thisWorkerArgs->lg_ctx->stepcounter +=
+		copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs;
+	    }
+
+
+
+	  pthread_mutex_unlock (&mutex);
+	}
+    }
+  //Create a function for this also a tag so that the worker know if he has to do this or not
+
+  if ((thisWorkerArgs->leqm10flag) || (thisWorkerArgs->leqmlogflag)
+      || (thisWorkerArgs->shorttermflag))
+    {
+      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex] =
+	sumandshorttermavrg (chsumaccumulator_conv,
+			     thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+      if (thisWorkerArgs->shorttermnwarray != NULL)
+	{
+	  thisWorkerArgs->shorttermnwarray[thisWorkerArgs->shorttermindex] =
+	    sumandshorttermavrg (chsumaccumulator_norm,
+				 thisWorkerArgs->nsamples /
+				 thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->speech != NULL)
+	{
+	  thisWorkerArgs->speech[thisWorkerArgs->shorttermindex] =
+	    speechcheck (thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+			 thisWorkerArgs->nch, thisWorkerArgs->sample_rate);
+	}
+      if (thisWorkerArgs->correlation != NULL)
+	{
+	  thisWorkerArgs->correlation[thisWorkerArgs->shorttermindex] =
+	    stereocorrelation (thisWorkerArgs->argbuffer,
+			       thisWorkerArgs->nsamples);
+	}
+      if (thisWorkerArgs->silence != NULL)
+	{
+	  thisWorkerArgs->silence[thisWorkerArgs->shorttermindex] =
+	    silencecheck (thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+			  thisWorkerArgs->silencethreshold);
+	}
+      if (thisWorkerArgs->tone != NULL)
+	{
+	  thisWorkerArgs->tone[thisWorkerArgs->shorttermindex] =
+	    tonecheck (thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+		       thisWorkerArgs->nch, thisWorkerArgs->sample_rate);
+	}
+#ifdef DEBUG
+      printf ("%d: %.6f\n", thisWorkerArgs->shorttermindex,
+	      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex]);
 #endif
+    }
+  pthread_mutex_lock (&mutex);
+  // this should be done under mutex conditions -> shared resources!
+  sumsamples (thisWorkerArgs->ptrtotsum, chsumaccumulator_norm,
+	      chsumaccumulator_conv,
+	      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+  pthread_mutex_unlock (&mutex);
 
 
+  free (sumandsquarebuffer);
+  sumandsquarebuffer = NULL;
 
-pthread_mutex_destroy (&mutex);
-pthread_attr_destroy (&attr);
-pthread_cond_destroy (&serialsignal);
-pthread_exit (NULL);
+  free (csumandsquarebuffer);
+  csumandsquarebuffer = NULL;
 
-return 0;
-}				// int main(...)
+  free (chsumaccumulator_norm);
+  chsumaccumulator_norm = NULL;
+
+  free (chsumaccumulator_conv);
+  chsumaccumulator_conv = NULL;
+
+  free (thisWorkerArgs->argbuffer);
+  thisWorkerArgs->argbuffer = NULL;
+  // the memory pointed to by this pointer is freed in main
+  // it is the same memory for all worker
+  // but it is necessary to set pointer to NULL otherwise free will not work later (really?)
+  thisWorkerArgs->chconf = NULL;
+  pthread_exit (0);
+
+}				//worker_function
 
 
 
 
 
+		/* The following is to experiment with integration of Dolby DI with Leq(M) with gating like LKFS */
+
 void *
-worker_function (void *argstruct)
+worker_function_gated2 (void *argstruct)
 {
 
   struct WorkerArgs *thisWorkerArgs = (struct WorkerArgs *) argstruct;
@@ -4322,6 +8259,7 @@ worker_function (void *argstruct)
   double *chsumaccumulator_conv;
 
   int copy_stepcounter;
+  int copy_stepcounter_leqmdi;
 
   sumandsquarebuffer =
     malloc (sizeof (double) *
@@ -4351,9 +8289,11 @@ worker_function (void *argstruct)
     }
 
 
+
   for (int ch = 0; ch < thisWorkerArgs->nch; ch++)
     {
 
+
       if (thisWorkerArgs->lkfsflag)
 	{
 
@@ -4364,6 +8304,19 @@ worker_function (void *argstruct)
 	    thisWorkerArgs->worker_id * thisWorkerArgs->lg_ctx->subdivs;
 
 	}
+      if (thisWorkerArgs->leqmdiflag)
+	{
+
+
+	  copy_stepcounter_leqmdi =
+	    thisWorkerArgs->pthread_iteration * thisWorkerArgs->ncpus *
+	    thisWorkerArgs->lg_ctx_leqmdi->subdivs +
+	    thisWorkerArgs->worker_id *
+	    thisWorkerArgs->lg_ctx_leqmdi->subdivs;
+
+	}
+
+
 
       double *normalizedbuffer;
       double *convolvedbuffer;
@@ -4378,6 +8331,14 @@ worker_function (void *argstruct)
 		(thisWorkerArgs->nsamples / thisWorkerArgs->nch));
 
 
+
+
+
+
+
+
+
+
       for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
 	   n += thisWorkerArgs->nch, m++)
 	{
@@ -4385,33 +8346,103 @@ worker_function (void *argstruct)
 	  //so not normalized but calibrated
 	  normalizedbuffer[m] = thisWorkerArgs->argbuffer[n] * thisWorkerArgs->chconf[ch];	//this scale amplitude according to specified calibration
 
-	}
 
-      if (thisWorkerArgs->lkfsflag)
-	{
+	}
+
+
+      /* lkfs */
+
+
+      if (thisWorkerArgs->lkfsflag)
+	{
+
+	  //this is quite an interesting solution because so one avoids to read thisWorkerArgs->lg_ctx->stepcounter and consequently to devise strategies to mantain seriality of reading, which is quite difficult
+	  //on the contrary it will not be necessary to have any particular precaution writing
+
+
+
+
+	  for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
+	       n += thisWorkerArgs->nch, m++)
+	    {
+
+
+
+	      //populate bufferA -- deinterleave
+	      thisWorkerArgs->lg_buffers->bufferA[m] = thisWorkerArgs->argbuffer[n];	//
+	    }
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+	  if (copy_stepcounter == 0)
+	    {			//this is problematic because lg_ctx is accessed by all threads / duplicate in lg_buffers outside the thread (before launching the thread)
+	      //for (int n=ch, m= 0; n < thisWorkerArgs->nsamples; n += thisWorkerArgs->nch, m++) {
+	      //for (int i=0; i < thisWorkerArgs->lg_ctx->gblocksize; i++) {
+	      for (int i = 0;
+		   i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
+		{		//this is for the case that gblocksize is incomplete like at the end of a file
+		  thisWorkerArgs->lg_buffers->bufferB[i] = 0.0;	//This is for the first level gate block
+		}
+	    }
+	  else
+	    {
+	      //MUTEX SHOULDN'T BE NEEDED AT THIS POINT - also copy no more needed, but deinterleaving of channels
+
+
+	      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
+		   n += thisWorkerArgs->nch, m++)
+		{
+		  thisWorkerArgs->lg_buffers->bufferB[m] =
+		    thisWorkerArgs->lg_ctx->oldBufferBackup[thisWorkerArgs->
+							    worker_id][n];
+		}
+
+	    }
+
+	}			/*  <--   if (thisWorkerArgs->lkfsflag) */
+
 
-	  //this is quite an interesting solution because so one avoids to read thisWorkerArgs->lg_ctx->stepcounter and consequently to devise strategies to mantain seriality of reading, which is quite difficult
-	  //on the contrary it will not be necessary to have any particular precaution writing
+#ifdef DI
+
+      /* START DOLBYDILEQM  BLOCK */
 
+      if (thisWorkerArgs->leqmdiflag)
+	{
 
 	  for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
 	       n += thisWorkerArgs->nch, m++)
 	    {
 	      //populate bufferA -- deinterleave
-	      thisWorkerArgs->lg_buffers->bufferA[m] = thisWorkerArgs->argbuffer[n];	//
+	      thisWorkerArgs->lg_buffers_leqmdi->bufferA[m] = thisWorkerArgs->argbuffer[n];	//
 	    }
 
 
 
 
-	  if (copy_stepcounter == 0)
-	    {
+
+	  if (copy_stepcounter_leqmdi == 0)
+	    {			//this is problematic because lg_ctx is accessed by all threads / duplicate in lg_buffers outside the thread (before launching the thread)
 	      //for (int n=ch, m= 0; n < thisWorkerArgs->nsamples; n += thisWorkerArgs->nch, m++) {
 	      //for (int i=0; i < thisWorkerArgs->lg_ctx->gblocksize; i++) {
 	      for (int i = 0;
 		   i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
 		{		//this is for the case that gblocksize is incomplete like at the end of a file
-		  thisWorkerArgs->lg_buffers->bufferB[i] = 0.0;	//This is for the first level gate block
+		  thisWorkerArgs->lg_buffers_leqmdi->bufferB[i] = 0.0;	//This is for the first level gate block
 		}
 	    }
 	  else
@@ -4423,15 +8454,17 @@ worker_function (void *argstruct)
 	      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
 		   n += thisWorkerArgs->nch, m++)
 		{
-		  thisWorkerArgs->lg_buffers->bufferB[m] =
-		    thisWorkerArgs->lg_ctx->oldBufferBackup[thisWorkerArgs->
-							    worker_id][n];
-
+		  thisWorkerArgs->lg_buffers_leqmdi->bufferB[m] =
+		    thisWorkerArgs->lg_ctx_leqmdi->
+		    oldBufferBackup[thisWorkerArgs->worker_id][n];
 		}
-
 	    }
 
-	}			/*  <--   if (thisWorkerArgs->lkfsflag) */
+	}			/*  <--   if (thisWorkerArgs->leqmdiflag) */
+
+      /* DOLBYDILEQM INSERT TIL HERE */
+
+#endif
 
 
 
@@ -4449,6 +8482,12 @@ worker_function (void *argstruct)
 
 	      pt_buffer = thisWorkerArgs->lg_buffers->bufferA;
 
+	    }
+	  else if (thisWorkerArgs->leqmdiflag)
+	    {
+
+	      pt_buffer = thisWorkerArgs->lg_buffers_leqmdi->bufferA;
+
 	    }
 	  else
 	    {
@@ -4468,21 +8507,28 @@ worker_function (void *argstruct)
 	  double temp_truepeak = thisWorkerArgs->truepeak->vector[ch];
 	  pthread_mutex_unlock (&mutex);
 
+	  int peakframe = -1;
 	  temp_truepeak =
 	    truepeakcheck (pt_buffer,
 			   thisWorkerArgs->nsamples / thisWorkerArgs->nch,
 			   temp_truepeak,
 			   thisWorkerArgs->truepeak->oversampling_ratio,
 			   thisWorkerArgs->truepeak->filtertaps,
-			   thisWorkerArgs->truepeak->filter_coeffs);
+			   thisWorkerArgs->truepeak->filter_coeffs,
+			   &peakframe);
 
 
 	  pthread_mutex_lock (&mutex);
-	  thisWorkerArgs->truepeak->vector[ch] = max (temp_truepeak, thisWorkerArgs->truepeak->vector[ch]);	//THIS CORRECTION IS NOT ENOUGH that is use max() againt actual value should be enough to prevent concurrency of threads. The other possibility (not yet implemented) would be to have a vector of true peaks per thread per channel instead of a vector per channel.
+	  if (temp_truepeak > thisWorkerArgs->truepeak->vector[ch])	// compare againt actual value, another thread may have found a higher peak meanwhile
+	    {
+	      thisWorkerArgs->truepeak->vector[ch] = temp_truepeak;
+	      thisWorkerArgs->truepeak->position[ch] =
+		thisWorkerArgs->firstframe + peakframe;
+	    }
 	  pthread_mutex_unlock (&mutex);
 
 
-	  if (!thisWorkerArgs->lkfsflag)
+	  if (!(thisWorkerArgs->lkfsflag || thisWorkerArgs->leqmdiflag))
 	    {
 	      free (pt_buffer);
 	      pt_buffer = NULL;
@@ -4497,15 +8543,12 @@ worker_function (void *argstruct)
 
 
 
-
-
-
       if (thisWorkerArgs->polyflag == 1)
 	{
 	  //M_filter instead of convolution
-	  M_filter (convolvedbuffer, normalizedbuffer,
-		    thisWorkerArgs->nsamples / thisWorkerArgs->nch,
-		    thisWorkerArgs->sample_rate);
+	  weighting_filter (convolvedbuffer, normalizedbuffer,
+			    thisWorkerArgs->nsamples / thisWorkerArgs->nch,
+			    thisWorkerArgs->sample_rate);
 	}
       else
 	{
@@ -4522,11 +8565,62 @@ worker_function (void *argstruct)
 	       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
 
 
+      /* No more accumulating all channels, instead processing and storing results separately */
+
+
+      accumulatechenergy (thisWorkerArgs->chsum, ch, csumandsquarebuffer,
+			  thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+      if (thisWorkerArgs->chsumnw != NULL)
+	{
+	  accumulatechenergy (thisWorkerArgs->chsumnw, ch, sumandsquarebuffer,
+			      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->chdc != NULL)
+	{
+	  accumulatechdc (thisWorkerArgs->chdc, ch, thisWorkerArgs->argbuffer,
+			  thisWorkerArgs->nsamples, thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->clip != NULL)
+	{
+	  clipcheck (thisWorkerArgs->clip, thisWorkerArgs->bufferindex, ch,
+		     thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+		     thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->spectrum != NULL)
+	{
+	  accumulatespectrum (thisWorkerArgs->spectrum, ch,
+			      thisWorkerArgs->argbuffer,
+			      thisWorkerArgs->nsamples, thisWorkerArgs->nch);
+	}
+      if (!thisWorkerArgs->chexclude[ch])
+	{
+	  accumulatech (chsumaccumulator_norm, sumandsquarebuffer,
+			thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	  accumulatech (chsumaccumulator_conv, csumandsquarebuffer,
+			thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	}
+
+
+
+
+      //Create a function for this also a tag so that the worker know if he has to do this or not
+
+      //Why is this not present in worker_function? Because this is for each channel separately
+      if (thisWorkerArgs->leqmdiflag)
+	{
+
+	  thisWorkerArgs->sc_shorttermarray[ch][thisWorkerArgs->
+						shorttermindex] =
+	    sumandshorttermavrg (csumandsquarebuffer,
+				 thisWorkerArgs->nsamples /
+				 thisWorkerArgs->nch);
 
-      accumulatech (chsumaccumulator_norm, sumandsquarebuffer,
-		    thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-      accumulatech (chsumaccumulator_conv, csumandsquarebuffer,
-		    thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	}
+      /*
+         #ifdef DEBUG // this must be changed to print all channels
+         printf("%d: %.6f\n", thisWorkerArgs->shorttermindex, thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex]);
+         #endif
+       */
 
 
       free (normalizedbuffer);
@@ -4535,12 +8629,27 @@ worker_function (void *argstruct)
       free (convolvedbuffer);
       convolvedbuffer = NULL;
 
+
+      /* lkfs */
+
+
+      /* For LKFS according to ITU Standard:
+         "The measurement interval shall be constrained such that it ends at the end of a gating block.
+         Incomplete gating blocks at the end of the measurement interval are not used."
+
+         But especially when linking against ffmpeg only here I have the exact number of frames/samples.
+         So here I can have two cases: 1. nsamples / chs < stepi in this case nsamples should be discarded 
+         2. stepi < nsamples / chs < gblock in  this case I would have a complete gating block and it should go through the while
+       */
+
+
+      /* THIS BLOCK MUST BE DOUBLED BUT ALSO SHOULD BE DEPENDENT on switch */
       if (thisWorkerArgs->lkfsflag)
 	{
 
 	  int stepi = thisWorkerArgs->lg_ctx->ops;
 	  //internal copy of step_counter
-
+	  //copy_stepcounter = thisWorkerArgs->lg_ctx->stepcounter;
 	  //put together samples
 	  while (stepi <= thisWorkerArgs->nsamples / thisWorkerArgs->nch)
 	    {			//instead of thisWorkerArgs->lg_ctx->gblocksize for block less the gblocksize at the end of file
@@ -4593,10 +8702,10 @@ worker_function (void *argstruct)
 		msaccumulate (thisWorkerArgs->lg_buffers->bufferSwap,
 			      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
 
-	      //pthread_mutex_lock (&mutex); //THIS ALSO SHOULD NOT BE NECESSARY
+	      //pthread_mutex_lock (&mutex); //NOT NECESSARY ANYMORE
 	      // this should be done under mutex conditions -> shared resources!
 	      // assign provisional measure of leq (not yet gated)
-	      /*
+	     /* 
 	         #ifdef DEBUG
 	         printf
 	         ("LG block index: %d\t Channel: %d\t Sample sum: %.20f\n",
@@ -4610,226 +8719,267 @@ worker_function (void *argstruct)
 	    }			/* while(stepi <= LGCtx->gblocksize)  */
 
 
-
-
 	}			/* if (thisWorkerArgs->lkfsflag) */
 
 
+#ifdef DI
 
-    }				// loop through channels
-
-
-
-
-
-  if (thisWorkerArgs->lkfsflag)
-    {
-      /* following if is to avoid incrementing stepcounter in case there where not enough samples to fill a gating block */
-      if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) >=
-	  thisWorkerArgs->lg_ctx->ops)
+      /* LEQMDI INSERT 2 START HERE  */
+      if (thisWorkerArgs->leqmdiflag)
 	{
 
-	  pthread_mutex_lock (&mutex);
-
-	  if (copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs == 0)
-	    {
-	      thisWorkerArgs->lg_ctx->stepcounter +=
-		thisWorkerArgs->lg_ctx->subdivs;
-	    }
-	  else
-	    {
-	      thisWorkerArgs->lg_ctx->stepcounter +=
-		copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs;
-	    }
-
-
-
-	  pthread_mutex_unlock (&mutex);
-	}
-    }
-  //Create a function for this also a tag so that the worker know if he has to do this or not
-
-  if ((thisWorkerArgs->leqm10flag) || (thisWorkerArgs->leqmlogflag))
-    {
-      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex] =
-	sumandshorttermavrg (chsumaccumulator_conv,
-			     thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-#ifdef DEBUG
-      printf ("%d: %.6f\n", thisWorkerArgs->shorttermindex,
-	      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex]);
-#endif
-    }
-  pthread_mutex_lock (&mutex);
-  // this should be done under mutex conditions -> shared resources!
-  sumsamples (thisWorkerArgs->ptrtotsum, chsumaccumulator_norm,
-	      chsumaccumulator_conv,
-	      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-  pthread_mutex_unlock (&mutex);
-
-
-  free (sumandsquarebuffer);
-  sumandsquarebuffer = NULL;
-
-  free (csumandsquarebuffer);
-  csumandsquarebuffer = NULL;
-
-  free (chsumaccumulator_norm);
-  chsumaccumulator_norm = NULL;
-
-  free (chsumaccumulator_conv);
-  chsumaccumulator_conv = NULL;
-
-  free (thisWorkerArgs->argbuffer);
-  thisWorkerArgs->argbuffer = NULL;
-  // the memory pointed to by this pointer is freed in main
-  // it is the same memory for all worker
-  // but it is necessary to set pointer to NULL otherwise free will not work later (really?)
-  thisWorkerArgs->chconf = NULL;
-  pthread_exit (0);
-
-}				//worker_function
-
-
-
-
-
-		/* The following is to experiment with integration of Dolby DI with Leq(M) with gating like LKFS */
-
-void *
-worker_function_gated2 (void *argstruct)
-{
-
-  struct WorkerArgs *thisWorkerArgs = (struct WorkerArgs *) argstruct;
-
-  double *sumandsquarebuffer;
-  double *csumandsquarebuffer;
-  double *chsumaccumulator_norm;
-  double *chsumaccumulator_conv;
+	  int stepi = thisWorkerArgs->lg_ctx_leqmdi->ops;
+	  //internal copy of step_counter
+	  //copy_stepcounter = thisWorkerArgs->lg_ctx_leqmdi->stepcounter;
+	  //put together samples
+	  while (stepi <= thisWorkerArgs->nsamples / thisWorkerArgs->nch)
+	    {			//instead of thisWorkerArgs->lg_ctx->gblocksize for block less the gblocksize at the end of file
 
-  int copy_stepcounter;
-  int copy_stepcounter_leqmdi;
+	      /* // Where should I put this?
 
-  sumandsquarebuffer =
-    malloc (sizeof (double) *
-	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
+	         if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi) < thisWorkerArgs->lg_ctx->ops)  { // pad buffer
 
+	         memcpy(thisWorkerArgs->lg_buffers->bufferLG, thisWorkerArgs->lg_buffers->bufferB + stepi, sizeof(double)*(thisWorkerArgs->lg_ctx->gblocksize - stepi)); //copy samples til boundary of bufferB
+	         memcpy(thisWorkerArgs->lg_buffers->bufferLG + thisWorkerArgs->lg_ctx->gblocksize - stepi, thisWorkerArgs->lg_buffers->bufferA, sizeof(double)*(thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi);
 
-  csumandsquarebuffer =
-    malloc (sizeof (double) *
-	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
+	         }
 
-  chsumaccumulator_norm =
-    malloc (sizeof (double) *
-	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
+	       */
+	      if (copy_stepcounter_leqmdi > 0)
+		{		//that must  not be the first gate block 
 
-  chsumaccumulator_conv =
-    malloc (sizeof (double) *
-	    (thisWorkerArgs->nsamples / thisWorkerArgs->nch));
+		  memcpy (thisWorkerArgs->lg_buffers_leqmdi->bufferLG, thisWorkerArgs->lg_buffers_leqmdi->bufferB + stepi, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//copy samples til boundary of bufferB
+		  memcpy (thisWorkerArgs->lg_buffers_leqmdi->bufferLG +
+			  thisWorkerArgs->nsamples / thisWorkerArgs->nch -
+			  stepi, thisWorkerArgs->lg_buffers_leqmdi->bufferA,
+			  sizeof (double) * stepi);
 
+		}
+	      else
+		{
 
+		  memcpy (thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
+			  thisWorkerArgs->lg_buffers_leqmdi->bufferA,
+			  sizeof (double) * stepi);
+		  memset (thisWorkerArgs->lg_buffers_leqmdi->bufferLG + stepi, 0, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//Check if this correct
 
-  for (int i = 0; i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
-    {
-      sumandsquarebuffer[i] = 0.0;
-      csumandsquarebuffer[i] = 0.0;
-      chsumaccumulator_norm[i] = 0.0;
-      chsumaccumulator_conv[i] = 0.0;
-    }
+		  //for the case this is the first ... but preferably another solution
+		}
 
+	      /*
 
+	         - SCALING ACCORDING TO M FILTER MUST BE ADDED
 
-  for (int ch = 0; ch < thisWorkerArgs->nch; ch++)
-    {
+	       */
 
 
-      if (thisWorkerArgs->lkfsflag)
-	{
+	      for (int i = 0;
+		   i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
 
+		{
+		  // use this for calibration depending on channel config for ex. chconf[6] = {1.0, 1.0, 1.0, 1.0, 0.707945784, 0.707945784} could be the default for 5.1 soundtracks
+		  //so not normalized but calibrated
+		  thisWorkerArgs->lg_buffers_leqmdi->bufferSwap[i] = thisWorkerArgs->lg_buffers_leqmdi->bufferLG[i] * thisWorkerArgs->chconf[ch];	//this scale amplitude according to specified calibration
 
-	  copy_stepcounter =
-	    thisWorkerArgs->pthread_iteration * thisWorkerArgs->ncpus *
-	    thisWorkerArgs->lg_ctx->subdivs +
-	    thisWorkerArgs->worker_id * thisWorkerArgs->lg_ctx->subdivs;
+		}
 
-	}
-      if (thisWorkerArgs->leqmdiflag)
-	{
 
 
-	  copy_stepcounter_leqmdi =
-	    thisWorkerArgs->pthread_iteration * thisWorkerArgs->ncpus *
-	    thisWorkerArgs->lg_ctx_leqmdi->subdivs +
-	    thisWorkerArgs->worker_id *
-	    thisWorkerArgs->lg_ctx_leqmdi->subdivs;
 
-	}
 
 
+	      if (thisWorkerArgs->polyflag == 1)
+		{
+		  //M_filter instead of convolution
+		  weighting_filter (thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
+				    thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
+				    thisWorkerArgs->nsamples /
+				    thisWorkerArgs->nch,
+				    thisWorkerArgs->sample_rate);
+		}
+	      else
+		{
+		  //convolution M ir
+		  convolv_buff (thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
+				thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
+				thisWorkerArgs->ir,
+				thisWorkerArgs->nsamples /
+				thisWorkerArgs->nch,
+				thisWorkerArgs->npoints * 2);
+		}
 
-      double *normalizedbuffer;
-      double *convolvedbuffer;
+	      rectify (thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
+		       thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
+		       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	      double tmp_sum =
+		msaccumulate (thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
+			      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+	      //pthread_mutex_lock (&mutex); //NO MORE NECESSARY
+	      // this should be done under mutex conditions -> shared resources!
+	      // assign provisional measure of leq (not yet gated)
+	     /* 
+	         #ifdef DEBUG
+	         printf
+	         ("LG Leq(M,DI) block index: %d\t Channel: %d\t Sample sum: %.20f\n",
+	         copy_stepcounter_leqmdi, ch, tmp_sum);
+	         #endif
+	       */
+	      thisWorkerArgs->lg_ctx_leqmdi->LGresultarray[ch][thisWorkerArgs->shorttermindex][copy_stepcounter_leqmdi % thisWorkerArgs->lg_ctx_leqmdi->subdivs] = tmp_sum;	//<- if below relative threshold, but postpone gating for the finale calculation
+	      //pthread_mutex_unlock (&mutex);
+	      copy_stepcounter_leqmdi++;
+	      stepi += thisWorkerArgs->lg_ctx_leqmdi->ops;
+	    }			/* while(stepi <= LGCtx->gblocksize)  */
 
 
-      normalizedbuffer =
-	malloc (sizeof (double) *
-		(thisWorkerArgs->nsamples / thisWorkerArgs->nch));
+	}			/* if (thisWorkerArgs->leqmdiflag) */
 
-      convolvedbuffer =
-	malloc (sizeof (double) *
-		(thisWorkerArgs->nsamples / thisWorkerArgs->nch));
+      /* END LEQMDI INSERT */
+#endif
 
+    }				// loop through channels
 
 
 
+  if (thisWorkerArgs->lkfsflag)
+    {
+      /* following if is to avoid incrementing stepcounter in case there where not enough samples to fill a gating block */
+      if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) >=
+	  thisWorkerArgs->lg_ctx->ops)
+	{
+	  pthread_mutex_lock (&mutex);
+	  if (copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs == 0)
+	    {
+	      thisWorkerArgs->lg_ctx->stepcounter +=
+		thisWorkerArgs->lg_ctx->subdivs;
+	    }
+	  else
+	    {
+	      thisWorkerArgs->lg_ctx->stepcounter +=
+		copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs;
+	    }
 
+	  pthread_mutex_unlock (&mutex);
+	}
+    }
 
 
+  /* LEQMDI INSERT 3 */
 
 
+#ifdef DI
 
-      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
-	   n += thisWorkerArgs->nch, m++)
+  if (thisWorkerArgs->leqmdiflag)
+    {
+      /* following if is to avoid incrementing stepcounter in case there where not enough samples to fill a gating block */
+      if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) >=
+	  thisWorkerArgs->lg_ctx_leqmdi->ops)
 	{
-	  // use this for calibration depending on channel config for ex. chconf[6] = {1.0, 1.0, 1.0, 1.0, 0.707945784, 0.707945784} could be the default for 5.1 soundtracks
-	  //so not normalized but calibrated
-	  normalizedbuffer[m] = thisWorkerArgs->argbuffer[n] * thisWorkerArgs->chconf[ch];	//this scale amplitude according to specified calibration
-
+	  pthread_mutex_lock (&mutex);
+	  if (copy_stepcounter_leqmdi %
+	      thisWorkerArgs->lg_ctx_leqmdi->subdivs == 0)
+	    {
+	      thisWorkerArgs->lg_ctx_leqmdi->stepcounter +=
+		thisWorkerArgs->lg_ctx_leqmdi->subdivs;
+	    }
+	  else
+	    {
+	      thisWorkerArgs->lg_ctx_leqmdi->stepcounter +=
+		copy_stepcounter_leqmdi %
+		thisWorkerArgs->lg_ctx_leqmdi->subdivs;
+	    }
 
+	  pthread_mutex_unlock (&mutex);
 	}
+    }
 
 
-      /* lkfs */
+  /* END LEQMDI INSERT 3 */
+#endif
 
 
-      if (thisWorkerArgs->lkfsflag)
-	{
 
-	  //this is quite an interesting solution because so one avoids to read thisWorkerArgs->lg_ctx->stepcounter and consequently to devise strategies to mantain seriality of reading, which is quite difficult
-	  //on the contrary it will not be necessary to have any particular precaution writing
 
 
 
+  if ((thisWorkerArgs->leqm10flag) || (thisWorkerArgs->leqmlogflag)
+      || (thisWorkerArgs->shorttermflag))
+    {
+      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex] =
+	sumandshorttermavrg (chsumaccumulator_conv,
+			     thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+      if (thisWorkerArgs->shorttermnwarray != NULL)
+	{
+	  thisWorkerArgs->shorttermnwarray[thisWorkerArgs->shorttermindex] =
+	    sumandshorttermavrg (chsumaccumulator_norm,
+				 thisWorkerArgs->nsamples /
+				 thisWorkerArgs->nch);
+	}
+      if (thisWorkerArgs->speech != NULL)
+	{
+	  thisWorkerArgs->speech[thisWorkerArgs->shorttermindex] =
+	    speechcheck (thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+			 thisWorkerArgs->nch, thisWorkerArgs->sample_rate);
+	}
+      if (thisWorkerArgs->correlation != NULL)
+	{
+	  thisWorkerArgs->correlation[thisWorkerArgs->shorttermindex] =
+	    stereocorrelation (thisWorkerArgs->argbuffer,
+			       thisWorkerArgs->nsamples);
+	}
+      if (thisWorkerArgs->silence != NULL)
+	{
+	  thisWorkerArgs->silence[thisWorkerArgs->shorttermindex] =
+	    silencecheck (thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+			  thisWorkerArgs->silencethreshold);
+	}
+      if (thisWorkerArgs->tone != NULL)
+	{
+	  thisWorkerArgs->tone[thisWorkerArgs->shorttermindex] =
+	    tonecheck (thisWorkerArgs->argbuffer, thisWorkerArgs->nsamples,
+		       thisWorkerArgs->nch, thisWorkerArgs->sample_rate);
+	}
+#ifdef DEBUG
+      printf ("%d: %.6f\n", thisWorkerArgs->shorttermindex,
+	      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex]);
+#endif
+    }
 
-	  for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
-	       n += thisWorkerArgs->nch, m++)
-	    {
 
 
 
-	      //populate bufferA -- deinterleave
-	      thisWorkerArgs->lg_buffers->bufferA[m] = thisWorkerArgs->argbuffer[n];	//
-	    }
 
 
 
 
+  pthread_mutex_lock (&mutex);
+  // this should be done under mutex conditions -> shared resources!
+  sumsamples (thisWorkerArgs->ptrtotsum, chsumaccumulator_norm,
+	      chsumaccumulator_conv,
+	      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+  pthread_mutex_unlock (&mutex);
 
 
+  free (sumandsquarebuffer);
+  sumandsquarebuffer = NULL;
 
+  free (csumandsquarebuffer);
+  csumandsquarebuffer = NULL;
 
+  free (chsumaccumulator_norm);
+  chsumaccumulator_norm = NULL;
 
+  free (chsumaccumulator_conv);
+  chsumaccumulator_conv = NULL;
 
+  free (thisWorkerArgs->argbuffer);
+  thisWorkerArgs->argbuffer = NULL;
+  // the memory pointed to by this pointer is freed in main
+  // it is the same memory for all worker
+  // but it is necessary to set pointer to NULL otherwise free will not work later (really?)
+  thisWorkerArgs->chconf = NULL;
+  pthread_exit (0);
 
+}				//worker_function_gated2
 
 
 
@@ -4837,868 +8987,2481 @@ worker_function_gated2 (void *argstruct)
 
 
 
-	  if (copy_stepcounter == 0)
-	    {			//this is problematic because lg_ctx is accessed by all threads / duplicate in lg_buffers outside the thread (before launching the thread)
-	      //for (int n=ch, m= 0; n < thisWorkerArgs->nsamples; n += thisWorkerArgs->nch, m++) {
-	      //for (int i=0; i < thisWorkerArgs->lg_ctx->gblocksize; i++) {
-	      for (int i = 0;
-		   i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
-		{		//this is for the case that gblocksize is incomplete like at the end of a file
-		  thisWorkerArgs->lg_buffers->bufferB[i] = 0.0;	//This is for the first level gate block
-		}
-	    }
-	  else
-	    {
-	      //MUTEX SHOULDN'T BE NEEDED AT THIS POINT - also copy no more needed, but deinterleaving of channels
+#ifdef FFMPEG
+int
+transfer_decoded_data (AVFrame * ptr_frame,
+		       struct WorkerArgs **dptrWorkerArgs, int w_id,
+		       AVCodecContext * codecCon)
+{
+  int doublesample_index = 0;	//this is to index the millisecond buffer of the worker
+  for (int ch_index = 0; ch_index < ptr_frame->channels; ch_index++)
+    {
 
+      for (int smpl_index = 0; smpl_index < ptr_frame->nb_samples;
+	   smpl_index++)
+	{			//limit to buffer measure and return rest?
 
-	      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
-		   n += thisWorkerArgs->nch, m++)
-		{
-		  thisWorkerArgs->lg_buffers->bufferB[m] =
-		    thisWorkerArgs->lg_ctx->oldBufferBackup[thisWorkerArgs->
-							    worker_id][n];
-		}
+	  dptrWorkerArgs[w_id]->argbuffer[doublesample_index++] =
+	    get (ptr_frame->data, ch_index, smpl_index, ptr_frame->channels,
+		 codecCon->sample_fmt);
+	  // end print samples 
+	}			//for nb_samples
+    }				//for channels
+  return ptr_frame->nb_samples;
+}
 
+						// will return 0 or the index of next to be copied sample, if not enough room in buffer
+int
+transfer_decoded_samples (AVFrame * ptr_frame, double *buf,
+			  AVCodecContext * codecCon, int buffersizs,
+			  int *doublesample_index)
+{
+  // static int doublesample_index = 0; //this is to index the millisecond buffer of the worker
+  //Yes the sample loop must be the external one, as I work with interleaved channels, not planar channels
+  for (int smpl_index = 0; smpl_index < ptr_frame->nb_samples; smpl_index++)
+    {				//limit to buffer measure and return rest?
+      for (int ch_index = 0; ch_index < ptr_frame->channels; ch_index++)
+	{
+	  buf[(*doublesample_index)++] =
+	    get (ptr_frame->data, ch_index, smpl_index, ptr_frame->channels,
+		 codecCon->sample_fmt);
+	  /*
+	     #ifdef DEBUG
+	     printf("%0.5f\n", buf[(*doublesample_index)-1]);
+	     #endif
+	   */
+	  if ((*doublesample_index) == buffersizs)
+	    {
+	      (*doublesample_index) = 0;
+	      //return (ptr_frame->nb_samples - smpl_index) * ptr_frame->channels;
+	      return smpl_index + 1;
 	    }
+	  // end print samples 
+	}			//for nb_samples
+    }				//for channels
+  return ptr_frame->nb_samples;
+}
 
-	}			/*  <--   if (thisWorkerArgs->lkfsflag) */
 
+int
+transfer_remaining_decoded_samples (AVFrame * ptr_frame, double *bufremain,
+				    AVCodecContext * codecCon, int nxtsmpl,
+				    int *doublesample_index)
+{
+  //int doublesample_index = 0; //this is to index the millisecond buffer of the worker
+  //Yes the sample loop must be the external one, as I work with interleaved channels, not planar channels
+  for (int smpl_index = nxtsmpl; smpl_index < ptr_frame->nb_samples;
+       smpl_index++)
+    {				//limit to buffer measure and return rest?
+      for (int ch_index = 0; ch_index < ptr_frame->channels; ch_index++)
+	{
+	  bufremain[(*doublesample_index)++] =
+	    get (ptr_frame->data, ch_index, smpl_index, ptr_frame->channels,
+		 codecCon->sample_fmt);
+	  /*
+	     #ifdef DEBUG
+	     printf("%0.5f\n", bufremain[(*doublesample_index)-1]);
+	     #endif                     
+	   */
+	  // end print samples 
+	}			//for nb_samples
+    }				//for channels
+  return (ptr_frame->nb_samples) - nxtsmpl;	//but what if also the second round at the same frame fill the buffer?
+}
 
-#ifdef DI
+// Drop the samples of the frame outside [startframe, endframe) by moving
+// the data pointers, returns the samples left
+int
+trim_frame (AVFrame * ptr_frame, AVCodecContext * codecCon,
+	    long long *position, long long startframe, long long endframe)
+{
+  long long first = *position;
+  long long last = first + ptr_frame->nb_samples;
+  *position = last;
+  if (first >= startframe && (endframe < 0 || last <= endframe))
+    return ptr_frame->nb_samples;
+  long long keepfirst = first > startframe ? first : startframe;
+  long long keeplast = (endframe >= 0 && last > endframe) ? endframe : last;
+  if (keeplast <= keepfirst)
+    {
+      ptr_frame->nb_samples = 0;
+      return 0;
+    }
+  int skip = (int) (keepfirst - first);
+  int bytes = av_get_bytes_per_sample (codecCon->sample_fmt);
+  if (av_sample_fmt_is_planar (codecCon->sample_fmt))
+    {
+      for (int ch = 0; ch < ptr_frame->channels && ch < AV_NUM_DATA_POINTERS;
+	   ch++)
+	ptr_frame->data[ch] += skip * bytes;
+    }
+  else
+    {
+      ptr_frame->data[0] += skip * bytes * ptr_frame->channels;
+    }
+  ptr_frame->nb_samples = (int) (keeplast - keepfirst);
+  return ptr_frame->nb_samples;
+}
 
-      /* START DOLBYDILEQM  BLOCK */
+// Open the files as one stream with the concat demuxer, it reads the
+// temporary ffconcat list while opening
+int
+open_concat_input (AVFormatContext ** ctx, const char *first,
+		   const char **files, int nfiles, const double *entries,
+		   const double *lengths)
+{
+#ifdef _WIN32
+  char listdir[MAX_PATH];
+  char listpath[MAX_PATH];
+  FILE *list = NULL;
+  if (GetTempPathA (MAX_PATH, listdir) != 0
+      && GetTempFileNameA (listdir, "lqm", 0, listpath) != 0)
+    list = fopen (listpath, "w");
+#else
+  char listpath[] = "/tmp/leqm-nrt-concat-XXXXXX";
+  int listfd = mkstemp (listpath);
+  FILE *list = listfd >= 0 ? fdopen (listfd, "w") : NULL;
+#endif
+  AVDictionary *options = NULL;
+  int result;
 
-      if (thisWorkerArgs->leqmdiflag)
+  if (list == NULL)
+    {
+      printf ("Could not write the list of files to concatenate.\n");
+      return -1;
+    }
+  fprintf (list, "ffconcat version 1.0\n");
+  for (int i = 0; i <= nfiles; i++)
+    {
+      // paths in the list are relative to the list itself
+      char *path = realpath (i == 0 ? first : files[i - 1], NULL);
+      if (path == NULL)
 	{
+	  printf ("Could not find %s.\n", i == 0 ? first : files[i - 1]);
+	  fclose (list);
+	  remove (listpath);
+	  return -1;
+	}
+      fprintf (list, "file '");
+      for (char *pt = path; *pt != '\0'; pt++)
+	{
+	  if (*pt == '\'')
+	    fprintf (list, "'\\''");
+	  else
+	    fputc (*pt, list);
+	}
+      fprintf (list, "'\n");
+      // the range played of a DCP reel or IMF resource
+      if (entries[i] > 0.0)
+	fprintf (list, "inpoint %.6f\n", entries[i]);
+      if (lengths[i] > 0.0)
+	fprintf (list, "outpoint %.6f\n", entries[i] + lengths[i]);
+      free (path);
+    }
+  fclose (list);
+  av_dict_set (&options, "safe", "0", 0);
+  result =
+    avformat_open_input (ctx, listpath, av_find_input_format ("concat"),
+			 &options);
+  av_dict_free (&options);
+  remove (listpath);
+  return result;
+}
 
-	  for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
-	       n += thisWorkerArgs->nch, m++)
-	    {
-	      //populate bufferA -- deinterleave
-	      thisWorkerArgs->lg_buffers_leqmdi->bufferA[m] = thisWorkerArgs->argbuffer[n];	//
-	    }
-
+// Cinema names of the channels from the channel layout, surrounds are Ls
+// and Rs unless there are both side and back pairs (7.1).
+void
+channel_names (AVCodecContext * codecCon, const char **names)
+{
+  uint64_t layout = codecCon->channel_layout;
+  int sideandback;
 
+  if (layout == 0)
+    {
+      default_channel_names (names, codecCon->channels);
+      return;
+    }
+  sideandback = (layout & AV_CH_SIDE_LEFT) && (layout & AV_CH_BACK_LEFT);
+  for (int i = 0; i < codecCon->channels; i++)
+    {
+      uint64_t channel = av_channel_layout_extract_channel (layout, i);
+      if (channel == AV_CH_FRONT_LEFT)
+	names[i] = "L";
+      else if (channel == AV_CH_FRONT_RIGHT)
+	names[i] = "R";
+      else if (channel == AV_CH_FRONT_CENTER)
+	names[i] = "C";
+      else if (channel == AV_CH_LOW_FREQUENCY)
+	names[i] = "LFE";
+      else if (channel == AV_CH_SIDE_LEFT)
+	names[i] = "Ls";
+      else if (channel == AV_CH_SIDE_RIGHT)
+	names[i] = "Rs";
+      else if (channel == AV_CH_BACK_LEFT)
+	names[i] = sideandback ? "Lrs" : "Ls";
+      else if (channel == AV_CH_BACK_RIGHT)
+	names[i] = sideandback ? "Rrs" : "Rs";
+      else if (channel == AV_CH_BACK_CENTER)
+	names[i] = "Cs";
+      else if (channel == AV_CH_FRONT_LEFT_OF_CENTER)
+	names[i] = "Lc";
+      else if (channel == AV_CH_FRONT_RIGHT_OF_CENTER)
+	names[i] = "Rc";
+      else
+	names[i] = av_get_channel_name (channel);
+    }
+}
 
+// Duration in seconds of the best audio stream, -1 if unknown
+double
+probe_audio (const char *path, int *samplerate, int *channels)
+{
+  AVFormatContext *ctx = NULL;
+  double duration = -1.0;
 
+  if (avformat_open_input (&ctx, path, NULL, NULL) != 0)
+    return -1.0;
+  if (avformat_find_stream_info (ctx, NULL) >= 0)
+    {
+      int streamindex =
+	av_find_best_stream (ctx, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0);
+      if (streamindex >= 0)
+	{
+	  AVStream *stream = ctx->streams[streamindex];
+	  *samplerate = stream->codecpar->sample_rate;
+	  *channels = stream->codecpar->channels;
+	  if (stream->duration != AV_NOPTS_VALUE)
+	    duration = stream->duration * av_q2d (stream->time_base);
+	  else if (ctx->duration != AV_NOPTS_VALUE)
+	    duration = ctx->duration / (double) AV_TIME_BASE;
+	}
+    }
+  avformat_close_input (&ctx);
+  return duration;
+}
 
-	  if (copy_stepcounter_leqmdi == 0)
-	    {			//this is problematic because lg_ctx is accessed by all threads / duplicate in lg_buffers outside the thread (before launching the thread)
-	      //for (int n=ch, m= 0; n < thisWorkerArgs->nsamples; n += thisWorkerArgs->nch, m++) {
-	      //for (int i=0; i < thisWorkerArgs->lg_ctx->gblocksize; i++) {
-	      for (int i = 0;
-		   i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
-		{		//this is for the case that gblocksize is incomplete like at the end of a file
-		  thisWorkerArgs->lg_buffers_leqmdi->bufferB[i] = 0.0;	//This is for the first level gate block
+// Dialnorm in dB (-1 to -31) of the first AC-3 or E-AC-3 syncframe of a
+// stream, from its bit stream information, 0 if none is found
+int
+ac3_dialnorm (const char *path, int streamindex)
+{
+  AVFormatContext *ctx = NULL;
+  AVPacket packet;
+  int dialnorm = 0;
+  int npackets = 0;
+
+  if (is_pipe (path) || avformat_open_input (&ctx, path, NULL, NULL) != 0)
+    return 0;
+  av_init_packet (&packet);
+  while (dialnorm == 0 && npackets < 100
+	 && av_read_frame (ctx, &packet) == 0)
+    {
+      if (packet.stream_index == streamindex)
+	{
+	  npackets++;
+	  for (int i = 0; i + 8 < packet.size; i++)
+	    {
+	      const uint8_t *b = packet.data + i;
+	      int bsid, value;
+	      if (b[0] != 0x0B || b[1] != 0x77)
+		continue;
+	      bsid = b[5] >> 3;
+	      if (bsid <= 10)
+		{
+		  // crc1, fscod, frmsizecod, bsid, bsmod, then acmod and
+		  // the mix levels it implies before lfeon and dialnorm
+		  int acmod = b[6] >> 5;
+		  int bit = 51;
+		  if ((acmod & 1) && acmod != 1)
+		    bit += 2;
+		  if (acmod & 4)
+		    bit += 2;
+		  if (acmod == 2)
+		    bit += 2;
+		  bit++;
+		  value = ((b[bit / 8] << 8 | b[bit / 8 + 1])
+			   >> (11 - bit % 8)) & 0x1F;
 		}
+	      else if (bsid <= 16)
+		// E-AC-3: dialnorm follows bsid
+		value = ((b[5] << 8 | b[6]) >> 6) & 0x1F;
+	      else
+		continue;
+	      // 0 is reserved and read as -31 dB
+	      dialnorm = value == 0 ? -31 : -value;
+	      break;
 	    }
-	  else
-	    {
+	}
+      av_packet_unref (&packet);
+    }
+  avformat_close_input (&ctx);
+  return dialnorm;
+}
 
-	      //MUTEX SHOULDN'T BE NEEDED AT THIS POINT - also copy no more needed, but deinterleaving of channels
+#elif defined SNDFILELIB
 
+// sf_read_double over the files of the program (more than one with
+// --concat, a buffer can span two of them), limited to the frames of the
+// measured range and to the frames left in each file (fileframes, NULL
+// for whole files)
+sf_count_t
+read_program (SNDFILE ** files, sf_count_t * fileframes, int nfiles,
+	      int *current, double *buf, sf_count_t items, int nch,
+	      sf_count_t * framesleft)
+{
+  sf_count_t itemsread = 0;
 
-	      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
-		   n += thisWorkerArgs->nch, m++)
-		{
-		  thisWorkerArgs->lg_buffers_leqmdi->bufferB[m] =
-		    thisWorkerArgs->lg_ctx_leqmdi->
-		    oldBufferBackup[thisWorkerArgs->worker_id][n];
-		}
-	    }
+  if (items > *framesleft * nch)
+    items = *framesleft * nch;
+  while (itemsread < items && *current < nfiles)
+    {
+      sf_count_t wanted = items - itemsread;
+      sf_count_t n;
+      if (fileframes != NULL && wanted > fileframes[*current] * nch)
+	wanted = fileframes[*current] * nch;
+      n = sf_read_double (files[*current], buf + itemsread, wanted);
+      if (fileframes != NULL)
+	fileframes[*current] -= n / nch;
+      itemsread += n;
+      if (itemsread < items)
+	(*current)++;
+    }
+  *framesleft -= itemsread / nch;
+  return itemsread;
+}
 
-	}			/*  <--   if (thisWorkerArgs->leqmdiflag) */
+// Cinema names of the channels from the channel map (WAVEFORMATEXTENSIBLE
+// mask, CAF layout...), surrounds are Ls and Rs unless there are both
+// side and rear pairs (7.1).
+void
+channel_names (SNDFILE * file, int nchannels, const char **names)
+{
+  int *map = calloc (nchannels, sizeof (int));
+  int side = 0, rear = 0;
 
-      /* DOLBYDILEQM INSERT TIL HERE */
+  if (sf_command (file, SFC_GET_CHANNEL_MAP_INFO, map,
+		  sizeof (int) * nchannels) != SF_TRUE)
+    {
+      free (map);
+      default_channel_names (names, nchannels);
+      return;
+    }
+  for (int i = 0; i < nchannels; i++)
+    {
+      side |= (map[i] == SF_CHANNEL_MAP_SIDE_LEFT);
+      rear |= (map[i] == SF_CHANNEL_MAP_REAR_LEFT);
+    }
+  for (int i = 0; i < nchannels; i++)
+    {
+      switch (map[i])
+	{
+	case SF_CHANNEL_MAP_MONO:
+	  names[i] = "M";
+	  break;
+	case SF_CHANNEL_MAP_LEFT:
+	case SF_CHANNEL_MAP_FRONT_LEFT:
+	  names[i] = "L";
+	  break;
+	case SF_CHANNEL_MAP_RIGHT:
+	case SF_CHANNEL_MAP_FRONT_RIGHT:
+	  names[i] = "R";
+	  break;
+	case SF_CHANNEL_MAP_CENTER:
+	case SF_CHANNEL_MAP_FRONT_CENTER:
+	  names[i] = "C";
+	  break;
+	case SF_CHANNEL_MAP_LFE:
+	  names[i] = "LFE";
+	  break;
+	case SF_CHANNEL_MAP_SIDE_LEFT:
+	  names[i] = "Ls";
+	  break;
+	case SF_CHANNEL_MAP_SIDE_RIGHT:
+	  names[i] = "Rs";
+	  break;
+	case SF_CHANNEL_MAP_REAR_LEFT:
+	  names[i] = (side && rear) ? "Lrs" : "Ls";
+	  break;
+	case SF_CHANNEL_MAP_REAR_RIGHT:
+	  names[i] = (side && rear) ? "Rrs" : "Rs";
+	  break;
+	case SF_CHANNEL_MAP_REAR_CENTER:
+	  names[i] = "Cs";
+	  break;
+	case SF_CHANNEL_MAP_FRONT_LEFT_OF_CENTER:
+	  names[i] = "Lc";
+	  break;
+	case SF_CHANNEL_MAP_FRONT_RIGHT_OF_CENTER:
+	  names[i] = "Rc";
+	  break;
+	default:
+	  names[i] = NULL;
+	  break;
+	}
+    }
+  free (map);
+}
 
-#endif
+// BW64 (ITU-R BS.2088) is RF64 with another id, which libsndfile does not
+// recognise, so the file is read through virtual io that shows "RF64" in
+// place of the first four bytes. The stream is released at exit.
+static sf_count_t
+bw64_filelen (void *user_data)
+{
+  FILE *f = user_data;
+  off_t pos = ftello (f);
+  fseeko (f, 0, SEEK_END);
+  off_t len = ftello (f);
+  fseeko (f, pos, SEEK_SET);
+  return len;
+}
+
+static sf_count_t
+bw64_seek (sf_count_t offset, int whence, void *user_data)
+{
+  FILE *f = user_data;
+  if (fseeko (f, offset, whence) != 0)
+    return -1;
+  return ftello (f);
+}
 
+static sf_count_t
+bw64_read (void *ptr, sf_count_t count, void *user_data)
+{
+  FILE *f = user_data;
+  off_t pos = ftello (f);
+  sf_count_t n = fread (ptr, 1, count, f);
+  for (off_t i = pos; i < 4 && i < pos + n; i++)
+    ((char *) ptr)[i - pos] = "RF64"[i];
+  return n;
+}
 
+static sf_count_t
+bw64_write (const void *ptr, sf_count_t count, void *user_data)
+{
+  return 0;
+}
 
+static sf_count_t
+bw64_tell (void *user_data)
+{
+  return ftello ((FILE *) user_data);
+}
 
+// Sound essence of a D-Cinema MXF track file (SMPTE 429-3, frame wrapped
+// PCM): where the value of every essence KLV lies in the file, so that
+// libsndfile reads them as one headerless stream
+struct MxfEssence
+{
+  FILE *f;
+  int nsegments;
+  off_t *fileoffset;
+  sf_count_t *start;		// of the segment in the stream
+  sf_count_t total;
+  sf_count_t pos;
+};
 
+static sf_count_t
+mxf_filelen (void *user_data)
+{
+  return ((struct MxfEssence *) user_data)->total;
+}
 
+static sf_count_t
+mxf_seek (sf_count_t offset, int whence, void *user_data)
+{
+  struct MxfEssence *mxf = user_data;
+
+  if (whence == SEEK_CUR)
+    offset += mxf->pos;
+  else if (whence == SEEK_END)
+    offset += mxf->total;
+  if (offset < 0 || offset > mxf->total)
+    return -1;
+  mxf->pos = offset;
+  return offset;
+}
 
-      /* New True Peak */
+static sf_count_t
+mxf_read (void *ptr, sf_count_t count, void *user_data)
+{
+  struct MxfEssence *mxf = user_data;
+  sf_count_t done = 0;
+  int segment = 0, last = mxf->nsegments - 1;
 
-      if (thisWorkerArgs->truepeakflag)
-	{
-	  double *pt_buffer;
-	  if (thisWorkerArgs->lkfsflag)
-	    {
+  // the last segment starting at or before pos
+  while (segment < last)
+    {
+      int middle = (segment + last + 1) / 2;
+      if (mxf->start[middle] <= mxf->pos)
+	segment = middle;
+      else
+	last = middle - 1;
+    }
+  while (done < count && mxf->pos < mxf->total)
+    {
+      sf_count_t end = segment + 1 < mxf->nsegments ?
+	mxf->start[segment + 1] : mxf->total;
+      sf_count_t n = min (count - done, end - mxf->pos);
+      if (fseeko (mxf->f,
+		  mxf->fileoffset[segment] + (mxf->pos - mxf->start[segment]),
+		  SEEK_SET) != 0
+	  || fread ((char *) ptr + done, 1, n, mxf->f) != (size_t) n)
+	break;
+      done += n;
+      mxf->pos += n;
+      if (mxf->pos == end)
+	segment++;
+    }
+  return done;
+}
 
-	      pt_buffer = thisWorkerArgs->lg_buffers->bufferA;
+static sf_count_t
+mxf_write (const void *ptr, sf_count_t count, void *user_data)
+{
+  return 0;
+}
 
-	    }
-	  else if (thisWorkerArgs->leqmdiflag)
-	    {
+static sf_count_t
+mxf_tell (void *user_data)
+{
+  return ((struct MxfEssence *) user_data)->pos;
+}
 
-	      pt_buffer = thisWorkerArgs->lg_buffers_leqmdi->bufferA;
+// BER coded length of a KLV, -1 on error
+static long long
+mxf_length (FILE * f)
+{
+  int first = fgetc (f);
+  long long length = 0;
+
+  if (first == EOF)
+    return -1;
+  if (first < 0x80)
+    return first;
+  for (int i = 0; i < (first & 0x7f); i++)
+    {
+      int byte = fgetc (f);
+      if (byte == EOF || i >= 8)
+	return -1;
+      length = length << 8 | byte;
+    }
+  return length;
+}
 
-	    }
-	  else
+// Open the PCM sound essence of a D-Cinema MXF track file, NULL if path
+// is not MXF or has none. The stream is released at exit.
+static SNDFILE *
+open_mxf (const char *path, SF_INFO * info)
+{
+  static SF_VIRTUAL_IO mxfio = { mxf_filelen, mxf_seek, mxf_read,
+    mxf_write, mxf_tell
+  };
+  // SMPTE 377 partition pack, 382 wave audio descriptor and sound
+  // essence element, 429-6 encrypted triplet
+  const unsigned char partition[11] = { 0x06, 0x0e, 0x2b, 0x34, 0x02, 0x05,
+    0x01, 0x01, 0x0d, 0x01, 0x02
+  };
+  const unsigned char descriptor[15] = { 0x06, 0x0e, 0x2b, 0x34, 0x02, 0x53,
+    0x01, 0x01, 0x0d, 0x01, 0x01, 0x01, 0x01, 0x01, 0x48
+  };
+  const unsigned char sound[13] = { 0x06, 0x0e, 0x2b, 0x34, 0x01, 0x02,
+    0x01, 0x01, 0x0d, 0x01, 0x03, 0x01, 0x16
+  };
+  const unsigned char encrypted[13] = { 0x06, 0x0e, 0x2b, 0x34, 0x02, 0x04,
+    0x01, 0x07, 0x0d, 0x01, 0x03, 0x01, 0x02
+  };
+  unsigned char key[16];
+  int samplerate = 0, channels = 0, bits = 0, capacity = 0;
+  struct MxfEssence *mxf;
+  FILE *f = fopen (path, "rb");
+  SNDFILE *file = NULL;
+
+  if (f == NULL)
+    return NULL;
+  if (fread (key, 1, 16, f) != 16 || memcmp (key, partition, 11) != 0)
+    {
+      fclose (f);
+      return NULL;
+    }
+  rewind (f);
+  mxf = calloc (1, sizeof (*mxf));
+  mxf->f = f;
+  while (fread (key, 1, 16, f) == 16)
+    {
+      long long length = mxf_length (f);
+      off_t value = ftello (f);
+      if (length < 0)
+	break;
+      if (memcmp (key, descriptor, 15) == 0 && samplerate == 0)
+	{
+	  // local set, 2 byte tags and lengths, big endian values
+	  unsigned char item[4], data[8];
+	  while (ftello (f) + 4 <= value + length
+		 && fread (item, 1, 4, f) == 4)
 	    {
-	      pt_buffer = malloc (sizeof (double) * thisWorkerArgs->nsamples);
-
-	      for (int n = ch, m = 0; n < thisWorkerArgs->nsamples;
-		   n += thisWorkerArgs->nch, m++)
+	      int tag = item[0] << 8 | item[1];
+	      int itemlength = item[2] << 8 | item[3];
+	      off_t next = ftello (f) + itemlength;
+	      if (itemlength == 8 && tag == 0x3d03
+		  && fread (data, 1, 8, f) == 8)
 		{
-		  //populate bufferA -- deinterleave
-		  pt_buffer[m] = thisWorkerArgs->argbuffer[n];	//
+		  // AudioSamplingRate, a rational
+		  int numerator =
+		    data[0] << 24 | data[1] << 16 | data[2] << 8 | data[3];
+		  int denominator =
+		    data[4] << 24 | data[5] << 16 | data[6] << 8 | data[7];
+		  samplerate = denominator > 0 ? numerator / denominator : 0;
 		}
-
-
+	      else if (itemlength == 4 && (tag == 0x3d07 || tag == 0x3d01)
+		       && fread (data, 1, 4, f) == 4)
+		{
+		  // ChannelCount, QuantizationBits
+		  int number =
+		    data[0] << 24 | data[1] << 16 | data[2] << 8 | data[3];
+		  if (tag == 0x3d07)
+		    channels = number;
+		  else
+		    bits = number;
+		}
+	      fseeko (f, next, SEEK_SET);
 	    }
-
-	  pthread_mutex_lock (&mutex);
-	  double temp_truepeak = thisWorkerArgs->truepeak->vector[ch];
-	  pthread_mutex_unlock (&mutex);
-
-	  temp_truepeak =
-	    truepeakcheck (pt_buffer,
-			   thisWorkerArgs->nsamples / thisWorkerArgs->nch,
-			   temp_truepeak,
-			   thisWorkerArgs->truepeak->oversampling_ratio,
-			   thisWorkerArgs->truepeak->filtertaps,
-			   thisWorkerArgs->truepeak->filter_coeffs);
-
-
-	  pthread_mutex_lock (&mutex);
-	  thisWorkerArgs->truepeak->vector[ch] = max (temp_truepeak, thisWorkerArgs->truepeak->vector[ch]);	//THIS CORRECTION IS NOT ENOUGH that is use max() againt actual value should be enough to prevent concurrency of threads. The other possibility (not yet implemented) would be to have a vector of true peaks per thread per channel instead of a vector per channel.
-	  pthread_mutex_unlock (&mutex);
-
-
-	  if (!(thisWorkerArgs->lkfsflag || thisWorkerArgs->leqmdiflag))
+	}
+      else if (memcmp (key, sound, 13) == 0)
+	{
+	  if (mxf->nsegments == capacity)
 	    {
-	      free (pt_buffer);
-	      pt_buffer = NULL;
+	      capacity = capacity ? 2 * capacity : 1024;
+	      mxf->fileoffset =
+		realloc (mxf->fileoffset, capacity * sizeof (off_t));
+	      mxf->start = realloc (mxf->start, capacity * sizeof (sf_count_t));
 	    }
+	  mxf->fileoffset[mxf->nsegments] = value;
+	  mxf->start[mxf->nsegments++] = mxf->total;
+	  mxf->total += length;
 	}
+      else if (memcmp (key, encrypted, 13) == 0)
+	{
+	  printf ("%s is encrypted, it must be decrypted first.\n", path);
+	  mxf->nsegments = 0;
+	  break;
+	}
+      if (fseeko (f, value + length, SEEK_SET) != 0)
+	break;
+    }
+  if (mxf->nsegments > 0 && samplerate > 0 && channels > 0
+      && (bits == 16 || bits == 24 || bits == 32))
+    {
+      memset (info, 0, sizeof (*info));
+      info->format = SF_FORMAT_RAW | SF_ENDIAN_LITTLE |
+	(bits == 16 ? SF_FORMAT_PCM_16 : bits == 24 ?
+	 SF_FORMAT_PCM_24 : SF_FORMAT_PCM_32);
+      info->samplerate = samplerate;
+      info->channels = channels;
+      file = sf_open_virtual (&mxfio, SFM_READ, info, mxf);
+    }
+  if (file == NULL)
+    {
+      fclose (f);
+      free (mxf->fileoffset);
+      free (mxf->start);
+      free (mxf);
+    }
+  return file;
+}
 
-      /* END INSERT */
-
-
-
-
+// libsndfile needs the length of the audio before it is read, so the
+// standard input (inpath -) is copied to a temporary file (outpath) and
+// measured from there. A FIFO is refused instead, it is meant to stream
+int
+spool_input (const char *inpath, char *outpath)
+{
+  char chunk[65536];
+  size_t nread;
+  int failed = 0;
+  FILE *input = strcmp (inpath, "-") == 0 ? stdin : fopen (inpath, "rb");
+  FILE *spool;
 
+  if (input == NULL)
+    {
+      printf ("Could not open %s.\n", inpath);
+      return -1;
+    }
+  if ((spool = create_temp_file (outpath, "input")) == NULL)
+    {
+      printf ("Could not create a file for the input of %s.\n", inpath);
+      if (input != stdin)
+	fclose (input);
+      return -1;
+    }
+#ifdef _WIN32
+  if (input == stdin)
+    _setmode (_fileno (stdin), _O_BINARY);
+#endif
+  while ((nread = fread (chunk, 1, sizeof (chunk), input)) > 0)
+    {
+      if (fwrite (chunk, 1, nread, spool) != nread)
+	{
+	  failed = 1;
+	  break;
+	}
+    }
+  if (ferror (input))
+    failed = 1;
+  if (input != stdin)
+    fclose (input);
+  if (fclose (spool) != 0)
+    failed = 1;
+  if (failed)
+    {
+      printf ("Could not copy the input of %s.\n", inpath);
+      remove (outpath);
+      outpath[0] = '\0';
+      return -1;
+    }
+  return 0;
+}
 
+// sf_open for reading, with BW64 files opened as RF64 and the sound
+// essence of MXF track files
+SNDFILE *
+open_soundfile (const char *path, SF_INFO * info)
+{
+  static SF_VIRTUAL_IO bw64io = { bw64_filelen, bw64_seek, bw64_read,
+    bw64_write, bw64_tell
+  };
+  SNDFILE *file = sf_open (path, SFM_READ, info);
+  char id[4];
+  FILE *f;
+
+  if (file != NULL || (info->format & SF_FORMAT_TYPEMASK) == SF_FORMAT_RAW)
+    return file;
+  if ((f = fopen (path, "rb")) == NULL)
+    return NULL;
+  if (fread (id, 1, 4, f) != 4 || memcmp (id, "BW64", 4) != 0)
+    {
+      fclose (f);
+      return open_mxf (path, info);
+    }
+  rewind (f);
+  memset (info, 0, sizeof (*info));
+  file = sf_open_virtual (&bw64io, SFM_READ, info, f);
+  if (file == NULL)
+    fclose (f);
+  return file;
+}
 
-      if (thisWorkerArgs->polyflag == 1)
+// Open the other stems of a multi-mono set, first is channel 1. They must
+// all be mono with the same rate and length, info then describes the whole
+// program.
+int
+open_multimono (SNDFILE * first, SF_INFO * info, const char **files,
+		int nfiles, SNDFILE ** monofiles)
+{
+  if (info->channels != 1)
+    {
+      printf ("With --multimono every file must be mono.\n");
+      return 1;
+    }
+  monofiles[0] = first;
+  for (int i = 0; i < nfiles; i++)
+    {
+      SF_INFO monoinfo;
+      memset (&monoinfo, 0, sizeof (monoinfo));
+      monofiles[i + 1] = open_soundfile (files[i], &monoinfo);
+      if (monofiles[i + 1] == NULL)
 	{
-	  //M_filter instead of convolution
-	  M_filter (convolvedbuffer, normalizedbuffer,
-		    thisWorkerArgs->nsamples / thisWorkerArgs->nch,
-		    thisWorkerArgs->sample_rate);
+	  printf ("Error while opening audio file, could not open %s.\n",
+		  files[i]);
+	  return 1;
 	}
-      else
+      if (monoinfo.channels != 1 || monoinfo.samplerate != info->samplerate
+	  || monoinfo.frames != info->frames)
 	{
-	  //convolution M ir
-	  convolv_buff (normalizedbuffer, convolvedbuffer, thisWorkerArgs->ir,
-			thisWorkerArgs->nsamples / thisWorkerArgs->nch,
-			thisWorkerArgs->npoints * 2);
+	  printf
+	    ("%s has %d channel(s), %d Hz and %lld frames, the first stem 1, %d Hz and %lld frames.\n",
+	     files[i], monoinfo.channels, monoinfo.samplerate,
+	     (long long) monoinfo.frames, info->samplerate,
+	     (long long) info->frames);
+	  return 1;
 	}
+    }
+  info->channels = nfiles + 1;
+  return 0;
+}
 
-      //rectify, square und sum
-      rectify (csumandsquarebuffer, convolvedbuffer,
-	       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-      rectify (sumandsquarebuffer, normalizedbuffer,
-	       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-
-
-      /* No more accumulating all channels, instead processing and storing results separately */
-
-
-      accumulatech (chsumaccumulator_norm, sumandsquarebuffer,
-		    thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-      accumulatech (chsumaccumulator_conv, csumandsquarebuffer,
-		    thisWorkerArgs->nsamples / thisWorkerArgs->nch);
+// Interleave the stems of a multi-mono set into buf, limited to the frames
+// of the measured range
+sf_count_t
+read_multimono (SNDFILE ** monofiles, int nfiles, double *buf,
+		double *scratch, sf_count_t items, sf_count_t * framesleft)
+{
+  sf_count_t frames = items / nfiles;
+  sf_count_t framesread = frames;
 
+  if (frames > *framesleft)
+    frames = *framesleft;
+  for (int f = 0; f < nfiles; f++)
+    {
+      sf_count_t n = sf_read_double (monofiles[f], scratch, frames);
+      for (sf_count_t k = 0; k < n; k++)
+	buf[k * nfiles + f] = scratch[k];
+      if (n < framesread)
+	framesread = n;
+    }
+  *framesleft -= framesread;
+  return framesread * nfiles;
+}
 
+#endif
 
+						//to get impulse response frequency response at equally spaced intervals is needed
 
-      //Create a function for this also a tag so that the worker know if he has to do this or not
+int
+equalinterval (double *freqsamples, double *freqresp, double *eqfreqsamples,
+	       double *eqfreqresp, int points, int samplingfreq,
+	       int origpoints)
+{
+  double freq;
+  // int findex = 0;
+  // int rindex = 0;
+  double pass = ((double) (samplingfreq >> 1)) / ((double) points);
+  for (int ieq = 0, i = 0; ieq < points; ieq++)
+    {
+      freq = ieq * pass;
+      eqfreqsamples[ieq] = freq;
 
-      //Why is this not present in worker_function? Because this is for each channel separately
-      if (thisWorkerArgs->leqmdiflag)
+      if ((freq == 0.0) || (freq < freqsamples[1]))
 	{
-
-	  thisWorkerArgs->sc_shorttermarray[ch][thisWorkerArgs->
-						shorttermindex] =
-	    sumandshorttermavrg (csumandsquarebuffer,
-				 thisWorkerArgs->nsamples /
-				 thisWorkerArgs->nch);
-
+	  eqfreqresp[ieq] = freqresp[0];
+	  continue;
 	}
-      /*
-         #ifdef DEBUG // this must be changed to print all channels
-         printf("%d: %.6f\n", thisWorkerArgs->shorttermindex, thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex]);
-         #endif
-       */
-
-
-      free (normalizedbuffer);
-      normalizedbuffer = NULL;
-
-      free (convolvedbuffer);
-      convolvedbuffer = NULL;
-
-
-      /* lkfs */
-
-
-      /* For LKFS according to ITU Standard:
-         "The measurement interval shall be constrained such that it ends at the end of a gating block.
-         Incomplete gating blocks at the end of the measurement interval are not used."
-
-         But especially when linking against ffmpeg only here I have the exact number of frames/samples.
-         So here I can have two cases: 1. nsamples / chs < stepi in this case nsamples should be discarded 
-         2. stepi < nsamples / chs < gblock in  this case I would have a complete gating block and it should go through the while
-       */
-
-
-      /* THIS BLOCK MUST BE DOUBLED BUT ALSO SHOULD BE DEPENDENT on switch */
-      if (thisWorkerArgs->lkfsflag)
+      else
 	{
 
-	  int stepi = thisWorkerArgs->lg_ctx->ops;
-	  //internal copy of step_counter
-	  //copy_stepcounter = thisWorkerArgs->lg_ctx->stepcounter;
-	  //put together samples
-	  while (stepi <= thisWorkerArgs->nsamples / thisWorkerArgs->nch)
-	    {			//instead of thisWorkerArgs->lg_ctx->gblocksize for block less the gblocksize at the end of file
-
-	      /* // Where should I put this?
-
-	         if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi) < thisWorkerArgs->lg_ctx->ops)  { // pad buffer
-
-	         memcpy(thisWorkerArgs->lg_buffers->bufferLG, thisWorkerArgs->lg_buffers->bufferB + stepi, sizeof(double)*(thisWorkerArgs->lg_ctx->gblocksize - stepi)); //copy samples til boundary of bufferB
-	         memcpy(thisWorkerArgs->lg_buffers->bufferLG + thisWorkerArgs->lg_ctx->gblocksize - stepi, thisWorkerArgs->lg_buffers->bufferA, sizeof(double)*(thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi);
-
-	         }
-
-	       */
-	      if (copy_stepcounter > 0)
-		{		//that must  not be the first gate block 
-
-		  memcpy (thisWorkerArgs->lg_buffers->bufferLG, thisWorkerArgs->lg_buffers->bufferB + stepi, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//copy samples til boundary of bufferB
-		  memcpy (thisWorkerArgs->lg_buffers->bufferLG +
-			  thisWorkerArgs->nsamples / thisWorkerArgs->nch -
-			  stepi, thisWorkerArgs->lg_buffers->bufferA,
-			  sizeof (double) * stepi);
-
+	  if ((freq >= freqsamples[i]) && (freq < freqsamples[i + 1]))
+	    {
+	      eqfreqresp[ieq] =
+		((freqresp[i + 1] - freqresp[i]) / (freqsamples[i + 1] -
+						    freqsamples[i])) * (freq -
+									freqsamples
+									[i]) +
+		freqresp[i];
+	    }
+	  else if (freq >= freqsamples[i + 1])
+	    {
+	      while (freq >= freqsamples[i + 1])
+		{
+		  i++;
+		  if ((i + 1) >= origpoints)
+		    {
+		      break;
+		    }
+		}
+	      if ((i + 1) < origpoints)
+		{
+		  eqfreqresp[ieq] =
+		    ((freqresp[i + 1] - freqresp[i]) / (freqsamples[i + 1] -
+							freqsamples[i])) *
+		    (freq - freqsamples[i]) + freqresp[i];
 		}
 	      else
 		{
-
-		  memcpy (thisWorkerArgs->lg_buffers->bufferLG,
-			  thisWorkerArgs->lg_buffers->bufferA,
-			  sizeof (double) * stepi);
-		  memset (thisWorkerArgs->lg_buffers->bufferLG + stepi, 0, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//Check if this correct
-
-		  //for the case this is the first ... but preferably another solution
+		  eqfreqresp[ieq] =
+		    ((1 - freqresp[i]) / (((double) (samplingfreq >> 1)) -
+					  freqsamples[i])) * (freq -
+							      freqsamples[i])
+		    + freqresp[i];
 		}
+	    }
+	}
+    }
+  return 0;
+}
 
 
-	      /* Filtering stage one and two */
-	      K_filter_stage1 (thisWorkerArgs->lg_buffers->bufferSwap,
-			       thisWorkerArgs->lg_buffers->bufferLG,
-			       thisWorkerArgs->nsamples / thisWorkerArgs->nch,
-			       thisWorkerArgs->Kcoeffs);
-	      K_filter_stage2 (thisWorkerArgs->lg_buffers->bufferLG,
-			       thisWorkerArgs->lg_buffers->bufferSwap,
-			       thisWorkerArgs->nsamples / thisWorkerArgs->nch,
-			       thisWorkerArgs->Kcoeffs);
-	      rectify (thisWorkerArgs->lg_buffers->bufferSwap,
-		       thisWorkerArgs->lg_buffers->bufferLG,
-		       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-	      double tmp_sum =
-		msaccumulate (thisWorkerArgs->lg_buffers->bufferSwap,
-			      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-
-	      //pthread_mutex_lock (&mutex); //NOT NECESSARY ANYMORE
-	      // this should be done under mutex conditions -> shared resources!
-	      // assign provisional measure of leq (not yet gated)
-	     /* 
-	         #ifdef DEBUG
-	         printf
-	         ("LG block index: %d\t Channel: %d\t Sample sum: %.20f\n",
-	         copy_stepcounter, ch, tmp_sum);
-	         #endif
-	       */
-	      thisWorkerArgs->lg_ctx->LGresultarray[ch][thisWorkerArgs->shorttermindex][copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs] = tmp_sum;	//<- if below relative threshold, but postpone gating for the finale calculation
-	      //pthread_mutex_unlock (&mutex);
-	      copy_stepcounter++;
-	      stepi += thisWorkerArgs->lg_ctx->ops;
-	    }			/* while(stepi <= LGCtx->gblocksize)  */
-
-
-	}			/* if (thisWorkerArgs->lkfsflag) */
 
 
-#ifdef DI
 
-      /* LEQMDI INSERT 2 START HERE  */
-      if (thisWorkerArgs->leqmdiflag)
+						//the following is different from version 1 because interpolate between db and not linear. Conversion from db to lin must be done after.
+						//it is also different for the way it interpolates between DC and 31 Hz
+						// Pay attention that also arguments to the functions are changed
+int
+equalinterval2 (double freqsamples[], double freqresp_db[],
+		double *eqfreqsamples, double *eqfreqresp, int points,
+		int samplingfreq, int origpoints, int bitdepthsoundfile)
+{
+  double freq;
+  //calculate miminum attenuation depending on the bitdeph (minus one), that is −6.020599913 dB per bit in eccess to sign
+  double dcatt = ((double) (bitdepthsoundfile - 1)) * (-6.020599913);	// + 20.00; //in dB
+  //double dcatt = -90.3;
+  double pass = ((double) (samplingfreq >> 1)) / ((double) points);
+  for (int ieq = 0, i = 0; ieq < points; ieq++)
+    {
+      freq = ieq * pass;
+      eqfreqsamples[ieq] = freq;
+      if (freq == 0.0)
+	{			// I would like to cange this
+	  eqfreqresp[ieq] = dcatt;
+	}
+      else if (freq < freqsamples[0])
+	{			// this has a lot of influence on final Leq(M) value
+	  eqfreqresp[ieq] =
+	    ((freqresp_db[0] - dcatt) / (freqsamples[0] - 0)) * freq + dcatt;
+	  //eqfreqresp[ieq] = freqresp_db[0]; // Is this meaningful? Shouldn't I interpolate between 0 Hz and 31 Hz? Otherwise for DC I have -35.5 dB
+	  continue;
+	}
+      else
 	{
-
-	  int stepi = thisWorkerArgs->lg_ctx_leqmdi->ops;
-	  //internal copy of step_counter
-	  //copy_stepcounter = thisWorkerArgs->lg_ctx_leqmdi->stepcounter;
-	  //put together samples
-	  while (stepi <= thisWorkerArgs->nsamples / thisWorkerArgs->nch)
-	    {			//instead of thisWorkerArgs->lg_ctx->gblocksize for block less the gblocksize at the end of file
-
-	      /* // Where should I put this?
-
-	         if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi) < thisWorkerArgs->lg_ctx->ops)  { // pad buffer
-
-	         memcpy(thisWorkerArgs->lg_buffers->bufferLG, thisWorkerArgs->lg_buffers->bufferB + stepi, sizeof(double)*(thisWorkerArgs->lg_ctx->gblocksize - stepi)); //copy samples til boundary of bufferB
-	         memcpy(thisWorkerArgs->lg_buffers->bufferLG + thisWorkerArgs->lg_ctx->gblocksize - stepi, thisWorkerArgs->lg_buffers->bufferA, sizeof(double)*(thisWorkerArgs->nsamples / thisWorkerArgs->nch) - stepi);
-
-	         }
-
-	       */
-	      if (copy_stepcounter_leqmdi > 0)
-		{		//that must  not be the first gate block 
-
-		  memcpy (thisWorkerArgs->lg_buffers_leqmdi->bufferLG, thisWorkerArgs->lg_buffers_leqmdi->bufferB + stepi, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//copy samples til boundary of bufferB
-		  memcpy (thisWorkerArgs->lg_buffers_leqmdi->bufferLG +
-			  thisWorkerArgs->nsamples / thisWorkerArgs->nch -
-			  stepi, thisWorkerArgs->lg_buffers_leqmdi->bufferA,
-			  sizeof (double) * stepi);
-
+	  if ((freq >= freqsamples[i]) && (freq < freqsamples[i + 1]))
+	    {
+	      eqfreqresp[ieq] =
+		((freqresp_db[i + 1] - freqresp_db[i]) / (freqsamples[i + 1] -
+							  freqsamples[i])) *
+		(freq - freqsamples[i]) + freqresp_db[i];
+	    }
+	  else if (freq >= freqsamples[i + 1])
+	    {
+	      while (freq >= freqsamples[i + 1])
+		{
+		  i++;
+		  if ((i + 1) >= origpoints)
+		    {
+		      break;
+		    }
 		}
-	      else
+	      if ((i + 1) < origpoints)
 		{
-
-		  memcpy (thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
-			  thisWorkerArgs->lg_buffers_leqmdi->bufferA,
-			  sizeof (double) * stepi);
-		  memset (thisWorkerArgs->lg_buffers_leqmdi->bufferLG + stepi, 0, sizeof (double) * (thisWorkerArgs->nsamples / thisWorkerArgs->nch - stepi));	//Check if this correct
-
-		  //for the case this is the first ... but preferably another solution
+		  eqfreqresp[ieq] =
+		    ((freqresp_db[i + 1] -
+		      freqresp_db[i]) / (freqsamples[i + 1] -
+					 freqsamples[i])) * (freq -
+							     freqsamples[i]) +
+		    freqresp_db[i];
 		}
-
-	      /*
-
-	         - SCALING ACCORDING TO M FILTER MUST BE ADDED
-
-	       */
-
-
-	      for (int i = 0;
-		   i < thisWorkerArgs->nsamples / thisWorkerArgs->nch; i++)
-
+	      else
 		{
-		  // use this for calibration depending on channel config for ex. chconf[6] = {1.0, 1.0, 1.0, 1.0, 0.707945784, 0.707945784} could be the default for 5.1 soundtracks
-		  //so not normalized but calibrated
-		  thisWorkerArgs->lg_buffers_leqmdi->bufferSwap[i] = thisWorkerArgs->lg_buffers_leqmdi->bufferLG[i] * thisWorkerArgs->chconf[ch];	//this scale amplitude according to specified calibration
-
+		  eqfreqresp[ieq] =
+		    ((1 - freqresp_db[i]) / (((double) (samplingfreq >> 1)) -
+					     freqsamples[i])) * (freq -
+								 freqsamples
+								 [i]) +
+		    freqresp_db[i];
 		}
+	    }
+	}
+    }
+  return 0;
+}
 
-
-
-
-
-
-	      if (thisWorkerArgs->polyflag == 1)
+int
+equalinterval3 (double freqsamples[], double freqresp_db[],
+		double *eqfreqsamples, double *eqfreqresp, int points,
+		int samplingfreq, int origpoints, int bitdepthsoundfile)
+{
+  double freq;
+  double firstslope =
+    (freqresp_db[1] - freqresp_db[0]) / (freqsamples[1] - freqsamples[0]);
+  /* DC attenuation is calculated from the first slope of attenuation curve sampling points */
+  double dcatt = freqresp_db[0] - firstslope * freqsamples[0];
+  double pass = ((double) (samplingfreq >> 1)) / ((double) points);
+  for (int ieq = 0, i = 0; ieq < points; ieq++)
+    {
+      freq = ieq * pass;
+      eqfreqsamples[ieq] = freq;
+      if (freq < freqsamples[0])
+	{			/* If frequency is less than first sampling point of M definition, slope of first and second point is used */// this has a lot of influence on final Leq(M) value
+	  eqfreqresp[ieq] = firstslope * freq + dcatt;
+	  //eqfreqresp[ieq] = freqresp_db[0]; // Is this meaningful? Shouldn't I interpolate between 0 Hz and 31 Hz? Otherwise for DC I have -35.5 dB
+	  continue;
+	}
+      else
+	{			/* all frequencies in between sampling frequencies of M definition */
+	  if ((freq >= freqsamples[i]) && (i == (origpoints - 1)))
+	    {
+	      eqfreqresp[ieq] =
+		((freqresp_db[origpoints - 1] -
+		  freqresp_db[origpoints - 2]) / (freqsamples[origpoints -
+							      1] -
+						  freqsamples[origpoints -
+							      2])) * (freq -
+								      freqsamples
+								      [origpoints
+								       - 1]) +
+		freqresp_db[origpoints - 1];
+	    }
+	  else if ((freq >= freqsamples[i]) && (freq < freqsamples[i + 1]))
+	    {
+	      eqfreqresp[ieq] =
+		((freqresp_db[i + 1] - freqresp_db[i]) / (freqsamples[i + 1] -
+							  freqsamples[i])) *
+		(freq - freqsamples[i]) + freqresp_db[i];
+	    }
+	  else if (freq >= freqsamples[i + 1])
+	    {
+	      while (freq >= freqsamples[i + 1])
 		{
-		  //M_filter instead of convolution
-		  M_filter (thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
-			    thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
-			    thisWorkerArgs->nsamples / thisWorkerArgs->nch,
-			    thisWorkerArgs->sample_rate);
+		  i++;
+		  if ((i + 1) >= origpoints)
+		    {
+		      break;
+		    }
+		}		// while
+	      if ((i + 1) < origpoints)
+		{
+		  eqfreqresp[ieq] =
+		    ((freqresp_db[i + 1] -
+		      freqresp_db[i]) / (freqsamples[i + 1] -
+					 freqsamples[i])) * (freq -
+							     freqsamples[i]) +
+		    freqresp_db[i];
 		}
 	      else
 		{
-		  //convolution M ir
-		  convolv_buff (thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
-				thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
-				thisWorkerArgs->ir,
-				thisWorkerArgs->nsamples /
-				thisWorkerArgs->nch,
-				thisWorkerArgs->npoints * 2);
+		  eqfreqresp[ieq] =
+		    ((1 - freqresp_db[i]) / (((double) (samplingfreq >> 1)) -
+					     freqsamples[i])) * (freq -
+								 freqsamples
+								 [i]) +
+		    freqresp_db[i];
 		}
+	    }
+	}
+    }
+  return 0;
+}
 
-	      rectify (thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
-		       thisWorkerArgs->lg_buffers_leqmdi->bufferLG,
-		       thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-	      double tmp_sum =
-		msaccumulate (thisWorkerArgs->lg_buffers_leqmdi->bufferSwap,
-			      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-	      //pthread_mutex_lock (&mutex); //NO MORE NECESSARY
-	      // this should be done under mutex conditions -> shared resources!
-	      // assign provisional measure of leq (not yet gated)
-	     /* 
-	         #ifdef DEBUG
-	         printf
-	         ("LG Leq(M,DI) block index: %d\t Channel: %d\t Sample sum: %.20f\n",
-	         copy_stepcounter_leqmdi, ch, tmp_sum);
-	         #endif
-	       */
-	      thisWorkerArgs->lg_ctx_leqmdi->LGresultarray[ch][thisWorkerArgs->shorttermindex][copy_stepcounter_leqmdi % thisWorkerArgs->lg_ctx_leqmdi->subdivs] = tmp_sum;	//<- if below relative threshold, but postpone gating for the finale calculation
-	      //pthread_mutex_unlock (&mutex);
-	      copy_stepcounter_leqmdi++;
-	      stepi += thisWorkerArgs->lg_ctx_leqmdi->ops;
-	    }			/* while(stepi <= LGCtx->gblocksize)  */
 
 
-	}			/* if (thisWorkerArgs->leqmdiflag) */
 
-      /* END LEQMDI INSERT */
-#endif
 
-    }				// loop through channels
+int
+convloglin (double *in, double *out, int points)
+{
+  for (int i = 0; i < points; i++)
+    {
+      out[i] = pow (10, (in[i] / 20.0));
+    }
 
+  return 0;
+}
 
 
-  if (thisWorkerArgs->lkfsflag)
+double
+convlinlog_single (double in)
+{
+  double out;
+  out = log10 (in) * 20.0f;
+  return out;
+}
+
+
+double
+convloglin_single (double in)
+{
+  double out;
+  out = powf (10, in / 20.0f);
+  return out;
+}
+
+
+double
+rounddb (double value, int decimals)
+{
+  /* round a reported dB value to the given number of decimals
+     according to the selected rounding policy, so that printf
+     does not apply its own (round half to even on the binary
+     representation) rounding afterwards */
+  double scale = pow (10, decimals);
+  double scaled = value * scale;
+
+  /* absorb binary representation errors like 81.94365 -> 819436.4999999 */
+  double tolerance = 1e-9 * fmax (1.0, fabs (scaled));
+  double nearest = round (scaled);
+  if (fabs (scaled - nearest) < tolerance)
     {
-      /* following if is to avoid incrementing stepcounter in case there where not enough samples to fill a gating block */
-      if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) >=
-	  thisWorkerArgs->lg_ctx->ops)
-	{
-	  pthread_mutex_lock (&mutex);
-	  if (copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs == 0)
-	    {
-	      thisWorkerArgs->lg_ctx->stepcounter +=
-		thisWorkerArgs->lg_ctx->subdivs;
-	    }
-	  else
-	    {
-	      thisWorkerArgs->lg_ctx->stepcounter +=
-		copy_stepcounter % thisWorkerArgs->lg_ctx->subdivs;
-	    }
+      scaled = nearest;
+    }
+  else if (fabs (fabs (scaled - trunc (scaled)) - 0.5) < tolerance)
+    {
+      scaled = trunc (scaled) + copysign (0.5, scaled);
+    }
 
-	  pthread_mutex_unlock (&mutex);
-	}
+  switch (roundingpolicy)
+    {
+    case ROUND_BANKERS:
+      return rint (scaled) / scale;	// default FE_TONEAREST, ties to even
+    case ROUND_TRUNCATE:
+      return trunc (scaled) / scale;
+    case ROUND_HALFUP:
+    default:
+      return round (scaled) / scale;	// ties away from zero
     }
+}
 
 
-  /* LEQMDI INSERT 3 */
 
+void
+fputs_json_string (const char *str, FILE * stream)
+{
+  fputc ('"', stream);
+  for (; *str != '\0'; str++)
+    {
+      if (*str == '"' || *str == '\\')
+	{
+	  fprintf (stream, "\\%c", *str);
+	}
+      else if ((unsigned char) *str < 0x20)
+	{
+	  fprintf (stream, "\\u%04x", (unsigned char) *str);
+	}
+      else
+	{
+	  fputc (*str, stream);
+	}
+    }
+  fputc ('"', stream);
+}
 
-#ifdef DI
+// str as a quoted JSON string, in a new buffer
+char *
+json_string (const char *str)
+{
+  char *out = malloc (6 * strlen (str) + 3);
+  char *p = out;
 
-  if (thisWorkerArgs->leqmdiflag)
+  *p++ = '"';
+  for (; *str != '\0'; str++)
     {
-      /* following if is to avoid incrementing stepcounter in case there where not enough samples to fill a gating block */
-      if ((thisWorkerArgs->nsamples / thisWorkerArgs->nch) >=
-	  thisWorkerArgs->lg_ctx_leqmdi->ops)
+      if (*str == '"' || *str == '\\')
 	{
-	  pthread_mutex_lock (&mutex);
-	  if (copy_stepcounter_leqmdi %
-	      thisWorkerArgs->lg_ctx_leqmdi->subdivs == 0)
-	    {
-	      thisWorkerArgs->lg_ctx_leqmdi->stepcounter +=
-		thisWorkerArgs->lg_ctx_leqmdi->subdivs;
-	    }
-	  else
+	  p += sprintf (p, "\\%c", *str);
+	}
+      else if ((unsigned char) *str < 0x20)
+	{
+	  p += sprintf (p, "\\u%04x", (unsigned char) *str);
+	}
+      else
+	{
+	  *p++ = *str;
+	}
+    }
+  strcpy (p, "\"");
+  return out;
+}
+
+// Print the provenance of a BWF file and return it as post-hook JSON
+// members. The time reference counts samples since midnight, so it is the
+// start timecode of the file.
+char *
+bext_report (const char *description, const char *originator,
+	     const char *reference, const char *date, const char *time,
+	     unsigned long long timereference, int samplerate, double tcrate)
+{
+  const char *fields[5] = { description, originator, reference, date, time };
+  const char *keys[5] = { "description", "originator",
+    "originator_reference", "origination_date", "origination_time"
+  };
+  size_t size = 160;
+  char tc[16];
+  char *json;
+  int len;
+
+  format_timecode (tc, sizeof (tc), (double) timereference / samplerate,
+		   tcrate);
+  if (description[0] != '\0')
+    printf ("BWF description: %s\n", description);
+  if (originator[0] != '\0')
+    printf ("BWF originator: %s%s%s%s\n", originator,
+	    reference[0] != '\0' ? " (" : "", reference,
+	    reference[0] != '\0' ? ")" : "");
+  if (date[0] != '\0')
+    printf ("BWF origination: %s %s\n", date, time);
+  printf ("BWF time reference: %llu samples (%s at %g fps)\n",
+	  timereference, tc, tcrate);
+  for (int i = 0; i < 5; i++)
+    size += 6 * strlen (fields[i]) + 32;
+  json = malloc (size);
+  len = sprintf (json, ", \"bext\": {");
+  for (int i = 0; i < 5; i++)
+    {
+      char *value = json_string (fields[i]);
+      len += sprintf (json + len, "\"%s\": %s, ", keys[i], value);
+      free (value);
+    }
+  sprintf (json + len, "\"time_reference\": %llu, \"start_timecode\": \"%s\"}",
+	   timereference, tc);
+  return json;
+}
+
+// The content of the chunk id (iXML, chna, axml...) of a WAV, RF64 or
+// BW64 file with a terminating 0 added, NULL if there is none. Neither
+// libsndfile nor ffmpeg hand these over, so the chunks are walked here.
+char *
+read_wav_chunk (const char *path, const char *id, unsigned long long *size)
+{
+  FILE *stream = is_pipe (path) ? NULL : fopen (path, "rb");
+  unsigned char header[12], chunk[8], ds64[16];
+  unsigned long long datasize = 0;
+  char *content = NULL;
+
+  if (stream == NULL)
+    return NULL;
+  if (fread (header, 1, 12, stream) != 12
+      || (memcmp (header, "RIFF", 4) != 0 && memcmp (header, "RF64", 4) != 0
+	  && memcmp (header, "BW64", 4) != 0)
+      || memcmp (header + 8, "WAVE", 4) != 0)
+    {
+      fclose (stream);
+      return NULL;
+    }
+  while (fread (chunk, 1, 8, stream) == 8)
+    {
+      unsigned long long chunksize = chunk[4] | chunk[5] << 8 |
+	chunk[6] << 16 | (unsigned long long) chunk[7] << 24;
+      if (memcmp (chunk, id, 4) == 0)
+	{
+	  content = malloc (chunksize + 1);
+	  if (fread (content, 1, chunksize, stream) != chunksize)
 	    {
-	      thisWorkerArgs->lg_ctx_leqmdi->stepcounter +=
-		copy_stepcounter_leqmdi %
-		thisWorkerArgs->lg_ctx_leqmdi->subdivs;
+	      free (content);
+	      content = NULL;
+	      break;
 	    }
-
-	  pthread_mutex_unlock (&mutex);
+	  content[chunksize] = '\0';
+	  if (size != NULL)
+	    *size = chunksize;
+	  break;
+	}
+      else if (memcmp (chunk, "ds64", 4) == 0 && chunksize >= 16
+	       && fread (ds64, 1, 16, stream) == 16)
+	{
+	  // RIFF and data sizes of 64 bit, the data one after the RIFF one
+	  for (int i = 7; i >= 0; i--)
+	    datasize = datasize << 8 | ds64[8 + i];
+	  chunksize -= 16;
+	}
+      else if (memcmp (chunk, "data", 4) == 0 && chunksize == 0xFFFFFFFF)
+	{
+	  chunksize = datasize;
 	}
+      if (fseeko (stream, chunksize + (chunksize & 1), SEEK_CUR) != 0)
+	break;
     }
+  fclose (stream);
+  return content;
+}
 
+// Value of the attribute name in the XML start tag holding
+// idattr="id" (or in the first tag named idattr when id is NULL)
+static int
+adm_attribute (const char *xml, const char *idattr, const char *id,
+	       const char *name, char *value, size_t len)
+{
+  char key[96];
+  const char *tag, *tagend, *from;
+  size_t n = 0;
 
-  /* END LEQMDI INSERT 3 */
-#endif
-
-
-
-
-
-
-  if ((thisWorkerArgs->leqm10flag) || (thisWorkerArgs->leqmlogflag))
+  if (id != NULL)
+    snprintf (key, sizeof (key), "%s=\"%s\"", idattr, id);
+  else
+    snprintf (key, sizeof (key), "<%s ", idattr);
+  tag = strstr (xml, key);
+  if (tag == NULL)
+    return 0;
+  while (tag > xml && *tag != '<')
+    tag--;
+  tagend = strchr (tag, '>');
+  snprintf (key, sizeof (key), " %s=\"", name);
+  from = strstr (tag, key);
+  if (tagend == NULL || from == NULL || from > tagend)
+    return 0;
+  from += strlen (key);
+  while (from[n] != '"' && from[n] != '\0' && n + 1 < len)
     {
-      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex] =
-	sumandshorttermavrg (chsumaccumulator_conv,
-			     thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-#ifdef DEBUG
-      printf ("%d: %.6f\n", thisWorkerArgs->shorttermindex,
-	      thisWorkerArgs->shorttermarray[thisWorkerArgs->shorttermindex]);
-#endif
+      value[n] = from[n];
+      n++;
     }
+  value[n] = '\0';
+  return 1;
+}
 
+// Cinema name of an ADM DirectSpeakers channel, from the name of its
+// audioChannelFormat (FrontLeft, RoomCentricLeftRearSurround...) or, for
+// the common definitions the axml may leave out, from its ID
+static const char *
+adm_channel_name (const char *name, int commonid)
+{
+  const char *common[7] = { NULL, "L", "R", "C", "LFE", "Ls", "Rs" };
+  int left = strstr (name, "Left") != NULL;
+
+  if (name[0] == '\0')
+    return commonid >= 1 && commonid <= 6 ? common[commonid] : NULL;
+  if (strstr (name, "LFE") != NULL || strstr (name, "LowFrequency") != NULL)
+    return "LFE";
+  if (strstr (name, "Top") != NULL)
+    return left ? "Lts" : "Rts";
+  if (strstr (name, "Rear") != NULL || strstr (name, "Back") != NULL)
+    return left ? "Lrs" : "Rrs";
+  if (strstr (name, "Side") != NULL || strstr (name, "Surround") != NULL)
+    return left ? "Ls" : "Rs";
+  if (strstr (name, "Centre") != NULL || strstr (name, "Center") != NULL)
+    return "C";
+  if (left)
+    return "L";
+  if (strstr (name, "Right") != NULL)
+    return "R";
+  return NULL;
+}
 
+// ADM (ITU-R BS.2076) type of every track of a BW64 file from its chna
+// chunk: 1 DirectSpeakers (bed), 3 Objects, 0 for none or other types.
+// NULL if the file has no chna chunk. Bed channels get their names from
+// the axml chunk, objects are named Obj.
+int *
+adm_tracks (const char *path, int nchannels, const char **names)
+{
+  unsigned long long size;
+  unsigned char *chna =
+    (unsigned char *) read_wav_chunk (path, "chna", &size);
+  char *axml;
+  char value[256];
+  int *types;
+  int nbeds = 0, nobjects = 0;
+
+  if (chna == NULL)
+    return NULL;
+  axml = read_wav_chunk (path, "axml", NULL);
+  types = calloc (nchannels, sizeof (int));
+  // numTracks, numUIDs, then 40 byte entries: trackIndex (from 1),
+  // audioTrackUID, audioTrackFormatIDRef (AT_yyyyxxxx_zz, yyyy the type),
+  // audioPackFormatIDRef, padding
+  for (unsigned long long e = 4; e + 40 <= size; e += 40)
+    {
+      int track = chna[e] | chna[e + 1] << 8;
+      char format[15];
+      char channelformat[12];
+      if (track < 1 || track > nchannels)
+	continue;
+      memcpy (format, chna + e + 14, 14);
+      format[14] = '\0';
+      types[track - 1] = (int) strtol (format + 3, NULL, 16) >> 16;
+      if (types[track - 1] == 3)
+	names[track - 1] = "Obj";
+      else if (types[track - 1] == 1)
+	{
+	  // audioTrackFormat AT_yyyyxxxx_zz carries audioChannelFormat AC_yyyyxxxx
+	  snprintf (channelformat, sizeof (channelformat), "AC_%.8s",
+		    format + 3);
+	  if (axml == NULL
+	      || !adm_attribute (axml, "audioChannelFormatID", channelformat,
+				 "audioChannelFormatName", value,
+				 sizeof (value)))
+	    value[0] = '\0';
+	  names[track - 1] =
+	    adm_channel_name (value, (int) strtol (format + 7, NULL, 16));
+	}
+    }
+  for (int i = 0; i < nchannels; i++)
+    {
+      nbeds += types[i] == 1;
+      nobjects += types[i] == 3;
+    }
+  if (axml != NULL
+      && adm_attribute (axml, "audioProgramme", NULL, "audioProgrammeName",
+			value, sizeof (value)))
+    printf ("ADM programme: %s\n", value);
+  printf ("ADM tracks: %d bed, %d object, %d other\n", nbeds, nobjects,
+	  nchannels - nbeds - nobjects);
+  free (axml);
+  free (chna);
+  return types;
+}
 
+// Text of the first <tag> element from start up to end, entities
+// decoded, in value. Returns where the element ends, NULL if not found.
+static const char *
+xml_element (const char *start, const char *end, const char *tag,
+	      char *value, size_t len)
+{
+  const char *entities[5][2] = { {"&amp;", "&"}, {"&lt;", "<"},
+  {"&gt;", ">"}, {"&quot;", "\""}, {"&apos;", "'"}
+  };
+  char open[64], close[64];
+  const char *from, *to;
+  size_t n = 0;
+
+  snprintf (open, sizeof (open), "<%s>", tag);
+  snprintf (close, sizeof (close), "</%s>", tag);
+  from = strstr (start, open);
+  if (from == NULL || from >= end)
+    return NULL;
+  from += strlen (open);
+  to = strstr (from, close);
+  if (to == NULL || to > end)
+    return NULL;
+  while (from < to && n + 1 < len)
+    {
+      int entity = -1;
+      for (int i = 0; i < 5 && *from == '&'; i++)
+	{
+	  if (strncmp (from, entities[i][0], strlen (entities[i][0])) == 0)
+	    entity = i;
+	}
+      if (entity >= 0)
+	{
+	  value[n++] = entities[entity][1][0];
+	  from += strlen (entities[entity][0]);
+	}
+      else
+	value[n++] = *from++;
+    }
+  value[n] = '\0';
+  return to + strlen (close);
+}
 
+// Print the production information of an iXML chunk (project, scene,
+// take, tape and track names) and return it as post-hook JSON members
+char *
+ixml_report (const char *xml)
+{
+  const char *tags[4] = { "PROJECT", "SCENE", "TAKE", "TAPE" };
+  const char *keys[4] = { "project", "scene", "take", "tape" };
+  const char *end = xml + strlen (xml);
+  const char *tracklist = strstr (xml, "<TRACK_LIST>");
+  char *json = malloc (64 + 7 * strlen (xml));
+  char value[256];
+  int len = sprintf (json, ", \"ixml\": {");
+
+  for (int i = 0; i < 4; i++)
+    {
+      char *quoted;
+      if (xml_element (xml, end, tags[i], value, sizeof (value)) == NULL)
+	continue;
+      printf ("iXML %s: %s\n", keys[i], value);
+      quoted = json_string (value);
+      len += sprintf (json + len, "\"%s\": %s, ", keys[i], quoted);
+      free (quoted);
+    }
+  len += sprintf (json + len, "\"tracks\": [");
+  if (tracklist != NULL)
+    {
+      const char *track = tracklist;
+      int ntracks = 0;
+      char channel[16];
+      while ((track = strstr (track, "<TRACK>")) != NULL)
+	{
+	  const char *trackend = strstr (track, "</TRACK>");
+	  char *quoted;
+	  if (trackend == NULL)
+	    break;
+	  if (xml_element (track, trackend, "NAME", value, sizeof (value))
+	      == NULL)
+	    value[0] = '\0';
+	  if (xml_element (track, trackend, "CHANNEL_INDEX", channel,
+			    sizeof (channel)) == NULL)
+	    snprintf (channel, sizeof (channel), "%d", ntracks + 1);
+	  printf ("iXML track %s: %s\n", channel, value);
+	  quoted = json_string (value);
+	  len += sprintf (json + len, "%s%s", ntracks ? ", " : "", quoted);
+	  free (quoted);
+	  ntracks++;
+	  track = trackend;
+	}
+    }
+  sprintf (json + len, "]}");
+  return json;
+}
 
 
+int
+run_prehook (const char *command, const char *filename)
+{
+  /* the hook gets the file in LEQM_FILE, whatever it prints is merged
+     into the report and a non-zero exit status vetoes the measurement */
+  char line[2048];
+  FILE *hook;
+  int status;
+
+  setenv ("LEQM_FILE", filename, 1);
+  fflush (stdout);
+  hook = popen (command, "r");
+  if (hook == NULL)
+    {
+      printf ("Could not run pre-hook %s.\n", command);
+      return -1;
+    }
+  while (fgets (line, sizeof (line), hook) != NULL)
+    {
+      line[strcspn (line, "\n")] = '\0';
+      printf ("Pre-hook: %s\n", line);
+    }
+  status = pclose (hook);
+#ifndef _WIN32
+  if (status != -1 && WIFEXITED (status))
+    {
+      status = WEXITSTATUS (status);
+    }
+#endif
+  return status;
+}
 
 
-  pthread_mutex_lock (&mutex);
-  // this should be done under mutex conditions -> shared resources!
-  sumsamples (thisWorkerArgs->ptrtotsum, chsumaccumulator_norm,
-	      chsumaccumulator_conv,
-	      thisWorkerArgs->nsamples / thisWorkerArgs->nch);
-  pthread_mutex_unlock (&mutex);
-
-
-  free (sumandsquarebuffer);
-  sumandsquarebuffer = NULL;
-
-  free (csumandsquarebuffer);
-  csumandsquarebuffer = NULL;
-
-  free (chsumaccumulator_norm);
-  chsumaccumulator_norm = NULL;
-
-  free (chsumaccumulator_conv);
-  chsumaccumulator_conv = NULL;
-
-  free (thisWorkerArgs->argbuffer);
-  thisWorkerArgs->argbuffer = NULL;
-  // the memory pointed to by this pointer is freed in main
-  // it is the same memory for all worker
-  // but it is necessary to set pointer to NULL otherwise free will not work later (really?)
-  thisWorkerArgs->chconf = NULL;
-  pthread_exit (0);
-
-}				//worker_function_gated2
+/* Weighted energy of a buffer summed over its channels, filtered as the
+   workers do it (history taken as zero at the start of the buffer) */
+double
+weighted_energy (double *interleaved, int nframes, int nch, int samplerate)
+{
+  double *in = malloc (sizeof (double) * nframes);
+  double *out = malloc (sizeof (double) * nframes);
+  double energy = 0.0;
 
+  for (int ch = 0; ch < nch; ch++)
+    {
+      for (int i = 0; i < nframes; i++)
+	in[i] = interleaved[i * nch + ch];
+      weighting_filter (out, in, nframes, samplerate);
+      for (int i = 0; i < nframes; i++)
+	energy += out[i] * out[i];
+    }
+  free (in);
+  free (out);
+  return energy;
+}
 
 
+#ifdef SNDFILELIB
+/* Leq of a whole other file (the stereo fold-down of --foldcheck) with
+   the weighting of the measurement, every channel at 0 dB and in buffers
+   of buffersizems like the program. -1 if it cannot be read. */
+double
+measure_file_leq (const char *path, int buffersizems, int *samplerate,
+		  int *channels)
+{
+  SF_INFO info;
+  SNDFILE *file;
+  double energy = 0.0;
+  long long nframes = 0;
+  sf_count_t frames;
+
+  memset (&info, 0, sizeof (info));
+  if (is_pipe (path) || !(file = open_soundfile (path, &info)))
+    return -1.0;
+  *samplerate = info.samplerate;
+  *channels = info.channels;
+  int bufferframes = (info.samplerate * buffersizems) / 1000;
+  double *buf = malloc (sizeof (double) * bufferframes * info.channels);
+  while ((frames = sf_readf_double (file, buf, bufferframes)) > 0)
+    {
+      energy += weighted_energy (buf, frames, info.channels, info.samplerate);
+      nframes += frames;
+    }
+  free (buf);
+  sf_close (file);
+  return nframes > 0 ? channelleq (energy, nframes) : -1.0;
+}
 
+/* The whole input file with the gain applied, in its own format.
+   Samples pushed over full scale are clipped by libsndfile. */
+int
+write_normalized (const char *inpath, const char *outpath, double gain)
+{
+  SF_INFO ininfo;
+  SF_INFO outinfo;
+  SNDFILE *in;
+  SNDFILE *out;
+  double factor = pow (10, gain / 20);
+  sf_count_t frames;
+
+  memset (&ininfo, 0, sizeof (ininfo));
+  if (!(in = sf_open (inpath, SFM_READ, &ininfo)))
+    return -1;
+  outinfo = ininfo;
+  if (!(out = sf_open (outpath, SFM_WRITE, &outinfo)))
+    {
+      puts (sf_strerror (NULL));
+      sf_close (in);
+      return -1;
+    }
+  sf_command (out, SFC_SET_CLIPPING, NULL, SF_TRUE);
+  double *buf = malloc (sizeof (double) * 4096 * ininfo.channels);
+  while ((frames = sf_readf_double (in, buf, 4096)) > 0)
+    {
+      for (sf_count_t i = 0; i < frames * ininfo.channels; i++)
+	buf[i] *= factor;
+      if (sf_writef_double (out, buf, frames) != frames)
+	{
+	  frames = -1;
+	  break;
+	}
+    }
+  free (buf);
+  sf_close (in);
+  sf_close (out);
+  return frames < 0 ? -1 : 0;
+}
+#elif defined FFMPEG
+/* The encoding is left to the ffmpeg program: its volume filter and the
+   default codec for the extension of outpath. The paths go through the
+   environment, so that they need no quoting. */
+int
+write_normalized (const char *inpath, const char *outpath, double gain)
+{
+  char command[256];
+  char line[2048];
+  FILE *ffmpeg;
+  int status;
 
+  setenv ("LEQM_FILE", inpath, 1);
+  setenv ("LEQM_OUT", outpath, 1);
+#ifdef _WIN32
+  snprintf (command, sizeof (command),
+	    "ffmpeg -nostdin -v error -y -i \"%%LEQM_FILE%%\" -af volume=%.4fdB \"%%LEQM_OUT%%\" 2>&1",
+	    gain);
+#else
+  snprintf (command, sizeof (command),
+	    "ffmpeg -nostdin -v error -y -i \"$LEQM_FILE\" -af volume=%.4fdB \"$LEQM_OUT\" 2>&1",
+	    gain);
+#endif
+  fflush (stdout);
+  ffmpeg = popen (command, "r");
+  if (ffmpeg == NULL)
+    return -1;
+  while (fgets (line, sizeof (line), ffmpeg) != NULL)
+    {
+      line[strcspn (line, "\n")] = '\0';
+      printf ("ffmpeg: %s\n", line);
+    }
+  status = pclose (ffmpeg);
+  return status == 0 ? 0 : -1;
+}
 
+/* Leq of a whole other file (the stereo fold-down of --foldcheck) with
+   the weighting of the measurement, every channel at 0 dB and in buffers
+   of buffersizems like the program. The ffmpeg program decodes it to
+   64 bit float samples, -1 if it cannot be read. */
+double
+measure_file_leq (const char *path, int buffersizems, int *samplerate,
+		  int *channels)
+{
+  char command[256];
+  FILE *ffmpeg;
+  double energy = 0.0;
+  long long nframes = 0;
+  size_t frames;
+
+  *samplerate = 0;
+  *channels = 0;
+  if (is_pipe (path))
+    return -1.0;
+  probe_audio (path, samplerate, channels);
+  if (*samplerate <= 0 || *channels <= 0)
+    return -1.0;
+  setenv ("LEQM_FILE", path, 1);
+#ifdef _WIN32
+  snprintf (command, sizeof (command),
+	    "ffmpeg -nostdin -v error -i \"%%LEQM_FILE%%\" -map 0:a:0 -f f64le -");
+  ffmpeg = popen (command, "rb");
+#else
+  snprintf (command, sizeof (command),
+	    "ffmpeg -nostdin -v error -i \"$LEQM_FILE\" -map 0:a:0 -f f64le -");
+  ffmpeg = popen (command, "r");
+#endif
+  if (ffmpeg == NULL)
+    return -1.0;
+  int bufferframes = (*samplerate * buffersizems) / 1000;
+  double *buf = malloc (sizeof (double) * bufferframes * *channels);
+  while ((frames = fread (buf, sizeof (double) * *channels, bufferframes,
+			  ffmpeg)) > 0)
+    {
+      energy += weighted_energy (buf, frames, *channels, *samplerate);
+      nframes += frames;
+    }
+  free (buf);
+  if (pclose (ffmpeg) != 0)
+    return -1.0;
+  return nframes > 0 ? channelleq (energy, nframes) : -1.0;
+}
+#endif
 
-#ifdef FFMPEG
+/* The standard input (-) or a FIFO: it can be read only once, in order,
+   and nothing can peek at it before the measurement does. */
 int
-transfer_decoded_data (AVFrame * ptr_frame,
-		       struct WorkerArgs **dptrWorkerArgs, int w_id,
-		       AVCodecContext * codecCon)
+is_pipe (const char *path)
 {
-  int doublesample_index = 0;	//this is to index the millisecond buffer of the worker
-  for (int ch_index = 0; ch_index < ptr_frame->channels; ch_index++)
-    {
+#ifdef S_ISFIFO
+  struct stat st;
+  if (stat (path, &st) == 0 && S_ISFIFO (st.st_mode))
+    return 1;
+#endif
+  return strcmp (path, "-") == 0;
+}
 
-      for (int smpl_index = 0; smpl_index < ptr_frame->nb_samples;
-	   smpl_index++)
-	{			//limit to buffer measure and return rest?
+/* Container of a file from its first bytes, whatever its extension, NULL
+   if unknown. Both libraries detect the formats they read the same way,
+   this is for the decisions taken before them and for the messages. */
+const char *
+sniff_format (const char *path)
+{
+  unsigned char magic[16] = { 0 };
+  FILE *stream = is_pipe (path) ? NULL : fopen (path, "rb");
+  size_t nread;
+
+  if (stream == NULL)
+    return NULL;
+  nread = fread (magic, 1, sizeof (magic), stream);
+  fclose (stream);
+  if (nread < 4)
+    return NULL;
+  if (memcmp (magic, "RIFF", 4) == 0 || memcmp (magic, "RF64", 4) == 0
+      || memcmp (magic, "BW64", 4) == 0)
+    return "WAV";
+  if (memcmp (magic, "fLaC", 4) == 0)
+    return "FLAC";
+  if (memcmp (magic, "OggS", 4) == 0)
+    return "Ogg";
+  if (memcmp (magic, "ID3", 3) == 0
+      || (magic[0] == 0xFF && (magic[1] & 0xE0) == 0xE0))
+    return "MPEG audio";
+  if (memcmp (magic + 4, "ftyp", 4) == 0)
+    return "MP4/QuickTime";
+  if (memcmp (magic, "FORM", 4) == 0 && (memcmp (magic + 8, "AIFF", 4) == 0
+					 || memcmp (magic + 8, "AIFC",
+						    4) == 0))
+    return "AIFF";
+  if (memcmp (magic, "caff", 4) == 0)
+    return "CAF";
+  if (memcmp (magic, "DSD ", 4) == 0)
+    return "DSF";
+  if (memcmp (magic, "FRM8", 4) == 0 && memcmp (magic + 12, "DSD ", 4) == 0)
+    return "DSDIFF";
+  if (memcmp (magic, "\x06\x0e\x2b\x34", 4) == 0)
+    return "MXF";
+  if (memcmp (magic, "\x1a\x45\xdf\xa3", 4) == 0)
+    return "Matroska";
+  if (magic[0] == 0x0B && magic[1] == 0x77)
+    return "AC-3";
+  // with or without a byte order mark
+  if (magic[0] == '<' || memcmp (magic, "\xef\xbb\xbf<", 4) == 0)
+    return "XML";
+  return NULL;
+}
 
-	  dptrWorkerArgs[w_id]->argbuffer[doublesample_index++] =
-	    get (ptr_frame->data, ch_index, smpl_index, ptr_frame->channels,
-		 codecCon->sample_fmt);
-	  // end print samples 
-	}			//for nb_samples
-    }				//for channels
-  return ptr_frame->nb_samples;
+/* A new empty file in the temporary folder, opened for writing, with its
+   name in path (4096 bytes). NULL if it could not be created. */
+FILE *
+create_temp_file (char *path, const char *stem)
+{
+#ifdef _WIN32
+  char tempdir[MAX_PATH];
+  if (GetTempPathA (MAX_PATH, tempdir) == 0
+      || GetTempFileNameA (tempdir, "lqm", 0, path) == 0)
+    {
+      path[0] = '\0';
+      return NULL;
+    }
+  return fopen (path, "wb");
+#else
+  snprintf (path, 4096, "/tmp/leqm-nrt-%s-XXXXXX", stem);
+  int fd = mkstemp (path);
+  if (fd < 0)
+    {
+      path[0] = '\0';
+      return NULL;
+    }
+  return fdopen (fd, "wb");
+#endif
 }
 
-						// will return 0 or the index of next to be copied sample, if not enough room in buffer
+/* The file at a URL downloaded to a temporary file (outpath) by the
+   command line tool for its scheme, which also finds the credentials
+   (environment, profile, instance role...). ffmpeg streams http(s) itself.
+   Returns 1 when downloaded, 0 if url is not one and -1 on error. */
 int
-transfer_decoded_samples (AVFrame * ptr_frame, double *buf,
-			  AVCodecContext * codecCon, int buffersizs,
-			  int *doublesample_index)
+fetch_url (const char *url, char *outpath)
 {
-  // static int doublesample_index = 0; //this is to index the millisecond buffer of the worker
-  //Yes the sample loop must be the external one, as I work with interleaved channels, not planar channels
-  for (int smpl_index = 0; smpl_index < ptr_frame->nb_samples; smpl_index++)
-    {				//limit to buffer measure and return rest?
-      for (int ch_index = 0; ch_index < ptr_frame->channels; ch_index++)
+  // scheme, command and the option before the file it writes, the URL
+  // and the file go through the environment
+  static const char *fetchers[][3] = {
+#ifndef FFMPEG
+    {"http://", "curl -fsSL", "-o"},
+    {"https://", "curl -fsSL", "-o"},
+#endif
+    {"s3://", "aws s3 cp --only-show-errors", ""},
+    {"gs://", "gcloud storage cp --quiet", ""},
+    // az://account/container/blob
+    {"az://", "azcopy copy --log-level ERROR", ""}
+  };
+  char command[256];
+  char line[2048];
+  char source[2048];
+  FILE *fetcher = NULL;
+  int i, n = sizeof (fetchers) / sizeof (fetchers[0]);
+
+  for (i = 0; i < n; i++)
+    {
+      if (strncmp (url, fetchers[i][0], strlen (fetchers[i][0])) == 0)
+	break;
+    }
+  if (i == n)
+    return 0;
+  snprintf (source, sizeof (source), "%s", url);
+  if (strcmp (fetchers[i][0], "az://") == 0)
+    {
+      // azcopy wants the blob endpoint of the storage account
+      const char *slash = strchr (url + 5, '/');
+      if (slash == NULL)
 	{
-	  buf[(*doublesample_index)++] =
-	    get (ptr_frame->data, ch_index, smpl_index, ptr_frame->channels,
-		 codecCon->sample_fmt);
-	  /*
-	     #ifdef DEBUG
-	     printf("%0.5f\n", buf[(*doublesample_index)-1]);
-	     #endif
-	   */
-	  if ((*doublesample_index) == buffersizs)
-	    {
-	      (*doublesample_index) = 0;
-	      //return (ptr_frame->nb_samples - smpl_index) * ptr_frame->channels;
-	      return smpl_index + 1;
-	    }
-	  // end print samples 
-	}			//for nb_samples
-    }				//for channels
-  return ptr_frame->nb_samples;
+	  printf ("Please give az://<account>/<container>/<blob>.\n");
+	  return -1;
+	}
+      snprintf (source, sizeof (source),
+		"https://%.*s.blob.core.windows.net%s",
+		(int) (slash - url - 5), url + 5, slash);
+    }
+  if ((fetcher = create_temp_file (outpath, "url")) == NULL)
+    {
+      printf ("Could not create a file for the download of %s.\n", url);
+      return -1;
+    }
+  fclose (fetcher);
+  setenv ("LEQM_FILE", source, 1);
+  setenv ("LEQM_OUT", outpath, 1);
+#ifdef _WIN32
+  snprintf (command, sizeof (command),
+	    "%s \"%%LEQM_FILE%%\" %s \"%%LEQM_OUT%%\" 2>&1", fetchers[i][1],
+	    fetchers[i][2]);
+#else
+  snprintf (command, sizeof (command),
+	    "%s \"$LEQM_FILE\" %s \"$LEQM_OUT\" 2>&1", fetchers[i][1],
+	    fetchers[i][2]);
+#endif
+  printf ("Downloading %s.\n", url);
+  fflush (stdout);
+  fetcher = popen (command, "r");
+  if (fetcher != NULL)
+    {
+      while (fgets (line, sizeof (line), fetcher) != NULL)
+	{
+	  line[strcspn (line, "\n")] = '\0';
+	  printf ("%s\n", line);
+	}
+    }
+  if (fetcher == NULL || pclose (fetcher) != 0)
+    {
+      printf ("Could not download %s.\n", url);
+      remove (outpath);
+      outpath[0] = '\0';
+      return -1;
+    }
+  return 1;
 }
 
-
+/* DSD (DSF or DSDIFF) is converted to a float WAV by the ffmpeg program,
+   into outpath. Returns 1 when converted, 0 if inpath is not DSD and -1
+   on error. */
 int
-transfer_remaining_decoded_samples (AVFrame * ptr_frame, double *bufremain,
-				    AVCodecContext * codecCon, int nxtsmpl,
-				    int *doublesample_index)
+convert_dsd (const char *inpath, char *outpath, int rate)
 {
-  //int doublesample_index = 0; //this is to index the millisecond buffer of the worker
-  //Yes the sample loop must be the external one, as I work with interleaved channels, not planar channels
-  for (int smpl_index = nxtsmpl; smpl_index < ptr_frame->nb_samples;
-       smpl_index++)
-    {				//limit to buffer measure and return rest?
-      for (int ch_index = 0; ch_index < ptr_frame->channels; ch_index++)
+  char command[256];
+  char line[2048];
+  const char *format = sniff_format (inpath);
+  FILE *ffmpeg;
+
+  if (format == NULL
+      || (strcmp (format, "DSF") != 0 && strcmp (format, "DSDIFF") != 0))
+    return 0;
+  if ((ffmpeg = create_temp_file (outpath, "dsd")) == NULL)
+    {
+      printf ("Could not create a file for the DSD conversion.\n");
+      return -1;
+    }
+  fclose (ffmpeg);
+  setenv ("LEQM_FILE", inpath, 1);
+  setenv ("LEQM_OUT", outpath, 1);
+#ifdef _WIN32
+  snprintf (command, sizeof (command),
+	    "ffmpeg -nostdin -v error -y -i \"%%LEQM_FILE%%\" -ar %d -c:a pcm_f32le -f wav \"%%LEQM_OUT%%\" 2>&1",
+	    rate);
+#else
+  snprintf (command, sizeof (command),
+	    "ffmpeg -nostdin -v error -y -i \"$LEQM_FILE\" -ar %d -c:a pcm_f32le -f wav \"$LEQM_OUT\" 2>&1",
+	    rate);
+#endif
+  fflush (stdout);
+  ffmpeg = popen (command, "r");
+  if (ffmpeg != NULL)
+    {
+      while (fgets (line, sizeof (line), ffmpeg) != NULL)
 	{
-	  bufremain[(*doublesample_index)++] =
-	    get (ptr_frame->data, ch_index, smpl_index, ptr_frame->channels,
-		 codecCon->sample_fmt);
-	  /*
-	     #ifdef DEBUG
-	     printf("%0.5f\n", bufremain[(*doublesample_index)-1]);
-	     #endif                     
-	   */
-	  // end print samples 
-	}			//for nb_samples
-    }				//for channels
-  return (ptr_frame->nb_samples) - nxtsmpl;	//but what if also the second round at the same frame fill the buffer?
+	  line[strcspn (line, "\n")] = '\0';
+	  printf ("ffmpeg: %s\n", line);
+	}
+    }
+  if (ffmpeg == NULL || pclose (ffmpeg) != 0)
+    {
+      printf ("Could not convert %s from DSD with ffmpeg.\n", inpath);
+      remove (outpath);
+      outpath[0] = '\0';
+      return -1;
+    }
+  return 1;
+}
+
+unsigned long long
+fnv1a (unsigned long long hash, const void *data, size_t len)
+{
+  // FNV-1a 64 bit, start from 14695981039346656037
+  const unsigned char *bytes = data;
+  for (size_t i = 0; i < len; i++)
+    {
+      hash ^= bytes[i];
+      hash *= 1099511628211ULL;
+    }
+  return hash;
 }
 
-#endif
+unsigned long long
+content_id (unsigned long long hash, const char *filename)
+{
+  /* hash continued over the file as stored, so that the same content
+     gets the same ID whatever its name, location or measuring machine.
+     0 if it cannot be read from the start again, e.g. a pipe */
+  unsigned char chunk[65536];
+  size_t nread;
+  FILE *stream = is_pipe (filename) ? NULL : fopen (filename, "rb");
+
+  if (stream == NULL)
+    {
+      return 0;
+    }
+  while ((nread = fread (chunk, 1, sizeof (chunk), stream)) > 0)
+    {
+      hash = fnv1a (hash, chunk, nread);
+    }
+  if (ferror (stream))
+    {
+      hash = 0;			// e.g. a folder
+    }
+  fclose (stream);
+  return hash;
+}
 
-						//to get impulse response frequency response at equally spaced intervals is needed
 
-int
-equalinterval (double *freqsamples, double *freqresp, double *eqfreqsamples,
-	       double *eqfreqresp, int points, int samplingfreq,
-	       int origpoints)
+char *
+read_options_file (const char *path)
 {
-  double freq;
-  // int findex = 0;
-  // int rindex = 0;
-  double pass = ((double) (samplingfreq >> 1)) / ((double) points);
-  for (int ieq = 0, i = 0; ieq < points; ieq++)
+  FILE *stream = fopen (path, "rb");
+  char *text;
+  long size;
+
+  if (stream == NULL)
     {
-      freq = ieq * pass;
-      eqfreqsamples[ieq] = freq;
+      return NULL;
+    }
+  fseek (stream, 0, SEEK_END);
+  size = ftell (stream);
+  fseek (stream, 0, SEEK_SET);
+  text = malloc (size + 1);
+  size = fread (text, 1, size, stream);
+  text[size] = '\0';
+  fclose (stream);
+  return text;
+}
 
-      if ((freq == 0.0) || (freq < freqsamples[1]))
-	{
-	  eqfreqresp[ieq] = freqresp[0];
-	  continue;
+// Range in seconds of a DCP reel sound or IMF resource between from and
+// to: EntryPoint and the duration element (frames or samples of EditRate,
+// else of defaultrate). The length is 0 when it plays to the end.
+static void
+cpl_range (const char *from, const char *to, const char *durationtag,
+	   const char *defaultrate, double *entry, double *length)
+{
+  char value[32];
+  double numerator = 0.0, denominator = 1.0;
+
+  *entry = 0.0;
+  *length = 0.0;
+  if (xml_element (from, to, "EditRate", value, sizeof (value)) == NULL)
+    snprintf (value, sizeof (value), "%s", defaultrate);
+  if (sscanf (value, "%lf %lf", &numerator, &denominator) != 2
+      || !(numerator > 0.0) || !(denominator > 0.0))
+    return;
+  if (xml_element (from, to, "EntryPoint", value, sizeof (value)) != NULL)
+    *entry = atof (value) * denominator / numerator;
+  if (xml_element (from, to, durationtag, value, sizeof (value)) != NULL)
+    *length = atof (value) * denominator / numerator;
+}
+
+// Path of the asset id from the ASSETMAP, in a new buffer
+static char *
+cpl_asset (const char *assetmap, const char *folder, const char *id)
+{
+  char key[160], file[1024];
+  const char *asset, *assetend;
+  char *path;
+
+  snprintf (key, sizeof (key), "<Id>%s</Id>", id);
+  asset = strstr (assetmap, key);
+  assetend = asset != NULL ? strstr (asset, "</Asset>") : NULL;
+  if (assetend == NULL
+      || xml_element (asset, assetend, "Path", file, sizeof (file)) == NULL)
+    {
+      printf ("The track file %s is not in the ASSETMAP.\n", id);
+      return NULL;
+    }
+  path = malloc (strlen (folder) + strlen (file) + 2);
+  sprintf (path, "%s/%s", folder, file);
+  return path;
+}
+
+// The sound track files of a DCP in reel order, or the audio resources of
+// an IMF composition in segment order (the main audio sequence of the
+// first segment), from the CPL (path, or the only one in the folder path)
+// and the ASSETMAP next to it, with the range played of each. Returns
+// their number, 0 if path is neither and -1 on error.
+int
+read_cpl (const char *path, char **files, double *entries, double *lengths,
+	  int maxfiles, const char **label)
+{
+  struct stat st;
+  char folder[2048], xmlpath[2048], title[256], trackid[128],
+    editrate[32];
+  char *cpl = NULL, *assetmap;
+  const char *end;
+  int imf, nfiles = 0;
+
+  if (stat (path, &st) != 0)
+    return 0;
+  if (S_ISDIR (st.st_mode))
+    {
+      DIR *dir = opendir (path);
+      struct dirent *entry;
+      snprintf (folder, sizeof (folder), "%s", path);
+      while (dir != NULL && (entry = readdir (dir)) != NULL)
+	{
+	  size_t len = strlen (entry->d_name);
+	  char *text;
+	  if (len < 4 || strcasecmp (entry->d_name + len - 4, ".xml") != 0)
+	    continue;
+	  snprintf (xmlpath, sizeof (xmlpath), "%s/%s", folder,
+		    entry->d_name);
+	  text = read_options_file (xmlpath);
+	  if (text == NULL || strstr (text, "<CompositionPlaylist") == NULL)
+	    {
+	      free (text);
+	      continue;
+	    }
+	  if (cpl != NULL)
+	    {
+	      printf
+		("There is more than one CPL in %s, please give the CPL file.\n",
+		 path);
+	      free (text);
+	      free (cpl);
+	      closedir (dir);
+	      return -1;
+	    }
+	  cpl = text;
+	}
+      if (dir != NULL)
+	closedir (dir);
+      if (cpl == NULL)
+	return 0;
+    }
+  else
+    {
+      const char *slash = strrchr (path, '/');
+      const char *format = sniff_format (path);
+      // by content, a CPL may have lost its .xml
+      if (format == NULL || strcmp (format, "XML") != 0)
+	return 0;
+      cpl = read_options_file (path);
+      if (cpl == NULL || strstr (cpl, "<CompositionPlaylist") == NULL)
+	{
+	  free (cpl);
+	  return 0;
 	}
+      if (slash != NULL)
+	snprintf (folder, sizeof (folder), "%.*s", (int) (slash - path),
+		  path);
       else
-	{
-
-	  if ((freq >= freqsamples[i]) && (freq < freqsamples[i + 1]))
+	snprintf (folder, sizeof (folder), ".");
+    }
+  snprintf (xmlpath, sizeof (xmlpath), "%s/ASSETMAP.xml", folder);
+  assetmap = read_options_file (xmlpath);
+  if (assetmap == NULL)
+    {
+      // Interop packages
+      snprintf (xmlpath, sizeof (xmlpath), "%s/ASSETMAP", folder);
+      assetmap = read_options_file (xmlpath);
+    }
+  if (assetmap == NULL)
+    {
+      printf ("No ASSETMAP next to the CPL in %s.\n", folder);
+      free (cpl);
+      return -1;
+    }
+  end = cpl + strlen (cpl);
+  imf = strstr (cpl, "<SegmentList>") != NULL;
+  *label = imf ? "Resource" : "Reel";
+  if (xml_element (cpl, end, imf ? "ContentTitle" : "ContentTitleText",
+		   title, sizeof (title)) != NULL)
+    printf ("%s composition: %s\n", imf ? "IMF" : "DCP", title);
+  if (!imf)
+    {
+      int nreel = 0;
+      for (const char *reel = strstr (cpl, "<Reel>"); reel != NULL;
+	   reel = strstr (reel + 1, "<Reel>"))
+	{
+	  const char *reelend = strstr (reel, "</Reel>");
+	  const char *sound = strstr (reel, "<MainSound>");
+	  char id[128];
+	  if (reelend == NULL)
+	    break;
+	  nreel++;
+	  if (sound == NULL || sound > reelend
+	      || xml_element (sound, reelend, "Id", id, sizeof (id)) == NULL)
 	    {
-	      eqfreqresp[ieq] =
-		((freqresp[i + 1] - freqresp[i]) / (freqsamples[i + 1] -
-						    freqsamples[i])) * (freq -
-									freqsamples
-									[i]) +
-		freqresp[i];
+	      printf ("Reel %d has no sound, left out.\n", nreel);
+	      continue;
 	    }
-	  else if (freq >= freqsamples[i + 1])
+	  if (nfiles == maxfiles)
 	    {
-	      while (freq >= freqsamples[i + 1])
+	      printf ("Only the first %d reels are measured.\n", maxfiles);
+	      break;
+	    }
+	  if ((files[nfiles] = cpl_asset (assetmap, folder, id)) == NULL)
+	    {
+	      nfiles = -1;
+	      break;
+	    }
+	  cpl_range (sound, reelend, "Duration", "24 1", &entries[nfiles],
+		     &lengths[nfiles]);
+	  printf ("Reel %d: %s\n", nreel, files[nfiles]);
+	  nfiles++;
+	}
+    }
+  else
+    {
+      // resources without EditRate use the one of the composition
+      if (xml_element (cpl, strstr (cpl, "<SegmentList>"), "EditRate",
+		       editrate, sizeof (editrate)) == NULL)
+	snprintf (editrate, sizeof (editrate), "24 1");
+      trackid[0] = '\0';
+      for (const char *segment = strstr (cpl, "<Segment>");
+	   segment != NULL && nfiles >= 0 && nfiles < maxfiles;
+	   segment = strstr (segment + 1, "<Segment>"))
+	{
+	  const char *segmentend = strstr (segment, "</Segment>");
+	  const char *sequence = segment, *sequenceend = NULL;
+	  char id[128];
+	  if (segmentend == NULL)
+	    break;
+	  // <cc:MainAudioSequence>, the namespace prefix varies
+	  while ((sequence = strstr (sequence, "MainAudioSequence>")) != NULL
+		 && sequence < segmentend)
+	    {
+	      sequenceend = strstr (sequence + 1, "MainAudioSequence>");
+	      if (sequenceend == NULL
+		  || xml_element (sequence, sequenceend, "TrackId", id,
+				  sizeof (id)) == NULL)
 		{
-		  i++;
-		  if ((i + 1) >= origpoints)
-		    {
-		      break;
-		    }
+		  sequence = NULL;
+		  break;
 		}
-	      if ((i + 1) < origpoints)
+	      if (trackid[0] == '\0')
 		{
-		  eqfreqresp[ieq] =
-		    ((freqresp[i + 1] - freqresp[i]) / (freqsamples[i + 1] -
-							freqsamples[i])) *
-		    (freq - freqsamples[i]) + freqresp[i];
+		  snprintf (trackid, sizeof (trackid), "%s", id);
+		  printf ("Audio track %s\n", trackid);
 		}
-	      else
+	      if (strcmp (id, trackid) == 0)
+		break;
+	      sequence = sequenceend + 1;
+	    }
+	  if (sequence == NULL || sequence >= segmentend)
+	    continue;
+	  for (const char *resource = strstr (sequence, "<Resource");
+	       resource != NULL && resource < sequenceend;
+	       resource = strstr (resource + 1, "<Resource"))
+	    {
+	      const char *resourceend = strstr (resource, "</Resource>");
+	      char value[32];
+	      int repeat = 1;
+	      // not <ResourceList>
+	      if (resource[9] != ' ' && resource[9] != '>')
+		continue;
+	      if (resourceend == NULL
+		  || xml_element (resource, resourceend, "TrackFileId", id,
+				  sizeof (id)) == NULL)
+		continue;
+	      if (xml_element (resource, resourceend, "RepeatCount", value,
+			       sizeof (value)) != NULL)
+		repeat = atoi (value);
+	      for (int i = 0; i < repeat; i++)
 		{
-		  eqfreqresp[ieq] =
-		    ((1 - freqresp[i]) / (((double) (samplingfreq >> 1)) -
-					  freqsamples[i])) * (freq -
-							      freqsamples[i])
-		    + freqresp[i];
+		  if (nfiles == maxfiles)
+		    {
+		      printf ("Only the first %d resources are measured.\n",
+			      maxfiles);
+		      break;
+		    }
+		  if ((files[nfiles] = cpl_asset (assetmap, folder, id)) ==
+		      NULL)
+		    {
+		      nfiles = -1;
+		      break;
+		    }
+		  cpl_range (resource, resourceend, "SourceDuration",
+			     editrate, &entries[nfiles], &lengths[nfiles]);
+		  printf ("Resource %d: %s\n", nfiles + 1, files[nfiles]);
+		  nfiles++;
 		}
+	      if (nfiles < 0 || nfiles == maxfiles)
+		break;
 	    }
 	}
     }
-  return 0;
+  free (assetmap);
+  free (cpl);
+  if (nfiles == 0)
+    {
+      printf ("The CPL has no audio.\n");
+      return -1;
+    }
+  return nfiles;
 }
 
 
-
-
-
-						//the following is different from version 1 because interpolate between db and not linear. Conversion from db to lin must be done after.
-						//it is also different for the way it interpolates between DC and 31 Hz
-						// Pay attention that also arguments to the functions are changed
 int
-equalinterval2 (double freqsamples[], double freqresp_db[],
-		double *eqfreqsamples, double *eqfreqresp, int points,
-		int samplingfreq, int origpoints, int bitdepthsoundfile)
+split_options (char *text, const char **args, int maxargs)
 {
-  double freq;
-  //calculate miminum attenuation depending on the bitdeph (minus one), that is −6.020599913 dB per bit in eccess to sign
-  double dcatt = ((double) (bitdepthsoundfile - 1)) * (-6.020599913);	// + 20.00; //in dB
-  //double dcatt = -90.3;
-  double pass = ((double) (samplingfreq >> 1)) / ((double) points);
-  for (int ieq = 0, i = 0; ieq < points; ieq++)
+  /* Options are separated by white space, "double quotes" keep a value
+     with spaces together (e.g. a hook command) and # comments out the
+     rest of the line. The text is split in place. */
+  int nargs = 0;
+  char *pt = text;
+
+  while (*pt != '\0' && nargs < maxargs)
     {
-      freq = ieq * pass;
-      eqfreqsamples[ieq] = freq;
-      if (freq == 0.0)
-	{			// I would like to cange this
-	  eqfreqresp[ieq] = dcatt;
-	}
-      else if (freq < freqsamples[0])
-	{			// this has a lot of influence on final Leq(M) value
-	  eqfreqresp[ieq] =
-	    ((freqresp_db[0] - dcatt) / (freqsamples[0] - 0)) * freq + dcatt;
-	  //eqfreqresp[ieq] = freqresp_db[0]; // Is this meaningful? Shouldn't I interpolate between 0 Hz and 31 Hz? Otherwise for DC I have -35.5 dB
+      while (isspace ((unsigned char) *pt))
+	pt++;
+      if (*pt == '\0')
+	break;
+      if (*pt == '#')
+	{
+	  while (*pt != '\0' && *pt != '\n')
+	    pt++;
 	  continue;
 	}
+      if (*pt == '"')
+	{
+	  args[nargs++] = ++pt;
+	  while (*pt != '\0' && *pt != '"')
+	    pt++;
+	}
       else
 	{
-	  if ((freq >= freqsamples[i]) && (freq < freqsamples[i + 1]))
-	    {
-	      eqfreqresp[ieq] =
-		((freqresp_db[i + 1] - freqresp_db[i]) / (freqsamples[i + 1] -
-							  freqsamples[i])) *
-		(freq - freqsamples[i]) + freqresp_db[i];
-	    }
-	  else if (freq >= freqsamples[i + 1])
-	    {
-	      while (freq >= freqsamples[i + 1])
-		{
-		  i++;
-		  if ((i + 1) >= origpoints)
-		    {
-		      break;
-		    }
-		}
-	      if ((i + 1) < origpoints)
-		{
-		  eqfreqresp[ieq] =
-		    ((freqresp_db[i + 1] -
-		      freqresp_db[i]) / (freqsamples[i + 1] -
-					 freqsamples[i])) * (freq -
-							     freqsamples[i]) +
-		    freqresp_db[i];
-		}
-	      else
-		{
-		  eqfreqresp[ieq] =
-		    ((1 - freqresp_db[i]) / (((double) (samplingfreq >> 1)) -
-					     freqsamples[i])) * (freq -
-								 freqsamples
-								 [i]) +
-		    freqresp_db[i];
-		}
-	    }
+	  args[nargs++] = pt;
+	  while (*pt != '\0' && !isspace ((unsigned char) *pt))
+	    pt++;
 	}
+      if (*pt != '\0')
+	*pt++ = '\0';
     }
-  return 0;
+  return nargs;
 }
 
+
 int
-equalinterval3 (double freqsamples[], double freqresp_db[],
-		double *eqfreqsamples, double *eqfreqresp, int points,
-		int samplingfreq, int origpoints, int bitdepthsoundfile)
+negate_options (const char **args, int nargs)
 {
-  double freq;
-  double firstslope =
-    (freqresp_db[1] - freqresp_db[0]) / (freqsamples[1] - freqsamples[0]);
-  /* DC attenuation is calculated from the first slope of attenuation curve sampling points */
-  double dcatt = freqresp_db[0] - firstslope * freqsamples[0];
-  double pass = ((double) (samplingfreq >> 1)) / ((double) points);
-  for (int ieq = 0, i = 0; ieq < points; ieq++)
+  /* --no-<switch> takes back a switch without value given earlier, e.g.
+     --leqnw of the options file. Both are removed from the arguments,
+     switches implying the negated one (--lra for --lkfs) still do. */
+  static const char *const switches[] = {
+    "accessibility", "measurementid", "dcoffset", "noskip", "statlevels",
+    "silence", "gate-silence", "linetone", "exclude-linetone",
+    "correlation", "vad", "exclude-lfe", "lfe-compare", "centre",
+    "balance", "follow", "chapters", "bandwidth", "clipping", "replaygain",
+    "soundcheck", "truepeak", "quiet", "verbose", "meter", "timing",
+    "dolbydi", "printdiinfo", "lkfs", "lufs", "lra", "maxloudness",
+    "logleqm10", "logleqm", "leqnw", NULL
+  };
+  int n = 0;
+
+  for (int i = 0; i < nargs; i++)
     {
-      freq = ieq * pass;
-      eqfreqsamples[ieq] = freq;
-      if (freq < freqsamples[0])
-	{			/* If frequency is less than first sampling point of M definition, slope of first and second point is used */// this has a lot of influence on final Leq(M) value
-	  eqfreqresp[ieq] = firstslope * freq + dcatt;
-	  //eqfreqresp[ieq] = freqresp_db[0]; // Is this meaningful? Shouldn't I interpolate between 0 Hz and 31 Hz? Otherwise for DC I have -35.5 dB
+      const char *name;
+      int known = 0;
+
+      if (strncmp (args[i], "--no-", 5) != 0)
+	{
+	  args[n++] = args[i];
 	  continue;
 	}
-      else
-	{			/* all frequencies in between sampling frequencies of M definition */
-	  if ((freq >= freqsamples[i]) && (i == (origpoints - 1)))
-	    {
-	      eqfreqresp[ieq] =
-		((freqresp_db[origpoints - 1] -
-		  freqresp_db[origpoints - 2]) / (freqsamples[origpoints -
-							      1] -
-						  freqsamples[origpoints -
-							      2])) * (freq -
-								      freqsamples
-								      [origpoints
-								       - 1]) +
-		freqresp_db[origpoints - 1];
-	    }
-	  else if ((freq >= freqsamples[i]) && (freq < freqsamples[i + 1]))
-	    {
-	      eqfreqresp[ieq] =
-		((freqresp_db[i + 1] - freqresp_db[i]) / (freqsamples[i + 1] -
-							  freqsamples[i])) *
-		(freq - freqsamples[i]) + freqresp_db[i];
-	    }
-	  else if (freq >= freqsamples[i + 1])
+      name = args[i] + 5;
+      for (int k = 0; switches[k] != NULL; k++)
+	{
+	  if (strcmp (name, switches[k]) == 0)
+	    known = 1;
+	}
+      if (!known)
+	{
+	  args[n++] = args[i];
+	  continue;
+	}
+      // --lkfs and --lufs are the same switch
+      for (int j = n - 1; j >= 0; j--)
+	{
+	  if (strncmp (args[j], "--", 2) == 0
+	      && (strcmp (args[j] + 2, name) == 0
+		  || ((strcmp (name, "lkfs") == 0
+		       || strcmp (name, "lufs") == 0)
+		      && (strcmp (args[j], "--lkfs") == 0
+			  || strcmp (args[j], "--lufs") == 0))))
 	    {
-	      while (freq >= freqsamples[i + 1])
-		{
-		  i++;
-		  if ((i + 1) >= origpoints)
-		    {
-		      break;
-		    }
-		}		// while
-	      if ((i + 1) < origpoints)
-		{
-		  eqfreqresp[ieq] =
-		    ((freqresp_db[i + 1] -
-		      freqresp_db[i]) / (freqsamples[i + 1] -
-					 freqsamples[i])) * (freq -
-							     freqsamples[i]) +
-		    freqresp_db[i];
-		}
-	      else
-		{
-		  eqfreqresp[ieq] =
-		    ((1 - freqresp_db[i]) / (((double) (samplingfreq >> 1)) -
-					     freqsamples[i])) * (freq -
-								 freqsamples
-								 [i]) +
-		    freqresp_db[i];
-		}
+	      memmove (&args[j], &args[j + 1], sizeof (char *) * (n - j - 1));
+	      n--;
 	    }
 	}
     }
-  return 0;
+  args[n] = NULL;
+  return n;
 }
 
+FILE *
+start_plugin (const char *command, int samplerate, int nch)
+{
+  /* A plugin reads on its standard input a header line
+     "LEQM-PCM 1 <sample rate> <channels>" followed by frames, each a 32 bit
+     little endian count of sample frames and as many interleaved 32 bit
+     little endian float samples per channel. A count of 0 ends the stream.
+     Whatever the plugin prints, JSON by convention, lands in the report. */
+  FILE *plugin;
+
+  fflush (stdout);
+#ifndef _WIN32
+  signal (SIGPIPE, SIG_IGN);	// a plugin may stop reading early
+  plugin = popen (command, "w");
+#else
+  plugin = popen (command, "wb");
+#endif
+  if (plugin != NULL)
+    {
+      // frames are written in one piece, so nothing is left to flush on pclose if the plugin quits
+      setvbuf (plugin, NULL, _IONBF, 0);
+      fprintf (plugin, "LEQM-PCM 1 %d %d\n", samplerate, nch);
+    }
+  return plugin;
+}
 
+void
+plugin_write (FILE * plugin, double *interleaved, int nsamples, int nch)
+{
+  uint32_t frames = nsamples / nch;
+  unsigned char *le = malloc (4 * (nsamples + 1));
 
-
+  for (int b = 0; b < 4; b++)
+    le[b] = (frames >> (8 * b)) & 0xff;
+  for (int n = 0; n < nsamples; n++)
+    {
+      float sample = (float) interleaved[n];
+      uint32_t bits;
+      memcpy (&bits, &sample, 4);
+      for (int b = 0; b < 4; b++)
+	le[4 * (n + 1) + b] = (bits >> (8 * b)) & 0xff;
+    }
+  fwrite (le, 1, 4 * (nsamples + 1), plugin);
+  free (le);
+}
 
 int
-convloglin (double *in, double *out, int points)
+finish_plugin (FILE * plugin, const char *command)
 {
-  for (int i = 0; i < points; i++)
+  unsigned char end[4] = { 0, 0, 0, 0 };
+  int status;
+
+  fwrite (end, 1, 4, plugin);
+  fflush (stdout);
+  status = pclose (plugin);
+#ifndef _WIN32
+  if (status != -1 && WIFEXITED (status))
     {
-      out[i] = pow (10, (in[i] / 20.0));
+      status = WEXITSTATUS (status);
     }
-
-  return 0;
+#endif
+  if (status != 0)
+    {
+      printf ("Plugin %s exited with status %d.\n", command, status);
+    }
+  return status;
 }
 
 
-double
-convlinlog_single (double in)
+int
+run_posthook (const char *command, const char *filename,
+	      const char *measurementid, struct Sum *totsum,
+	      const char *extrajson)
 {
-  double out;
-  out = log10 (in) * 20.0f;
-  return out;
-}
-
+  /* results are passed twice: as environment variables for simple shell
+     scripts and as a JSON object on the standard input of the hook */
+  char value[64];
+  FILE *hook;
+  int status;
+#ifndef _WIN32
+  void (*oldpipe) (int);
+#endif
+
+  setenv ("LEQM_FILE", filename, 1);
+  snprintf (value, sizeof (value), "%.4f", rounddb (totsum->leqm, 4));
+  setenv ("LEQM_LEQM", value, 1);
+  snprintf (value, sizeof (value), "%.4f", rounddb (totsum->rms, 4));
+  setenv ("LEQM_LEQNW", value, 1);
+  if (measurementid != NULL)
+    {
+      setenv ("LEQM_ID", measurementid, 1);
+    }
 
-double
-convloglin_single (double in)
-{
-  double out;
-  out = powf (10, in / 20.0f);
-  return out;
+  fflush (stdout);
+#ifndef _WIN32
+  oldpipe = signal (SIGPIPE, SIG_IGN);	// the hook is free not to read its input
+#endif
+  hook = popen (command, "w");
+  if (hook == NULL)
+    {
+      printf ("Could not run post-hook %s.\n", command);
+#ifndef _WIN32
+      signal (SIGPIPE, oldpipe);
+#endif
+      return -1;
+    }
+  fprintf (hook, "{");
+  if (measurementid != NULL)
+    {
+      fprintf (hook, "\"id\": \"%s\", ", measurementid);
+    }
+  fprintf (hook, "\"file\": ");
+  fputs_json_string (filename, hook);
+  fprintf (hook, ", \"leqm\": %.4f, \"leqnw\": %.4f",
+	   rounddb (totsum->leqm, 4), rounddb (totsum->rms, 4));
+  if (extrajson != NULL)
+    {
+      fputs (extrajson, hook);	// further members, each starting with ", "
+    }
+  fprintf (hook, "}\n");
+  status = pclose (hook);
+#ifndef _WIN32
+  signal (SIGPIPE, oldpipe);
+  if (status != -1 && WIFEXITED (status))
+    {
+      status = WEXITSTATUS (status);
+    }
+#endif
+  if (status != 0)
+    {
+      printf ("Post-hook exited with status %d.\n", status);
+    }
+  return status;
 }
 
 						// convolution
@@ -5812,6 +11575,171 @@ accumulatech (double *chaccumulator, double *inputchannel, int nsamples)
   return 0;
 }
 
+
+int
+accumulatechenergy (double *chsum, int channel, double *squared,
+		    int nsamples)
+{
+  double energy = 0.0;
+  for (int i = 0; i < nsamples; i++)
+    {
+      energy += squared[i];
+    }
+  pthread_mutex_lock (&mutex);
+  chsum[channel] += energy;
+  pthread_mutex_unlock (&mutex);
+  return 0;
+}
+
+
+int
+accumulatechdc (double *chdc, int channel, double *interleaved,
+		int nsamples, int nch)
+{
+  double sum = 0.0;
+  for (int n = channel; n < nsamples; n += nch)
+    {
+      sum += interleaved[n];
+    }
+  pthread_mutex_lock (&mutex);
+  chdc[channel] += sum;
+  pthread_mutex_unlock (&mutex);
+  return 0;
+}
+
+
+double
+channelleq (double chsum, long long nsamples)
+{
+  /* same reference as meanoverduration, so that the per channel values
+     add up in power to the program value */
+  double leq = 10 * log10 (chsum / ((double) nsamples)) + 108.010299957;
+  if (!(leq > 0.0))
+    {
+      leq = 0.0;
+    }
+  return leq;
+}
+
+/* Redraw the --meter display on stderr: a bar per channel with its Leq(M)
+   since the last redraw (40 to 100 dB), the running program Leq(M), the
+   short-term one over the same span and the true peak so far (NULL
+   without --truepeak). At most every 200 ms until the final one. */
+void
+draw_meter (struct Meter *meter, struct Sum *totsum, const double *chsum,
+	    int nch, const char **names, const double *truepeaks,
+	    int samplerate, int final)
+{
+  struct timespec now;
+  struct Sum running = *totsum;
+  struct Sum window = *totsum;
+  long long nsamples = totsum->nsamples - meter->lastsum.nsamples;
+  char label[32];
+  double peak = 0.0;
+
+  clock_gettime (CLOCK_MONOTONIC, &now);
+  if (nsamples <= 0 || (!final && meter->lines > 0
+			&& (now.tv_sec - meter->lastdraw.tv_sec) +
+			(now.tv_nsec - meter->lastdraw.tv_nsec) / 1e9 < 0.2))
+    return;
+  if (meter->lines > 0)
+    fprintf (stderr, "\033[%dA", meter->lines);
+  for (int i = 0; i < nch; i++)
+    {
+      double level = channelleq (chsum[i] - meter->lastchsum[i], nsamples);
+      int width = (int) ((level - 40.0) / 60.0 * 50.0);
+      fprintf (stderr, "\033[K%-12s %5.1f |",
+	       channel_label (label, sizeof (label), i, names), level);
+      for (int j = 0; j < 50; j++)
+	fputc (j < width ? '#' : ' ', stderr);
+      fprintf (stderr, "|\n");
+      meter->lastchsum[i] = chsum[i];
+      if (truepeaks != NULL && truepeaks[i] > peak)
+	peak = truepeaks[i];
+    }
+  window.csum -= meter->lastsum.csum;
+  window.sum -= meter->lastsum.sum;
+  window.nsamples = nsamples;
+  meanoverduration (&running);
+  meanoverduration (&window);
+  fprintf (stderr, "\033[K%8.1f s  Leq(M) %.1f  short-term %.1f",
+	   totsum->nsamples / (double) samplerate, running.leqm,
+	   window.leqm);
+  if (truepeaks != NULL && peak > 0.0)
+    fprintf (stderr, "  true peak %.1f dBFS", log10 (peak) * 10 + 12.04);
+  fprintf (stderr, "\n");
+  fflush (stderr);
+  meter->lines = nch + 1;
+  meter->lastsum = *totsum;
+  meter->lastdraw = now;
+}
+
+/* A --progress-json snapshot, one JSON object per line on stderr: wall
+   clock seconds since the start, frames and seconds of audio measured and
+   the running Leq(M). Every interval seconds (lastemit is the last one),
+   the final one with "done" true. */
+void
+progress_json (struct Sum *totsum, int samplerate,
+	       const struct timespec *start, double interval,
+	       double *lastemit, int final)
+{
+  struct timespec now;
+  struct Sum running = *totsum;
+  double elapsed;
+
+  clock_gettime (CLOCK_MONOTONIC, &now);
+  elapsed = (now.tv_sec - start->tv_sec) +
+    (now.tv_nsec - start->tv_nsec) / 1e9;
+  if ((!final && elapsed - *lastemit < interval) || totsum->nsamples <= 0)
+    return;
+  meanoverduration (&running);
+  fprintf (stderr,
+	   "{\"elapsed\": %.3f, \"frames\": %lld, \"seconds\": %.3f, \"leqm\": %.4f, \"done\": %s}\n",
+	   elapsed, totsum->nsamples, totsum->nsamples / (double) samplerate,
+	   rounddb (running.leqm, 4), final ? "true" : "false");
+  fflush (stderr);
+  *lastemit = elapsed;
+}
+
+/* The progress bar on stderr, with the time left estimated from the
+   elapsed one. Only after the first second (short files go without) and
+   at most every 200 ms, the final call clears it. */
+void
+draw_progress (long long frames, long long totalframes,
+	       const struct timespec *start, double *lastdraw, int final)
+{
+  struct timespec now;
+  double elapsed, fraction;
+  char bar[41];
+  int width, left;
+
+  if (final)
+    {
+      if (*lastdraw > 0.0)
+	{
+	  fprintf (stderr, "\r\033[K");
+	  fflush (stderr);
+	}
+      return;
+    }
+  clock_gettime (CLOCK_MONOTONIC, &now);
+  elapsed = (now.tv_sec - start->tv_sec) +
+    (now.tv_nsec - start->tv_nsec) / 1e9;
+  if (totalframes <= 0 || frames <= 0 || elapsed < 1.0
+      || elapsed - *lastdraw < 0.2)
+    return;
+  fraction = frames < totalframes ? frames / (double) totalframes : 1.0;
+  width = (int) (fraction * 40);
+  memset (bar, '#', width);
+  memset (bar + width, '.', 40 - width);
+  bar[40] = '\0';
+  left = (int) (elapsed / fraction - elapsed + 0.5);
+  fprintf (stderr, "\r[%s] %3d%%  ETA %02d:%02d:%02d", bar,
+	   (int) (fraction * 100), left / 3600, left / 60 % 60, left % 60);
+  fflush (stderr);
+  *lastdraw = elapsed;
+}
+
 double
 msaccumulate (double *inputbuffer, int nsamples)
 {
@@ -5910,7 +11838,585 @@ sumandshorttermavrg (double *channelaccumulator, int nsamples)
       stsum += channelaccumulator[i];
 
     }
-  return stsum / (double) nsamples;
+  return stsum / (double) nsamples;
+}
+
+void
+statlevels_finalcomputation (double *shorttermarray, int nperiods,
+			     int buffersizems, const char *label)
+{
+  /* Ln is the level exceeded during n percent of the windows */
+  double *levels = malloc (sizeof (double) * nperiods);
+  int ln[3] = { 10, 50, 90 };
+
+  if (nperiods < 1)
+    {
+      free (levels);
+      return;
+    }
+  for (int i = 0; i < nperiods; i++)
+    {
+      levels[i] = 10 * log10 (shorttermarray[i]) + 108.010299957;
+      if (!(levels[i] > 0.0))
+	levels[i] = 0.0;
+    }
+  qsort (levels, nperiods, sizeof (double), comparedoubles);
+  printf ("Statistical levels over %d ms windows:\n", buffersizems);
+  for (int i = 0; i < 3; i++)
+    {
+      printf ("L%d Leq(%s): %.4f\n", ln[i], label,
+	      rounddb (levels[(int)
+			      round ((nperiods - 1) * (1.0 - ln[i] / 100.0))],
+		       4));
+    }
+  free (levels);
+}
+
+// Concatenate JSON members, both strings are taken over, a NULL member
+// (nothing to report) leaves json as it is
+char *
+append_json (char *json, char *member)
+{
+  if (member == NULL)
+    return json;
+  if (json == NULL)
+    return member;
+  json = realloc (json, strlen (json) + strlen (member) + 1);
+  strcat (json, member);
+  free (member);
+  return json;
+}
+
+// Comma separated channel numbers from 1, returns how many or -1
+int
+parse_channellist (const char *spec, int *channels, int maxchannels)
+{
+  int n = 0;
+  const char *p = spec;
+
+  while (*p != '\0')
+    {
+      char *end;
+      long channel = strtol (p, &end, 10);
+      if (end == p || channel < 1 || n == maxchannels
+	  || (*end != ',' && *end != '\0'))
+	return -1;
+      channels[n++] = (int) channel;
+      p = (*end == ',') ? end + 1 : end;
+    }
+  return n;
+}
+
+char *
+histogram_finalcomputation (double *shorttermarray, int nperiods,
+			    double binwidth, const char *label)
+{
+  /* Prints the histogram and returns it as a JSON member for the post-hook,
+     contiguous bins from the lowest to the highest level, lower bin edges */
+  int lowbin = 0;
+  int highbin = 0;
+  int nbins;
+  int *counts;
+  char *json;
+  size_t jsonsize;
+  size_t jsonlen;
+
+  if (nperiods < 1)
+    return NULL;
+  for (int i = 0; i < nperiods; i++)
+    {
+      double level = 10 * log10 (shorttermarray[i]) + 108.010299957;
+      int bin = (int) floor ((level > 0.0 ? level : 0.0) / binwidth);
+      if (i == 0 || bin < lowbin)
+	lowbin = bin;
+      if (i == 0 || bin > highbin)
+	highbin = bin;
+    }
+  nbins = highbin - lowbin + 1;
+  counts = calloc (nbins, sizeof (int));
+  for (int i = 0; i < nperiods; i++)
+    {
+      double level = 10 * log10 (shorttermarray[i]) + 108.010299957;
+      counts[(int) floor ((level > 0.0 ? level : 0.0) / binwidth) -
+	     lowbin]++;
+    }
+
+  jsonsize = 64 + 32 * (size_t) nbins;
+  json = malloc (jsonsize);
+  jsonlen = snprintf (json, jsonsize,
+		      ", \"histogram\": {\"binwidth\": %.4f, \"bins\": [",
+		      binwidth);
+  printf ("Histogram of window Leq(%s), %.2f dB bins (lower edge, count):\n",
+	  label, binwidth);
+  for (int b = 0; b < nbins; b++)
+    {
+      printf ("%.2f\t%d\n", (lowbin + b) * binwidth, counts[b]);
+      jsonlen += snprintf (json + jsonlen, jsonsize - jsonlen, "%s[%.4f, %d]",
+			   b ? ", " : "", (lowbin + b) * binwidth, counts[b]);
+    }
+  snprintf (json + jsonlen, jsonsize - jsonlen, "]}");
+  free (counts);
+  return json;
+}
+
+int
+write_timeseries (const char *filename, double *shorttermarray,
+		  double *shorttermnwarray, int nperiods, double buffersec,
+		  double lastbuffersec, const char *label)
+{
+  /* one row per window, time is the end of the window as in leqmlog.txt */
+  FILE *csv = fopen (filename, "w");
+  double time = 0.0;
+
+  if (csv == NULL)
+    {
+      printf ("Could not open %s for writing.\n", filename);
+      return 1;
+    }
+  fprintf (csv, "time_s,leq_%s,leq_nw\n", label);
+  for (int i = 0; i < nperiods; i++)
+    {
+      double leqm = 10 * log10 (shorttermarray[i]) + 108.010299957;
+      double leqnw = 10 * log10 (shorttermnwarray[i]) + 108.010299957;
+      time += (i == nperiods - 1) ? lastbuffersec : buffersec;
+      fprintf (csv, "%.4f,%.4f,%.4f\n", time,
+	       rounddb (leqm > 0.0 ? leqm : 0.0, 4),
+	       rounddb (leqnw > 0.0 ? leqnw : 0.0, 4));
+    }
+  fclose (csv);
+  return 0;
+}
+
+/* Seconds, mm:ss or hh:mm:ss, each with optional decimals. Returns -1 on
+   error. */
+double
+parse_clocktime (const char *spec)
+{
+  double seconds = 0.0;
+  const char *p = spec;
+
+  for (int field = 0; field < 3; field++)
+    {
+      char *end;
+      double value = strtod (p, &end);
+      if (end == p || value < 0.0)
+	return -1.0;
+      seconds = seconds * 60.0 + value;
+      if (*end == '\0')
+	return seconds;
+      if (*end != ':')
+	return -1.0;
+      p = end + 1;
+    }
+  return -1.0;
+}
+
+/* Comma separated lengths in seconds, with optional s, m or h suffix.
+   Returns the number of lengths or -1. */
+int
+parse_segmentlengths (const char *spec, double *lengths, int maxlengths)
+{
+  int n = 0;
+  const char *p = spec;
+
+  while (*p != '\0')
+    {
+      char *end;
+      double value = strtod (p, &end);
+      if (end == p || n == maxlengths)
+	return -1;
+      if (*end == 's')
+	end++;
+      else if (*end == 'm')
+	{
+	  value *= 60.0;
+	  end++;
+	}
+      else if (*end == 'h')
+	{
+	  value *= 3600.0;
+	  end++;
+	}
+      if (!(value > 0.0) || (*end != ',' && *end != '\0'))
+	return -1;
+      lengths[n++] = value;
+      p = (*end == ',') ? end + 1 : end;
+    }
+  return n;
+}
+
+static void
+print_segment (const char *kind, int n, const char *title, double start,
+	       double end, double energy, double duration, const char *label)
+{
+  char tcstart[16], tcend[16];
+
+  format_timecode (tcstart, sizeof (tcstart), tcoffset + start, tcrate);
+  format_timecode (tcend, sizeof (tcend), tcoffset + end, tcrate);
+  printf ("%s %d (%s - %s)", kind, n, tcstart, tcend);
+  if (title != NULL)
+    printf (" %s", title);
+  if (duration > 0.0)
+    {
+      double leq = 10 * log10 (energy / duration) + 108.010299957;
+      printf (": Leq(%s) %.4f\n", label,
+	      rounddb (leq > 0.0 ? leq : 0.0, 4));
+    }
+  else
+    {
+      printf (": shorter than buffersize, not measured\n");
+    }
+}
+
+void
+segment_finalcomputation (double *shorttermarray, int nperiods,
+			  double buffersec, double lastbuffersec,
+			  double *lengths, int nlengths, const char *kind,
+			  char **titles, const char *label)
+{
+  /* a buffer belongs to the segment its start falls in, so boundaries
+     are rounded to buffersize */
+  int segment = 0;
+  double segmentstart = 0.0;
+  double segmentend = lengths[0];
+  double energy = 0.0;
+  double duration = 0.0;
+
+  for (int i = 0; i < nperiods; i++)
+    {
+      double start = i * buffersec;
+      while (start >= segmentend - buffersec / 2)
+	{
+	  print_segment (kind, segment + 1,
+			 titles != NULL ? titles[segment] : NULL,
+			 segmentstart, start, energy, duration, label);
+	  segment++;
+	  segmentstart = start;
+	  segmentend +=
+	    lengths[segment < nlengths ? segment : nlengths - 1];
+	  energy = 0.0;
+	  duration = 0.0;
+	}
+      double d = (i == nperiods - 1) ? lastbuffersec : buffersec;
+      energy += shorttermarray[i] * d;
+      duration += d;
+    }
+  print_segment (kind, segment + 1,
+		 titles != NULL ? titles[segment] : NULL, segmentstart,
+		 segmentstart + duration, energy, duration, label);
+}
+
+void
+tracks_finalcomputation (double *shorttermarray, int nperiods,
+			 double buffersec, double lastbuffersec,
+			 double *starts, char **titles, int ntracks,
+			 const char *kind, const char *label)
+{
+  // a track lasts until the next one starts, the first one from 0
+  double *lengths = malloc (sizeof (double) * ntracks);
+
+  for (int i = 0; i < ntracks; i++)
+    {
+      lengths[i] = (i + 1 < ntracks) ?
+	starts[i + 1] - (i > 0 ? starts[i] : 0.0) : 1e12;
+    }
+  segment_finalcomputation (shorttermarray, nperiods, buffersec,
+			    lastbuffersec, lengths, ntracks, kind, titles,
+			    label);
+  free (lengths);
+}
+
+/* Track start times (INDEX 01) and titles of a single file CUE sheet.
+   Returns the number of tracks or -1. */
+int
+read_cuesheet (const char *path, double *starts, char **titles,
+	       int maxtracks)
+{
+  FILE *cue = fopen (path, "r");
+  char line[1024];
+  int ntracks = 0;
+  int nfiles = 0;
+
+  if (cue == NULL)
+    return -1;
+  while (fgets (line, sizeof (line), cue) != NULL)
+    {
+      char *pt = line;
+      int tracknumber, indexnumber, mm, ss, ff;
+      while (isspace ((unsigned char) *pt))
+	pt++;
+      if (strncmp (pt, "FILE ", 5) == 0)
+	{
+	  nfiles++;
+	}
+      else if (sscanf (pt, "TRACK %d", &tracknumber) == 1)
+	{
+	  if (ntracks == maxtracks)
+	    break;
+	  starts[ntracks] = -1.0;
+	  titles[ntracks] = NULL;
+	  ntracks++;
+	}
+      else if (ntracks > 0 && strncmp (pt, "TITLE ", 6) == 0
+	       && titles[ntracks - 1] == NULL)
+	{
+	  char *title = pt + 6;
+	  title[strcspn (title, "\r\n")] = '\0';
+	  titles[ntracks - 1] = strdup (title);
+	}
+      else if (ntracks > 0
+	       && sscanf (pt, "INDEX %d %d:%d:%d", &indexnumber, &mm, &ss,
+			  &ff) == 4 && indexnumber == 1)
+	{
+	  // CD frames, 75 per second
+	  starts[ntracks - 1] = mm * 60.0 + ss + ff / 75.0;
+	}
+    }
+  fclose (cue);
+  int valid = ntracks > 0;
+  if (nfiles > 1)
+    {
+      printf ("Only CUE sheets for a single audio file are supported.\n");
+      valid = 0;
+    }
+  for (int i = 0; valid && i < ntracks; i++)
+    {
+      if (starts[i] < 0.0 || (i > 0 && starts[i] < starts[i - 1]))
+	{
+	  printf ("Track %d of the CUE sheet has no valid INDEX 01.\n",
+		  i + 1);
+	  valid = 0;
+	}
+    }
+  if (!valid)
+    {
+      for (int i = 0; i < ntracks; i++)
+	free (titles[i]);
+      return -1;
+    }
+  return ntracks;
+}
+
+void
+maxwindow_finalcomputation (double *shorttermarray, int nperiods,
+			    double buffersec, double lastbuffersec,
+			    double windowsec, const char *label)
+{
+  /* the window slides by one buffer, so its length and position are
+     multiples of buffersize */
+  int nwin = (int) round (windowsec / buffersec);
+  double maxenergy = -1.0;
+  int maxstart = 0;
+
+  if (nwin < 1)
+    nwin = 1;
+  if (nwin > nperiods)
+    {
+      printf ("Max Leq(%s) over %.1f s: not available, program shorter.\n",
+	      label, windowsec);
+      return;
+    }
+  for (int start = 0; start + nwin <= nperiods; start++)
+    {
+      double energy = 0.0;
+      double duration = 0.0;
+      for (int i = start; i < start + nwin; i++)
+	{
+	  double d = (i == nperiods - 1) ? lastbuffersec : buffersec;
+	  energy += shorttermarray[i] * d;
+	  duration += d;
+	}
+      energy /= duration;
+      if (energy > maxenergy)
+	{
+	  maxenergy = energy;
+	  maxstart = start;
+	}
+    }
+  double leq = 10 * log10 (maxenergy) + 108.010299957;
+  char tc[16];
+  format_timecode (tc, sizeof (tc), tcoffset + maxstart * buffersec, tcrate);
+  printf ("Max Leq(%s) over %.1f s: %.4f from %.3f s (%s)\n", label,
+	  nwin * buffersec, rounddb (leq > 0.0 ? leq : 0.0, 4),
+	  maxstart * buffersec, tc);
+}
+
+void
+vad_finalcomputation (double *shorttermarray, int *speecharray, int nperiods,
+		      double buffersec, double lastbuffersec,
+		      const char *label)
+{
+  double speechenergy = 0.0;
+  double speechsec = 0.0;
+  double total = (nperiods - 1) * buffersec + lastbuffersec;
+
+  if (nperiods < 1)
+    return;
+  for (int i = 0; i < nperiods; i++)
+    {
+      double d = (i == nperiods - 1) ? lastbuffersec : buffersec;
+      if (speecharray[i])
+	{
+	  speechenergy += shorttermarray[i] * d;
+	  speechsec += d;
+	}
+    }
+  printf ("Speech detected: %.3f s (%.2f%%)\n", speechsec,
+	  100.0 * speechsec / total);
+  if (speechsec == 0.0)
+    {
+      printf ("Leq(%s,VAD): not available, no speech detected.\n", label);
+      return;
+    }
+  double leq = 10 * log10 (speechenergy / speechsec) + 108.010299957;
+  printf ("Leq(%s,VAD): %.4f\n", label, rounddb (leq > 0.0 ? leq : 0.0, 4));
+}
+
+/* Prints the runs of silent buffers that are at the start or the end, or
+   else at least 1 s long, and marks them in gate unless it is NULL */
+void
+silence_finalcomputation (int *silencearray, int nperiods, double buffersec,
+			  double lastbuffersec, int *gate)
+{
+  double total = (nperiods - 1) * buffersec + lastbuffersec;
+  double silent = 0.0;
+  int nregions = 0;
+
+  for (int i = 0; i < nperiods;)
+    {
+      if (!silencearray[i])
+	{
+	  i++;
+	  continue;
+	}
+      int first = i;
+      while (i < nperiods && silencearray[i])
+	i++;
+      double start = first * buffersec;
+      double end = (i == nperiods) ? total : i * buffersec;
+      const char *where = "internal";
+      if (first == 0 && i == nperiods)
+	where = "whole program";
+      else if (first == 0)
+	where = "leading";
+      else if (i == nperiods)
+	where = "trailing";
+      else if (end - start < 1.0)
+	continue;
+      char tcstart[16], tcend[16];
+      format_timecode (tcstart, sizeof (tcstart), tcoffset + start, tcrate);
+      format_timecode (tcend, sizeof (tcend), tcoffset + end, tcrate);
+      printf ("Silence %d (%s - %s): %.3f s, %s\n", ++nregions, tcstart,
+	      tcend, end - start, where);
+      for (int j = first; gate != NULL && j < i; j++)
+	gate[j] = 1;
+      silent += end - start;
+    }
+  if (nperiods > 0)
+    printf ("Silence: %.3f s (%.2f%%)\n", silent, 100.0 * silent / total);
+}
+
+/* The line-up tone has to start the program, at most after silence, and
+   last 2 s. Its level is the median of the tone buffers, so that the
+   buffers only partly filled with tone at either end do not count. */
+void
+tone_finalcomputation (double *tonearray, int nperiods, double buffersec,
+		       double lastbuffersec, int *gate)
+{
+  int first = 0;
+  int end;
+
+  while (first < nperiods && isinf (tonearray[first]))
+    first++;
+  for (end = first; end < nperiods && isfinite (tonearray[end]); end++)
+    ;
+  double start = first * buffersec;
+  double stop = (end == nperiods) ? (nperiods - 1) * buffersec +
+    lastbuffersec : end * buffersec;
+  if (end == first || stop - start < 2.0)
+    {
+      printf ("Line-up tone: none found.\n");
+      return;
+    }
+  double *levels = malloc (sizeof (double) * (end - first));
+  memcpy (levels, tonearray + first, sizeof (double) * (end - first));
+  qsort (levels, end - first, sizeof (double), comparedoubles);
+  char tcstart[16], tcend[16];
+  format_timecode (tcstart, sizeof (tcstart), tcoffset + start, tcrate);
+  format_timecode (tcend, sizeof (tcend), tcoffset + stop, tcrate);
+  printf ("Line-up tone (%s - %s): 1 kHz at %.2f dBFS, %.3f s\n", tcstart,
+	  tcend, rounddb (levels[(end - first) / 2], 2), stop - start);
+  free (levels);
+  for (int i = first; gate != NULL && i < end; i++)
+    gate[i] = 1;
+}
+
+void
+correlation_finalcomputation (double *correlationarray, int nperiods,
+			      double buffersec, double lastbuffersec)
+{
+  double sum = 0.0;
+  double measured = 0.0;
+  double outofphase = 0.0;
+  double minimum = 2.0;
+  int minindex = 0;
+
+  for (int i = 0; i < nperiods; i++)
+    {
+      double d = (i == nperiods - 1) ? lastbuffersec : buffersec;
+      if (isnan (correlationarray[i]))
+	continue;
+      sum += correlationarray[i] * d;
+      measured += d;
+      if (correlationarray[i] < -0.5)
+	outofphase += d;
+      if (correlationarray[i] < minimum)
+	{
+	  minimum = correlationarray[i];
+	  minindex = i;
+	}
+    }
+  if (measured == 0.0)
+    {
+      printf ("Phase correlation: not available, no signal.\n");
+      return;
+    }
+  char tc[16];
+  format_timecode (tc, sizeof (tc), tcoffset + minindex * buffersec, tcrate);
+  printf ("Phase correlation: average %.2f, minimum %.2f at %.3f s (%s)\n",
+	  sum / measured, minimum, minindex * buffersec, tc);
+  if (outofphase > 0.0)
+    {
+      printf
+	("Warning: out of phase content (correlation below -0.5) for %.3f s (%.2f%%).\n",
+	 outofphase, 100.0 * outofphase / measured);
+    }
+}
+
+void
+timeabove_finalcomputation (double *shorttermarray, int nperiods,
+			    double buffersec, double lastbuffersec,
+			    double *thresholds, int nthresholds,
+			    const char *label)
+{
+  /* the last buffer is usually shorter than the others */
+  double total = (nperiods - 1) * buffersec + lastbuffersec;
+
+  if (nperiods < 1)
+    return;
+  printf ("Time above threshold over %.0f ms windows:\n", buffersec * 1000);
+  for (int t = 0; t < nthresholds; t++)
+    {
+      double above = 0.0;
+      for (int i = 0; i < nperiods; i++)
+	{
+	  double level = 10 * log10 (shorttermarray[i]) + 108.010299957;
+	  if (level > thresholds[t])
+	    above += (i == nperiods - 1) ? lastbuffersec : buffersec;
+	}
+      printf ("Leq(%s) > %.1f: %.3f s (%.2f%%)\n", label, thresholds[t],
+	      above, 100.0 * above / total);
+    }
 }
 
 void
@@ -5923,7 +12429,7 @@ logleqm (FILE * filehandle, double featuretimesec, double temp_leqm)
     }
   fprintf (filehandle, "%.4f", featuretimesec);
   fprintf (filehandle, "\t");
-  fprintf (filehandle, "%.4f\n", temp_leqm);
+  fprintf (filehandle, "%.4f\n", rounddb (temp_leqm, 4));
 
 
 }
@@ -5938,7 +12444,7 @@ logleqm10 (FILE * filehandle, double featuretimesec, double longaverage)
     }
   fprintf (filehandle, "%.4f", featuretimesec);
   fprintf (filehandle, "\t");
-  fprintf (filehandle, "%.4f\n", leqm10);
+  fprintf (filehandle, "%.4f\n", rounddb (leqm10, 4));
   return leqm10;
 }
 
@@ -6288,7 +12794,7 @@ dolbydifinalcomputation (double **sc_staa, uint8_t ** stdda, int nch,
 
 
 
-void
+double
 lkfs_finalcomputation (LG * pt_lgctx, int *pt_chgateconf, int nchannels)
 {
   int i_ch;
@@ -6332,151 +12838,617 @@ lkfs_finalcomputation (LG * pt_lgctx, int *pt_chgateconf, int nchannels)
 		pt_lgctx->chgainconf[i_ch] *
 		pt_lgctx->LGresultarray[i_ch][p_sp][s_sd];
 
-	      // see p. 5 of ITU 1770-4
-	    }
-	  //Loudness without Gating (single block)
-	  LD_meas = -0.691 + 10 * log10 (LD_accum);
-	  /*
-	     #ifdef DEBUG
-	     printf ("Loudness (without Gating): %.4f\n", LD_meas);
-	     #endif
-	   */
-	  if (LD_meas > gamma_A)
-	    {
-	      ch_accumulator[i_lgb++] = LD_accum;
-	      gated_A_index++;
-	    }
-	  else
-	    {
-	      ch_accumulator[i_lgb++] = 0.0;
-	    }			//
-	}
+	      // see p. 5 of ITU 1770-4
+	    }
+	  //Loudness without Gating (single block)
+	  LD_meas = -0.691 + 10 * log10 (LD_accum);
+	  /*
+	     #ifdef DEBUG
+	     printf ("Loudness (without Gating): %.4f\n", LD_meas);
+	     #endif
+	   */
+	  if (LD_meas > gamma_A)
+	    {
+	      ch_accumulator[i_lgb++] = LD_accum;
+	      gated_A_index++;
+	    }
+	  else
+	    {
+	      ch_accumulator[i_lgb++] = 0.0;
+	    }			//
+	}
+    }
+
+  //remainder
+  if ((pt_lgctx->stepcounter % pt_lgctx->subdivs) != 0)
+    {
+      for (int s_sd = 0; s_sd < (pt_lgctx->stepcounter % pt_lgctx->subdivs);
+	   s_sd++)
+	{
+	  //Absolute gating gating
+	  LD_accum = 0.0;
+	  //LD_meas = 0.0;
+	  for (i_ch = 0; i_ch < nchannels; i_ch++)
+	    {
+	      LD_accum +=
+		pt_lgctx->chgainconf[i_ch] *
+		pt_lgctx->LGresultarray[i_ch][pt_lgctx->stepcounter /
+					      pt_lgctx->subdivs][s_sd];
+
+	      // see p. 5 of ITU 1770-4
+	    }
+	  //Loudness without Gating (single block)
+	  LD_meas = -0.691 + 10 * log10 (LD_accum);
+	  if (LD_meas > gamma_A)
+	    {
+	      ch_accumulator[i_lgb++] = LD_accum;
+	      gated_A_index++;
+	    }
+	  else
+	    {
+	      ch_accumulator[i_lgb++] = 0.0;
+	    }			//
+	}
+
+    }
+
+  // Relative Gating
+
+
+  double gated_A_accum = 0.0;
+  for (i_lgb = 0; i_lgb < pt_lgctx->stepcounter; i_lgb++)
+    {
+      gated_A_accum += ch_accumulator[i_lgb];
+    }
+
+
+  gamma_R =
+    -0.691 + 10 * log10 (gated_A_accum / ((double) gated_A_index)) +
+    gamma_r;
+
+  i_lgb = 0;
+
+  for (int p_sp = 0; p_sp < pt_lgctx->stepcounter / pt_lgctx->subdivs; p_sp++)
+    {
+      for (int s_sd = 0; s_sd < pt_lgctx->subdivs; s_sd++)
+	{
+	  //Relative gating
+	  LD_accum = 0.0;
+	  LD_meas = 0.0;
+	  for (i_ch = 0; i_ch < nchannels; i_ch++)
+	    {
+	      LD_accum +=
+		pt_lgctx->chgainconf[i_ch] *
+		pt_lgctx->LGresultarray[i_ch][p_sp][s_sd];
+
+	      // see p. 5 of ITU 1770-4
+	    }
+	  //Loudness without Gating (single block)
+	  LD_meas = -0.691 + 10 * log10 (LD_accum);
+	  if (LD_meas > gamma_R)
+	    {
+	      ch_accumulator[i_lgb++] = LD_accum;
+	      gated_R_index++;
+	    }
+	  else
+	    {
+	      ch_accumulator[i_lgb++] = 0.0;
+	    }			//
+	}
+    }
+
+  //remainder
+
+  //remainder
+  if ((pt_lgctx->stepcounter % pt_lgctx->subdivs) != 0)
+    {
+      for (int s_sd = 0; s_sd < (pt_lgctx->stepcounter % pt_lgctx->subdivs);
+	   s_sd++)
+	{
+	  //Absolute gating gating
+	  LD_accum = 0.0;
+	  //LD_meas = 0.0; 
+	  for (i_ch = 0; i_ch < nchannels; i_ch++)
+	    {
+	      LD_accum +=
+		pt_lgctx->chgainconf[i_ch] *
+		pt_lgctx->LGresultarray[i_ch][pt_lgctx->stepcounter /
+					      pt_lgctx->subdivs][s_sd];
+
+	      // see p. 5 of ITU 1770-4
+	    }
+	  //Loudness without Gating (single block)
+	  LD_meas = -0.691 + 10 * log10 (LD_accum);
+	  if (LD_meas > gamma_R)
+	    {
+	      ch_accumulator[i_lgb++] = LD_accum;
+	      gated_R_index++;
+	    }
+	  else
+	    {
+	      ch_accumulator[i_lgb++] = 0.0;
+	    }			//
+	}
+    }
+
+  double LKFS_accum = 0.0;
+  double LKFS;
+
+  for (i_lgb = 0; i_lgb < pt_lgctx->stepcounter; i_lgb++)
+    {
+      LKFS_accum += ch_accumulator[i_lgb];
+    }
+  LKFS = -0.691 + 10 * log10 (LKFS_accum / ((double) gated_R_index));
+
+  printf ("LKFS: %.4f\n", rounddb (LKFS, 4));
+
+
+  free (ch_accumulator);
+  return LKFS;
+}
+
+int
+comparedoubles (const void *a, const void *b)
+{
+  double da = *(const double *) a;
+  double db = *(const double *) b;
+
+  return (da > db) - (da < db);
+}
+
+/* Channel weighted mean square of every 400 ms block, in step order.
+   Caller frees. */
+double *
+lkfs_blockpower (LG * pt_lgctx, int nchannels)
+{
+  double *blockpower;
+  int i_lgb, i_ch;
+
+  blockpower = malloc (sizeof (double) * pt_lgctx->stepcounter);
+  for (i_lgb = 0; i_lgb < pt_lgctx->stepcounter; i_lgb++)
+    {
+      blockpower[i_lgb] = 0.0;
+      for (i_ch = 0; i_ch < nchannels; i_ch++)
+	{
+	  blockpower[i_lgb] +=
+	    pt_lgctx->chgainconf[i_ch] *
+	    pt_lgctx->LGresultarray[i_ch][i_lgb /
+					  pt_lgctx->subdivs][i_lgb %
+							     pt_lgctx->subdivs];
+	}
+    }
+  return blockpower;
+}
+
+/* Number of consecutive 400 ms blocks spanning a 3 s short-term window */
+int
+lkfs_shorttermblocks (LG * pt_lgctx, int samplerate)
+{
+  int nsteps = (int) round (3.0 * samplerate / pt_lgctx->ops);
+  int nblocks = nsteps - pt_lgctx->subdivs + 1;
+
+  return nblocks < 1 ? 1 : nblocks;
+}
+
+/* Start in seconds of the short-term window beginning at block index.
+   Block i ends after (i + 1) overlap steps, the first blocks are zero padded. */
+double
+shorttermwindowstart (LG * pt_lgctx, int index, int samplerate)
+{
+  long long startframe =
+    (long long) (index + 1) * pt_lgctx->ops - pt_lgctx->gblocksize;
+
+  return startframe < 0 ? 0.0 : startframe / (double) samplerate;
+}
+
+/* HH:MM:SS:FF at fps frames per second, for locating events in an edit.
+   Non-drop frame, the inverse of parse_timecode */
+void
+format_timecode (char *tc, size_t len, double seconds, double fps)
+{
+  int nominal = (int) round (fps);
+  long long totalframes = (long long) floor (seconds * fps + 1e-6);
+  int ff = totalframes % nominal;
+  long long totalseconds = totalframes / nominal;
+
+  snprintf (tc, len, "%02lld:%02lld:%02lld:%02d", totalseconds / 3600,
+	    (totalseconds / 60) % 60, totalseconds % 60, ff);
+}
+
+/* Names of the usual cinema layouts for files without a channel layout,
+   NULL where unknown */
+void
+default_channel_names (const char **names, int nchannels)
+{
+  static const char *layout71[8] =
+    { "L", "R", "C", "LFE", "Ls", "Rs", "Lrs", "Rrs" };
+
+  for (int i = 0; i < nchannels; i++)
+    {
+      if (nchannels == 1)
+	names[i] = "M";
+      else if (nchannels == 2 || nchannels == 6 || nchannels == 8)
+	names[i] = layout71[i];
+      else if (nchannels == 16)
+	names[i] = dcinema16names[i];
+      else
+	names[i] = NULL;
+    }
+}
+
+/* Gains of every channel to Lo (first nchannels) and Ro (next nchannels)
+   as in ITU-R BS.775: centre and surrounds at -3 dB, LFE and the
+   accessibility tracks dropped. For mono both are summed at -3 dB.
+   NULL if a channel has no name. */
+double *
+downmix_matrix (const char **names, int nchannels, int outch)
+{
+  double *matrix = calloc (2 * nchannels, sizeof (double));
+
+  for (int i = 0; i < nchannels; i++)
+    {
+      const char *name = names[i];
+      double left = 0.0, right = 0.0;
+      if (name == NULL)
+	{
+	  free (matrix);
+	  return NULL;
+	}
+      if (strcmp (name, "L") == 0 || strcmp (name, "Lc") == 0)
+	left = 1.0;
+      else if (strcmp (name, "R") == 0 || strcmp (name, "Rc") == 0)
+	right = 1.0;
+      else if (strcmp (name, "C") == 0 || strcmp (name, "Cs") == 0
+	       || strcmp (name, "M") == 0)
+	left = right = M_SQRT1_2;
+      else if (strcmp (name, "Ls") == 0 || strcmp (name, "Lrs") == 0)
+	left = M_SQRT1_2;
+      else if (strcmp (name, "Rs") == 0 || strcmp (name, "Rrs") == 0)
+	right = M_SQRT1_2;
+      if (outch == 2)
+	{
+	  matrix[i] = left;
+	  matrix[nchannels + i] = right;
+	}
+      else
+	{
+	  matrix[i] = M_SQRT1_2 * (left + right);
+	}
+    }
+  return matrix;
+}
+
+// The downmix goes to the first channel(s) and the others are silenced,
+// so everything after keeps its channel count
+void
+downmix_buffer (double *interleaved, int nsamples, int nch,
+		const double *matrix)
+{
+  for (int frame = 0; frame < nsamples / nch; frame++)
+    {
+      double *x = interleaved + frame * nch;
+      double lo = 0.0, ro = 0.0;
+      for (int ch = 0; ch < nch; ch++)
+	{
+	  lo += matrix[ch] * x[ch];
+	  ro += matrix[nch + ch] * x[ch];
+	}
+      for (int ch = 0; ch < nch; ch++)
+	x[ch] = 0.0;
+      x[0] = lo;
+      if (nch > 1)
+	x[1] = ro;
+    }
+}
+
+static void
+print_balance (const char *pair, double first, double second,
+	       const char *firstname, const char *secondname, int warn)
+{
+  if (first == 0.0 || second == 0.0)
+    {
+      printf ("%s balance: not available, no signal on the %s channels.\n",
+	      pair, first == 0.0 ? firstname : secondname);
+      return;
+    }
+  double diff = 10 * log10 (first / second);
+  printf ("%s balance: %+.2f dB\n", pair, rounddb (diff, 2));
+  if (warn && fabs (diff) > 3.0)
+    {
+      printf ("Warning: the %s channels are %.2f dB louder than the %s ones.\n",
+	      diff > 0.0 ? firstname : secondname, rounddb (fabs (diff), 2),
+	      diff > 0.0 ? secondname : firstname);
+    }
+}
+
+/* Left/right and front/rear energy differences (positive when left or
+   front is louder) from the mean weighted energy per channel of each
+   side, before the --chconfcal gains, so that the same level in every
+   channel reads 0 dB whatever the number of channels on each side and
+   the -3 dB of the surrounds. Channels left out of the program and LFE
+   do not count. */
+void
+balance_finalcomputation (const double *chsum, const double *chconf,
+			  const int *chexclude, const char **names,
+			  int nchannels)
+{
+  double left = 0.0, right = 0.0, front = 0.0, rear = 0.0;
+  int nleft = 0, nright = 0, nfront = 0, nrear = 0;
+  double total = 0.0;
+  int hasside = 0, hasrear = 0;
+
+  if (names == NULL || names[0] == NULL)
+    {
+      printf ("Balance: not available, the channel layout is unknown.\n");
+      return;
+    }
+  for (int i = 0; i < nchannels; i++)
+    {
+      const char *name = names[i];
+      double energy;
+      if (chexclude[i] || name == NULL || chconf[i] == 0.0)
+	continue;
+      total += chsum[i];
+      energy = chsum[i] / (chconf[i] * chconf[i]);
+      if (strcmp (name, "L") == 0 || strcmp (name, "Lc") == 0
+	  || strcmp (name, "Lo") == 0)
+	{
+	  left += energy;
+	  nleft++;
+	  front += energy;
+	  nfront++;
+	  hasside = 1;
+	}
+      else if (strcmp (name, "R") == 0 || strcmp (name, "Rc") == 0
+	       || strcmp (name, "Ro") == 0)
+	{
+	  right += energy;
+	  nright++;
+	  front += energy;
+	  nfront++;
+	}
+      else if (strcmp (name, "C") == 0)
+	{
+	  front += energy;
+	  nfront++;
+	}
+      else if (strcmp (name, "Ls") == 0 || strcmp (name, "Lrs") == 0)
+	{
+	  left += energy;
+	  nleft++;
+	  rear += energy;
+	  nrear++;
+	  hasrear = 1;
+	}
+      else if (strcmp (name, "Rs") == 0 || strcmp (name, "Rrs") == 0)
+	{
+	  right += energy;
+	  nright++;
+	  rear += energy;
+	  nrear++;
+	}
+      else if (strcmp (name, "Cs") == 0)
+	{
+	  rear += energy;
+	  nrear++;
+	  hasrear = 1;
+	}
+    }
+  if (nleft > 0)
+    left /= nleft;
+  if (nright > 0)
+    right /= nright;
+  if (nfront > 0)
+    front /= nfront;
+  if (nrear > 0)
+    rear /= nrear;
+  if (hasside)
+    print_balance ("Left/right", left, right, "left", "right", 1);
+  // surrounds are usually mixed lower, so no warning there
+  if (hasrear)
+    print_balance ("Front/rear", front, rear, "front", "rear", 0);
+  // a dropped channel is far below the others, -100 dB is plain silence
+  for (int i = 0; i < nchannels; i++)
+    {
+      char chlabel[32];
+      if (chexclude[i] || names[i] == NULL || strcmp (names[i], "LFE") == 0
+	  || strcmp (names[i], "folded") == 0)
+	continue;
+      if (total > 0.0 && chsum[i] < total * 1e-10)
+	printf ("Warning: %s is silent.\n",
+		channel_label (chlabel, sizeof (chlabel), i, names));
+    }
+}
+
+// "Ch 3 (LFE)", or "Ch 3" without a name
+const char *
+channel_label (char *label, size_t len, int index, const char **names)
+{
+  if (names != NULL && names[index] != NULL)
+    snprintf (label, len, "Ch %d (%s)", index, names[index]);
+  else
+    snprintf (label, len, "Ch %d", index);
+  return label;
+}
+
+/* hh:mm:ss:ff non-drop frame to seconds, frames are counted at the
+   nominal rate (24 for 23.976). Returns -1 on error. */
+double
+parse_timecode (const char *tc, double fps)
+{
+  int hh, mm, ss, ff;
+  char tail;
+  int nominal = (int) round (fps);
+
+  if (sscanf (tc, "%d:%d:%d:%d%c", &hh, &mm, &ss, &ff, &tail) != 4
+      || hh < 0 || mm < 0 || mm > 59 || ss < 0 || ss > 59 || ff < 0
+      || ff >= nominal)
+    return -1.0;
+  return (((hh * 60LL + mm) * 60LL + ss) * nominal + ff) / fps;
+}
+
+/* Loudness Range as per EBU Tech 3342. Short-term loudness over 3 s
+   windows is built from the 400 ms LKFS blocks (already K weighted and
+   channel weighted), one window every overlap step. Windows below -70 LUFS
+   and then below 20 LU under their power mean are dropped, LRA is the
+   distance between the 10th and the 95th percentile of what is left. */
+void
+lra_finalcomputation (LG * pt_lgctx, int nchannels, int samplerate)
+{
+  int nblocks = lkfs_shorttermblocks (pt_lgctx, samplerate);
+  int nwindows = pt_lgctx->stepcounter - nblocks + 1;
+  double *stl;
+  double *blockpower;
+  double gated_accum = 0.0;
+  double gamma_R;
+  int gated_A_index = 0;
+  int gated_R_index = 0;
+  int i_lgb, i_w;
+
+  if (nwindows < 1)
+    {
+      printf ("LRA: not available, program shorter than 3 s.\n");
+      return;
     }
 
-  //remainder
-  if ((pt_lgctx->stepcounter % pt_lgctx->subdivs) != 0)
+  blockpower = lkfs_blockpower (pt_lgctx, nchannels);
+  stl = malloc (sizeof (double) * nwindows);
+
+  //absolute gate
+  for (i_w = 0; i_w < nwindows; i_w++)
     {
-      for (int s_sd = 0; s_sd < (pt_lgctx->stepcounter % pt_lgctx->subdivs);
-	   s_sd++)
+      double accum = 0.0;
+      double st;
+      for (i_lgb = i_w; i_lgb < i_w + nblocks; i_lgb++)
 	{
-	  //Absolute gating gating
-	  LD_accum = 0.0;
-	  //LD_meas = 0.0;
-	  for (i_ch = 0; i_ch < nchannels; i_ch++)
-	    {
-	      LD_accum +=
-		pt_lgctx->chgainconf[i_ch] *
-		pt_lgctx->LGresultarray[i_ch][pt_lgctx->stepcounter /
-					      pt_lgctx->subdivs][s_sd];
-
-	      // see p. 5 of ITU 1770-4
-	    }
-	  //Loudness without Gating (single block)
-	  LD_meas = -0.691 + 10 * log10 (LD_accum);
-	  if (LD_meas > gamma_A)
-	    {
-	      ch_accumulator[i_lgb++] = LD_accum;
-	      gated_A_index++;
-	    }
-	  else
-	    {
-	      ch_accumulator[i_lgb++] = 0.0;
-	    }			//
+	  accum += blockpower[i_lgb];
+	}
+      accum /= (double) nblocks;
+      st = -0.691 + 10 * log10 (accum);
+      if (st > -70.0)
+	{
+	  stl[gated_A_index++] = st;
+	  gated_accum += accum;
 	}
-
     }
 
-  // Relative Gating
-
+  if (gated_A_index == 0)
+    {
+      printf ("LRA: not available, program below -70 LUFS.\n");
+      free (blockpower);
+      free (stl);
+      return;
+    }
 
-  double gated_A_accum = 0.0;
-  for (i_lgb = 0; i_lgb < pt_lgctx->stepcounter; i_lgb++)
+  //relative gate, 20 LU below the power mean of the absolute gated windows
+  gamma_R = -0.691 + 10 * log10 (gated_accum / ((double) gated_A_index)) -
+    20.0;
+  for (i_w = 0; i_w < gated_A_index; i_w++)
     {
-      gated_A_accum += ch_accumulator[i_lgb];
+      if (stl[i_w] > gamma_R)
+	stl[gated_R_index++] = stl[i_w];
     }
 
+  qsort (stl, gated_R_index, sizeof (double), comparedoubles);
+  double lowpercentile = stl[(int) round ((gated_R_index - 1) * 0.10)];
+  double highpercentile = stl[(int) round ((gated_R_index - 1) * 0.95)];
 
-  gamma_R =
-    -0.691 + 10 * log10 (gated_A_accum / ((double) gated_A_index)) - 10;
+  printf ("LRA: %.4f LU\n", rounddb (highpercentile - lowpercentile, 4));
 
-  i_lgb = 0;
+  free (blockpower);
+  free (stl);
+}
 
-  for (int p_sp = 0; p_sp < pt_lgctx->stepcounter / pt_lgctx->subdivs; p_sp++)
+/* Maximum momentary (400 ms) and short-term (3 s) loudness, EBU Tech 3341 */
+void
+maxloudness_finalcomputation (LG * pt_lgctx, int nchannels, int samplerate,
+			      const char **chnames)
+{
+  int nblocks = lkfs_shorttermblocks (pt_lgctx, samplerate);
+  double *blockpower;
+  double maxmomentary = 0.0;
+  double maxshortterm = 0.0;
+  int maxshorttermindex = 0;
+  int i_lgb, i_w, i_ch;
+  char tc[16];
+
+  if (pt_lgctx->stepcounter < 1)
+    return;
+
+  blockpower = lkfs_blockpower (pt_lgctx, nchannels);
+  for (i_lgb = 0; i_lgb < pt_lgctx->stepcounter; i_lgb++)
     {
-      for (int s_sd = 0; s_sd < pt_lgctx->subdivs; s_sd++)
+      if (blockpower[i_lgb] > maxmomentary)
+	maxmomentary = blockpower[i_lgb];
+    }
+  printf ("Max momentary: %.4f LUFS\n",
+	  rounddb (-0.691 + 10 * log10 (maxmomentary), 4));
+
+  if (pt_lgctx->stepcounter >= nblocks)
+    {
+      for (i_w = 0; i_w + nblocks <= pt_lgctx->stepcounter; i_w++)
 	{
-	  //Relative gating
-	  LD_accum = 0.0;
-	  LD_meas = 0.0;
-	  for (i_ch = 0; i_ch < nchannels; i_ch++)
+	  double accum = 0.0;
+	  for (i_lgb = i_w; i_lgb < i_w + nblocks; i_lgb++)
 	    {
-	      LD_accum +=
-		pt_lgctx->chgainconf[i_ch] *
-		pt_lgctx->LGresultarray[i_ch][p_sp][s_sd];
-
-	      // see p. 5 of ITU 1770-4
+	      accum += blockpower[i_lgb];
 	    }
-	  //Loudness without Gating (single block)
-	  LD_meas = -0.691 + 10 * log10 (LD_accum);
-	  if (LD_meas > gamma_R)
+	  accum /= (double) nblocks;
+	  if (accum > maxshortterm)
 	    {
-	      ch_accumulator[i_lgb++] = LD_accum;
-	      gated_R_index++;
+	      maxshortterm = accum;
+	      maxshorttermindex = i_w;
 	    }
-	  else
-	    {
-	      ch_accumulator[i_lgb++] = 0.0;
-	    }			//
 	}
-    }
+      double windowstart =
+	shorttermwindowstart (pt_lgctx, maxshorttermindex, samplerate);
+      format_timecode (tc, sizeof (tc), tcoffset + windowstart, tcrate);
+      printf ("Max short-term: %.4f LUFS\n",
+	      rounddb (-0.691 + 10 * log10 (maxshortterm), 4));
+      printf ("Max short-term position: %.3f s (%s)\n", windowstart, tc);
 
-  //remainder
-
-  //remainder
-  if ((pt_lgctx->stepcounter % pt_lgctx->subdivs) != 0)
-    {
-      for (int s_sd = 0; s_sd < (pt_lgctx->stepcounter % pt_lgctx->subdivs);
-	   s_sd++)
+      /* per channel, unweighted by the LKFS channel gains */
+      for (i_ch = 0; i_ch < nchannels; i_ch++)
 	{
-	  //Absolute gating gating
-	  LD_accum = 0.0;
-	  //LD_meas = 0.0; 
-	  for (i_ch = 0; i_ch < nchannels; i_ch++)
+	  double chmax = 0.0;
+	  int chmaxindex = 0;
+	  for (i_w = 0; i_w + nblocks <= pt_lgctx->stepcounter; i_w++)
 	    {
-	      LD_accum +=
-		pt_lgctx->chgainconf[i_ch] *
-		pt_lgctx->LGresultarray[i_ch][pt_lgctx->stepcounter /
-					      pt_lgctx->subdivs][s_sd];
-
-	      // see p. 5 of ITU 1770-4
+	      double accum = 0.0;
+	      for (i_lgb = i_w; i_lgb < i_w + nblocks; i_lgb++)
+		{
+		  accum +=
+		    pt_lgctx->LGresultarray[i_ch][i_lgb /
+						  pt_lgctx->subdivs][i_lgb %
+								     pt_lgctx->subdivs];
+		}
+	      accum /= (double) nblocks;
+	      if (accum > chmax)
+		{
+		  chmax = accum;
+		  chmaxindex = i_w;
+		}
 	    }
-	  //Loudness without Gating (single block)
-	  LD_meas = -0.691 + 10 * log10 (LD_accum);
-	  if (LD_meas > gamma_R)
+	  if (chmax > 0.0)
 	    {
-	      ch_accumulator[i_lgb++] = LD_accum;
-	      gated_R_index++;
+	      windowstart =
+		shorttermwindowstart (pt_lgctx, chmaxindex, samplerate);
+	      format_timecode (tc, sizeof (tc), tcoffset + windowstart, tcrate);
+	      char chlabel[32];
+	      printf ("%s max short-term: %.4f LUFS at %.3f s (%s)\n",
+		      channel_label (chlabel, sizeof (chlabel), i_ch,
+				     chnames),
+		      rounddb (-0.691 + 10 * log10 (chmax), 4), windowstart,
+		      tc);
 	    }
-	  else
-	    {
-	      ch_accumulator[i_lgb++] = 0.0;
-	    }			//
 	}
     }
-
-  double LKFS_accum = 0.0;
-  double LKFS;
-
-  for (i_lgb = 0; i_lgb < pt_lgctx->stepcounter; i_lgb++)
+  else
     {
-      LKFS_accum += ch_accumulator[i_lgb];
+      printf ("Max short-term: not available, program shorter than 3 s.\n");
     }
-  LKFS = -0.691 + 10 * log10 (LKFS_accum / ((double) gated_R_index));
-
-  printf ("LKFS: %.4f\n", LKFS);
-
 
-  free (ch_accumulator);
+  free (blockpower);
 }
 
 
@@ -6657,7 +13629,8 @@ lkfs_finalcomputation_withdolbydi (LG * pt_lgctx, int *pt_chgateconf,
 
 
   gamma_R =
-    -0.691 + 10 * log10 (gated_A_accum / ((double) gated_A_index)) - 10;
+    -0.691 + 10 * log10 (gated_A_accum / ((double) gated_A_index)) +
+    gamma_r;
 
   i_lgb = 0;
 
@@ -6738,7 +13711,7 @@ lkfs_finalcomputation_withdolbydi (LG * pt_lgctx, int *pt_chgateconf,
     }
   LKFS = -0.691 + 10 * log10 (LKFS_accum / ((double) gated_R_index));
 
-  printf ("LKFS: %.4f\n", LKFS);
+  printf ("LKFS: %.4f\n", rounddb (LKFS, 4));
 
   dialoguepercentage =
     ((double) digatedcounter_percent) / ((double) pt_lgctx->stepcounter) * 100.00;
@@ -6753,7 +13726,7 @@ lkfs_finalcomputation_withdolbydi (LG * pt_lgctx, int *pt_chgateconf,
 	}
       DILKFS =
 	-0.691 + 10 * log10 (DI_LKFS_accum / ((double) digatedcounter));
-      printf ("LKFS(DI): %.2f\n", DILKFS);
+      printf ("LKFS(DI): %.2f\n", rounddb (DILKFS, 2));
     }
   free (ch_accumulator);
   free (dich_accumulator);
@@ -7030,8 +14003,9 @@ dolbydifinalcomputation2 (LGLeqM * pt_lgctx_leqmdi, int *pt_chgateconf,
     }
   LGLEQM = 10 * log10 (LGLEQM_accum / ((double) gated_R_index));	// not taking the square root because multiplying by 10, it is indeed power
 
-  printf ("Leq(M,LG)FS: %.4f\n", LGLEQM);
-  printf ("Leq(M,LG): %.4f\n", LGLEQM + 108.010299957);
+  printf ("Leq(%s,LG)FS: %.4f\n", weightinglabel, rounddb (LGLEQM, 4));
+  printf ("Leq(%s,LG): %.4f\n", weightinglabel,
+	  rounddb (LGLEQM + 108.010299957, 4));
   dialoguepercentage =
     ((double) digatedcounter_percent) / ((double) pt_lgctx_leqmdi->stepcounter) *
     100.00;
@@ -7045,8 +14019,10 @@ dolbydifinalcomputation2 (LGLeqM * pt_lgctx_leqmdi, int *pt_chgateconf,
 	  DI_LGLEQM_accum += dich_accumulator[i_lgb];
 	}
       DI_LGLEQM = 10 * log10 (DI_LGLEQM_accum / ((double) digatedcounter));	// it is power
-      printf ("Leq(M,DI)FS: %.4f\n", DI_LGLEQM);
-      printf ("Leq(M,DI): %.4f\n", DI_LGLEQM + 108.010299957);
+      printf ("Leq(%s,DI)FS: %.4f\n", weightinglabel,
+	      rounddb (DI_LGLEQM, 4));
+      printf ("Leq(%s,DI): %.4f\n", weightinglabel,
+	      rounddb (DI_LGLEQM + 108.010299957, 4));
     }
   free (ch_accumulator);
   free (dich_accumulator);
@@ -7330,165 +14306,465 @@ calcSampleStepLG (float percentOverlap, int samplerate, int LGbufferms)
 
 
 
+								/*
+
+								   Order 6 FS 88200 and FS 176400
+
+								   Poles of the CCIR 468 analog network mapped with the matched
+								   z-transform, numerator fitted by least squares to the analog
+								   response (log-spaced, 20 Hz to min(0.49 FS, 40 kHz)).
+								   Deviation from the ISO 21727 table is below 0.2 dB at every
+								   specified frequency.
+
+								 */
+
+static const double M_b_88200[] = {
+  0.00048181600108179441, 0.005249109215169378, 0.034324229691439619,
+  -0.01158969451520697, -0.027824051951042223, -0.00064135358428738822
+};
+
+static const double M_a_88200[] = {
+  1.0, -3.8669963467640693, 6.5804116222408027, -6.2612371259728068,
+  3.4901601541122171, -1.0724116358594027, 0.14018062279261204
+};
+
+static const double M_b_176400[] = {
+  1.5568689390080044e-06, 0.00021483018318608674, 0.0017465230421244353,
+  -0.00034821106337225028, -0.0014943704886057803, -0.00012032853504518383
+};
+
+static const double M_a_176400[] = {
+  1.0, -4.9635397568589017, 10.384865285577426, -11.712722521964766,
+  7.5040562101536148, -2.5868038979753418, 0.37440702823613237
+};
+
+
+								/*
+
+								   Order 6 FS 44100, FS 48000 and FS 192000
+
+								   The same design, then scaled to meet 6.3 kHz exactly (see
+								   precalculate_coeffs_M_filter). They replace the order 5
+								   (44.1 and 48 kHz) and order 9 (192 kHz) sets above, which
+								   were out of the ISO 21727 tolerance at 31.5 Hz and, for
+								   44.1 and 48 kHz, at 6.3 kHz.
+
+								 */
+
+static const double M_b_44100[] = {
+  -0.0084122379997550387, 0.1334639819574317, 0.35621337483460958,
+  -0.23978508944058199, -0.2400456850547843, 0.0075601569896958723,
+  -0.0089962515297442574
+};
+
+static const double M_a_44100[] = {
+  1.0, -1.7928375014050517, 1.8577752416254651, -1.283371975062598,
+  0.5968632026912859, -0.17156106862782192, 0.019650607006524615
+};
+
+static const double M_b_48000[] = {
+  -0.0045845226072215054, 0.093142232265170807, 0.28473609022703389,
+  -0.17496371120475113, -0.19744369475917928, 0.0072206226736531241,
+  -0.0081081018279658724
+};
+
+static const double M_a_48000[] = {
+  1.0, -2.102426287610629, 2.3759392400844468, -1.7222417072372074,
+  0.81548388119079518, -0.23171094208898627, 0.027042022678777193
+};
+
+static const double M_b_192000[] = {
+  -1.9126682406897496e-07, 0.00014808314160436297, 0.0011756504196573868,
+  -0.00020622169711819772, -0.0010370985378902132, -7.8956535303349913e-05,
+  -1.2655242546720447e-06
+};
+
+static const double M_a_192000[] = {
+  1.0, -5.0510002805541632, 10.733251320110851, -12.273716575711301,
+  7.9603310630204343, -2.7742188601111319, 0.40551767960866747
+};
+
+
 int
-M_filter (double *smp_out, double *smp_in, int samples, int samplerate)
+iir_filter (double *smp_out, double *smp_in, int nsamples,
+	    const double *b, int nb, const double *a, int na)
 {
-  if (samplerate == 44100)
+  /* Direct form I, a[0] is assumed to be 1. As in M_filter the
+     history before the first sample of the buffer is taken as zero */
+  for (int i = 0; i < nsamples; i++)
     {
-      for (int i = 0; i < samples; i++)
+      double acc = 0.0;
+      for (int k = 0; k < nb && k <= i; k++)
+	{
+	  acc += b[k] * smp_in[i - k];
+	}
+      for (int k = 1; k < na && k <= i; k++)
 	{
+	  acc -= a[k] * smp_out[i - k];
+	}
+      smp_out[i] = acc;
+    }
+  return 0;
+}
 
-	  // Order 5
-	  switch (i)
-	    {
-	    case 0:
-	      smp_out[i] = 0.4034108659797224 * smp_in[i];
-	      break;
-	    case 1:
-	      smp_out[i] =
-		0.4034108659797224 * smp_in[i] +
-		0.0675046624145518 * smp_in[i - 1] +
-		1.5224995723629664 * smp_out[i - 1];
-	      break;
-	    case 2:
-	      smp_out[i] =
-		0.4034108659797224 * smp_in[i] +
-		0.0675046624145518 * smp_in[i - 1] -
-		0.3122917473135974 * smp_in[i - 2] +
-		1.5224995723629664 * smp_out[i - 1] -
-		1.3617953870010380 * smp_out[i - 2];
-	      break;
-	    case 3:
-	      smp_out[i] =
-		0.4034108659797224 * smp_in[i] +
-		0.0675046624145518 * smp_in[i - 1] -
-		0.3122917473135974 * smp_in[i - 2] -
-		0.1471391464872613 * smp_in[i - 3] +
-		1.5224995723629664 * smp_out[i - 1] -
-		1.3617953870010380 * smp_out[i - 2] +
-		0.7794603877415162 * smp_out[i - 3];
-	      break;
-	    case 4:
-	      smp_out[i] =
-		0.4034108659797224 * smp_in[i] +
-		0.0675046624145518 * smp_in[i - 1] -
-		0.3122917473135974 * smp_in[i - 2] -
-		0.1471391464872613 * smp_in[i - 3] -
-		0.0173711282192394 * smp_in[i - 4] +
-		1.5224995723629664 * smp_out[i - 1] -
-		1.3617953870010380 * smp_out[i - 2] +
-		0.7794603877415162 * smp_out[i - 3] -
-		0.2773974331876455 * smp_out[i - 4];
-	      break;
-	    default:
-	      smp_out[i] =
-		0.4034108659797224 * smp_in[i] +
-		0.0675046624145518 * smp_in[i - 1] -
-		0.3122917473135974 * smp_in[i - 2] -
-		0.1471391464872613 * smp_in[i - 3] -
-		0.0173711282192394 * smp_in[i - 4] +
-		0.0101026340442429 * smp_in[i - 5] +
-		1.5224995723629664 * smp_out[i - 1] -
-		1.3617953870010380 * smp_out[i - 2] +
-		0.7794603877415162 * smp_out[i - 3] -
-		0.2773974331876455 * smp_out[i - 4] +
-		0.0477648119172564 * smp_out[i - 5];
-	      break;
-	    }
 
+int
+M_filter_supported (int samplerate)
+{
+  switch (samplerate)
+    {
+    case 44100:
+    case 48000:
+    case 88200:
+    case 96000:
+    case 176400:
+    case 192000:
+      return 1;
+    default:
+      return 0;
+    }
+}
+
+
+int
+print_M_filter_response (int samplerate, int json)
+{
+  /* The response is taken from the impulse response of M_filter itself,
+     one second long, so that what is printed is what is used for the
+     measurement, including the shipped coefficient sets. */
+  int nsamples = samplerate;
+  int first = 1;
+  double *impulse = calloc (nsamples, sizeof (double));
+  double *response = calloc (nsamples, sizeof (double));
+
+  if (!M_filter_supported (samplerate))
+    {
+      mcoeffs = malloc (sizeof (mcoeff));
+      precalculate_coeffs_M_filter (mcoeffs, samplerate);
+    }
+  impulse[0] = 1.0;
+  M_filter (response, impulse, nsamples, samplerate);
+
+  if (json)
+    {
+      printf ("{\"samplerate\": %d, \"response\": [", samplerate);
+    }
+  else
+    {
+      printf ("Hz,dB\n");
+    }
+  /* 1/12 octave steps around 1 kHz, from 20 Hz up to Nyquist */
+  for (int k = -67;; k++)
+    {
+      double freq = 1000.0 * pow (2.0, k / 12.0);
+      if (freq >= samplerate / 2.0)
+	{
+	  break;
+	}
+      double re = 0.0;
+      double im = 0.0;
+      for (int i = 0; i < nsamples; i++)
+	{
+	  re += response[i] * cos (2.0 * M_PI * freq * i / samplerate);
+	  im -= response[i] * sin (2.0 * M_PI * freq * i / samplerate);
+	}
+      double db = rounddb (10.0 * log10 (re * re + im * im), 4);
+      if (json)
+	{
+	  printf ("%s{\"hz\": %.2f, \"db\": %.4f}", first ? "" : ", ", freq,
+		  db);
+	}
+      else
+	{
+	  printf ("%.2f,%.4f\n", freq, db);
+	}
+      first = 0;
+    }
+  if (json)
+    {
+      printf ("]}\n");
+    }
+
+  free (impulse);
+  free (response);
+  return 0;
+}
+
+
+int
+M_filter_selftest (int samplerate, int verbose)
+{
+  /* ITU-R BS.468-4 response and tolerances, lowered by 5.6 dB to the
+     M curve of ISO 21727. The standard gives only the upper tolerance
+     at 31.5 kHz, there the lower one is taken as unlimited. Deviations
+     are compared after rounding to 0.1 dB, the resolution of the table.
+     Returns the number of frequencies out of tolerance, verbose prints
+     them all. */
+  const double freqs[] =
+    { 31.5, 63, 100, 200, 400, 800, 1000, 2000, 3150, 4000, 5000, 6300,
+    7100, 8000, 9000, 10000, 12500, 14000, 16000, 20000, 31500
+  };
+  const double mresp[] =
+    { -35.5, -29.5, -25.4, -19.4, -13.4, -7.5, -5.6, 0.0, 3.4, 4.9, 6.1,
+    6.6, 6.4, 5.8, 4.5, 2.5, -5.6, -10.9, -17.3, -27.8, -48.3
+  };
+  const double tolerance[] =
+    { 2.0, 1.4, 1.0, 0.85, 0.7, 0.55, 0.5, 0.5, 0.5, 0.5, 0.5, 0.0, 0.2,
+    0.4, 0.6, 0.8, 1.2, 1.4, 1.6, 2.0, 2.8
+  };
+  int npoints = sizeof (freqs) / sizeof (freqs[0]);
+  int nsamples = 2 * samplerate;	// the second half is measured
+  int failed = 0;
+  double *tone = malloc (sizeof (double) * nsamples);
+  double *filtered = malloc (sizeof (double) * nsamples);
+
+  if (!M_filter_supported (samplerate) && mcoeffs == NULL)
+    {
+      mcoeffs = malloc (sizeof (mcoeff));
+      precalculate_coeffs_M_filter (mcoeffs, samplerate);
+    }
+
+  if (verbose)
+    printf ("M filter self-conformance test at %d Hz\n", samplerate);
+  for (int k = 0; k < npoints; k++)
+    {
+      if (freqs[k] >= samplerate / 2.0)
+	{
+	  if (verbose)
+	    printf ("%8.1f Hz: above Nyquist, skipped\n", freqs[k]);
+	  continue;
+	}
+      for (int i = 0; i < nsamples; i++)
+	{
+	  tone[i] = sin (2.0 * M_PI * freqs[k] * i / samplerate);
+	}
+      M_filter (filtered, tone, nsamples, samplerate);
+      double insum = 0.0;
+      double outsum = 0.0;
+      for (int i = samplerate; i < nsamples; i++)
+	{
+	  insum += tone[i] * tone[i];
+	  outsum += filtered[i] * filtered[i];
+	}
+      double db = 10.0 * log10 (outsum / insum);
+      double deviation = round ((db - mresp[k]) * 10.0) / 10.0;
+      int pass;
+      if (k == npoints - 1)
+	{
+	  pass = deviation <= tolerance[k] + 1e-9;
+	}
+      else
+	{
+	  pass = fabs (deviation) <= tolerance[k] + 1e-9;
+	}
+      failed += !pass;
+      if (verbose)
+	printf ("%8.1f Hz: %8.2f dB, expected %6.1f dB +/- %.2f: %s\n",
+		freqs[k], db, mresp[k], tolerance[k], pass ? "PASS" : "FAIL");
+    }
+  if (verbose)
+    printf ("%s\n", failed ? "Self-test FAILED." : "Self-test passed.");
+
+  free (tone);
+  free (filtered);
+  return failed;
+}
 
 
-	}
+static void
+put_le (unsigned char *p, uint32_t v, int bytes)
+{
+  for (int i = 0; i < bytes; i++)
+    p[i] = (v >> (8 * i)) & 0xff;
+}
+
+static double
+random_uniform (uint64_t * state)
+{
+  // xorshift64*, the same sequence on every platform
+  *state ^= *state >> 12;
+  *state ^= *state << 25;
+  *state ^= *state >> 27;
+  return (double) ((*state * 2685821657736338717ULL) >> 11) /
+    (double) (1ULL << 53) * 2.0 - 1.0;
+}
+
+// Paul Kellet's refined pink noise filter, state is 7 values
+static double
+pink_sample (double *b, double white)
+{
+  b[0] = 0.99886 * b[0] + white * 0.0555179;
+  b[1] = 0.99332 * b[1] + white * 0.0750759;
+  b[2] = 0.96900 * b[2] + white * 0.1538520;
+  b[3] = 0.86650 * b[3] + white * 0.3104856;
+  b[4] = 0.55000 * b[4] + white * 0.5329522;
+  b[5] = -0.7616 * b[5] - white * 0.0168980;
+  double pink = b[0] + b[1] + b[2] + b[3] + b[4] + b[5] + b[6] +
+    white * 0.5362;
+  b[6] = white * 0.115926;
+  return pink;
+}
 
+/* --generate tone|pink out.wav [options]: calibration material to check
+   the meter end to end. The pink noise is made twice from the same seeds,
+   first to find its RMS and then to write it scaled to the level. */
+int
+generate_signal (const char **args)
+{
+  const char *kind;
+  const char *path;
+  double freq = 1000.0;
+  double level = -20.0;
+  int rate = 48000;
+  double duration = 10.0;
+  int nch = 1;
+
+  if (args[0] == NULL || args[1] == NULL
+      || (strcmp (args[0], "tone") != 0 && strcmp (args[0], "pink") != 0))
+    {
+      printf
+	("Please use --generate tone <out.wav> or --generate pink <out.wav>.\n");
+      return 1;
+    }
+  kind = args[0];
+  path = args[1];
+  for (int i = 2; args[i] != NULL; i += 2)
+    {
+      if (checkargvalue (args[i + 1]))
+	return 1;
+      if (strcmp (args[i], "--freq") == 0)
+	freq = atof (args[i + 1]);
+      else if (strcmp (args[i], "--level") == 0)
+	level = atof (args[i + 1]);
+      else if (strcmp (args[i], "--rate") == 0)
+	rate = atoi (args[i + 1]);
+      else if (strcmp (args[i], "--duration") == 0)
+	duration = atof (args[i + 1]);
+      else if (strcmp (args[i], "--channels") == 0)
+	nch = atoi (args[i + 1]);
+      else
+	{
+	  printf ("Unknown option %s for --generate.\n", args[i]);
+	  return 1;
+	}
+    }
+  if (rate <= 0 || nch < 1 || nch > 64 || !(duration > 0.0)
+      || !(freq > 0.0) || freq >= rate / 2.0 || level > 0.0)
+    {
+      printf
+	("Please provide a positive rate, duration and frequency below Nyquist,\n1 to 64 channels and a level of 0 dBFS or lower.\n");
+      return 1;
     }
-  else if (samplerate == 48000)
-    {				// if (samplerate == 44100)
 
-      /* This coefficient are only for 48kHz sample rate */
-      for (int i = 0; i < samples; i++)
+  long long nframes = (long long) llround (duration * rate);
+  uint32_t datasize = (uint32_t) (nframes * nch * 3);
+  if (nframes * nch * 3 > 0xffffff00LL)
+    {
+      printf ("The signal does not fit in a WAV file, please shorten it.\n");
+      return 1;
+    }
+  double gain[64];
+  double state[64][7];
+  uint64_t seed[64];
+  if (strcmp (kind, "pink") == 0)
+    {
+      for (int ch = 0; ch < nch; ch++)
 	{
-	  /* // Order 4
-	     switch(i) {
-	     case 0:
-	     smp_out[i] =  0.3160057437484637  * smp_in[i];
-	     break;
-	     case 1:
-	     smp_out[i] = 0.3183679456956268 * smp_in[i] +  0.1494237633315084 * smp_in[i-1] + 1.509001373787255 * smp_out[i-1];
-	     break;
-	     case 2:
-	     smp_out[i] = 0.3183679456956268 * smp_in[i] +  0.1494237633315084 * smp_in[i-1] - 0.2095809948670236 * smp_in[i-2] + 1.509001373787255 * smp_out[i-1] - 1.263289551410631 * smp_out[i-2];
-	     break;
-	     case 3:
-	     smp_out[i] = 0.3183679456956268 * smp_in[i] +  0.1494237633315084 * smp_in[i-1] - 0.2095809948670236 * smp_in[i-2] - 0.1892237517582008 * smp_in[i-3] + 1.509001373787255 * smp_out[i-1] - 1.263289551410631 * smp_out[i-2] + 0.603342410310913  * smp_out[i-3];
-	     break;
-	     default:
-	     smp_out[i] = 0.3183679456956268 * smp_in[i] +  0.1494237633315084 * smp_in[i-1] - 0.2095809948670236 * smp_in[i-2] - 0.1892237517582008 * smp_in[i-3]  -0.0603259946368122 * smp_in[i-4] + 1.509001373787255 * smp_out[i-1] - 1.263289551410631 * smp_out[i-2] + 0.603342410310913  * smp_out[i-3] - 0.143867967944599 * smp_out[i-4];
-	     break;
-	     } */
-	  // Order 5
-	  switch (i)
+	  double sum = 0.0;
+	  memset (state[ch], 0, sizeof (state[ch]));
+	  seed[ch] = 0x9e3779b97f4a7c15ULL * (ch + 1);
+	  for (long long n = 0; n < nframes; n++)
 	    {
-	    case 0:
-	      smp_out[i] = 0.31837346242469328 * smp_in[i];
-	      break;
-	    case 1:
-	      smp_out[i] =
-		0.31837346242469328 * smp_in[i] +
-		0.10800452155339044 * smp_in[i - 1] +
-		1.6391291074367320 * smp_out[i - 1];
-	      break;
-	    case 2:
-	      smp_out[i] =
-		0.31837346242469328 * smp_in[i] +
-		0.10800452155339044 * smp_in[i - 1] -
-		0.21106344349319428 * smp_in[i - 2] +
-		1.6391291074367320 * smp_out[i - 1] -
-		1.5160386192837869 * smp_out[i - 2];
-	      break;
-	    case 3:
-	      smp_out[i] =
-		0.31837346242469328 * smp_in[i] +
-		0.10800452155339044 * smp_in[i - 1] -
-		0.21106344349319428 * smp_in[i - 2] -
-		0.15438275853192485 * smp_in[i - 3] +
-		1.6391291074367320 * smp_out[i - 1] -
-		1.5160386192837869 * smp_out[i - 2] +
-		0.8555167646249104 * smp_out[i - 3];
-	      break;
-	    case 4:
-	      smp_out[i] =
-		0.31837346242469328 * smp_in[i] +
-		0.10800452155339044 * smp_in[i - 1] -
-		0.21106344349319428 * smp_in[i - 2] -
-		0.15438275853192485 * smp_in[i - 3] -
-		0.05130596901975942 * smp_in[i - 4] +
-		1.6391291074367320 * smp_out[i - 1] -
-		1.5160386192837869 * smp_out[i - 2] +
-		0.8555167646249104 * smp_out[i - 3] -
-		0.2870466545317107 * smp_out[i - 4];
-	      break;
-	    default:
-	      smp_out[i] =
-		0.31837346242469328 * smp_in[i] +
-		0.10800452155339044 * smp_in[i - 1] -
-		0.21106344349319428 * smp_in[i - 2] -
-		0.15438275853192485 * smp_in[i - 3] -
-		0.05130596901975942 * smp_in[i - 4] -
-		0.00518224535906041 * smp_in[i - 5] +
-		1.6391291074367320 * smp_out[i - 1] -
-		1.5160386192837869 * smp_out[i - 2] +
-		0.8555167646249104 * smp_out[i - 3] -
-		0.2870466545317107 * smp_out[i - 4] +
-		0.0428951718612053 * smp_out[i - 5];
-	      break;
+	      double v = pink_sample (state[ch], random_uniform (&seed[ch]));
+	      sum += v * v;
 	    }
+	  // the RMS of a sine of that level
+	  gain[ch] = pow (10, level / 20) / sqrt (2.0) / sqrt (sum / nframes);
+	  memset (state[ch], 0, sizeof (state[ch]));
+	  seed[ch] = 0x9e3779b97f4a7c15ULL * (ch + 1);
+	}
+    }
 
+  FILE *out = fopen (path, "wb");
+  if (out == NULL)
+    {
+      printf ("Could not write %s.\n", path);
+      return 1;
+    }
+  unsigned char header[44];
+  memcpy (header, "RIFF", 4);
+  put_le (header + 4, 36 + datasize, 4);
+  memcpy (header + 8, "WAVEfmt ", 8);
+  put_le (header + 16, 16, 4);
+  put_le (header + 20, 1, 2);	// PCM
+  put_le (header + 22, nch, 2);
+  put_le (header + 24, rate, 4);
+  put_le (header + 28, rate * nch * 3, 4);
+  put_le (header + 32, nch * 3, 2);
+  put_le (header + 34, 24, 2);
+  memcpy (header + 36, "data", 4);
+  put_le (header + 40, datasize, 4);
+  fwrite (header, 1, 44, out);
+
+  unsigned char *frame = malloc (nch * 3);
+  double amplitude = pow (10, level / 20);
+  long long clipped = 0;
+  for (long long n = 0; n < nframes; n++)
+    {
+      double tone = amplitude * sin (2.0 * M_PI * freq * n / rate);
+      for (int ch = 0; ch < nch; ch++)
+	{
+	  double v = tone;
+	  if (strcmp (kind, "pink") == 0)
+	    v = gain[ch] * pink_sample (state[ch],
+					random_uniform (&seed[ch]));
+	  long q = lround (v * 8388608.0);
+	  if (q > 8388607 || q < -8388608)
+	    {
+	      clipped++;
+	      q = q > 0 ? 8388607 : -8388608;
+	    }
+	  put_le (frame + 3 * ch, (uint32_t) q, 3);
+	}
+      fwrite (frame, 1, nch * 3, out);
+    }
+  free (frame);
+  if (fclose (out) != 0)
+    {
+      printf ("Could not write %s.\n", path);
+      return 1;
+    }
+  if (strcmp (kind, "tone") == 0)
+    printf ("Wrote %s: %.1f Hz tone at %.2f dBFS, %d Hz, %.3f s, %d channel%s.\n",
+	    path, freq, level, rate, (double) nframes / rate, nch,
+	    nch > 1 ? "s" : "");
+  else
+    printf ("Wrote %s: pink noise at %.2f dBFS RMS, %d Hz, %.3f s, %d channel%s.\n",
+	    path, level, rate, (double) nframes / rate, nch,
+	    nch > 1 ? "s" : "");
+  if (clipped)
+    printf ("Warning: %lld samples clipped, please lower the level.\n",
+	    clipped);
+  return 0;
+}
 
-
-	}			// for
+int
+M_filter (double *smp_out, double *smp_in, int samples, int samplerate)
+{
+  if (samplerate == 44100)
+    {
+      iir_filter (smp_out, smp_in, samples, M_b_44100, 7, M_a_44100, 7);
     }
-  else if (samplerate == 96000)
+  else if (samplerate == 48000)
+    {				// if (samplerate == 44100)
+      iir_filter (smp_out, smp_in, samples, M_b_48000, 7, M_a_48000, 7);
+    }
+  else if (samplerate == 88200)
     {				// if (samplerate == 48000)
+      iir_filter (smp_out, smp_in, samples, M_b_88200, 6, M_a_88200, 7);
+    }
+  else if (samplerate == 96000)
+    {				// if (samplerate == 88200)
       for (int i = 0; i < samples; i++)
 	{
 	  switch (i)
@@ -7590,151 +14866,33 @@ M_filter (double *smp_out, double *smp_in, int samples, int samplerate)
 	    }
 	}
     }
-  else if (samplerate == 192000)
+  else if (samplerate == 176400)
     {				// if (samplerate == 96000)
-      for (int i = 0; i < samples; i++)
-	{
-	  switch (i)
-	    {
-	    case 0:
-	      smp_out[i] = 1.44318321996676E-4 * smp_in[i];
-	      break;
-	    case 1:
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] +
-		6.637252076760877 * smp_out[i - 1];
-	      break;
-	    case 2:
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2];
-	      break;
-	    case 3:
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] -
-		3.01386180177350E-4 * smp_in[i - 3] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2] +
-		35.816564526532424 * smp_out[i - 3];
-	      break;
-	    case 4:
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] -
-		3.01386180177350E-4 * smp_in[i - 3] -
-		7.03016165414926E-6 * smp_in[i - 4] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2] +
-		35.816564526532424 * smp_out[i - 3] -
-		42.281935151372885 * smp_out[i - 4];
-	      break;
-
-	    case 5:
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] -
-		3.01386180177350E-4 * smp_in[i - 3] -
-		7.03016165414926E-6 * smp_in[i - 4] +
-		2.04514103920991E-4 * smp_in[i - 5] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2] +
-		35.816564526532424 * smp_out[i - 3] -
-		42.281935151372885 * smp_out[i - 4] +
-		34.193652600767841 * smp_out[i - 5];
-	      break;
-
-	    case 6:
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] -
-		3.01386180177350E-4 * smp_in[i - 3] -
-		7.03016165414926E-6 * smp_in[i - 4] +
-		2.04514103920991E-4 * smp_in[i - 5] +
-		5.85534078264994E-5 * smp_in[i - 6] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2] +
-		35.816564526532424 * smp_out[i - 3] -
-		42.281935151372885 * smp_out[i - 4] +
-		34.193652600767841 * smp_out[i - 5] -
-		19.040936622298062 * smp_out[i - 6];
-	      break;
-	    case 7:
-
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] -
-		3.01386180177350E-4 * smp_in[i - 3] -
-		7.03016165414926E-6 * smp_in[i - 4] +
-		2.04514103920991E-4 * smp_in[i - 5] +
-		5.85534078264994E-5 * smp_in[i - 6] -
-		9.99320871937674E-5 * smp_in[i - 7] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2] +
-		35.816564526532424 * smp_out[i - 3] -
-		42.281935151372885 * smp_out[i - 4] +
-		34.193652600767841 * smp_out[i - 5] -
-		19.040936622298062 * smp_out[i - 6] +
-		7.090648293919744 * smp_out[i - 7];
-	      break;
-	    case 8:
-
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] -
-		3.01386180177350E-4 * smp_in[i - 3] -
-		7.03016165414926E-6 * smp_in[i - 4] +
-		2.04514103920991E-4 * smp_in[i - 5] +
-		5.85534078264994E-5 * smp_in[i - 6] -
-		9.99320871937674E-5 * smp_in[i - 7] -
-		9.02747116074520E-5 * smp_in[i - 8] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2] +
-		35.816564526532424 * smp_out[i - 3] -
-		42.281935151372885 * smp_out[i - 4] +
-		34.193652600767841 * smp_out[i - 5] -
-		19.040936622298062 * smp_out[i - 6] +
-		7.090648293919744 * smp_out[i - 7] -
-		1.616538001967351 * smp_out[i - 8];
-	      break;
+      iir_filter (smp_out, smp_in, samples, M_b_176400, 6, M_a_176400, 7);
+    }
+  else if (samplerate == 192000)
+    {				// if (samplerate == 176400)
+      iir_filter (smp_out, smp_in, samples, M_b_192000, 7, M_a_192000, 7);
+    }
+  else if (mcoeffs != NULL && mcoeffs->samplerate == samplerate)
+    {				// designed at runtime
+      iir_filter (smp_out, smp_in, samples, mcoeffs->b, mcoeffs->nb,
+		  mcoeffs->a, mcoeffs->na);
+    }
+}
 
-	    default:
-	      smp_out[i] =
-		1.44318321996676E-4 * smp_in[i] +
-		2.22020582676945E-4 * smp_in[i - 1] -
-		1.04877188873611E-4 * smp_in[i - 2] -
-		3.01386180177350E-4 * smp_in[i - 3] -
-		7.03016165414926E-6 * smp_in[i - 4] +
-		2.04514103920991E-4 * smp_in[i - 5] +
-		5.85534078264994E-5 * smp_in[i - 6] -
-		9.99320871937674E-5 * smp_in[i - 7] -
-		9.02747116074520E-5 * smp_in[i - 8] -
-		2.72118221944114E-5 * smp_in[i - 9] +
-		6.637252076760877 * smp_out[i - 1] -
-		19.972276555714540 * smp_out[i - 2] +
-		35.816564526532424 * smp_out[i - 3] -
-		42.281935151372885 * smp_out[i - 4] +
-		34.193652600767841 * smp_out[i - 5] -
-		19.040936622298062 * smp_out[i - 6] +
-		7.090648293919744 * smp_out[i - 7] -
-		1.616538001967351 * smp_out[i - 8] +
-		0.173496773056347 * smp_out[i - 9];
-	      break;
 
-	    }
 
-	}
+int
+weighting_filter (double *smp_out, double *smp_in, int samples,
+		  int samplerate)
+{
+  if (wcoeffs != NULL)
+    {
+      return iir_filter (smp_out, smp_in, samples, wcoeffs->b, wcoeffs->nb,
+			 wcoeffs->a, wcoeffs->na);
     }
+  return M_filter (smp_out, smp_in, samples, samplerate);
 }
 
 
@@ -7743,9 +14901,11 @@ init_truepeak_ctx (int ch, int os, int taps)
 {
   TruePeak *tp = malloc (sizeof (TruePeak));
   tp->vector = malloc (sizeof (double) * ch);
+  tp->position = malloc (sizeof (long long) * ch);
   for (int i = 0; i < ch; i++)
     {
       tp->vector[i] = 0.0;
+      tp->position[i] = 0;
     }
   tp->oversampling_ratio = os;
   tp->filtertaps = taps;
@@ -7758,15 +14918,396 @@ freetruepeak (TruePeak * tp)
 {
   free (tp->vector);
   tp->vector = NULL;
+  free (tp->position);
+  tp->position = NULL;
   free (tp->filter_coeffs);
   tp->filter_coeffs = NULL;
   free (tp);
 }
 
 
+Clip *
+init_clip_ctx (int ch, double threshold, int minrun)
+{
+  Clip *cl = malloc (sizeof (Clip));
+  cl->nch = ch;
+  cl->threshold = threshold;
+  cl->minrun = minrun;
+  cl->count = calloc (ch, sizeof (long long));
+  cl->worstrun = calloc (ch, sizeof (long long));
+  cl->nbuffers = 0;
+  cl->capacity = 0;
+  cl->head = NULL;
+  cl->tail = NULL;
+  cl->full = NULL;
+  return cl;
+}
+
+void
+freeclip (Clip * cl)
+{
+  free (cl->count);
+  free (cl->worstrun);
+  free (cl->head);
+  free (cl->tail);
+  free (cl->full);
+  free (cl);
+}
+
+void
+clipcheck (Clip * cl, int bufferindex, int channel, double *interleaved,
+	   int nsamples, int nch)
+{
+  long long head = 0;
+  long long run = 0;
+  long long count = 0;
+  long long worst = 0;
+  int athead = 1;
+
+  for (int n = channel; n < nsamples; n += nch)
+    {
+      if (fabs (interleaved[n]) >= cl->threshold)
+	{
+	  run++;
+	}
+      else
+	{
+	  if (athead)
+	    {
+	      head = run;
+	      athead = 0;
+	    }
+	  else if (run >= cl->minrun)
+	    {
+	      count++;
+	      worst = max (run, worst);
+	    }
+	  run = 0;
+	}
+    }
+
+  pthread_mutex_lock (&mutex);
+  if (bufferindex >= cl->capacity)
+    {
+      int newcapacity = max (2 * cl->capacity, bufferindex + 64);
+      cl->head = realloc (cl->head, sizeof (long long) * newcapacity * cl->nch);
+      cl->tail = realloc (cl->tail, sizeof (long long) * newcapacity * cl->nch);
+      cl->full = realloc (cl->full, sizeof (int) * newcapacity * cl->nch);
+      for (int i = cl->capacity * cl->nch; i < newcapacity * cl->nch; i++)
+	{
+	  cl->head[i] = 0;
+	  cl->tail[i] = 0;
+	  cl->full[i] = 0;
+	}
+      cl->capacity = newcapacity;
+    }
+  cl->nbuffers = max (cl->nbuffers, bufferindex + 1);
+  cl->full[bufferindex * cl->nch + channel] = athead;
+  cl->head[bufferindex * cl->nch + channel] = athead ? run : head;
+  cl->tail[bufferindex * cl->nch + channel] = athead ? 0 : run;
+  cl->count[channel] += count;
+  cl->worstrun[channel] = max (worst, cl->worstrun[channel]);
+  pthread_mutex_unlock (&mutex);
+}
+
+int
+clip_finalcomputation (Clip * cl, const char **chnames)
+{
+  int clipped = 0;
+
+  for (int ch = 0; ch < cl->nch; ch++)
+    {
+      long long carry = 0;	// run continuing from the preceding buffers
+      for (int b = 0; b <= cl->nbuffers; b++)
+	{
+	  int idx = b * cl->nch + ch;
+	  if (b < cl->nbuffers && cl->full[idx])
+	    {
+	      carry += cl->head[idx];
+	      continue;
+	    }
+	  if (b < cl->nbuffers)
+	    {
+	      carry += cl->head[idx];
+	    }
+	  if (carry >= cl->minrun)
+	    {
+	      cl->count[ch]++;
+	      cl->worstrun[ch] = max (carry, cl->worstrun[ch]);
+	    }
+	  carry = (b < cl->nbuffers) ? cl->tail[idx] : 0;
+	}
+      char chlabel[32];
+      printf ("%s: %lld clips, worst run %lld samples\n",
+	      channel_label (chlabel, sizeof (chlabel), ch, chnames),
+	      cl->count[ch], cl->worstrun[ch]);
+      if (cl->count[ch] > 0)
+	clipped = 1;
+    }
+  return clipped;
+}
+
+
+void
+fft_radix2 (double complex * x, int n)
+{
+  // in place, n must be a power of two
+  for (int i = 1, j = 0; i < n; i++)
+    {
+      int bit = n >> 1;
+      for (; j & bit; bit >>= 1)
+	j ^= bit;
+      j ^= bit;
+      if (i < j)
+	{
+	  double complex tmp = x[i];
+	  x[i] = x[j];
+	  x[j] = tmp;
+	}
+    }
+  for (int len = 2; len <= n; len <<= 1)
+    {
+      double complex wlen = cexp (-2.0 * I * M_PI / len);
+      for (int i = 0; i < n; i += len)
+	{
+	  double complex w = 1.0;
+	  for (int k = 0; k < len / 2; k++)
+	    {
+	      double complex u = x[i + k];
+	      double complex v = x[i + k + len / 2] * w;
+	      x[i + k] = u + v;
+	      x[i + k + len / 2] = u - v;
+	      w *= wlen;
+	    }
+	}
+    }
+}
+
+void
+accumulatespectrum (double *spectrum, int channel, double *interleaved,
+		    int nsamples, int nch)
+{
+  /* Hann windowed power spectrum of the first SPECTRUMPOINTS frames of the
+     buffer, one look per buffer is enough for a long term average */
+  double complex frame[SPECTRUMPOINTS];
+  double power[SPECTRUMPOINTS / 2 + 1];
+
+  if (nsamples / nch < SPECTRUMPOINTS)
+    return;
+  for (int m = 0, n = channel; m < SPECTRUMPOINTS; m++, n += nch)
+    {
+      frame[m] =
+	interleaved[n] * 0.5 * (1 - cos (2 * M_PI * m / (SPECTRUMPOINTS - 1)));
+    }
+  fft_radix2 (frame, SPECTRUMPOINTS);
+  for (int k = 0; k <= SPECTRUMPOINTS / 2; k++)
+    {
+      power[k] = creal (frame[k] * conj (frame[k]));
+    }
+  pthread_mutex_lock (&mutex);
+  for (int k = 0; k <= SPECTRUMPOINTS / 2; k++)
+    {
+      spectrum[k] += power[k];
+    }
+  pthread_mutex_unlock (&mutex);
+}
+
+void
+bandwidth_finalcomputation (double *spectrum, int samplerate)
+{
+  double nyquist = samplerate / 2.0;
+  double maxpower = 0.0;
+  int highestbin = 0;
+
+  for (int k = 1; k <= SPECTRUMPOINTS / 2; k++)	// skip DC
+    {
+      maxpower = max (spectrum[k], maxpower);
+    }
+  if (maxpower == 0.0)
+    {
+      printf ("Estimated audio bandwidth: not available, no signal.\n");
+      return;
+    }
+  //highest bin within 70 dB of the strongest one
+  for (int k = SPECTRUMPOINTS / 2; k > 0; k--)
+    {
+      if (spectrum[k] > maxpower * 1e-7)
+	{
+	  highestbin = k;
+	  break;
+	}
+    }
+  double bw = (double) highestbin * samplerate / SPECTRUMPOINTS;
+  printf ("Estimated audio bandwidth: %.0f Hz (Nyquist %.0f Hz)\n", bw,
+	  nyquist);
+  if (bw < 0.8 * nyquist)
+    {
+      printf
+	("Warning: no content above %.0f Hz, the file may be an upsampled or lossy proxy\nand the measurement may not represent the master.\n",
+	 bw);
+    }
+}
+
+int
+speechcheck (double *interleaved, int nsamples, int nch, int samplerate)
+{
+  /* Voice activity of one buffer from the sum of the channels, cut in
+     20 ms frames. Frames above -50 dBFS are active. Speech needs 30% of
+     active frames, 60% of their energy in the 300 Hz - 3.4 kHz band and
+     the syllabic modulation of speech: a spread of the frame levels of
+     4 dB at least, which steady music and noise rarely have. */
+  int framelen = samplerate / 50;
+  int nframes = nsamples / nch / framelen;
+  double b[2][3];
+  double a[2][3];
+  double x[2][2] = { {0.0} };
+  double y[2][2] = { {0.0} };
+  double bandenergy = 0.0;
+  double activeenergy = 0.0;
+  double levelsum = 0.0;
+  double levelsquares = 0.0;
+  int nactive = 0;
+
+  if (nframes < 2)
+    return 0;
+  //second order Butterworth high pass at 300 Hz and low pass at 3.4 kHz
+  for (int f = 0; f < 2; f++)
+    {
+      double K = tan (M_PI * (f == 0 ? 300.0 : 3400.0) / samplerate);
+      double norm = 1.0 / (1.0 + M_SQRT2 * K + K * K);
+      if (f == 0)
+	{
+	  b[f][0] = norm;
+	  b[f][1] = -2.0 * norm;
+	}
+      else
+	{
+	  b[f][0] = K * K * norm;
+	  b[f][1] = 2.0 * K * K * norm;
+	}
+      b[f][2] = b[f][0];
+      a[f][1] = 2.0 * (K * K - 1.0) * norm;
+      a[f][2] = (1.0 - M_SQRT2 * K + K * K) * norm;
+    }
+  for (int fr = 0; fr < nframes; fr++)
+    {
+      double energy = 0.0;
+      double band = 0.0;
+      for (int m = fr * framelen; m < (fr + 1) * framelen; m++)
+	{
+	  double v = 0.0;
+	  for (int ch = 0; ch < nch; ch++)
+	    v += interleaved[m * nch + ch];
+	  energy += v * v;
+	  for (int f = 0; f < 2; f++)
+	    {
+	      double out = b[f][0] * v + b[f][1] * x[f][0] + b[f][2] * x[f][1]
+		- a[f][1] * y[f][0] - a[f][2] * y[f][1];
+	      x[f][1] = x[f][0];
+	      x[f][0] = v;
+	      y[f][1] = y[f][0];
+	      y[f][0] = out;
+	      v = out;
+	    }
+	  band += v * v;
+	}
+      double level = 10 * log10 (energy / framelen + 1e-20);
+      if (level > -50.0)
+	{
+	  nactive++;
+	  activeenergy += energy;
+	  bandenergy += band;
+	  levelsum += level;
+	  levelsquares += level * level;
+	}
+    }
+  if (nactive < 0.3 * nframes || nactive < 2)
+    return 0;
+  double mean = levelsum / nactive;
+  double spread = sqrt (max (levelsquares / nactive - mean * mean, 0.0));
+  return bandenergy >= 0.6 * activeenergy && spread >= 4.0;
+}
+
+int
+silencecheck (double *interleaved, int nsamples, double threshold)
+{
+  for (int n = 0; n < nsamples; n++)
+    {
+      if (fabs (interleaved[n]) >= threshold)
+	return 0;
+    }
+  return 1;
+}
+
+double
+tonecheck (double *interleaved, int nsamples, int nch, int samplerate)
+{
+  /* A buffer is line-up tone when nine tenths of the energy of every
+     channel with signal is within a 1 kHz band pass (Q 5, so 997 Hz
+     passes too). Returns the level of the loudest channel in dBFS of a
+     full scale sine (AES17), -INFINITY when silent (below -70 dBFS) and
+     NAN for anything else. */
+  double K = tan (M_PI * 1000.0 / samplerate);
+  double norm = 1.0 / (1.0 + K / 5.0 + K * K);
+  double b0 = K / 5.0 * norm;
+  double a1 = 2.0 * (K * K - 1.0) * norm;
+  double a2 = (1.0 - K / 5.0 + K * K) * norm;
+  int nframes = nsamples / nch;
+  double loudest = 0.0;
+
+  if (nframes == 0)
+    return NAN;
+  for (int ch = 0; ch < nch; ch++)
+    {
+      double x1 = 0.0, x2 = 0.0, y1 = 0.0, y2 = 0.0;
+      double energy = 0.0, band = 0.0;
+      for (int n = ch; n < nsamples; n += nch)
+	{
+	  double x = interleaved[n];
+	  double y = b0 * x - b0 * x2 - a1 * y1 - a2 * y2;
+	  x2 = x1;
+	  x1 = x;
+	  y2 = y1;
+	  y1 = y;
+	  energy += x * x;
+	  band += y * y;
+	}
+      double level = 2.0 * energy / nframes;
+      if (level < 1e-7)
+	continue;
+      if (band < 0.9 * energy)
+	return NAN;
+      loudest = max (level, loudest);
+    }
+  if (loudest == 0.0)
+    return -INFINITY;
+  return 10 * log10 (loudest);
+}
+
+double
+stereocorrelation (double *interleaved, int nsamples)
+{
+  /* Pearson correlation of the two channels over the buffer: +1 mono,
+     0 unrelated, -1 one channel inverted. NAN when a channel is silent
+     (below -90 dBFS), so that pauses do not count. */
+  double lr = 0.0;
+  double ll = 0.0;
+  double rr = 0.0;
+
+  for (int n = 0; n + 1 < nsamples; n += 2)
+    {
+      lr += interleaved[n] * interleaved[n + 1];
+      ll += interleaved[n] * interleaved[n];
+      rr += interleaved[n + 1] * interleaved[n + 1];
+    }
+  if (ll < 1e-9 * nsamples / 2 || rr < 1e-9 * nsamples / 2)
+    return NAN;
+  return lr / sqrt (ll * rr);
+}
+
 double
 truepeakcheck (double *in_buf, int ns, double truepeak, int os_ratio,
-	       int filtertaps, double *coeff_vector)
+	       int filtertaps, double *coeff_vector, int *pt_peakframe)
 {
 
   /*
@@ -7832,7 +15373,11 @@ truepeakcheck (double *in_buf, int ns, double truepeak, int os_ratio,
          printf("Sample value: %.8f\n", os_buffer[m]);
          #endif       
        */
-      truepeak = max (interp_buffer[m] * interp_buffer[m], truepeak);	//rectify
+      if (interp_buffer[m] * interp_buffer[m] > truepeak)	//rectify
+	{
+	  truepeak = interp_buffer[m] * interp_buffer[m];
+	  *pt_peakframe = m / os_ratio;
+	}
 
     }
 
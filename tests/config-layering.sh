@@ -0,0 +1,69 @@
+#!/bin/sh
+# A list option given in the options file, in LEQM_NRT_OPTIONS and on the
+# command line is replaced by the later layer, not appended to, and
+# --no-<switch> takes back a switch of an earlier layer. The modes without
+# an audio file are not disturbed by the layers.
+
+LEQM_NRT=${LEQM_NRT:-src/leqm-nrt}
+TMP=${TMPDIR:-/tmp}/leqm-nrt-layering.$$
+mkdir -p "$TMP" || exit 1
+trap 'rm -rf "$TMP"' EXIT
+fail=0
+
+leqm ()
+{
+  "$LEQM_NRT" "$TMP/tone.wav" --numcpus 1 "$@" | grep -E '^(Leq|LKFS)'
+}
+
+"$LEQM_NRT" --generate tone "$TMP/tone.wav" --channels 2 --duration 2 \
+  > /dev/null || exit 1
+printf -- '--chconfcal -6 -6  # quieter\n--lkfschgain 2 2\n--leqnw\n' \
+  > "$TMP/leqm-nrt.conf"
+export LEQM_NRT_CONFIG="$TMP/leqm-nrt.conf"
+unset LEQM_NRT_OPTIONS
+
+expected=$(LEQM_NRT_CONFIG=/nonexistent leqm --chconfcal 0 0 --lkfs)
+got=$(leqm --chconfcal 0 0 --lkfschgain 1 1 --lkfs --no-leqnw)
+if [ "$got" != "$expected" ]; then
+  echo "options file and command line: got '$got', expected '$expected'"
+  fail=1
+fi
+
+got=$(LEQM_NRT_OPTIONS="--chconfcal -3 -3 --no-leqnw" \
+  leqm --chconfcal 0 0 --lkfschgain 1 1 --lkfs)
+if [ "$got" != "$expected" ]; then
+  echo "three layers: got '$got', expected '$expected'"
+  fail=1
+fi
+
+if ! leqm | grep -q '^Leq(noW)'; then
+  echo "--leqnw of the options file was not applied"
+  fail=1
+fi
+
+expected=$(leqm)
+got=$("$LEQM_NRT" - --numcpus 1 < "$TMP/tone.wav" | grep -E '^(Leq|LKFS)')
+if [ "$got" != "$expected" ]; then
+  echo "standard input: got '$got', expected '$expected'"
+  fail=1
+fi
+
+if ! "$LEQM_NRT" --version | grep -q '^This is leqm-nrt version'; then
+  echo "--version with an options file"
+  fail=1
+fi
+if ! "$LEQM_NRT" --help | grep -q -- '--print-config'; then
+  echo "--help with an options file"
+  fail=1
+fi
+if ! "$LEQM_NRT" --selftest 96000 | grep -q '^Self-test passed'; then
+  echo "--selftest with an options file"
+  fail=1
+fi
+if ! "$LEQM_NRT" --generate tone "$TMP/generated.wav" > /dev/null \
+  || [ ! -s "$TMP/generated.wav" ]; then
+  echo "--generate with an options file"
+  fail=1
+fi
+
+exit $fail